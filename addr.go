@@ -1,6 +1,10 @@
 package ble
 
-import "strings"
+import (
+	"fmt"
+	"net"
+	"strings"
+)
 
 // Addr represents a network end point address.
 // It's MAC address on Linux or Device UUID on OS X.
@@ -18,3 +22,101 @@ type addr string
 func (a addr) String() string {
 	return string(a)
 }
+
+// AddrType is the type of a Bluetooth device address [Vol 6, Part B, 1.3].
+type AddrType uint8
+
+// Bluetooth device address types.
+const (
+	AddrPublic       AddrType = iota // Public device address.
+	AddrRandomStatic                 // Random static device address.
+	AddrRPA                          // Resolvable private address.
+	AddrNRPA                         // Non-resolvable private address.
+)
+
+var addrTypeNames = map[AddrType]string{
+	AddrPublic:       "public",
+	AddrRandomStatic: "static",
+	AddrRPA:          "rpa",
+	AddrNRPA:         "nrpa",
+}
+
+func (t AddrType) String() string {
+	if s, ok := addrTypeNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("AddrType(%d)", uint8(t))
+}
+
+// Random reports whether the address type is one of the random device address types.
+func (t AddrType) Random() bool {
+	return t != AddrPublic
+}
+
+// DeviceAddr is a Bluetooth device address, which carries its type.
+type DeviceAddr struct {
+	MAC  [6]byte // Most significant octet first, as written.
+	Type AddrType
+}
+
+// NewDeviceAddr returns the DeviceAddr of a 6 bytes address (most significant octet first).
+// The subtype of a random address is derived from its two most significant bits.
+func NewDeviceAddr(b []byte, random bool) DeviceAddr {
+	var a DeviceAddr
+	copy(a.MAC[:], b)
+	if random {
+		switch a.MAC[0] >> 6 {
+		case 0x03:
+			a.Type = AddrRandomStatic
+		case 0x01:
+			a.Type = AddrRPA
+		default:
+			a.Type = AddrNRPA
+		}
+	}
+	return a
+}
+
+// ParseAddr parses an address in the form "01:23:45:67:89:ab", optionally
+// followed by "/public" or "/random". Addresses without suffix are public.
+func ParseAddr(s string) (DeviceAddr, error) {
+	random := false
+	if i := strings.LastIndexByte(s, '/'); i >= 0 {
+		switch strings.ToLower(s[i+1:]) {
+		case "public":
+		case "random":
+			random = true
+		default:
+			return DeviceAddr{}, fmt.Errorf("invalid address type: %q", s[i+1:])
+		}
+		s = s[:i]
+	}
+	b, err := net.ParseMAC(s)
+	if err != nil || len(b) != 6 {
+		return DeviceAddr{}, fmt.Errorf("invalid address: %q", s)
+	}
+	return NewDeviceAddr(b, random), nil
+}
+
+// String returns the address in the form "01:23:45:67:89:ab".
+func (a DeviceAddr) String() string {
+	return net.HardwareAddr(a.MAC[:]).String()
+}
+
+// MarshalText returns the address in the form accepted by ParseAddr.
+func (a DeviceAddr) MarshalText() ([]byte, error) {
+	if a.Type.Random() {
+		return []byte(a.String() + "/random"), nil
+	}
+	return []byte(a.String() + "/public"), nil
+}
+
+// UnmarshalText parses an address in the form accepted by ParseAddr.
+func (a *DeviceAddr) UnmarshalText(b []byte) error {
+	x, err := ParseAddr(string(b))
+	if err != nil {
+		return err
+	}
+	*a = x
+	return nil
+}
@@ -9,3 +9,42 @@ func TestNewAddr(t *testing.T) {
 		t.Error("address should be \"test\" but is ", a.String())
 	}
 }
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		s    string
+		str  string
+		typ  AddrType
+		text string
+	}{
+		{"01:23:45:67:89:AB", "01:23:45:67:89:ab", AddrPublic, "01:23:45:67:89:ab/public"},
+		{"01:23:45:67:89:ab/public", "01:23:45:67:89:ab", AddrPublic, "01:23:45:67:89:ab/public"},
+		{"C1:23:45:67:89:AB/random", "c1:23:45:67:89:ab", AddrRandomStatic, "c1:23:45:67:89:ab/random"},
+		{"41:23:45:67:89:ab/Random", "41:23:45:67:89:ab", AddrRPA, "41:23:45:67:89:ab/random"},
+		{"01:23:45:67:89:ab/random", "01:23:45:67:89:ab", AddrNRPA, "01:23:45:67:89:ab/random"},
+	}
+	for _, tt := range tests {
+		a, err := ParseAddr(tt.s)
+		if err != nil {
+			t.Errorf("ParseAddr(%q): %v", tt.s, err)
+			continue
+		}
+		if a.String() != tt.str || a.Type != tt.typ {
+			t.Errorf("ParseAddr(%q) = %s (%s), want %s (%s)", tt.s, a, a.Type, tt.str, tt.typ)
+		}
+		b, _ := a.MarshalText()
+		if string(b) != tt.text {
+			t.Errorf("%s.MarshalText() = %s, want %s", a, b, tt.text)
+		}
+		var x DeviceAddr
+		if err := x.UnmarshalText(b); err != nil || x != a {
+			t.Errorf("UnmarshalText(%s) = %v, %v, want %v", b, x, err, a)
+		}
+	}
+
+	for _, s := range []string{"", "01:23:45:67:89", "01:23:45:67:89:ab/other", "01-23-45-67-89-ab-cd-ef"} {
+		if _, err := ParseAddr(s); err == nil {
+			t.Errorf("ParseAddr(%q) should fail", s)
+		}
+	}
+}
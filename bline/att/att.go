@@ -12,6 +12,14 @@ var (
 	// ErrSeqProtoTimeout means the request hasn't been acknowledged in 30 seconds.
 	// [Vol 3, Part F, 3.3.3]
 	ErrSeqProtoTimeout = errors.New("req timeout")
+
+	// ErrReliableWrite means a value echoed in a Prepare Write Response differs
+	// from the one requested. [Vol 3, Part G, 4.9.5]
+	ErrReliableWrite = errors.New("reliable write mismatch")
+
+	// ErrQueueFull means an update is dropped, as the update queue of the
+	// connection is full.
+	ErrQueueFull = errors.New("update queue full")
 )
 
 var rspOfReq = map[byte]byte{
@@ -27,4 +35,6 @@ var rspOfReq = map[byte]byte{
 	PrepareWriteRequestCode:    PrepareWriteResponseCode,
 	ExecuteWriteRequestCode:    ExecuteWriteResponseCode,
 	HandleValueIndicationCode:  HandleValueConfirmationCode,
+
+	ReadMultipleVariableRequestCode: ReadMultipleVariableResponseCode,
 }
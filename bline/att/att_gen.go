@@ -392,6 +392,42 @@ func (r ReadByGroupTypeResponse) AttributeDataList() []byte { return r[2:] }
 // SetAttributeDataList ...
 func (r ReadByGroupTypeResponse) SetAttributeDataList(v []byte) { copy(r[2:], v) }
 
+// ReadMultipleVariableRequestCode ...
+const ReadMultipleVariableRequestCode = 0x20
+
+// ReadMultipleVariableRequest implements Read Multiple Variable Request (0x20) [Vol 3, Part F, 3.4.4.11].
+type ReadMultipleVariableRequest []byte
+
+// AttributeOpcode ...
+func (r ReadMultipleVariableRequest) AttributeOpcode() uint8 { return r[0] }
+
+// SetAttributeOpcode ...
+func (r ReadMultipleVariableRequest) SetAttributeOpcode() { r[0] = 0x20 }
+
+// SetOfHandles ...
+func (r ReadMultipleVariableRequest) SetOfHandles() []byte { return r[1:] }
+
+// SetSetOfHandles ...
+func (r ReadMultipleVariableRequest) SetSetOfHandles(v []byte) { copy(r[1:], v) }
+
+// ReadMultipleVariableResponseCode ...
+const ReadMultipleVariableResponseCode = 0x21
+
+// ReadMultipleVariableResponse implements Read Multiple Variable Response (0x21) [Vol 3, Part F, 3.4.4.12].
+type ReadMultipleVariableResponse []byte
+
+// AttributeOpcode ...
+func (r ReadMultipleVariableResponse) AttributeOpcode() uint8 { return r[0] }
+
+// SetAttributeOpcode ...
+func (r ReadMultipleVariableResponse) SetAttributeOpcode() { r[0] = 0x21 }
+
+// LengthValueTupleList ...
+func (r ReadMultipleVariableResponse) LengthValueTupleList() []byte { return r[1:] }
+
+// SetLengthValueTupleList ...
+func (r ReadMultipleVariableResponse) SetLengthValueTupleList(v []byte) { copy(r[1:], v) }
+
 // WriteRequestCode ...
 const WriteRequestCode = 0x12
 
@@ -471,20 +507,20 @@ func (r SignedWriteCommand) AttributeHandle() uint16 { return binary.LittleEndia
 func (r SignedWriteCommand) SetAttributeHandle(v uint16) { binary.LittleEndian.PutUint16(r[1:], v) }
 
 // AttributeValue ...
-func (r SignedWriteCommand) AttributeValue() []byte { return r[3:] }
+func (r SignedWriteCommand) AttributeValue() []byte { return r[3 : len(r)-12] }
 
 // SetAttributeValue ...
-func (r SignedWriteCommand) SetAttributeValue(v []byte) { copy(r[3:], v) }
+func (r SignedWriteCommand) SetAttributeValue(v []byte) { copy(r[3:len(r)-12], v) }
 
 // AuthenticationSignature ...
 func (r SignedWriteCommand) AuthenticationSignature() [12]byte {
 	b := [12]byte{}
-	copy(b[:], r[3:])
+	copy(b[:], r[len(r)-12:])
 	return b
 }
 
 // SetAuthenticationSignature ...
-func (r SignedWriteCommand) SetAuthenticationSignature(v [12]byte) { copy(r[3:3+12], v[:]) }
+func (r SignedWriteCommand) SetAuthenticationSignature(v [12]byte) { copy(r[len(r)-12:], v[:]) }
 
 // PrepareWriteRequestCode ...
 const PrepareWriteRequestCode = 0x16
@@ -602,6 +638,24 @@ func (r HandleValueNotification) AttributeValue() []byte { return r[3:] }
 // SetAttributeValue ...
 func (r HandleValueNotification) SetAttributeValue(v []byte) { copy(r[3:], v) }
 
+// MultipleHandleValueNotificationCode ...
+const MultipleHandleValueNotificationCode = 0x23
+
+// MultipleHandleValueNotification implements Multiple Handle Value Notification (0x23) [Vol 3, Part F, 3.4.7.4].
+type MultipleHandleValueNotification []byte
+
+// AttributeOpcode ...
+func (r MultipleHandleValueNotification) AttributeOpcode() uint8 { return r[0] }
+
+// SetAttributeOpcode ...
+func (r MultipleHandleValueNotification) SetAttributeOpcode() { r[0] = 0x23 }
+
+// HandleLengthValueTupleList ...
+func (r MultipleHandleValueNotification) HandleLengthValueTupleList() []byte { return r[1:] }
+
+// SetHandleLengthValueTupleList ...
+func (r MultipleHandleValueNotification) SetHandleLengthValueTupleList(v []byte) { copy(r[1:], v) }
+
 // HandleValueIndicationCode ...
 const HandleValueIndicationCode = 0x1D
 
@@ -11,4 +11,10 @@ type attr struct {
 	v  []byte
 	rh ble.ReadHandler
 	wh ble.WriteHandler
+
+	// Security requirements of accessing the attribute.
+	signed     bool // Signed writes are accepted.
+	perm       ble.Permission
+	minKeySize int
+	ah         ble.AuthorizeHandler
 }
@@ -0,0 +1,404 @@
+package att
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	ble "traulfs/Bline/ble"
+
+	"github.com/pkg/errors"
+)
+
+// Bearer is an L2CAP channel of Enhanced Credit Based Flow Control Mode, which
+// carries an Enhanced ATT bearer [Vol 3, Part F, 3.2.11]. Each SDU carries an
+// ATT PDU. The ATT_MTU of the bearer is the minimum of the MTUs of the channel.
+type Bearer interface {
+	io.ReadWriteCloser
+
+	// RxMTU returns the maximum SDU size, which the local device accepts.
+	RxMTU() int
+
+	// TxMTU returns the maximum SDU size, which the remote device accepts.
+	TxMTU() int
+}
+
+// maxBearers is the maximum number of Enhanced ATT bearers of a client.
+const maxBearers = 15
+
+// bearerMTU returns the ATT_MTU of an Enhanced ATT bearer.
+func bearerMTU(b Bearer) int {
+	mtu := b.TxMTU()
+	if b.RxMTU() < mtu {
+		mtu = b.RxMTU()
+	}
+	if mtu > ble.MaxMTU {
+		mtu = ble.MaxMTU
+	}
+	return mtu
+}
+
+// bearer is an ATT bearer of a client. It runs a single transaction at a time
+// [Vol 3, Part F, 3.3.2], so the client runs one transaction on each bearer.
+type bearer struct {
+	rw   io.ReadWriter
+	eatt bool
+
+	// txBuf is owned by the holder of the bearer.
+	txBuf   []byte
+	rxBuf   []byte
+	rspc    chan []byte
+	chErr   chan error
+	done    chan struct{}
+	expired chan struct{} // Closed, once a transaction timed out.
+
+	// The state of the transaction, which is owned by the holder too.
+	pending     bool      // A canceled request still awaits its response.
+	deadline    time.Time // The transaction times out at deadline.
+	timedOut    bool      // A transaction timed out; the bearer is unusable.
+	cancelQueue bool      // The prepare queue of the server is to be cleared.
+}
+
+// transactionTimeout is the time, which a server has to respond to a request
+// [Vol 3, Part F, 3.3.3]. It's shortened by the tests.
+var transactionTimeout = 30 * time.Second
+
+func newBearer(rw io.ReadWriter, mtu int, eatt bool) *bearer {
+	return &bearer{
+		rw:      rw,
+		eatt:    eatt,
+		txBuf:   make([]byte, mtu, mtu),
+		rxBuf:   make([]byte, ble.MaxMTU),
+		rspc:    make(chan []byte),
+		chErr:   make(chan error, 1),
+		done:    make(chan struct{}),
+		expired: make(chan struct{}),
+	}
+}
+
+// AddBearer adds an Enhanced ATT bearer to the client, and serves it until the
+// channel is closed. The transactions of the client are spread over the idle
+// bearers, so discoveries no longer hold up other requests.
+func (c *Client) AddBearer(b Bearer) error {
+	br := newBearer(b, bearerMTU(b), true)
+	select {
+	case c.chBearer <- br:
+	default:
+		return errors.New("too many ATT bearers")
+	}
+	go c.serve(br)
+	return nil
+}
+
+// acquire returns an idle bearer, once there's one. The bearers closed
+// meanwhile are dropped.
+func (c *Client) acquire() (*bearer, error) {
+	ctx := c.context()
+	for {
+		var br *bearer
+		select {
+		case br = <-c.chBearer:
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "no idle ATT bearer")
+		}
+		select {
+		case <-br.done:
+			if br.eatt {
+				continue
+			}
+		default:
+		}
+		return br, nil
+	}
+}
+
+// acquireATT returns the unenhanced ATT bearer, once it's idle.
+func (c *Client) acquireATT() (*bearer, error) {
+	var held []*bearer
+	defer func() {
+		for _, br := range held {
+			c.release(br)
+		}
+	}()
+	for {
+		br, err := c.acquire()
+		if err != nil {
+			return nil, err
+		}
+		if !br.eatt {
+			return br, nil
+		}
+		held = append(held, br)
+	}
+}
+
+// release puts a bearer back to the pool of idle bearers. A bearer, which
+// still awaits the response to a canceled request, is put back once the
+// response is received, or the transaction times out.
+func (c *Client) release(br *bearer) {
+	if !br.pending && !br.cancelQueue {
+		c.chBearer <- br
+		return
+	}
+	go func() {
+		br.settle()
+		if br.cancelQueue && !br.timedOut {
+			if err := br.executeWrite(context.Background(), cancelPreparedWrites); err != nil {
+				logger.Warn("client", "cancel prepared writes", err)
+			}
+		}
+		br.cancelQueue = false
+		c.chBearer <- br
+	}()
+}
+
+// settle waits for the response to a canceled request, and drops it.
+func (br *bearer) settle() {
+	if !br.pending {
+		return
+	}
+	br.pending = false
+	t := time.NewTimer(time.Until(br.deadline))
+	defer t.Stop()
+	select {
+	case <-br.rspc:
+	case err := <-br.chErr:
+		// Leave the error to the next request.
+		br.chErr <- err
+	case <-t.C:
+		br.expire()
+	}
+}
+
+// expire makes the bearer unusable, after a transaction timed out. No more
+// PDUs are sent on it; Enhanced ATT bearers are closed, while the unenhanced
+// one is only established again with a new link [Vol 3, Part F, 3.3.3].
+func (br *bearer) expire() {
+	if br.timedOut {
+		return
+	}
+	br.timedOut = true
+	close(br.expired)
+	if br.eatt {
+		if cl, ok := br.rw.(io.Closer); ok {
+			cl.Close()
+		}
+	}
+}
+
+func (br *bearer) sendCmd(b []byte) error {
+	if br.timedOut {
+		return errors.Wrap(ErrSeqProtoTimeout, "ATT bearer unusable")
+	}
+	_, err := br.rw.Write(b)
+	return err
+}
+
+// sendReq sends a request, and waits for its response. If ctx is done first,
+// the response is dropped once it's received.
+func (br *bearer) sendReq(ctx context.Context, b []byte) (rsp []byte, err error) {
+	if br.timedOut {
+		return nil, errors.Wrap(ErrSeqProtoTimeout, "ATT bearer unusable")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "ATT request canceled")
+	}
+	logger.Debug("client", "req", fmt.Sprintf("% X", b))
+	if _, err := br.rw.Write(b); err != nil {
+		return nil, errors.Wrap(err, "send ATT request failed")
+	}
+	br.deadline = time.Now().Add(transactionTimeout)
+	t := time.NewTimer(transactionTimeout)
+	defer t.Stop()
+	for {
+		select {
+		case rsp := <-br.rspc:
+			if rsp[0] == ErrorResponseCode || rsp[0] == rspOfReq[b[0]] {
+				return rsp, nil
+			}
+			// Sometimes when we connect to an Apple device, it sends
+			// ATT requests asynchronously to us. // In this case, we
+			// returns an ErrReqNotSupp response, and continue to wait
+			// the response to our request.
+			errRsp := newErrorResponse(rsp[0], 0x0000, ble.ErrReqNotSupp)
+			logger.Debug("client", "req", fmt.Sprintf("% X", b))
+			_, err := br.rw.Write(errRsp)
+			if err != nil {
+				return nil, errors.Wrap(err, "unexpected ATT response received")
+			}
+		case err := <-br.chErr:
+			return nil, errors.Wrap(err, "ATT request failed")
+		case <-ctx.Done():
+			br.pending = true
+			return nil, errors.Wrap(ctx.Err(), "ATT request canceled")
+		case <-t.C:
+			br.expire()
+			return nil, errors.Wrap(ErrSeqProtoTimeout, "ATT request timeout")
+		}
+	}
+}
+
+// serve receives the PDUs of a bearer, until it's closed.
+func (c *Client) serve(br *bearer) {
+
+	type asyncWork struct {
+		handle func([]byte)
+		data   []byte
+	}
+
+	ch := make(chan asyncWork, 16)
+	defer close(ch)
+	defer close(br.done)
+	go func() {
+		for w := range ch {
+			w.handle(w.data)
+		}
+	}()
+
+	notify := func(b []byte) {
+		// Deliver the full request to upper layer.
+		select {
+		case ch <- asyncWork{handle: c.handler.HandleNotification, data: b}:
+		default:
+			// If this really happens, especially on a slow machine, enlarge the channel buffer.
+			_ = logger.Error("client", "req", "can't enqueue incoming notification.")
+		}
+	}
+
+	confirmation := []byte{HandleValueConfirmationCode}
+	for {
+		n, err := br.rw.Read(br.rxBuf)
+		logger.Debug("client", "rsp", fmt.Sprintf("% X", br.rxBuf[:n]))
+		if err != nil {
+			// We don't expect any error from the bearer (L2CAP ACL-U)
+			// Pass it along to the pending request, if any, and escape.
+			br.chErr <- err
+			return
+		}
+		if n == 0 {
+			continue
+		}
+
+		b := make([]byte, n)
+		copy(b, br.rxBuf)
+
+		// TODO: better request identification
+		if b[0] == ExchangeMTURequestCode {
+			// Schedule this to be taken care of
+			select {
+			case ch <- asyncWork{handle: func(b []byte) { c.handleRequest(br, b) }, data: b}:
+			default:
+				// If this really happens, especially on a slow machine, enlarge the channel buffer.
+				_ = logger.Error("client", "req", "can't enqueue incoming request.")
+			}
+			continue
+		}
+
+		switch b[0] {
+		case HandleValueNotificationCode, HandleValueIndicationCode:
+			notify(b)
+		case MultipleHandleValueNotificationCode:
+			// Deliver each value as a Handle Value Notification.
+			for _, nb := range splitNotifications(b) {
+				notify(nb)
+			}
+			continue
+		default:
+			// A response, which is received after its transaction timed
+			// out, has no request waiting for it, and is dropped.
+			select {
+			case br.rspc <- b:
+			case <-br.expired:
+			}
+			continue
+		}
+
+		// Always write aknowledgement for an indication, even it was an invalid request.
+		// The confirmation is sent on the bearer, which received the indication.
+		if b[0] == HandleValueIndicationCode {
+			logger.Debug("client", "req", fmt.Sprintf("% X", b))
+			_, _ = br.rw.Write(confirmation)
+		}
+	}
+}
+
+// splitNotifications returns the Handle Value Notifications of the values in a
+// Multiple Handle Value Notification [Vol 3, Part F, 3.4.7.4].
+func splitNotifications(b MultipleHandleValueNotification) [][]byte {
+	var ns [][]byte
+	l := b.HandleLengthValueTupleList()
+	for len(l) >= 4 {
+		h := binary.LittleEndian.Uint16(l)
+		n := int(binary.LittleEndian.Uint16(l[2:]))
+		if len(l) < 4+n {
+			logger.Warn("client", "notification", "truncated Multiple Handle Value Notification")
+			break
+		}
+		nb := HandleValueNotification(make([]byte, 3+n))
+		nb.SetAttributeOpcode()
+		nb.SetAttributeHandle(h)
+		nb.SetAttributeValue(l[4 : 4+n])
+		ns = append(ns, nb)
+		l = l[4+n:]
+	}
+	return ns
+}
+
+// ReadMultipleVariable requests the server to read two or more values of a
+// set of attributes, which may have variable lengths, and return their values
+// in a Read Multiple Variable Response. The server returns the values that fit
+// in the ATT_MTU, in the order of the handles; the last of them is truncated,
+// if truncated is set. [Vol 3, Part F, 3.4.4.11 & 3.4.4.12]
+func (c *Client) ReadMultipleVariable(handles []uint16) (values [][]byte, truncated bool, err error) {
+	// Acquire a bearer and reuse its txBuf, and release it after usage.
+	br, err := c.acquire()
+	if err != nil {
+		return nil, false, err
+	}
+	defer c.release(br)
+	txBuf := br.txBuf
+
+	// Should request to read two or more values.
+	if len(handles) < 2 || len(handles)*2 > len(txBuf)-1 {
+		return nil, false, ErrInvalidArgument
+	}
+
+	req := ReadMultipleVariableRequest(txBuf[:1+len(handles)*2])
+	req.SetAttributeOpcode()
+	p := req.SetOfHandles()
+	for _, h := range handles {
+		binary.LittleEndian.PutUint16(p, h)
+		p = p[2:]
+	}
+
+	b, err := br.sendReq(c.context(), req)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Convert and validate the response.
+	rsp := ReadMultipleVariableResponse(b)
+	switch {
+	case rsp[0] == ErrorResponseCode && len(rsp) == 5:
+		return nil, false, ble.ATTError(rsp[4])
+	case rsp[0] == ErrorResponseCode && len(rsp) != 5:
+		fallthrough
+	case rsp[0] != rsp.AttributeOpcode():
+		return nil, false, ErrInvalidResponse
+	}
+
+	l := rsp.LengthValueTupleList()
+	for len(l) >= 2 && len(values) < len(handles) {
+		n := int(binary.LittleEndian.Uint16(l))
+		l = l[2:]
+		if n > len(l) {
+			// The last value is truncated.
+			n, truncated = len(l), true
+		}
+		values = append(values, l[:n])
+		l = l[n:]
+	}
+	return values, truncated, nil
+}
@@ -1,9 +1,10 @@
 package att
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
-	"time"
 
 	ble "traulfs/Bline/ble"
 
@@ -17,29 +18,49 @@ type NotificationHandler interface {
 
 // Client implementa an Attribute Protocol Client.
 type Client struct {
-	l2c  ble.Conn
-	rspc chan []byte
+	l2c ble.Conn
+
+	// att is the unenhanced ATT bearer on the fixed channel. Idle bearers,
+	// including the Enhanced ATT bearers, are pooled in chBearer.
+	att      *bearer
+	chBearer chan *bearer
 
-	rxBuf   []byte
-	chTxBuf chan []byte
-	chErr   chan error
 	handler NotificationHandler
+
+	// ctx bounds the waits of the requests; see WithContext.
+	ctx context.Context
 }
 
 // NewClient returns an Attribute Protocol Client.
 func NewClient(l2c ble.Conn, h NotificationHandler) *Client {
 	c := &Client{
-		l2c:     l2c,
-		rspc:    make(chan []byte),
-		chTxBuf: make(chan []byte, 1),
-		rxBuf:   make([]byte, ble.MaxMTU),
-		chErr:   make(chan error, 1),
-		handler: h,
-	}
-	c.chTxBuf <- make([]byte, l2c.TxMTU(), l2c.TxMTU())
+		l2c:      l2c,
+		att:      newBearer(l2c, l2c.TxMTU(), false),
+		chBearer: make(chan *bearer, 1+maxBearers),
+		handler:  h,
+	}
+	c.chBearer <- c.att
 	return c
 }
 
+// WithContext returns a view of the client, whose requests give up waiting
+// for an idle bearer, or for their response, once ctx is done. The response
+// of a canceled request is dropped when it's received, so the bearer is busy
+// until then. The error of a canceled request wraps the error of ctx.
+func (c *Client) WithContext(ctx context.Context) *Client {
+	c2 := *c
+	c2.ctx = ctx
+	return &c2
+}
+
+// context returns the context of the requests.
+func (c *Client) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
 // ExchangeMTU informs the server of the client’s maximum receive MTU size and
 // request the server to respond with its maximum receive MTU size. [Vol 3, Part F, 3.4.2.1]
 func (c *Client) ExchangeMTU(clientRxMTU int) (serverRxMTU int, err error) {
@@ -47,11 +68,14 @@ func (c *Client) ExchangeMTU(clientRxMTU int) (serverRxMTU int, err error) {
 		return 0, ErrInvalidArgument
 	}
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	// The same txBuf, or a newly allocate one, if the txMTU is changed,
-	// will be released back to the channel.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
+	// Acquire the unenhanced bearer and reuse its txBuf, and release it after
+	// usage. The MTU of Enhanced ATT bearers is set by L2CAP instead.
+	br, err := c.acquireATT()
+	if err != nil {
+		return 0, err
+	}
+	defer c.release(br)
+	txBuf := br.txBuf
 
 	// Let L2CAP know the MTU we can handle.
 	c.l2c.SetRxMTU(clientRxMTU)
@@ -60,7 +84,7 @@ func (c *Client) ExchangeMTU(clientRxMTU int) (serverRxMTU int, err error) {
 	req.SetAttributeOpcode()
 	req.SetClientRxMTU(uint16(clientRxMTU))
 
-	b, err := c.sendReq(req)
+	b, err := br.sendReq(c.context(), req)
 	if err != nil {
 		return 0, err
 	}
@@ -82,9 +106,8 @@ func (c *Client) ExchangeMTU(clientRxMTU int) (serverRxMTU int, err error) {
 	if len(txBuf) != txMTU {
 		// Let L2CAP know the MTU that the remote device can handle.
 		c.l2c.SetTxMTU(txMTU)
-		// Put a re-allocated txBuf back to the channel.
-		// The txBuf has been captured in deferred function.
-		txBuf = make([]byte, txMTU, txMTU)
+		// Re-allocate the txBuf of the bearer.
+		br.txBuf = make([]byte, txMTU, txMTU)
 	}
 
 	return txMTU, nil
@@ -98,16 +121,20 @@ func (c *Client) FindInformation(starth, endh uint16) (fmt int, data []byte, err
 		return 0x00, nil, ErrInvalidArgument
 	}
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
+	// Acquire a bearer and reuse its txBuf, and release it after usage.
+	br, err := c.acquire()
+	if err != nil {
+		return 0x00, nil, err
+	}
+	defer c.release(br)
+	txBuf := br.txBuf
 
 	req := FindInformationRequest(txBuf[:5])
 	req.SetAttributeOpcode()
 	req.SetStartingHandle(starth)
 	req.SetEndingHandle(endh)
 
-	b, err := c.sendReq(req)
+	b, err := br.sendReq(c.context(), req)
 	if err != nil {
 		return 0x00, nil, err
 	}
@@ -131,19 +158,53 @@ func (c *Client) FindInformation(starth, endh uint16) (fmt int, data []byte, err
 	return int(rsp.Format()), rsp.InformationData(), nil
 }
 
-// // HandleInformationList ...
-// type HandleInformationList []byte
-//
-// // FoundAttributeHandle ...
-// func (l HandleInformationList) FoundAttributeHandle() []byte { return l[:2] }
-//
-// // GroupEndHandle ...
-// func (l HandleInformationList) GroupEndHandle() []byte { return l[2:4] }
-//
-// // FindByTypeValue ...
-// func (c *Client) FindByTypeValue(starth, endh, attrType uint16, value []byte) ([]HandleInformationList, error) {
-// 	return nil, nil
-// }
+// FindByTypeValue obtains the handles of attributes that have a 16-bit UUID
+// attribute type and attribute value. It returns the Handles Information List,
+// where each entry has the found attribute handle and the group end handle.
+// [Vol 3, Part F, 3.4.3.3 & 3.4.3.4]
+func (c *Client) FindByTypeValue(starth, endh, attrType uint16, value []byte) ([]byte, error) {
+	if starth == 0 || starth > endh {
+		return nil, ErrInvalidArgument
+	}
+
+	// Acquire a bearer and reuse its txBuf, and release it after usage.
+	br, err := c.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(br)
+	txBuf := br.txBuf
+
+	if 7+len(value) > len(txBuf) {
+		return nil, ErrInvalidArgument
+	}
+
+	req := FindByTypeValueRequest(txBuf[:7+len(value)])
+	req.SetAttributeOpcode()
+	req.SetStartingHandle(starth)
+	req.SetEndingHandle(endh)
+	req.SetAttributeType(attrType)
+	req.SetAttributeValue(value)
+
+	b, err := br.sendReq(c.context(), req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert and validate the response.
+	rsp := FindByTypeValueResponse(b)
+	switch {
+	case rsp[0] == ErrorResponseCode && len(rsp) == 5:
+		return nil, ble.ATTError(rsp[4])
+	case rsp[0] == ErrorResponseCode && len(rsp) != 5:
+		fallthrough
+	case rsp[0] != rsp.AttributeOpcode():
+		fallthrough
+	case len(rsp) < 5 || len(rsp.HandleInformationList())%4 != 0:
+		return nil, ErrInvalidResponse
+	}
+	return rsp.HandleInformationList(), nil
+}
 
 // ReadByType obtains the values of attributes where the attribute type is known
 // but the handle is not known. [Vol 3, Part F, 3.4.4.1 & 3.4.4.2]
@@ -152,9 +213,13 @@ func (c *Client) ReadByType(starth, endh uint16, uuid ble.UUID) (int, []byte, er
 		return 0, nil, ErrInvalidArgument
 	}
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
+	// Acquire a bearer and reuse its txBuf, and release it after usage.
+	br, err := c.acquire()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer c.release(br)
+	txBuf := br.txBuf
 
 	req := ReadByTypeRequest(txBuf[:5+len(uuid)])
 	req.SetAttributeOpcode()
@@ -162,7 +227,7 @@ func (c *Client) ReadByType(starth, endh uint16, uuid ble.UUID) (int, []byte, er
 	req.SetEndingHandle(endh)
 	req.SetAttributeType(uuid)
 
-	b, err := c.sendReq(req)
+	b, err := br.sendReq(c.context(), req)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -186,15 +251,19 @@ func (c *Client) ReadByType(starth, endh uint16, uuid ble.UUID) (int, []byte, er
 // value in a Read Response. [Vol 3, Part F, 3.4.4.3 & 3.4.4.4]
 func (c *Client) Read(handle uint16) ([]byte, error) {
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
+	// Acquire a bearer and reuse its txBuf, and release it after usage.
+	br, err := c.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(br)
+	txBuf := br.txBuf
 
 	req := ReadRequest(txBuf[:3])
 	req.SetAttributeOpcode()
 	req.SetAttributeHandle(handle)
 
-	b, err := c.sendReq(req)
+	b, err := br.sendReq(c.context(), req)
 	if err != nil {
 		return nil, err
 	}
@@ -219,16 +288,20 @@ func (c *Client) Read(handle uint16) ([]byte, error) {
 // [Vol 3, Part F, 3.4.4.5 & 3.4.4.6]
 func (c *Client) ReadBlob(handle, offset uint16) ([]byte, error) {
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
+	// Acquire a bearer and reuse its txBuf, and release it after usage.
+	br, err := c.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(br)
+	txBuf := br.txBuf
 
 	req := ReadBlobRequest(txBuf[:5])
 	req.SetAttributeOpcode()
 	req.SetAttributeHandle(handle)
 	req.SetValueOffset(offset)
 
-	b, err := c.sendReq(req)
+	b, err := br.sendReq(c.context(), req)
 	if err != nil {
 		return nil, err
 	}
@@ -255,15 +328,19 @@ func (c *Client) ReadBlob(handle, offset uint16) ([]byte, error) {
 // attributes have a known fixed size is defined in a higher layer specification.
 // [Vol 3, Part F, 3.4.4.7 & 3.4.4.8]
 func (c *Client) ReadMultiple(handles []uint16) ([]byte, error) {
+	// Acquire a bearer and reuse its txBuf, and release it after usage.
+	br, err := c.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(br)
+	txBuf := br.txBuf
+
 	// Should request to read two or more values.
-	if len(handles) < 2 || len(handles)*2 > c.l2c.TxMTU()-1 {
+	if len(handles) < 2 || len(handles)*2 > len(txBuf)-1 {
 		return nil, ErrInvalidArgument
 	}
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
-
 	req := ReadMultipleRequest(txBuf[:1+len(handles)*2])
 	req.SetAttributeOpcode()
 	p := req.SetOfHandles()
@@ -272,7 +349,7 @@ func (c *Client) ReadMultiple(handles []uint16) ([]byte, error) {
 		p = p[2:]
 	}
 
-	b, err := c.sendReq(req)
+	b, err := br.sendReq(c.context(), req)
 	if err != nil {
 		return nil, err
 	}
@@ -300,9 +377,13 @@ func (c *Client) ReadByGroupType(starth, endh uint16, uuid ble.UUID) (int, []byt
 		return 0, nil, ErrInvalidArgument
 	}
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
+	// Acquire a bearer and reuse its txBuf, and release it after usage.
+	br, err := c.acquire()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer c.release(br)
+	txBuf := br.txBuf
 
 	req := ReadByGroupTypeRequest(txBuf[:5+len(uuid)])
 	req.SetAttributeOpcode()
@@ -310,7 +391,7 @@ func (c *Client) ReadByGroupType(starth, endh uint16, uuid ble.UUID) (int, []byt
 	req.SetEndingHandle(endh)
 	req.SetAttributeGroupType(uuid)
 
-	b, err := c.sendReq(req)
+	b, err := br.sendReq(c.context(), req)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -336,20 +417,24 @@ func (c *Client) ReadByGroupType(starth, endh uint16, uuid ble.UUID) (int, []byt
 // Write requests the server to write the value of an attribute and acknowledge that
 // this has been achieved in a Write Response. [Vol 3, Part F, 3.4.5.1 & 3.4.5.2]
 func (c *Client) Write(handle uint16, value []byte) error {
-	if len(value) > c.l2c.TxMTU()-3 {
+
+	// Acquire a bearer and reuse its txBuf, and release it after usage.
+	br, err := c.acquire()
+	if err != nil {
+		return err
+	}
+	defer c.release(br)
+	txBuf := br.txBuf
+	if len(value) > len(txBuf)-3 {
 		return ErrInvalidArgument
 	}
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
-
 	req := WriteRequest(txBuf[:3+len(value)])
 	req.SetAttributeOpcode()
 	req.SetAttributeHandle(handle)
 	req.SetAttributeValue(value)
 
-	b, err := c.sendReq(req)
+	b, err := br.sendReq(c.context(), req)
 	if err != nil {
 		return err
 	}
@@ -370,40 +455,63 @@ func (c *Client) Write(handle uint16, value []byte) error {
 // WriteCommand requests the server to write the value of an attribute, typically
 // into a control-point attribute. [Vol 3, Part F, 3.4.5.3]
 func (c *Client) WriteCommand(handle uint16, value []byte) error {
-	if len(value) > c.l2c.TxMTU()-3 {
+
+	// Acquire a bearer and reuse its txBuf, and release it after usage.
+	br, err := c.acquire()
+	if err != nil {
+		return err
+	}
+	defer c.release(br)
+	txBuf := br.txBuf
+	if len(value) > len(txBuf)-3 {
 		return ErrInvalidArgument
 	}
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
-
 	req := WriteCommand(txBuf[:3+len(value)])
 	req.SetAttributeOpcode()
 	req.SetAttributeHandle(handle)
 	req.SetAttributeValue(value)
 
-	return c.sendCmd(req)
+	return br.sendCmd(req)
 }
 
 // SignedWrite requests the server to write the value of an attribute with an authentication
-// signature, typically into a control-point attribute. [Vol 3, Part F, 3.4.5.4]
-func (c *Client) SignedWrite(handle uint16, value []byte, signature [12]byte) error {
-	if len(value) > c.l2c.TxMTU()-15 {
+// signature, typically into a control-point attribute. The value is signed with
+// the CSRK, which the local device distributed when bonding. [Vol 3, Part F, 3.4.5.4]
+//
+// SignedWrite used to take the authentication signature as a third argument,
+// which callers had to compute themselves. It signs the value now, and the
+// connection must be a ble.SecureConn.
+func (c *Client) SignedWrite(handle uint16, value []byte) error {
+	sc, ok := c.l2c.(ble.SecureConn)
+	if !ok {
+		return errors.New("signing not supported")
+	}
+
+	// Acquire the unenhanced bearer and reuse its txBuf, and release it after
+	// usage. Signed writes are sent on unencrypted links only, which have no
+	// Enhanced ATT bearers.
+	br, err := c.acquireATT()
+	if err != nil {
+		return err
+	}
+	defer c.release(br)
+	txBuf := br.txBuf
+	if len(value) > len(txBuf)-15 {
 		return ErrInvalidArgument
 	}
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
-
 	req := SignedWriteCommand(txBuf[:15+len(value)])
 	req.SetAttributeOpcode()
 	req.SetAttributeHandle(handle)
 	req.SetAttributeValue(value)
+	signature, err := sc.Sign(req[:3+len(value)])
+	if err != nil {
+		return err
+	}
 	req.SetAuthenticationSignature(signature)
 
-	return c.sendCmd(req)
+	return br.sendCmd(req)
 }
 
 // PrepareWrite requests the server to prepare to write the value of an attribute.
@@ -411,20 +519,29 @@ func (c *Client) SignedWrite(handle uint16, value []byte, signature [12]byte) er
 // the Client can verify that the value was received correctly.
 // [Vol 3, Part F, 3.4.6.1 & 3.4.6.2]
 func (c *Client) PrepareWrite(handle uint16, offset uint16, value []byte) (uint16, uint16, []byte, error) {
-	if len(value) > c.l2c.TxMTU()-5 {
-		return 0, 0, nil, ErrInvalidArgument
+
+	// Acquire a bearer and reuse its txBuf, and release it after usage.
+	br, err := c.acquire()
+	if err != nil {
+		return 0, 0, nil, err
 	}
+	defer c.release(br)
+	return br.prepareWrite(c.context(), handle, offset, value)
+}
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
+func (br *bearer) prepareWrite(ctx context.Context, handle uint16, offset uint16, value []byte) (uint16, uint16, []byte, error) {
+	txBuf := br.txBuf
+	if len(value) > len(txBuf)-5 {
+		return 0, 0, nil, ErrInvalidArgument
+	}
 
 	req := PrepareWriteRequest(txBuf[:5+len(value)])
 	req.SetAttributeOpcode()
 	req.SetAttributeHandle(handle)
 	req.SetValueOffset(offset)
+	req.SetPartAttributeValue(value)
 
-	b, err := c.sendReq(req)
+	b, err := br.sendReq(ctx, req)
 	if err != nil {
 		return 0, 0, nil, err
 	}
@@ -449,15 +566,21 @@ func (c *Client) PrepareWrite(handle uint16, offset uint16, value []byte) (uint1
 // handled by the server as an atomic operation. [Vol 3, Part F, 3.4.6.3 & 3.4.6.4]
 func (c *Client) ExecuteWrite(flags uint8) error {
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
+	// Acquire a bearer and reuse its txBuf, and release it after usage.
+	br, err := c.acquire()
+	if err != nil {
+		return err
+	}
+	defer c.release(br)
+	return br.executeWrite(c.context(), flags)
+}
 
-	req := ExecuteWriteRequest(txBuf[:1])
+func (br *bearer) executeWrite(ctx context.Context, flags uint8) error {
+	req := ExecuteWriteRequest(br.txBuf[:2])
 	req.SetAttributeOpcode()
 	req.SetFlags(flags)
 
-	b, err := c.sendReq(req)
+	b, err := br.sendReq(ctx, req)
 	if err != nil {
 		return err
 	}
@@ -475,116 +598,78 @@ func (c *Client) ExecuteWrite(flags uint8) error {
 	return nil
 }
 
-func (c *Client) sendCmd(b []byte) error {
-	_, err := c.l2c.Write(b)
-	return err
+// Flags of Execute Write Request.
+const (
+	cancelPreparedWrites = 0x00
+	writePreparedValues  = 0x01
+)
+
+// QueuedWrite is the value of an attribute, which is written with Prepare
+// Write Requests.
+type QueuedWrite struct {
+	Handle uint16
+	Value  []byte
 }
 
-func (c *Client) sendReq(b []byte) (rsp []byte, err error) {
-	logger.Debug("client", "req", fmt.Sprintf("% X", b))
-	if _, err := c.l2c.Write(b); err != nil {
-		return nil, errors.Wrap(err, "send ATT request failed")
+// WriteQueued writes the values of one or more attributes with Prepare Write
+// Requests, split into parts that fit in the ATT_MTU, and an Execute Write
+// Request, which writes them all atomically. If reliable is set, each part
+// echoed by the server is verified, and the writes are canceled on a mismatch.
+// [Vol 3, Part G, 4.9.4 & 4.9.5]
+func (c *Client) WriteQueued(ws []QueuedWrite, reliable bool) error {
+	// The parts are queued on a single bearer. After a failure, the prepare
+	// queue of the server is cleared on release.
+	br, err := c.acquire()
+	if err != nil {
+		return err
 	}
-	for {
-		select {
-		case rsp := <-c.rspc:
-			if rsp[0] == ErrorResponseCode || rsp[0] == rspOfReq[b[0]] {
-				return rsp, nil
+	defer c.release(br)
+
+	for _, w := range ws {
+		if len(w.Value) > 512 {
+			return ErrInvalidArgument
+		}
+		for off := 0; ; {
+			n := len(w.Value) - off
+			if n > len(br.txBuf)-5 {
+				n = len(br.txBuf) - 5
 			}
-			// Sometimes when we connect to an Apple device, it sends
-			// ATT requests asynchronously to us. // In this case, we
-			// returns an ErrReqNotSupp response, and continue to wait
-			// the response to our request.
-			errRsp := newErrorResponse(rsp[0], 0x0000, ble.ErrReqNotSupp)
-			logger.Debug("client", "req", fmt.Sprintf("% X", b))
-			_, err := c.l2c.Write(errRsp)
+			part := w.Value[off : off+n]
+			h, o, v, err := br.prepareWrite(c.context(), w.Handle, uint16(off), part)
 			if err != nil {
-				return nil, errors.Wrap(err, "unexpected ATT response received")
+				br.cancelQueue = true
+				return err
+			}
+			if reliable && (h != w.Handle || int(o) != off || !bytes.Equal(v, part)) {
+				br.cancelQueue = true
+				return ErrReliableWrite
+			}
+			if off += n; off >= len(w.Value) {
+				break
 			}
-		case err := <-c.chErr:
-			return nil, errors.Wrap(err, "ATT request failed")
-		case <-time.After(30 * time.Second):
-			return nil, errors.Wrap(ErrSeqProtoTimeout, "ATT request timeout")
 		}
 	}
+	return br.executeWrite(c.context(), writePreparedValues)
 }
 
-// Loop ...
+// Loop serves the unenhanced ATT bearer, until the connection is closed.
 func (c *Client) Loop() {
-
-	type asyncWork struct {
-		handle func([]byte)
-		data   []byte
-	}
-
-	ch := make(chan asyncWork, 16)
-	defer close(ch)
-	go func() {
-		for w := range ch {
-			w.handle(w.data)
-		}
-	}()
-
-	confirmation := []byte{HandleValueConfirmationCode}
-	for {
-		n, err := c.l2c.Read(c.rxBuf)
-		logger.Debug("client", "rsp", fmt.Sprintf("% X", c.rxBuf[:n]))
-		if err != nil {
-			// We don't expect any error from the bearer (L2CAP ACL-U)
-			// Pass it along to the pending request, if any, and escape.
-			c.chErr <- err
-			return
-		}
-
-		b := make([]byte, n)
-		copy(b, c.rxBuf)
-
-		// TODO: better request identification
-		if b[0] == ExchangeMTURequestCode {
-			// Schedule this to be taken care of
-			select {
-			case ch <- asyncWork{handle: c.handleRequest, data: b}:
-			default:
-				// If this really happens, especially on a slow machine, enlarge the channel buffer.
-				_ = logger.Error("client", "req", "can't enqueue incoming request.")
-			}
-			continue
-		}
-
-		if (b[0] != HandleValueNotificationCode) && (b[0] != HandleValueIndicationCode) {
-			c.rspc <- b
-			continue
-		}
-
-		// Deliver the full request to upper layer.
-		select {
-		case ch <- asyncWork{handle: c.handler.HandleNotification, data: b}:
-		default:
-			// If this really happens, especially on a slow machine, enlarge the channel buffer.
-			_ = logger.Error("client", "req", "can't enqueue incoming notification.")
-		}
-
-		// Always write aknowledgement for an indication, even it was an invalid request.
-		if b[0] == HandleValueIndicationCode {
-			logger.Debug("client", "req", fmt.Sprintf("% X", b))
-			_, _ = c.l2c.Write(confirmation)
-		}
-	}
+	c.serve(c.att)
 }
 
-func (c *Client) handleRequest(b []byte) {
-	switch b[0] {
-	case ExchangeMTURequestCode:
+func (c *Client) handleRequest(br *bearer, b []byte) {
+	switch {
+	case b[0] == ExchangeMTURequestCode && !br.eatt:
 		resp := c.handleExchangeMTURequest(b)
 		if len(resp) != 0 {
-			err := c.sendCmd(resp)
+			err := br.sendCmd(resp)
 			if err != nil {
 				_ = logger.Error("client", "req", fmt.Sprintf("error sending MTU response: %s", err.Error()))
 			}
 		}
 	default:
 		errRsp := newErrorResponse(b[0], 0x0000, ble.ErrReqNotSupp)
-		_ = c.sendCmd(errRsp)
+		_ = br.sendCmd(errRsp)
 		_ = logger.Warn("client", "req", fmt.Sprintf("Received unhandled request [0x%X]", b))
 	}
 }
@@ -593,12 +678,13 @@ func (c *Client) handleRequest(b []byte) {
 // ExchangeMTU informs the server of the client’s maximum receive MTU size and
 // request the server to respond with its maximum receive MTU size. [Vol 3, Part F, 3.4.2.1]
 func (c *Client) handleExchangeMTURequest(r ExchangeMTURequest) []byte {
-	// Acquire and reuse the txBuf, and release it after usage.
-	// The same txBuf, or a newly allocate one, if the txMTU is changed,
-	// will be released back to the channel.
-
+	// Acquire the unenhanced bearer, and release it after usage.
 	// We do this first to prevent races with ExchangeMTURequest
-	txBuf := <-c.chTxBuf
+	br, err := c.acquireATT()
+	if err != nil {
+		return nil
+	}
+	defer c.release(br)
 
 	// Validate the request.
 	switch {
@@ -616,17 +702,13 @@ func (c *Client) handleExchangeMTURequest(r ExchangeMTURequest) []byte {
 	logger.Debug("client", "req", fmt.Sprintf("server requested an MTU change to TX:%d RX:%d", txMTU, rxMTU))
 	c.l2c.SetTxMTU(txMTU)
 
-	defer func() {
-		// Update the tx buffer if needed
-		if len(txBuf) != txMTU {
-			c.chTxBuf <- make([]byte, txMTU, txMTU)
-		} else {
-			c.chTxBuf <- txBuf
-		}
-	}()
+	// Update the tx buffer if needed
+	if len(br.txBuf) != txMTU {
+		br.txBuf = make([]byte, txMTU, txMTU)
+	}
 
-	rsp := ExchangeMTUResponse(txBuf)
+	rsp := ExchangeMTUResponse(make([]byte, 3))
 	rsp.SetAttributeOpcode()
 	rsp.SetServerRxMTU(uint16(rxMTU))
-	return rsp[:3]
+	return rsp
 }
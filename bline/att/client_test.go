@@ -0,0 +1,134 @@
+package att
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// notifications receives the notifications of a client under test.
+type notifications chan []byte
+
+func (n notifications) HandleNotification(req []byte) { n <- req }
+
+// newTestClient returns a running client, and its connection to the server,
+// which the test plays.
+func newTestClient(t *testing.T) (*Client, *fakeConn, notifications) {
+	t.Helper()
+	cn := newFakeConn()
+	n := make(notifications, 16)
+	c := NewClient(cn, n)
+	go c.Loop()
+	t.Cleanup(func() { cn.Close() })
+	return c, cn, n
+}
+
+// noPDU checks that the client sends nothing for a while.
+func (c *fakeConn) noPDU(t *testing.T) {
+	t.Helper()
+	select {
+	case b := <-c.tx:
+		t.Fatalf("got % X from the client", b)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestClientCanceled checks that the response of a canceled request is
+// dropped, and the bearer reused once it's received.
+func TestClientCanceled(t *testing.T) {
+	c, cn, _ := newTestClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.WithContext(ctx).Read(0x0003)
+		done <- err
+	}()
+	if req := cn.recv(t); !bytes.Equal(req, readRequest(0x0003)) {
+		t.Fatalf("got % X, want Read Request", req)
+	}
+	cancel()
+	if err := <-done; errors.Cause(err) != context.Canceled {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	type result struct {
+		v   []byte
+		err error
+	}
+	next := make(chan result, 1)
+	go func() {
+		v, err := c.Read(0x0005)
+		next <- result{v, err}
+	}()
+	// The bearer is busy, until the response of the canceled request arrives.
+	cn.noPDU(t)
+	cn.rx <- []byte{ReadResponseCode, 'o', 'l', 'd'}
+	if req := cn.recv(t); !bytes.Equal(req, readRequest(0x0005)) {
+		t.Fatalf("got % X, want Read Request", req)
+	}
+	cn.rx <- []byte{ReadResponseCode, 'n', 'e', 'w'}
+	if r := <-next; r.err != nil || string(r.v) != "new" {
+		t.Errorf("got %q, %v, want new", r.v, r.err)
+	}
+}
+
+// TestClientTimeout checks that the bearer is unusable after a transaction
+// timed out, and the late response is dropped without holding up the
+// notifications.
+func TestClientTimeout(t *testing.T) {
+	d := transactionTimeout
+	transactionTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { transactionTimeout = d })
+
+	for _, tc := range []struct {
+		name   string
+		cancel bool // The request is canceled, before it times out.
+	}{
+		{"timed out", false},
+		{"canceled", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, cn, n := newTestClient(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() {
+				_, err := c.WithContext(ctx).Read(0x0003)
+				done <- err
+			}()
+			cn.recv(t)
+			want := ErrSeqProtoTimeout
+			if tc.cancel {
+				cancel()
+				want = context.Canceled
+			}
+			if err := <-done; errors.Cause(err) != want {
+				t.Fatalf("got %v, want %v", err, want)
+			}
+
+			// The next request fails, once the transaction timed out.
+			if _, err := c.Read(0x0003); errors.Cause(err) != ErrSeqProtoTimeout {
+				t.Errorf("got %v, want %v", err, ErrSeqProtoTimeout)
+			}
+			cn.noPDU(t)
+
+			cn.rx <- []byte{ReadResponseCode, 'l', 'a', 't', 'e'}
+			cn.rx <- []byte{HandleValueNotificationCode, 0x03, 0x00, 0x01}
+			select {
+			case b := <-n:
+				if !bytes.Equal(b, []byte{HandleValueNotificationCode, 0x03, 0x00, 0x01}) {
+					t.Errorf("got notification % X", b)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("the notification wasn't delivered after the late response")
+			}
+			if err := c.WriteCommand(0x0003, []byte{0x01}); errors.Cause(err) != ErrSeqProtoTimeout {
+				t.Errorf("WriteCommand: got %v, want %v", err, ErrSeqProtoTimeout)
+			}
+			cn.noPDU(t)
+		})
+	}
+}
@@ -1,16 +1,27 @@
 package att
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"sync"
 
 	ble "traulfs/Bline/ble"
 )
 
-// A DB is a contiguous range of attributes.
+// A DB is a contiguous range of attributes. Its services may be set again,
+// while the servers use it.
 type DB struct {
+	mu    sync.RWMutex
+	attrs []*attr // nil for the handles, which aren't used
+	base  uint16  // handle for first attr in attrs
+	svcs  []dbService
+}
+
+// dbService is a service, and the attributes generated for it.
+type dbService struct {
+	s     *ble.Service
 	attrs []*attr
-	base  uint16 // handle for first attr in attrs
 }
 
 const (
@@ -33,8 +44,10 @@ func (r *DB) idx(h int) int {
 
 // at returns attr a.
 func (r *DB) at(h uint16) (a *attr, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	i := r.idx(int(h))
-	if i < 0 {
+	if i < 0 || r.attrs[i] == nil {
 		return nil, false
 	}
 	return r.attrs[i], true
@@ -43,6 +56,8 @@ func (r *DB) at(h uint16) (a *attr, ok bool) {
 // subrange returns attributes in range [start, end]; it may return an empty slice.
 // subrange does not panic for out-of-range start or end.
 func (r *DB) subrange(start, end uint16) []*attr {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	startidx := r.idx(int(start))
 	switch startidx {
 	case tooSmall:
@@ -58,23 +73,93 @@ func (r *DB) subrange(start, end uint16) []*attr {
 	case tooLarge:
 		endidx = len(r.attrs)
 	}
-	return r.attrs[startidx:endidx]
+	aa := make([]*attr, 0, endidx-startidx)
+	for _, a := range r.attrs[startidx:endidx] {
+		if a != nil {
+			aa = append(aa, a)
+		}
+	}
+	return aa
 }
 
 // NewDB ...
 func NewDB(ss []*ble.Service, base uint16) *DB {
-	h := base
-	var attrs []*attr
-	var aa []*attr
-	for i, s := range ss {
-		h, aa = genSvcAttr(s, h)
-		if i == len(ss)-1 {
-			aa[0].endh = 0xFFFF
+	r := &DB{base: base}
+	r.SetServices(ss)
+	return r
+}
+
+// SetServices replaces the services of the database. The services, which were
+// in the database before, keep their handles where possible, so the handles
+// known to the clients stay valid. SetServices returns the range of handles,
+// which were added, removed, or changed, if any. [Vol 3, Part G, 7.1]
+func (r *DB) SetServices(ss []*ble.Service) (start, end uint16, changed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := make(map[*ble.Service]dbService, len(r.svcs))
+	for _, o := range r.svcs {
+		old[o.s] = o
+	}
+
+	var svcs []dbService
+	h := r.base
+	last := r.base
+	for _, s := range ss {
+		starth := h
+		if o, ok := old[s]; ok && o.attrs[0].h >= h {
+			starth = o.attrs[0].h
 		}
-		attrs = append(attrs, aa...)
+		var aa []*attr
+		h, aa = genSvcAttr(s, starth)
+		svcs = append(svcs, dbService{s: s, attrs: aa})
+		last = h
+	}
+
+	attrs := make([]*attr, int(last)-int(r.base))
+	unchanged := make(map[*ble.Service]bool, len(svcs))
+	extend := func(aa []*attr) {
+		if !changed || aa[0].h < start {
+			start = aa[0].h
+		}
+		if !changed || aa[0].endh > end {
+			end = aa[0].endh
+		}
+		changed = true
+	}
+	for _, n := range svcs {
+		for _, a := range n.attrs {
+			attrs[int(a.h)-int(r.base)] = a
+		}
+		if o, ok := old[n.s]; ok && sameAttrs(o.attrs, n.attrs) {
+			unchanged[n.s] = true
+			continue
+		}
+		extend(n.attrs)
 	}
+	for _, o := range r.svcs {
+		if !unchanged[o.s] {
+			extend(o.attrs)
+		}
+	}
+
+	r.attrs, r.svcs = attrs, svcs
 	DumpAttributes(attrs)
-	return &DB{attrs: attrs, base: base}
+	return start, end, changed
+}
+
+// sameAttrs reports whether the attributes of a service have the same
+// handles, types and static values.
+func sameAttrs(aa, bb []*attr) bool {
+	if len(aa) != len(bb) {
+		return false
+	}
+	for i, a := range aa {
+		b := bb[i]
+		if a.h != b.h || a.endh != b.endh || !a.typ.Equal(b.typ) || !bytes.Equal(a.v, b.v) {
+			return false
+		}
+	}
+	return true
 }
 
 func genSvcAttr(s *ble.Service, h uint16) (uint16, []*attr) {
@@ -111,11 +196,16 @@ func genCharAttr(c *ble.Characteristic, h uint16) (uint16, []*attr) {
 		v:   c.Value,
 		rh:  c.ReadHandler,
 		wh:  c.WriteHandler,
+
+		signed:     c.Property&ble.CharSignedWrite != 0,
+		perm:       c.Permission | securePermission(c.Secure),
+		minKeySize: c.MinKeySize,
+		ah:         c.AuthorizeHandler,
 	}
 
 	c.Handle = h
 	c.ValueHandle = vh
-	if c.NotifyHandler != nil || c.IndicateHandler != nil {
+	if c.CCCD == nil && (c.NotifyHandler != nil || c.IndicateHandler != nil) {
 		c.CCCD = newCCCD(c)
 		c.Descriptors = append(c.Descriptors, c.CCCD)
 	}
@@ -132,6 +222,19 @@ func genCharAttr(c *ble.Characteristic, h uint16) (uint16, []*attr) {
 	return h, attrs
 }
 
+// securePermission maps the deprecated Secure properties of a characteristic
+// onto permissions.
+func securePermission(p ble.Property) ble.Permission {
+	var perm ble.Permission
+	if p&ble.CharRead != 0 {
+		perm |= ble.PermReadEncrypt
+	}
+	if p&(ble.CharWrite|ble.CharWriteNR) != 0 {
+		perm |= ble.PermWriteEncrypt
+	}
+	return perm
+}
+
 func genDescAttr(d *ble.Descriptor, h uint16) *attr {
 	return &attr{
 		h:   h,
@@ -139,6 +242,10 @@ func genDescAttr(d *ble.Descriptor, h uint16) *attr {
 		v:   d.Value,
 		rh:  d.ReadHandler,
 		wh:  d.WriteHandler,
+
+		perm:       d.Permission,
+		minKeySize: d.MinKeySize,
+		ah:         d.AuthorizeHandler,
 	}
 }
 
@@ -147,6 +254,9 @@ func DumpAttributes(aa []*attr) {
 	logger.Debug("server", "db", "Generating attribute table:")
 	logger.Debug("server", "db", "handle   endh   type")
 	for _, a := range aa {
+		if a == nil {
+			continue
+		}
 		if a.v != nil {
 			logger.Debug("server", "db", fmt.Sprintf("0x%04X 0x%04X 0x%s [% X]", a.h, a.endh, a.typ, a.v))
 			continue
@@ -164,47 +274,57 @@ func newCCCD(c *ble.Characteristic) *ble.Descriptor {
 	d := ble.NewDescriptor(ble.ClientCharacteristicConfigUUID)
 
 	d.HandleRead(ble.ReadHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
-		cccs := req.Conn().(*conn).cccs
-		ccc := cccs[c.Handle]
+		cn := req.Conn().(*conn)
+		cn.mu.Lock()
+		ccc := cn.cccs[c.Handle]
+		cn.mu.Unlock()
 		binary.Write(rsp, binary.LittleEndian, ccc)
 	}))
 
 	d.HandleWrite(ble.WriteHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
 		cn := req.Conn().(*conn)
-		old := cn.cccs[c.Handle]
-		ccc := binary.LittleEndian.Uint16(req.Data())
-
-		oldNotify := old&cccNotify != 0
-		oldIndicate := old&cccIndicate != 0
-		newNotify := ccc&cccNotify != 0
-		newIndicate := ccc&cccIndicate != 0
-
-		if newNotify && !oldNotify {
-			if c.Property&ble.CharNotify == 0 {
-				rsp.SetStatus(ble.ErrUnlikely)
-				return
-			}
-			send := func(b []byte) (int, error) { return cn.svr.notify(c.ValueHandle, b) }
-			cn.nn[c.Handle] = ble.NewNotifier(send)
-			go c.NotifyHandler.ServeNotify(req, cn.nn[c.Handle])
-		}
-		if !newNotify && oldNotify {
-			cn.nn[c.Handle].Close()
+		cn.mu.Lock()
+		defer cn.mu.Unlock()
+		if e := cn.configure(req, c, binary.LittleEndian.Uint16(req.Data())); e != ble.ErrSuccess {
+			rsp.SetStatus(e)
 		}
+	}))
+	return d
+}
 
-		if newIndicate && !oldIndicate {
-			if c.Property&ble.CharIndicate == 0 {
-				rsp.SetStatus(ble.ErrUnlikely)
-				return
-			}
-			send := func(b []byte) (int, error) { return cn.svr.indicate(c.ValueHandle, b) }
-			cn.in[c.Handle] = ble.NewNotifier(send)
-			go c.IndicateHandler.ServeNotify(req, cn.in[c.Handle])
+// configure sets the client configuration of characteristic c, and starts or
+// stops serving its notifications and indications. The caller holds cn.mu.
+func (cn *conn) configure(req ble.Request, c *ble.Characteristic, ccc uint16) ble.ATTError {
+	old := cn.cccs[c.Handle]
+
+	oldNotify := old&cccNotify != 0
+	oldIndicate := old&cccIndicate != 0
+	newNotify := ccc&cccNotify != 0
+	newIndicate := ccc&cccIndicate != 0
+
+	if newNotify && !oldNotify {
+		if c.Property&ble.CharNotify == 0 {
+			return ble.ErrUnlikely
 		}
-		if !newIndicate && oldIndicate {
-			cn.in[c.Handle].Close()
+		send := func(b []byte) (int, error) { return cn.svr.notify(c.ValueHandle, b) }
+		cn.nn[c.Handle] = ble.NewNotifier(send)
+		go c.NotifyHandler.ServeNotify(req, cn.nn[c.Handle])
+	}
+	if !newNotify && oldNotify {
+		cn.nn[c.Handle].Close()
+	}
+
+	if newIndicate && !oldIndicate {
+		if c.Property&ble.CharIndicate == 0 {
+			return ble.ErrUnlikely
 		}
-		cn.cccs[c.Handle] = ccc
-	}))
-	return d
+		send := func(b []byte) (int, error) { return cn.svr.indicate(c.ValueHandle, b) }
+		cn.in[c.Handle] = ble.NewNotifier(send)
+		go c.IndicateHandler.ServeNotify(req, cn.in[c.Handle])
+	}
+	if !newIndicate && oldIndicate {
+		cn.in[c.Handle].Close()
+	}
+	cn.cccs[c.Handle] = ccc
+	return ble.ErrSuccess
 }
@@ -0,0 +1,110 @@
+package att
+
+import (
+	"testing"
+
+	ble "traulfs/Bline/ble"
+)
+
+// testService returns a service with a characteristic of a static value for
+// each UUID of cs. Each characteristic takes 2 handles.
+func testService(u uint16, cs ...uint16) *ble.Service {
+	s := ble.NewService(ble.UUID16(u))
+	for _, c := range cs {
+		s.NewCharacteristic(ble.UUID16(c)).SetValue([]byte{0x01})
+	}
+	return s
+}
+
+func TestSetServices(t *testing.T) {
+	type span struct{ h, endh uint16 }
+	for _, tc := range []struct {
+		name       string
+		update     func(a, b, c *ble.Service) []*ble.Service
+		want       []span // Of a, b and c; 0 if removed.
+		changed    bool
+		start, end uint16
+	}{
+		{
+			name:   "unchanged",
+			update: func(a, b, c *ble.Service) []*ble.Service { return []*ble.Service{a, b, c} },
+			want:   []span{{1, 3}, {4, 6}, {7, 9}},
+		},
+		{
+			name:    "removed",
+			update:  func(a, b, c *ble.Service) []*ble.Service { return []*ble.Service{a, c} },
+			want:    []span{{1, 3}, {}, {7, 9}},
+			changed: true, start: 4, end: 6,
+		},
+		{
+			name: "added at the end",
+			update: func(a, b, c *ble.Service) []*ble.Service {
+				return []*ble.Service{a, b, c, testService(0x1811, 0x2A00)}
+			},
+			want:    []span{{1, 3}, {4, 6}, {7, 9}},
+			changed: true, start: 10, end: 12,
+		},
+		{
+			name: "added in the gap of a removed one",
+			update: func(a, b, c *ble.Service) []*ble.Service {
+				return []*ble.Service{a, testService(0x1811, 0x2A00), c}
+			},
+			want:    []span{{1, 3}, {}, {7, 9}},
+			changed: true, start: 4, end: 6,
+		},
+		{
+			name: "added in front",
+			update: func(a, b, c *ble.Service) []*ble.Service {
+				return []*ble.Service{a, testService(0x1811, 0x2A00), b, c}
+			},
+			want:    []span{{1, 3}, {7, 9}, {10, 12}},
+			changed: true, start: 4, end: 12,
+		},
+		{
+			name: "grown",
+			update: func(a, b, c *ble.Service) []*ble.Service {
+				b.NewCharacteristic(ble.UUID16(0x2A01)).SetValue([]byte{0x02})
+				return []*ble.Service{a, b, c}
+			},
+			want:    []span{{1, 3}, {4, 8}, {9, 11}},
+			changed: true, start: 4, end: 11,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b, c := testService(0x180A, 0x2A24), testService(0x180D, 0x2A37), testService(0x180F, 0x2A19)
+			db := NewDB([]*ble.Service{a, b, c}, 1)
+			start, end, changed := db.SetServices(tc.update(a, b, c))
+			if changed != tc.changed || start != tc.start || end != tc.end {
+				t.Errorf("got %v 0x%04X-0x%04X, want %v 0x%04X-0x%04X", changed, start, end, tc.changed, tc.start, tc.end)
+			}
+			for i, s := range []*ble.Service{a, b, c} {
+				w := tc.want[i]
+				if w.h == 0 {
+					continue
+				}
+				x, ok := db.at(w.h)
+				if !ok || !x.typ.Equal(ble.PrimaryServiceUUID) || !ble.UUID(x.v).Equal(s.UUID) || x.endh != w.endh {
+					t.Errorf("service %s: not at 0x%04X-0x%04X", s.UUID, w.h, w.endh)
+				}
+				if vh := s.Characteristics[0].ValueHandle; vh != w.h+2 {
+					t.Errorf("service %s: got value handle 0x%04X, want 0x%04X", s.UUID, vh, w.h+2)
+				}
+			}
+		})
+	}
+}
+
+// TestSetServicesGap checks that the handles of a removed service aren't used.
+func TestSetServicesGap(t *testing.T) {
+	a, b, c := testService(0x180A, 0x2A24), testService(0x180D, 0x2A37), testService(0x180F, 0x2A19)
+	db := NewDB([]*ble.Service{a, b, c}, 1)
+	db.SetServices([]*ble.Service{a, c})
+	for h := uint16(4); h <= 6; h++ {
+		if _, ok := db.at(h); ok {
+			t.Errorf("0x%04X: got an attribute in the gap", h)
+		}
+	}
+	if n := len(db.subrange(1, 0xFFFF)); n != 6 {
+		t.Errorf("got %d attributes, want 6", n)
+	}
+}
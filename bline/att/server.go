@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
 	ble "traulfs/Bline/ble"
@@ -12,17 +13,67 @@ import (
 
 type conn struct {
 	ble.Conn
-	svr  *Server
+	svr *Server
+
+	// The client configuration is shared by the bearers of the connection.
+	mu   sync.Mutex
 	cccs map[uint16]uint16
 	nn   map[uint16]ble.Notifier
 	in   map[uint16]ble.Notifier
+
+	// The prepare queue of the client [Vol 3, Part F, 3.4.6], which is
+	// shared by the bearers of the connection too.
+	qmu   sync.Mutex
+	queue []preparedWrite
+
+	// The updates of values, which are sent to the client in turn. They're
+	// queued under umu.
+	umu     sync.Mutex
+	updates chan update
+	closed  chan struct{}
+}
+
+// IdentityAddr implements ble.IdentityConn, so handlers can tell the clients
+// apart across connections.
+func (c *conn) IdentityAddr() ble.Addr {
+	if ic, ok := c.Conn.(ble.IdentityConn); ok {
+		return ic.IdentityAddr()
+	}
+	return c.RemoteAddr()
 }
 
+// Bonded implements ble.IdentityConn.
+func (c *conn) Bonded() bool {
+	if ic, ok := c.Conn.(ble.IdentityConn); ok {
+		return ic.Bonded()
+	}
+	return false
+}
+
+// preparedWrite is a part of a value, which is queued by a Prepare Write
+// Request until it's executed or canceled.
+type preparedWrite struct {
+	a      *attr
+	offset int
+	value  []byte
+}
+
+// maxPreparedWrites is the number of parts the prepare queue holds.
+const maxPreparedWrites = 64
+
+// maxAttrValueLen is the maximum length of an attribute value [Vol 3, Part F, 3.2.9].
+const maxAttrValueLen = 512
+
 // Server implements an ATT (Attribute Protocol) server.
 type Server struct {
 	conn *conn
 	db   *DB
 
+	// bearer carries the ATT PDUs; it's the connection itself, unless the
+	// server serves an Enhanced ATT bearer.
+	bearer io.ReadWriteCloser
+	eatt   bool
+
 	// Refer to [Vol 3, Part F, 3.3.2 & 3.3.3] for the requirement of
 	// sequential request-response protocol, and transactions.
 	rxMTU     int
@@ -33,9 +84,13 @@ type Server struct {
 
 	dummyRspWriter ble.ResponseWriter
 
-	// Store a write handler for defer execute once receiving ExecuteWriteRequest
-	prepareWriteRequestAttr *attr
-	prepareWriteRequestData bytes.Buffer
+	// securityRequest makes the server request security, when the client
+	// accesses an attribute which requires more security than the link has.
+	securityRequest bool
+
+	// The value of a long read, which is kept for its Read Blob Requests.
+	longHandle uint16
+	longValue  []byte
 }
 
 // NewServer returns an ATT (Attribute Protocol) server.
@@ -53,8 +108,12 @@ func NewServer(db *DB, l2c ble.Conn) (*Server, error) {
 			cccs: make(map[uint16]uint16),
 			in:   make(map[uint16]ble.Notifier),
 			nn:   make(map[uint16]ble.Notifier),
+
+			updates: make(chan update, updateQueueLen),
+			closed:  make(chan struct{}),
 		},
-		db: db,
+		db:     db,
+		bearer: l2c,
 
 		rxMTU:     mtu,
 		txBuf:     make([]byte, ble.DefaultMTU, ble.DefaultMTU),
@@ -70,6 +129,82 @@ func NewServer(db *DB, l2c ble.Conn) (*Server, error) {
 	return s, nil
 }
 
+// NewBearer returns a server of an Enhanced ATT bearer [Vol 3, Part F, 3.2.11],
+// which shares the database and the client configuration of s. Its Loop serves
+// the requests received on the bearer, concurrently with the other bearers.
+// Notifications and indications are sent on the unenhanced bearer.
+func (s *Server) NewBearer(b Bearer) *Server {
+	mtu := bearerMTU(b)
+	return &Server{
+		conn:   s.conn,
+		db:     s.db,
+		bearer: b,
+		eatt:   true,
+
+		rxMTU:     mtu,
+		txBuf:     make([]byte, mtu, mtu),
+		chConfirm: make(chan bool),
+
+		dummyRspWriter:  s.dummyRspWriter,
+		securityRequest: s.securityRequest,
+	}
+}
+
+// SetSecurityRequest sets whether the server sends a Security Request, when the
+// client accesses an attribute which requires more security than the link has.
+func (s *Server) SetSecurityRequest(b bool) {
+	s.securityRequest = b
+}
+
+// Security levels of LE security mode 1 [Vol 3, Part C, 10.2.1].
+const (
+	securityEncrypted     = 2
+	securityAuthenticated = 3
+)
+
+// checkSecurity checks the permission of reading or writing an attribute
+// against the security state of the link [Vol 3, Part F, 4.10].
+func (s *Server) checkSecurity(a *attr, write bool) ble.ATTError {
+	level, keySize := 1, 0
+	sc, ok := s.conn.Conn.(ble.SecureConn)
+	if ok {
+		level, keySize = sc.SecurityLevel(), sc.EncryptionKeySize()
+	}
+	e := s.checkPermission(a, write, level, keySize)
+	if (e == ble.ErrAuthentication || e == ble.ErrInsuffEnc || e == ble.ErrInsuffEncrKeySize) && ok && s.securityRequest {
+		go func() {
+			if err := sc.RequestSecurity(); err != nil {
+				logger.Warn("server", "security request", err)
+			}
+		}()
+	}
+	return e
+}
+
+// checkPermission checks the permission of reading or writing an attribute
+// against a security level and an encryption key size.
+func (s *Server) checkPermission(a *attr, write bool, level, keySize int) ble.ATTError {
+	encrypt, authen, author := ble.PermReadEncrypt, ble.PermReadAuthen, ble.PermReadAuthor
+	if write {
+		encrypt, authen, author = ble.PermWriteEncrypt, ble.PermWriteAuthen, ble.PermWriteAuthor
+	}
+	if a.perm&(encrypt|authen|author) == 0 {
+		return ble.ErrSuccess
+	}
+	e := ble.ErrSuccess
+	switch {
+	case a.perm&authen != 0 && level < securityAuthenticated:
+		e = ble.ErrAuthentication
+	case a.perm&(encrypt|authen) != 0 && level < securityEncrypted:
+		e = ble.ErrInsuffEnc
+	case a.perm&(encrypt|authen) != 0 && keySize < a.minKeySize:
+		e = ble.ErrInsuffEncrKeySize
+	case a.perm&author != 0 && (a.ah == nil || !a.ah.Authorize(ble.NewRequest(s.conn, nil, 0), write)):
+		e = ble.ErrAuthorization
+	}
+	return e
+}
+
 // notify sends notification to remote central.
 func (s *Server) notify(h uint16, data []byte) (int, error) {
 	// Acquire and reuse notifyBuffer. Release it after usage.
@@ -118,6 +253,36 @@ func (s *Server) indicate(h uint16, data []byte) (int, error) {
 	}
 }
 
+// NotifyMultiple sends the values of several attributes in a Multiple Handle
+// Value Notification [Vol 3, Part F, 3.4.7.4]. The client must support it, as
+// told by its Client Supported Features. The values, which don't fit in the
+// ATT_MTU, are dropped.
+func (s *Server) NotifyMultiple(handles []uint16, values [][]byte) (int, error) {
+	if len(handles) < 2 || len(handles) != len(values) {
+		return 0, ErrInvalidArgument
+	}
+	s = s.conn.svr // Sent on the unenhanced bearer.
+
+	// Acquire and reuse notifyBuffer. Release it after usage.
+	nBuf := <-s.chNotBuf
+	defer func() { s.chNotBuf <- nBuf }()
+
+	rsp := MultipleHandleValueNotification(nBuf)
+	rsp.SetAttributeOpcode()
+	l := rsp.HandleLengthValueTupleList()
+	n := 0
+	for i, h := range handles {
+		if n+4+len(values[i]) > len(l) {
+			break
+		}
+		binary.LittleEndian.PutUint16(l[n:], h)
+		binary.LittleEndian.PutUint16(l[n+2:], uint16(len(values[i])))
+		copy(l[n+4:], values[i])
+		n += 4 + len(values[i])
+	}
+	return s.conn.Write(rsp[:1+n])
+}
+
 // Loop accepts incoming ATT request, and respond response.
 func (s *Server) Loop() {
 	type sbuf struct {
@@ -127,16 +292,19 @@ func (s *Server) Loop() {
 	pool := make(chan *sbuf, 2)
 	pool <- &sbuf{buf: make([]byte, s.rxMTU)}
 	pool <- &sbuf{buf: make([]byte, s.rxMTU)}
+	if !s.eatt {
+		go s.conn.sendUpdates()
+	}
 
 	seq := make(chan *sbuf)
 	go func() {
 		b := <-pool
 		for {
-			n, err := s.conn.Read(b.buf)
+			n, err := s.bearer.Read(b.buf)
 			if n == 0 || err != nil {
 				close(seq)
 				close(s.chConfirm)
-				_ = s.conn.Close()
+				_ = s.bearer.Close()
 				return
 			}
 			if b.buf[0] == HandleValueConfirmationCode {
@@ -155,11 +323,18 @@ func (s *Server) Loop() {
 	for req := range seq {
 		if rsp := s.handleRequest(req.buf[:req.len]); rsp != nil {
 			if len(rsp) != 0 {
-				s.conn.Write(rsp)
+				s.bearer.Write(rsp)
 			}
 		}
 		pool <- req
 	}
+	if s.eatt {
+		// The connection remains, with its client configuration.
+		return
+	}
+	close(s.conn.closed)
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
 	for h, ccc := range s.conn.cccs {
 		if ccc != 0 {
 			logger.Info("cleanup", ble.ContextKeyCCC, fmt.Sprintf("0x%02X", ccc))
@@ -176,6 +351,10 @@ func (s *Server) Loop() {
 func (s *Server) handleRequest(b []byte) []byte {
 	var resp []byte
 	logger.Debug("server", "req", fmt.Sprintf("% X", b))
+	if b[0] != ReadBlobRequestCode {
+		// The long read, if any, is over.
+		s.longValue = nil
+	}
 	switch reqType := b[0]; reqType {
 	case ExchangeMTURequestCode:
 		resp = s.handleExchangeMTURequest(b)
@@ -199,9 +378,12 @@ func (s *Server) handleRequest(b []byte) []byte {
 		resp = s.handlePrepareWriteRequest(b)
 	case ExecuteWriteRequestCode:
 		resp = s.handleExecuteWriteRequest(b)
-	case ReadMultipleRequestCode,
-		SignedWriteCommandCode:
-		fallthrough
+	case SignedWriteCommandCode:
+		s.handleSignedWriteCommand(b)
+	case ReadMultipleVariableRequestCode:
+		resp = s.handleReadMultipleVariableRequest(b)
+	case ReadMultipleRequestCode:
+		resp = s.handleReadMultipleRequest(b)
 	default:
 		resp = newErrorResponse(reqType, 0x0000, ble.ErrReqNotSupp)
 	}
@@ -213,6 +395,9 @@ func (s *Server) handleRequest(b []byte) []byte {
 func (s *Server) handleExchangeMTURequest(r ExchangeMTURequest) []byte {
 	// Validate the request.
 	switch {
+	case s.eatt:
+		// The ATT_MTU of Enhanced ATT bearers is set by L2CAP.
+		return newErrorResponse(r.AttributeOpcode(), 0x0000, ble.ErrReqNotSupp)
 	case len(r) != 3:
 		fallthrough
 	case r.ClientRxMTU() < 23:
@@ -355,6 +540,14 @@ func (s *Server) handleReadByTypeRequest(r ReadByTypeRequest) []byte {
 		if !a.typ.Equal(ble.UUID(r.AttributeType())) {
 			continue
 		}
+		if e := s.checkSecurity(a, false); e != ble.ErrSuccess {
+			// Return if the first value read cause an error.
+			if dlen == 0 {
+				return newErrorResponse(r.AttributeOpcode(), a.h, e)
+			}
+			// Otherwise, stop before it.
+			break
+		}
 		v := a.v
 		if v == nil {
 			buf2 := bytes.NewBuffer(make([]byte, 0, len(s.txBuf)-2))
@@ -412,15 +605,11 @@ func (s *Server) handleReadRequest(r ReadRequest) []byte {
 		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), ble.ErrInvalidHandle)
 	}
 
-	// Simple case. Read-only, no-authorization, no-authentication.
-	if a.v != nil {
-		binary.Write(buf, binary.LittleEndian, a.v)
-		return rsp[:1+buf.Len()]
+	if e := s.checkSecurity(a, false); e != ble.ErrSuccess {
+		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), e)
 	}
 
-	// Pass the request to upper layer with the ResponseWriter, which caps
-	// the buffer to a valid length of payload.
-	if e := handleATT(a, s, r, ble.NewResponseWriter(buf)); e != ble.ErrSuccess {
+	if e := s.readValue(a, r, 0, buf); e != ble.ErrSuccess {
 		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), e)
 	}
 	return rsp[:1+buf.Len()]
@@ -444,20 +633,155 @@ func (s *Server) handleReadBlobRequest(r ReadBlobRequest) []byte {
 	buf := bytes.NewBuffer(rsp.PartAttributeValue())
 	buf.Reset()
 
-	// Simple case. Read-only, no-authorization, no-authentication.
-	if a.v != nil {
-		binary.Write(buf, binary.LittleEndian, a.v)
-		return rsp[:1+buf.Len()]
+	if e := s.checkSecurity(a, false); e != ble.ErrSuccess {
+		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), e)
 	}
 
-	// Pass the request to upper layer with the ResponseWriter, which caps
-	// the buffer to a valid length of payload.
-	if e := handleATT(a, s, r, ble.NewResponseWriter(buf)); e != ble.ErrSuccess {
+	if e := s.readValue(a, r, int(r.ValueOffset()), buf); e != ble.ErrSuccess {
 		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), e)
 	}
 	return rsp[:1+buf.Len()]
 }
 
+// readValue writes the part of the value of a at offset, which fits in buf.
+// Static values, and the values set by the handlers with ble.WriteValue are
+// sliced by the server; if a part of the value is left, the value is kept for
+// the Read Blob Requests of a long read [Vol 3, Part G, 4.8.3].
+func (s *Server) readValue(a *attr, r []byte, offset int, buf *bytes.Buffer) ble.ATTError {
+	v := a.v
+	if v == nil && offset > 0 && s.longValue != nil && s.longHandle == a.h {
+		v = s.longValue
+	}
+	if v == nil {
+		// Pass the request to upper layer with the ResponseWriter, which caps
+		// the buffer to a valid length of payload.
+		w := &valueWriter{ResponseWriter: ble.NewResponseWriter(buf)}
+		if e := handleATT(a, s, r, w); e != ble.ErrSuccess {
+			return e
+		}
+		if !w.set {
+			// The handler has written the part at offset itself.
+			return ble.ErrSuccess
+		}
+		v = w.value
+	}
+	if offset > len(v) {
+		return ble.ErrInvalidOffset
+	}
+	n := len(v) - offset
+	if n > buf.Cap()-buf.Len() {
+		n = buf.Cap() - buf.Len()
+	}
+	buf.Write(v[offset : offset+n])
+
+	s.longValue = nil
+	if a.v == nil && offset+n < len(v) {
+		s.longHandle, s.longValue = a.h, v
+	}
+	return ble.ErrSuccess
+}
+
+// valueWriter takes the whole value of an attribute from a read handler,
+// which uses ble.WriteValue.
+type valueWriter struct {
+	ble.ResponseWriter
+	value []byte
+	set   bool
+}
+
+// SetValue implements ble.ValueSetter.
+func (w *valueWriter) SetValue(v []byte) {
+	w.value = append([]byte(nil), v...)
+	w.set = true
+}
+
+// handle Read Multiple Variable request. [Vol 3, Part F, 3.4.4.11 & 3.4.4.12]
+func (s *Server) handleReadMultipleVariableRequest(r ReadMultipleVariableRequest) []byte {
+	// Validate the request.
+	switch {
+	case len(r) < 5 || len(r)%2 != 1:
+		return newErrorResponse(r.AttributeOpcode(), 0x0000, ble.ErrInvalidPDU)
+	}
+
+	rsp := ReadMultipleVariableResponse(s.txBuf)
+	rsp.SetAttributeOpcode()
+	buf := bytes.NewBuffer(rsp.LengthValueTupleList())
+	buf.Reset()
+
+	for hs := r.SetOfHandles(); len(hs) >= 2; hs = hs[2:] {
+		h := binary.LittleEndian.Uint16(hs)
+		a, ok := s.db.at(h)
+		if !ok {
+			return newErrorResponse(r.AttributeOpcode(), h, ble.ErrInvalidHandle)
+		}
+		if e := s.checkSecurity(a, false); e != ble.ErrSuccess {
+			return newErrorResponse(r.AttributeOpcode(), h, e)
+		}
+
+		// Read the whole value; it's truncated when added to the response.
+		v := bytes.NewBuffer(make([]byte, 0, ble.MaxMTU))
+		if a.v != nil {
+			v.Write(a.v)
+		} else if e := handleATT(a, s, r, ble.NewResponseWriter(v)); e != ble.ErrSuccess {
+			return newErrorResponse(r.AttributeOpcode(), h, e)
+		}
+
+		// The length is the one of the whole value, even if the value is truncated.
+		if buf.Len()+2 > buf.Cap() {
+			break
+		}
+		binary.Write(buf, binary.LittleEndian, uint16(v.Len()))
+		if n := buf.Cap() - buf.Len(); v.Len() > n {
+			buf.Write(v.Bytes()[:n])
+			break
+		}
+		buf.Write(v.Bytes())
+	}
+	return rsp[:1+buf.Len()]
+}
+
+// handle Read Multiple request. [Vol 3, Part F, 3.4.4.7 & 3.4.4.8]
+func (s *Server) handleReadMultipleRequest(r ReadMultipleRequest) []byte {
+	// Validate the request.
+	switch {
+	case len(r) < 5 || len(r)%2 != 1:
+		return newErrorResponse(r.AttributeOpcode(), 0x0000, ble.ErrInvalidPDU)
+	}
+
+	rsp := ReadMultipleResponse(s.txBuf)
+	rsp.SetAttributeOpcode()
+	buf := bytes.NewBuffer(rsp.SetOfValues())
+	buf.Reset()
+
+	// The values are read, and checked, even if the response is full; an
+	// error with any of them fails the whole request.
+	for hs := r.SetOfHandles(); len(hs) >= 2; hs = hs[2:] {
+		h := binary.LittleEndian.Uint16(hs)
+		a, ok := s.db.at(h)
+		if !ok {
+			return newErrorResponse(r.AttributeOpcode(), h, ble.ErrInvalidHandle)
+		}
+		if e := s.checkSecurity(a, false); e != ble.ErrSuccess {
+			return newErrorResponse(r.AttributeOpcode(), h, e)
+		}
+
+		v := bytes.NewBuffer(make([]byte, 0, ble.MaxMTU))
+		if a.v != nil {
+			v.Write(a.v)
+		} else if e := handleATT(a, s, r, ble.NewResponseWriter(v)); e != ble.ErrSuccess {
+			return newErrorResponse(r.AttributeOpcode(), h, e)
+		}
+
+		// The set of values is truncated to fit in the ATT_MTU.
+		n := buf.Cap() - buf.Len()
+		if v.Len() < n {
+			n = v.Len()
+		}
+		buf.Write(v.Bytes()[:n])
+	}
+	return rsp[:1+buf.Len()]
+}
+
 // handle Read Blob request. [Vol 3, Part F, 3.4.4.9 & 3.4.4.10]
 func (s *Server) handleReadByGroupRequest(r ReadByGroupTypeRequest) []byte {
 	// Validate the request.
@@ -526,18 +850,27 @@ func (s *Server) handleWriteRequest(r WriteRequest) []byte {
 	if a == nil {
 		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), ble.ErrWriteNotPerm)
 	}
+	if e := s.checkSecurity(a, true); e != ble.ErrSuccess {
+		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), e)
+	}
 	if e := handleATT(a, s, r, ble.NewResponseWriter(nil)); e != ble.ErrSuccess {
 		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), e)
 	}
 	return []byte{WriteResponseCode}
 }
 
+// handle Prepare Write request. [Vol 3, Part F, 3.4.6.1 & 3.4.6.2]
+// The part of the value is only queued; the offset, and the length of the
+// value are validated once the queue is executed.
 func (s *Server) handlePrepareWriteRequest(r PrepareWriteRequest) []byte {
-	logger.Debug("handlePrepareWriteRequest ->", "r.AttributeHandle", r.AttributeHandle())
 	// Validate the request.
+	// The response echoes the request, so it must fit in the ATT_MTU of the
+	// client, which might be smaller than the one of the server.
 	switch {
-	case len(r) < 3:
+	case len(r) < 5:
 		return newErrorResponse(r.AttributeOpcode(), 0x0000, ble.ErrInvalidPDU)
+	case len(r) > len(s.txBuf):
+		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), ble.ErrInvalidPDU)
 	}
 
 	a, ok := s.db.at(r.AttributeHandle())
@@ -546,42 +879,131 @@ func (s *Server) handlePrepareWriteRequest(r PrepareWriteRequest) []byte {
 	}
 
 	// We don't support write to static value. Pass the request to upper layer.
-	if a == nil {
+	if a == nil || a.wh == nil {
 		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), ble.ErrWriteNotPerm)
 	}
-
-	if e := handleATT(a, s, r, ble.NewResponseWriter(nil)); e != ble.ErrSuccess {
+	if e := s.checkSecurity(a, true); e != ble.ErrSuccess {
 		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), e)
 	}
 
-	// Convert and validate the response.
-	rsp := PrepareWriteResponse(r)
+	s.conn.qmu.Lock()
+	defer s.conn.qmu.Unlock()
+	if len(s.conn.queue) >= maxPreparedWrites {
+		return newErrorResponse(r.AttributeOpcode(), r.AttributeHandle(), ble.ErrPrepQueueFull)
+	}
+	s.conn.queue = append(s.conn.queue, preparedWrite{
+		a:      a,
+		offset: int(r.ValueOffset()),
+		value:  append([]byte(nil), r.PartAttributeValue()...),
+	})
+
+	rsp := PrepareWriteResponse(s.txBuf[:len(r)])
+	copy(rsp, r)
 	rsp.SetAttributeOpcode()
 	return rsp
 }
 
+// handle Execute Write request. [Vol 3, Part F, 3.4.6.3 & 3.4.6.4]
+// The queue is cleared, whether it's executed or canceled. The offsets, the
+// lengths, and the values of handlers, which are ble.WriteValidators, are
+// validated before any value is written, so an invalid one leaves all the
+// attributes unchanged. The writes are not atomic beyond that: the values are
+// written in turn, and a handler, which fails, leaves the attributes written
+// before it changed, since they can't be rolled back; the Error Response
+// tells the handle of the failing one.
 func (s *Server) handleExecuteWriteRequest(r ExecuteWriteRequest) []byte {
 	// Validate the request.
 	switch {
-	case len(r) < 2:
+	case len(r) != 2:
+		return newErrorResponse(r.AttributeOpcode(), 0x0000, ble.ErrInvalidPDU)
+	case r.Flags() > 0x01:
 		return newErrorResponse(r.AttributeOpcode(), 0x0000, ble.ErrInvalidPDU)
 	}
 
-	switch r.Flags() {
-	case 0:
-		// 0x00 – Cancel all prepared writes
-		s.prepareWriteRequestAttr = nil
-	case 1:
-		// 0x01 – Immediately write all pending prepared values
-		a := s.prepareWriteRequestAttr
-		if e := handleATT(a, s, r, ble.NewResponseWriter(nil)); e != ble.ErrSuccess {
-			return newErrorResponse(r.AttributeOpcode(), 0, e)
-		}
+	s.conn.qmu.Lock()
+	defer s.conn.qmu.Unlock()
+	queue := s.conn.queue
+	s.conn.queue = nil
+	if r.Flags() == 0x00 {
+		// Cancel all prepared writes.
+		return []byte{ExecuteWriteResponseCode}
 	}
 
+	ws, h, e := mergePreparedWrites(queue)
+	if e != ble.ErrSuccess {
+		return newErrorResponse(r.AttributeOpcode(), h, e)
+	}
+	for _, w := range ws {
+		// The security of the link may have changed since the parts were queued.
+		if e := s.checkSecurity(w.a, true); e != ble.ErrSuccess {
+			return newErrorResponse(r.AttributeOpcode(), w.a.h, e)
+		}
+		if v, ok := w.a.wh.(ble.WriteValidator); ok {
+			if e := v.ValidateWrite(ble.NewRequest(s.conn, w.value, w.offset)); e != ble.ErrSuccess {
+				return newErrorResponse(r.AttributeOpcode(), w.a.h, e)
+			}
+		}
+	}
+	for _, w := range ws {
+		rsp := ble.NewResponseWriter(nil)
+		w.a.wh.ServeWrite(ble.NewRequest(s.conn, w.value, w.offset), rsp)
+		if e := rsp.Status(); e != ble.ErrSuccess {
+			return newErrorResponse(r.AttributeOpcode(), w.a.h, e)
+		}
+	}
 	return []byte{ExecuteWriteResponseCode}
 }
 
+// mergePreparedWrites merges the queued parts into one value per attribute,
+// in the order the attributes were first queued. The first part of an
+// attribute shall start within, or right after its current value, as far as
+// valueLen knows it, and each following part within, or right after the parts
+// queued before it. Otherwise, the handle of the attribute is returned with
+// the error.
+func mergePreparedWrites(queue []preparedWrite) ([]preparedWrite, uint16, ble.ATTError) {
+	var ws []preparedWrite
+	idx := make(map[*attr]int)
+	for _, p := range queue {
+		if p.offset > maxAttrValueLen {
+			return nil, p.a.h, ble.ErrInvalidOffset
+		}
+		if p.offset+len(p.value) > maxAttrValueLen {
+			return nil, p.a.h, ble.ErrInvalAttrValueLen
+		}
+		i, ok := idx[p.a]
+		if !ok {
+			if p.offset > 0 && p.offset > valueLen(p.a) {
+				return nil, p.a.h, ble.ErrInvalidOffset
+			}
+			idx[p.a] = len(ws)
+			ws = append(ws, p)
+			continue
+		}
+		w := &ws[i]
+		off := p.offset - w.offset
+		if off < 0 || off > len(w.value) {
+			return nil, p.a.h, ble.ErrInvalidOffset
+		}
+		if end := off + len(p.value); end > len(w.value) {
+			w.value = append(w.value, make([]byte, end-len(w.value))...)
+		}
+		copy(w.value[off:], p.value)
+	}
+	return ws, 0, ble.ErrSuccess
+}
+
+// valueLen returns the length of the static value of a. The value of a read
+// handler isn't read just to know its length, since reads may have side
+// effects; any offset within the maximum length of a value is valid then, and
+// the write handler checks it, or its ble.WriteValidator before any value is
+// written.
+func valueLen(a *attr) int {
+	if a.v != nil {
+		return len(a.v)
+	}
+	return maxAttrValueLen
+}
+
 // handle Write command. [Vol 3, Part F, 3.4.5.3]
 func (s *Server) handleWriteCommand(r WriteCommand) []byte {
 	// Validate the request.
@@ -596,7 +1018,7 @@ func (s *Server) handleWriteCommand(r WriteCommand) []byte {
 	}
 
 	// We don't support write to static value. Pass the request to upper layer.
-	if a == nil {
+	if a == nil || s.checkSecurity(a, true) != ble.ErrSuccess {
 		return nil
 	}
 	if e := handleATT(a, s, r, s.dummyRspWriter); e != ble.ErrSuccess {
@@ -605,6 +1027,45 @@ func (s *Server) handleWriteCommand(r WriteCommand) []byte {
 	return nil
 }
 
+// handle Signed Write command. [Vol 3, Part F, 3.4.5.4]
+// Commands with an invalid or replayed signature are ignored.
+func (s *Server) handleSignedWriteCommand(r SignedWriteCommand) []byte {
+	// Validate the request.
+	switch {
+	case len(r) <= 15:
+		return nil
+	}
+
+	a, ok := s.db.at(r.AttributeHandle())
+	if !ok || a == nil || !a.signed {
+		return nil
+	}
+	sc, ok := s.conn.Conn.(ble.SecureConn)
+	if !ok {
+		return nil
+	}
+	authenticated, err := sc.Verify(r[:len(r)-12], r.AuthenticationSignature())
+	if err != nil {
+		logger.Warn("server", "signed write", err)
+		return nil
+	}
+
+	// The signature satisfies the security requirements of an encrypted, or
+	// authenticated link, as the CSRK is [Vol 3, Part C, 10.4].
+	level, keySize := securityEncrypted, 16
+	if authenticated {
+		level = securityAuthenticated
+	}
+	if l := sc.SecurityLevel(); l > level {
+		level = l
+	}
+	if s.checkPermission(a, true, level, keySize) != ble.ErrSuccess {
+		return nil
+	}
+	handleATT(a, s, r, s.dummyRspWriter)
+	return nil
+}
+
 func newErrorResponse(op byte, h uint16, s ble.ATTError) []byte {
 	r := ErrorResponse(make([]byte, 5))
 	r.SetAttributeOpcode()
@@ -620,7 +1081,7 @@ func handleATT(a *attr, s *Server, req []byte, rsp ble.ResponseWriter) ble.ATTEr
 	var data []byte
 	conn := s.conn
 	switch req[0] {
-	case ReadByTypeRequestCode:
+	case ReadByTypeRequestCode, ReadMultipleRequestCode, ReadMultipleVariableRequestCode:
 		fallthrough
 	case ReadRequestCode:
 		if a.rh == nil {
@@ -633,27 +1094,6 @@ func handleATT(a *attr, s *Server, req []byte, rsp ble.ResponseWriter) ble.ATTEr
 		}
 		offset = int(ReadBlobRequest(req).ValueOffset())
 		a.rh.ServeRead(ble.NewRequest(conn, data, offset), rsp)
-	case PrepareWriteRequestCode:
-		if a.wh == nil {
-			return ble.ErrWriteNotPerm
-		}
-		data = PrepareWriteRequest(req).PartAttributeValue()
-		logger.Debug("handleATT", "PartAttributeValue",
-			fmt.Sprintf("data: %x, offset: %d, %p\n", data, int(PrepareWriteRequest(req).ValueOffset()), s.prepareWriteRequestAttr))
-
-		if s.prepareWriteRequestAttr == nil {
-			s.prepareWriteRequestAttr = a
-			s.prepareWriteRequestData.Reset()
-		}
-		s.prepareWriteRequestData.Write(data)
-
-	case ExecuteWriteRequestCode:
-		if a.wh == nil {
-			return ble.ErrWriteNotPerm
-		}
-		data = s.prepareWriteRequestData.Bytes()
-		a.wh.ServeWrite(ble.NewRequest(conn, data, offset), rsp)
-		s.prepareWriteRequestAttr = nil
 	case WriteRequestCode:
 		fallthrough
 	case WriteCommandCode:
@@ -662,9 +1102,13 @@ func handleATT(a *attr, s *Server, req []byte, rsp ble.ResponseWriter) ble.ATTEr
 		}
 		data = WriteRequest(req).AttributeValue()
 		a.wh.ServeWrite(ble.NewRequest(conn, data, offset), rsp)
-	// case SignedWriteCommandCode:
+	case SignedWriteCommandCode:
+		if a.wh == nil {
+			return ble.ErrWriteNotPerm
+		}
+		data = SignedWriteCommand(req).AttributeValue()
+		a.wh.ServeWrite(ble.NewRequest(conn, data, offset), rsp)
 	// case ReadByGroupTypeRequestCode:
-	// case ReadMultipleRequestCode:
 	default:
 		return ble.ErrReqNotSupp
 	}
@@ -0,0 +1,720 @@
+package att
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	ble "traulfs/Bline/ble"
+)
+
+// fakeConn is the connection of a client to a server under test. The PDUs
+// sent by the client are delivered on rx, and those sent by the server on tx.
+type fakeConn struct {
+	ctx    context.Context
+	rx     chan []byte
+	tx     chan []byte
+	closed chan struct{}
+	once   sync.Once
+	mtu    int
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		ctx:    context.Background(),
+		rx:     make(chan []byte, 16),
+		tx:     make(chan []byte, 64),
+		closed: make(chan struct{}),
+		mtu:    ble.DefaultMTU,
+	}
+}
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	select {
+	case p := <-c.rx:
+		return copy(b, p), nil
+	case <-c.closed:
+		return 0, io.EOF
+	}
+}
+
+func (c *fakeConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	case c.tx <- append([]byte(nil), b...):
+		return len(b), nil
+	}
+}
+
+func (c *fakeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeConn) Context() context.Context       { return c.ctx }
+func (c *fakeConn) SetContext(ctx context.Context) { c.ctx = ctx }
+func (c *fakeConn) LocalAddr() ble.Addr            { return ble.NewAddr("00:00:00:00:00:01") }
+func (c *fakeConn) RemoteAddr() ble.Addr           { return ble.NewAddr("00:00:00:00:00:02") }
+func (c *fakeConn) RxMTU() int                     { return c.mtu }
+func (c *fakeConn) SetRxMTU(mtu int)               { c.mtu = mtu }
+func (c *fakeConn) TxMTU() int                     { return c.mtu }
+func (c *fakeConn) SetTxMTU(mtu int)               {}
+func (c *fakeConn) ReadRSSI() int                  { return 0 }
+func (c *fakeConn) Disconnected() <-chan struct{}  { return c.closed }
+
+// newTestServer returns a running server of the services ss, and the
+// connection of its client.
+func newTestServer(t *testing.T, ss ...*ble.Service) (*Server, *fakeConn) {
+	t.Helper()
+	c := newFakeConn()
+	s, err := NewServer(NewDB(ss, 1), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Loop()
+	t.Cleanup(func() { c.Close() })
+	return s, c
+}
+
+// request sends a request, and returns the response of the server.
+func (c *fakeConn) request(t *testing.T, req ...byte) []byte {
+	t.Helper()
+	c.rx <- req
+	return c.recv(t)
+}
+
+// recv returns the next PDU sent by the server.
+func (c *fakeConn) recv(t *testing.T) []byte {
+	t.Helper()
+	select {
+	case b := <-c.tx:
+		return b
+	case <-time.After(2 * time.Second):
+		t.Fatal("no PDU from the server")
+		return nil
+	}
+}
+
+// updateService returns a service with a characteristic, which supports
+// notifications and indications.
+func updateService() (*ble.Service, *ble.Characteristic) {
+	s := ble.NewService(ble.UUID16(0x180D))
+	c := s.NewCharacteristic(ble.UUID16(0x2A37))
+	c.HandleNotify(ble.NotifyHandlerFunc(func(req ble.Request, n ble.Notifier) {}))
+	c.HandleIndicate(ble.NotifyHandlerFunc(func(req ble.Request, n ble.Notifier) {}))
+	return s, c
+}
+
+func TestUpdate(t *testing.T) {
+	svc, c := updateService()
+	s, cn := newTestServer(t, svc)
+
+	if s.Update(c, []byte{0x01}, false, nil) {
+		t.Fatal("Update: sent to a client, which didn't subscribe")
+	}
+	if err := s.RestoreCCC(c, cccNotify|cccIndicate); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	if !s.Update(c, []byte{0x01, 0x02}, false, func(err error) { done <- err }) {
+		t.Fatal("Update: not sent to a subscribed client")
+	}
+	if b := cn.recv(t); b[0] != HandleValueNotificationCode || len(b) != 5 || b[3] != 0x01 || b[4] != 0x02 {
+		t.Errorf("got % X, want a notification of 01 02", b)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("notification: %v", err)
+	}
+
+	s.Update(c, []byte{0x03}, true, func(err error) { done <- err })
+	if b := cn.recv(t); b[0] != HandleValueIndicationCode {
+		t.Fatalf("got % X, want an indication", b)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("indication done before its confirmation: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	cn.rx <- []byte{HandleValueConfirmationCode}
+	if err := <-done; err != nil {
+		t.Errorf("indication: %v", err)
+	}
+}
+
+// TestUpdateClosed checks that each update is done, when the connection closes
+// while it's queued.
+func TestUpdateClosed(t *testing.T) {
+	svc, c := updateService()
+	s, cn := newTestServer(t, svc)
+	if err := s.RestoreCCC(c, cccIndicate); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 100
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			s.Update(c, []byte{0x01}, true, func(error) { wg.Done() })
+		}()
+		if i == n/2 {
+			cn.Close()
+		}
+	}
+	ch := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("some updates were never done")
+	}
+}
+
+// value is the value of an attribute, which its handlers read and write.
+type value struct {
+	mu sync.Mutex
+	b  []byte
+}
+
+func (v *value) ServeRead(req ble.Request, rsp ble.ResponseWriter) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	ble.WriteValue(req, rsp, v.b)
+}
+
+func (v *value) ServeWrite(req ble.Request, rsp ble.ResponseWriter) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	off := req.Offset()
+	if off > len(v.b) {
+		rsp.SetStatus(ble.ErrInvalidOffset)
+		return
+	}
+	v.b = append(v.b[:off:off], req.Data()...)
+}
+
+func (v *value) String() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return string(v.b)
+}
+
+// validatedValue is a value, which refuses the offsets past its value, and the
+// values starting with '!'.
+type validatedValue struct{ *value }
+
+func (v validatedValue) ValidateWrite(req ble.Request) ble.ATTError {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	switch {
+	case req.Offset() > len(v.b):
+		return ble.ErrInvalidOffset
+	case bytes.HasPrefix(req.Data(), []byte("!")):
+		return ble.ErrUnlikely
+	}
+	return ble.ErrSuccess
+}
+
+// writeService returns a service with a readable characteristic, and a
+// write-only one, which both validate the writes.
+func writeService() (svc *ble.Service, a, b *ble.Characteristic, av, bv *value) {
+	svc = ble.NewService(ble.UUID16(0x180A))
+	av, bv = &value{b: []byte("abcd")}, &value{}
+	a = svc.NewCharacteristic(ble.UUID16(0x2A24))
+	a.HandleRead(av)
+	a.HandleWrite(validatedValue{av})
+	b = svc.NewCharacteristic(ble.UUID16(0x2A25))
+	b.HandleWrite(validatedValue{bv})
+	return svc, a, b, av, bv
+}
+
+// countedValue is a value, which counts its reads.
+type countedValue struct {
+	*value
+	reads int
+}
+
+func (v *countedValue) ServeRead(req ble.Request, rsp ble.ResponseWriter) {
+	v.reads++
+	v.value.ServeRead(req, rsp)
+}
+
+func prepareWrite(h uint16, offset int, v string) []byte {
+	return append([]byte{PrepareWriteRequestCode, byte(h), byte(h >> 8), byte(offset), byte(offset >> 8)}, v...)
+}
+
+func TestExecuteWrite(t *testing.T) {
+	type part struct {
+		b      bool // The part is for the write-only characteristic.
+		offset int
+		v      string
+	}
+	for _, tc := range []struct {
+		name  string
+		parts []part
+		flags byte
+		err   ble.ATTError
+		errB  bool // The error is for the write-only characteristic.
+		wantA string
+		wantB string
+	}{
+		{name: "long write", parts: []part{{false, 0, "12"}, {false, 2, "34"}, {false, 4, "5"}}, flags: 1, wantA: "12345"},
+		{name: "within the value", parts: []part{{false, 2, "zz"}}, flags: 1, wantA: "abzz"},
+		{name: "after the value", parts: []part{{false, 4, "e"}}, flags: 1, wantA: "abcde"},
+		{name: "past the value", parts: []part{{true, 0, "34"}, {false, 5, "e"}}, flags: 1, err: ble.ErrInvalidOffset, wantA: "abcd"},
+		{name: "gap between parts", parts: []part{{false, 0, "12"}, {false, 3, "4"}}, flags: 1, err: ble.ErrInvalidOffset, wantA: "abcd"},
+		{name: "value too long", parts: []part{{true, 511, "xy"}}, flags: 1, err: ble.ErrInvalAttrValueLen, errB: true, wantA: "abcd"},
+		{name: "offset too large", parts: []part{{true, 513, "x"}}, flags: 1, err: ble.ErrInvalidOffset, errB: true, wantA: "abcd"},
+		{name: "canceled", parts: []part{{false, 0, "12"}, {true, 0, "34"}}, flags: 0, wantA: "abcd"},
+		{name: "multiple attributes", parts: []part{{false, 0, "12"}, {true, 0, "34"}, {false, 2, "56"}}, flags: 1, wantA: "1256", wantB: "34"},
+		{name: "invalid value", parts: []part{{false, 0, "12"}, {true, 0, "!"}}, flags: 1, err: ble.ErrUnlikely, errB: true, wantA: "abcd"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, a, b, av, bv := writeService()
+			_, cn := newTestServer(t, svc)
+			for _, p := range tc.parts {
+				h := a.ValueHandle
+				if p.b {
+					h = b.ValueHandle
+				}
+				req := prepareWrite(h, p.offset, p.v)
+				rsp := cn.request(t, req...)
+				if rsp[0] != PrepareWriteResponseCode || !bytes.Equal(rsp[1:], req[1:]) {
+					t.Fatalf("Prepare Write: got % X, want an echo of % X", rsp, req)
+				}
+			}
+
+			rsp := cn.request(t, ExecuteWriteRequestCode, tc.flags)
+			want := []byte{ExecuteWriteResponseCode}
+			if tc.err != ble.ErrSuccess {
+				h := a.ValueHandle
+				if tc.errB {
+					h = b.ValueHandle
+				}
+				want = newErrorResponse(ExecuteWriteRequestCode, h, tc.err)
+			}
+			if !bytes.Equal(rsp, want) {
+				t.Errorf("Execute Write: got % X, want % X", rsp, want)
+			}
+			if av.String() != tc.wantA || bv.String() != tc.wantB {
+				t.Errorf("got values %q %q, want %q %q", av, bv, tc.wantA, tc.wantB)
+			}
+
+			// The queue is empty afterwards.
+			if rsp := cn.request(t, ExecuteWriteRequestCode, 0x01); rsp[0] != ExecuteWriteResponseCode {
+				t.Errorf("Execute Write of an empty queue: got % X", rsp)
+			}
+		})
+	}
+}
+
+// TestExecuteWriteNoReads checks that the read handler of an attribute isn't
+// served to check the offsets of a long write.
+func TestExecuteWriteNoReads(t *testing.T) {
+	svc := ble.NewService(ble.UUID16(0x180A))
+	v := &countedValue{value: &value{b: []byte("abcd")}}
+	c := svc.NewCharacteristic(ble.UUID16(0x2A24))
+	c.HandleRead(v)
+	c.HandleWrite(v)
+	_, cn := newTestServer(t, svc)
+	for _, req := range [][]byte{prepareWrite(c.ValueHandle, 2, "zz"), {ExecuteWriteRequestCode, 0x01}} {
+		if rsp := cn.request(t, req...); rsp[0] == ErrorResponseCode {
+			t.Fatalf("got % X", rsp)
+		}
+	}
+	if v.reads != 0 || v.String() != "abzz" {
+		t.Errorf("got %d reads, value %q, want 0 reads, abzz", v.reads, v)
+	}
+}
+
+func TestPrepareQueueFull(t *testing.T) {
+	svc, a, _, av, _ := writeService()
+	_, cn := newTestServer(t, svc)
+	for i := 0; i < maxPreparedWrites; i++ {
+		if rsp := cn.request(t, prepareWrite(a.ValueHandle, i, "x")...); rsp[0] != PrepareWriteResponseCode {
+			t.Fatalf("Prepare Write %d: got % X", i, rsp)
+		}
+	}
+	rsp := cn.request(t, prepareWrite(a.ValueHandle, maxPreparedWrites, "x")...)
+	if want := newErrorResponse(PrepareWriteRequestCode, a.ValueHandle, ble.ErrPrepQueueFull); !bytes.Equal(rsp, want) {
+		t.Fatalf("Prepare Write: got % X, want % X", rsp, want)
+	}
+
+	// Canceling the queue makes room again.
+	if rsp := cn.request(t, ExecuteWriteRequestCode, 0x00); rsp[0] != ExecuteWriteResponseCode {
+		t.Fatalf("Execute Write: got % X", rsp)
+	}
+	if rsp := cn.request(t, prepareWrite(a.ValueHandle, 0, "x")...); rsp[0] != PrepareWriteResponseCode {
+		t.Errorf("Prepare Write after cancel: got % X", rsp)
+	}
+	if av.String() != "abcd" {
+		t.Errorf("got value %q, want abcd", av)
+	}
+}
+
+// TestPrepareWriteTooLong checks that a Prepare Write Request, which doesn't
+// fit in the ATT_MTU of the client, is refused instead of echoed.
+func TestPrepareWriteTooLong(t *testing.T) {
+	svc, a, _, av, _ := writeService()
+	cn := newFakeConn()
+	cn.mtu = 512
+	s, err := NewServer(NewDB([]*ble.Service{svc}, 1), cn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Loop()
+	defer cn.Close()
+	req := prepareWrite(a.ValueHandle, 0, string(bytes.Repeat([]byte("x"), 95)))
+	rsp := cn.request(t, req...)
+	if want := newErrorResponse(PrepareWriteRequestCode, a.ValueHandle, ble.ErrInvalidPDU); !bytes.Equal(rsp, want) {
+		t.Fatalf("Prepare Write: got % X, want % X", rsp, want)
+	}
+	if rsp := cn.request(t, ExecuteWriteRequestCode, 0x01); rsp[0] != ExecuteWriteResponseCode {
+		t.Errorf("Execute Write: got % X", rsp)
+	}
+	if av.String() != "abcd" {
+		t.Errorf("got value %q, want abcd", av)
+	}
+}
+
+// readService returns a service with a characteristic of a static value, one,
+// which returns a new value on each read with ble.WriteValue, and one, which
+// slices its value itself.
+func readService(static []byte) (svc *ble.Service, st, whole, part *ble.Characteristic, reads *int) {
+	svc = ble.NewService(ble.UUID16(0x180A))
+	st = svc.NewCharacteristic(ble.UUID16(0x2A24))
+	st.SetValue(static)
+	reads = new(int)
+	whole = svc.NewCharacteristic(ble.UUID16(0x2A25))
+	whole.HandleRead(ble.ReadHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
+		*reads++
+		ble.WriteValue(req, rsp, bytes.Repeat([]byte{byte(*reads)}, 30))
+	}))
+	part = svc.NewCharacteristic(ble.UUID16(0x2A26))
+	part.HandleRead(ble.ReadHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
+		rsp.Write([]byte{byte(req.Offset())})
+	}))
+	return svc, st, whole, part, reads
+}
+
+func readRequest(h uint16) []byte {
+	return []byte{ReadRequestCode, byte(h), byte(h >> 8)}
+}
+
+func readBlobRequest(h uint16, offset int) []byte {
+	return []byte{ReadBlobRequestCode, byte(h), byte(h >> 8), byte(offset), byte(offset >> 8)}
+}
+
+func TestReadBlob(t *testing.T) {
+	static := make([]byte, 40)
+	for i := range static {
+		static[i] = byte(i)
+	}
+	svc, st, whole, part, reads := readService(static)
+	_, cn := newTestServer(t, svc)
+	mtu := ble.DefaultMTU
+
+	for _, tc := range []struct {
+		name string
+		req  []byte
+		want []byte
+	}{
+		{"static read", readRequest(st.ValueHandle), append([]byte{ReadResponseCode}, static[:mtu-1]...)},
+		{"static blob", readBlobRequest(st.ValueHandle, mtu-1), append([]byte{ReadBlobResponseCode}, static[mtu-1:]...)},
+		{"static blob at the end", readBlobRequest(st.ValueHandle, len(static)), []byte{ReadBlobResponseCode}},
+		{"static blob past the end", readBlobRequest(st.ValueHandle, len(static)+1), newErrorResponse(ReadBlobRequestCode, st.ValueHandle, ble.ErrInvalidOffset)},
+
+		// The parts of a long read are of the same value.
+		{"whole read", readRequest(whole.ValueHandle), append([]byte{ReadResponseCode}, bytes.Repeat([]byte{1}, mtu-1)...)},
+		{"whole blob", readBlobRequest(whole.ValueHandle, mtu-1), append([]byte{ReadBlobResponseCode}, bytes.Repeat([]byte{1}, 30-mtu+1)...)},
+		{"whole read again", readRequest(whole.ValueHandle), append([]byte{ReadResponseCode}, bytes.Repeat([]byte{2}, mtu-1)...)},
+
+		// Handlers, which don't use ble.WriteValue, get the offset.
+		{"part blob", readBlobRequest(part.ValueHandle, 7), []byte{ReadBlobResponseCode, 7}},
+	} {
+		if got := cn.request(t, tc.req...); !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: got % X, want % X", tc.name, got, tc.want)
+		}
+	}
+	if *reads != 2 {
+		t.Errorf("the handler was called %d times, want 2", *reads)
+	}
+}
+
+// multipleService returns a service with characteristics of static values "ab",
+// "cde" and a long one, and a write-only characteristic.
+func multipleService(long []byte) (*ble.Service, []*ble.Characteristic) {
+	svc := ble.NewService(ble.UUID16(0x180A))
+	var cs []*ble.Characteristic
+	for i, v := range [][]byte{[]byte("ab"), []byte("cde"), long} {
+		c := svc.NewCharacteristic(ble.UUID16(0x2A24 + uint16(i)))
+		c.SetValue(v)
+		cs = append(cs, c)
+	}
+	c := svc.NewCharacteristic(ble.UUID16(0x2A27))
+	c.HandleWrite(ble.WriteHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {}))
+	return svc, append(cs, c)
+}
+
+func handles(op byte, hs ...uint16) []byte {
+	b := []byte{op}
+	for _, h := range hs {
+		b = append(b, byte(h), byte(h>>8))
+	}
+	return b
+}
+
+func TestReadMultiple(t *testing.T) {
+	long := bytes.Repeat([]byte{0x55}, 30)
+	svc, cs := multipleService(long)
+	_, cn := newTestServer(t, svc)
+	ab, cde, lv, wo := cs[0].ValueHandle, cs[1].ValueHandle, cs[2].ValueHandle, cs[3].ValueHandle
+	mtu := ble.DefaultMTU
+
+	for _, tc := range []struct {
+		name string
+		req  []byte
+		want []byte
+	}{
+		{"values", handles(ReadMultipleRequestCode, ab, cde), []byte{ReadMultipleResponseCode, 'a', 'b', 'c', 'd', 'e'}},
+		{"truncated", handles(ReadMultipleRequestCode, ab, lv), append([]byte{ReadMultipleResponseCode, 'a', 'b'}, long[:mtu-3]...)},
+		{"invalid handle", handles(ReadMultipleRequestCode, ab, 0x0100), newErrorResponse(ReadMultipleRequestCode, 0x0100, ble.ErrInvalidHandle)},
+		{"not readable", handles(ReadMultipleRequestCode, ab, wo), newErrorResponse(ReadMultipleRequestCode, wo, ble.ErrReadNotPerm)},
+		{"single handle", handles(ReadMultipleRequestCode, ab), newErrorResponse(ReadMultipleRequestCode, 0x0000, ble.ErrInvalidPDU)},
+
+		// The lengths are the ones of the whole values.
+		{"variable", handles(ReadMultipleVariableRequestCode, ab, cde),
+			[]byte{ReadMultipleVariableResponseCode, 2, 0, 'a', 'b', 3, 0, 'c', 'd', 'e'}},
+		{"variable truncated", handles(ReadMultipleVariableRequestCode, ab, lv, cde),
+			append([]byte{ReadMultipleVariableResponseCode, 2, 0, 'a', 'b', 30, 0}, long[:mtu-7]...)},
+		{"variable not readable", handles(ReadMultipleVariableRequestCode, wo, ab), newErrorResponse(ReadMultipleVariableRequestCode, wo, ble.ErrReadNotPerm)},
+	} {
+		if got := cn.request(t, tc.req...); !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: got % X, want % X", tc.name, got, tc.want)
+		}
+	}
+}
+
+// secureConn is a fakeConn, which reports a security state, and the Security
+// Requests sent on it.
+type secureConn struct {
+	*fakeConn
+	level, keySize int
+	requests       chan struct{}
+	verify         func(m []byte, sig [12]byte) (bool, error)
+}
+
+func (c *secureConn) SecurityLevel() int              { return c.level }
+func (c *secureConn) EncryptionKeySize() int          { return c.keySize }
+func (c *secureConn) Sign(m []byte) ([12]byte, error) { return [12]byte{}, nil }
+
+func (c *secureConn) Verify(m []byte, sig [12]byte) (bool, error) {
+	if c.verify == nil {
+		return false, errors.New("no remote CSRK")
+	}
+	return c.verify(m, sig)
+}
+
+func (c *secureConn) RequestSecurity() error {
+	c.requests <- struct{}{}
+	return nil
+}
+
+func TestPermission(t *testing.T) {
+	const (
+		plain         = 0 // The connection doesn't report its security state.
+		unencrypted   = 1
+		encrypted     = 2
+		authenticated = 3
+	)
+	for _, tc := range []struct {
+		name       string
+		perm       ble.Permission
+		secure     ble.Property // Deprecated Secure of the characteristic.
+		minKeySize int
+		authorize  *bool
+		level      int
+		keySize    int
+		write      bool
+		secReq     bool // The server sends Security Requests.
+		want       ble.ATTError
+		request    bool // A Security Request is sent.
+	}{
+		{name: "open", level: plain, want: ble.ErrSuccess},
+		{name: "read encrypt", perm: ble.PermReadEncrypt, level: encrypted, keySize: 16, want: ble.ErrSuccess},
+		{name: "read encrypt unencrypted", perm: ble.PermReadEncrypt, level: unencrypted, want: ble.ErrInsuffEnc},
+		{name: "read encrypt plain", perm: ble.PermReadEncrypt, level: plain, secReq: true, want: ble.ErrInsuffEnc},
+		{name: "write encrypt on read", perm: ble.PermWriteEncrypt, level: unencrypted, want: ble.ErrSuccess},
+		{name: "write encrypt", perm: ble.PermWriteEncrypt, level: unencrypted, write: true, want: ble.ErrInsuffEnc},
+		{name: "read authen encrypted", perm: ble.PermReadAuthen, level: encrypted, keySize: 16, want: ble.ErrAuthentication},
+		{name: "read authen", perm: ble.PermReadAuthen, level: authenticated, keySize: 16, want: ble.ErrSuccess},
+		{name: "write authen unencrypted", perm: ble.PermWriteAuthen, level: unencrypted, write: true, want: ble.ErrAuthentication},
+		{name: "key size", perm: ble.PermReadEncrypt, minKeySize: 16, level: encrypted, keySize: 7, want: ble.ErrInsuffEncrKeySize},
+		{name: "key size met", perm: ble.PermReadEncrypt, minKeySize: 16, level: encrypted, keySize: 16, want: ble.ErrSuccess},
+		{name: "key size unencrypted", perm: ble.PermWriteEncrypt, minKeySize: 16, level: unencrypted, write: true, want: ble.ErrInsuffEnc},
+		{name: "author no handler", perm: ble.PermReadAuthor, level: unencrypted, want: ble.ErrAuthorization},
+		{name: "author refused", perm: ble.PermWriteAuthor, authorize: new(bool), level: unencrypted, write: true, want: ble.ErrAuthorization},
+		{name: "author granted", perm: ble.PermWriteAuthor, authorize: func() *bool { b := true; return &b }(), level: unencrypted, write: true, want: ble.ErrSuccess},
+		{name: "author before authen", perm: ble.PermReadAuthen | ble.PermReadAuthor, level: encrypted, keySize: 16, want: ble.ErrAuthentication},
+		{name: "deprecated secure read", secure: ble.CharRead, level: unencrypted, want: ble.ErrInsuffEnc},
+		{name: "deprecated secure write", secure: ble.CharWrite, level: unencrypted, write: true, want: ble.ErrInsuffEnc},
+		{name: "security request encrypt", perm: ble.PermReadEncrypt, level: unencrypted, secReq: true, want: ble.ErrInsuffEnc, request: true},
+		{name: "security request authen", perm: ble.PermWriteAuthen, level: encrypted, keySize: 16, write: true, secReq: true, want: ble.ErrAuthentication, request: true},
+		{name: "security request key size", perm: ble.PermReadEncrypt, minKeySize: 16, level: encrypted, keySize: 7, secReq: true, want: ble.ErrInsuffEncrKeySize, request: true},
+		{name: "no security request for author", perm: ble.PermReadAuthor, level: unencrypted, secReq: true, want: ble.ErrAuthorization},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := ble.NewService(ble.UUID16(0x180A))
+			c := svc.NewCharacteristic(ble.UUID16(0x2A24))
+			v := &value{b: []byte("abcd")}
+			c.HandleRead(v)
+			c.HandleWrite(v)
+			c.Permission, c.Secure, c.MinKeySize = tc.perm, tc.secure, tc.minKeySize
+			if tc.authorize != nil {
+				c.AuthorizeHandler = ble.AuthorizeHandlerFunc(func(req ble.Request, write bool) bool {
+					if write != tc.write {
+						t.Errorf("Authorize: got write %v", write)
+					}
+					return *tc.authorize
+				})
+			}
+
+			fc := newFakeConn()
+			var conn ble.Conn = fc
+			sc := &secureConn{fakeConn: fc, level: tc.level, keySize: tc.keySize, requests: make(chan struct{}, 1)}
+			if tc.level != plain {
+				conn = sc
+			}
+			s, err := NewServer(NewDB([]*ble.Service{svc}, 1), conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.SetSecurityRequest(tc.secReq)
+			go s.Loop()
+			defer fc.Close()
+
+			req, op, ok := readRequest(c.ValueHandle), byte(ReadRequestCode), []byte{ReadResponseCode, 'a', 'b', 'c', 'd'}
+			if tc.write {
+				req = append([]byte{WriteRequestCode, byte(c.ValueHandle), byte(c.ValueHandle >> 8)}, "wxyz"...)
+				op, ok = WriteRequestCode, []byte{WriteResponseCode}
+			}
+			want := ok
+			if tc.want != ble.ErrSuccess {
+				want = newErrorResponse(op, c.ValueHandle, tc.want)
+			}
+			if rsp := fc.request(t, req...); !bytes.Equal(rsp, want) {
+				t.Errorf("got % X, want % X", rsp, want)
+			}
+			if wrote := v.String() == "wxyz"; wrote != (tc.write && tc.want == ble.ErrSuccess) {
+				t.Errorf("got value %q", v)
+			}
+
+			timeout := 50 * time.Millisecond
+			if tc.request {
+				timeout = 2 * time.Second
+			}
+			select {
+			case <-sc.requests:
+				if !tc.request {
+					t.Error("got Security Request")
+				}
+			case <-time.After(timeout):
+				if tc.request {
+					t.Error("no Security Request")
+				}
+			}
+		})
+	}
+}
+
+// TestSignedWrite checks that Signed Write Commands are written, once their
+// signature is verified, and ignored otherwise.
+func TestSignedWrite(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		property      ble.Property
+		perm          ble.Permission
+		plain         bool // The connection can't verify signatures.
+		authenticated bool // The CSRK of the peer is authenticated.
+		counters      []uint32
+		macs          []byte // The first byte of the MAC of each command, 0xAA is valid.
+		written       []string
+	}{
+		{"valid", ble.CharSignedWrite, 0, false, false, []uint32{0}, []byte{0xAA}, []string{"0"}},
+		{"replayed", ble.CharSignedWrite, 0, false, false, []uint32{0, 1, 1, 0}, []byte{0xAA, 0xAA, 0xAA, 0xAA}, []string{"0", "1"}},
+		{"bad MAC", ble.CharSignedWrite, 0, false, false, []uint32{0, 1}, []byte{0x55, 0xAA}, []string{"1"}},
+		{"not signed", ble.CharWrite, 0, false, false, []uint32{0}, []byte{0xAA}, nil},
+		{"plain connection", ble.CharSignedWrite, 0, true, false, []uint32{0}, []byte{0xAA}, nil},
+		{"encrypt", ble.CharSignedWrite, ble.PermWriteEncrypt, false, false, []uint32{0}, []byte{0xAA}, []string{"0"}},
+		{"authen unauthenticated", ble.CharSignedWrite, ble.PermWriteAuthen, false, false, []uint32{0}, []byte{0xAA}, nil},
+		{"authen", ble.CharSignedWrite, ble.PermWriteAuthen, false, true, []uint32{0}, []byte{0xAA}, []string{"0"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := ble.NewService(ble.UUID16(0x180A))
+			c := svc.NewCharacteristic(ble.UUID16(0x2A24))
+			var mu sync.Mutex
+			var written []string
+			c.HandleWrite(ble.WriteHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
+				mu.Lock()
+				defer mu.Unlock()
+				written = append(written, string(req.Data()))
+			}))
+			c.Property |= tc.property
+			c.Permission = tc.perm
+
+			fc := newFakeConn()
+			var conn ble.Conn = fc
+			if !tc.plain {
+				next := uint32(0)
+				conn = &secureConn{fakeConn: fc, level: 1, verify: func(m []byte, sig [12]byte) (bool, error) {
+					counter := binary.LittleEndian.Uint32(sig[:])
+					switch {
+					case m[0] != SignedWriteCommandCode || len(m) != 4:
+						t.Errorf("got signed data % X", m)
+					case counter < next:
+						return false, errors.New("sign counter replayed")
+					case sig[4] != 0xAA:
+						return false, errors.New("invalid signature")
+					}
+					next = counter + 1
+					return tc.authenticated, nil
+				}}
+			}
+			s, err := NewServer(NewDB([]*ble.Service{svc}, 1), conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go s.Loop()
+			defer fc.Close()
+
+			h := c.ValueHandle
+			for i, counter := range tc.counters {
+				cmd := []byte{SignedWriteCommandCode, byte(h), byte(h >> 8), byte('0' + counter), 0, 0, 0, 0, tc.macs[i]}
+				binary.LittleEndian.PutUint32(cmd[4:], counter)
+				fc.rx <- append(cmd, make([]byte, 7)...)
+			}
+			// The commands are handled in order, before the request.
+			fc.request(t, readRequest(h)...)
+			mu.Lock()
+			defer mu.Unlock()
+			if len(written) != len(tc.written) {
+				t.Fatalf("got writes %q, want %q", written, tc.written)
+			}
+			for i := range written {
+				if written[i] != tc.written[i] {
+					t.Errorf("got writes %q, want %q", written, tc.written)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package att
+
+import (
+	"encoding/binary"
+	"io"
+
+	ble "traulfs/Bline/ble"
+)
+
+// updateQueueLen is the number of updates, which are queued for a connection.
+const updateQueueLen = 16
+
+// update is a value, which is notified or indicated to the client.
+type update struct {
+	h        uint16
+	v        []byte
+	indicate bool
+	done     func(error)
+}
+
+// Subscribed reports whether the client subscribed to the notifications, or
+// the indications of characteristic c.
+func (s *Server) Subscribed(c *ble.Characteristic, indicate bool) bool {
+	flag := uint16(cccNotify)
+	if indicate {
+		flag = cccIndicate
+	}
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	return s.conn.cccs[c.Handle]&flag != 0
+}
+
+// RestoreCCC sets the client configuration of characteristic c, as if the
+// client wrote ccc to its CCCD. The configuration of a bonded client is kept
+// across connections, so it's restored on each of them [Vol 3, Part G, 3.3.3.3].
+func (s *Server) RestoreCCC(c *ble.Characteristic, ccc uint16) error {
+	if c.CCCD == nil {
+		return ErrInvalidArgument
+	}
+	v := make([]byte, 2)
+	binary.LittleEndian.PutUint16(v, ccc)
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	if e := s.conn.configure(ble.NewRequest(s.conn, v, 0), c, ccc); e != ble.ErrSuccess {
+		return e
+	}
+	return nil
+}
+
+// Update queues the value v of characteristic c, which is notified, or
+// indicated to the client if it subscribed to it. Updates are sent in turn,
+// without blocking the caller; if the queue of the connection is full, the
+// update is dropped with ErrQueueFull. Unless done is nil, it's called with
+// the result, once the notification is sent, or the indication confirmed.
+// Update reports whether the client subscribed to c.
+func (s *Server) Update(c *ble.Characteristic, v []byte, indicate bool, done func(error)) bool {
+	if !s.Subscribed(c, indicate) {
+		return false
+	}
+	if done == nil {
+		done = func(error) {}
+	}
+	u := update{h: c.ValueHandle, v: append([]byte(nil), v...), indicate: indicate, done: done}
+	// The queue is only fed under umu, so an update is never queued after
+	// sendUpdates drained the queue of a closed connection.
+	var err error
+	s.conn.umu.Lock()
+	select {
+	case <-s.conn.closed:
+		err = io.ErrClosedPipe
+	default:
+		select {
+		case s.conn.updates <- u:
+		default:
+			err = ErrQueueFull
+		}
+	}
+	s.conn.umu.Unlock()
+	if err != nil {
+		done(err)
+	}
+	return true
+}
+
+// sendUpdates sends the queued updates on the unenhanced bearer, until the
+// connection is closed. The updates left are dropped.
+func (cn *conn) sendUpdates() {
+	for {
+		select {
+		case u := <-cn.updates:
+			if u.indicate {
+				_, err := cn.svr.indicate(u.h, u.v)
+				u.done(err)
+			} else {
+				_, err := cn.svr.notify(u.h, u.v)
+				u.done(err)
+			}
+		case <-cn.closed:
+			var left []update
+			cn.umu.Lock()
+			for len(cn.updates) != 0 {
+				left = append(left, <-cn.updates)
+			}
+			cn.umu.Unlock()
+			for _, u := range left {
+				u.done(io.ErrClosedPipe)
+			}
+			return
+		}
+	}
+}
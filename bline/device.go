@@ -4,11 +4,13 @@ import (
 	"context"
 	"io"
 	"log"
+	"sync"
 
 	ble "traulfs/Bline/ble"
 	"traulfs/Bline/ble/bline/att"
 	"traulfs/Bline/ble/bline/gatt"
 	"traulfs/Bline/ble/bline/hci"
+	"traulfs/Bline/ble/bline/hci/socket"
 
 	"github.com/pkg/errors"
 )
@@ -46,12 +48,19 @@ func NewDeviceWithNameAndHandler(name string, handler ble.NotifyHandler, opts ..
 		return nil, errors.Wrapf(err, "maximum ATT_MTU is %d", ble.MaxMTU)
 	}
 
-	go loop(dev, srv, mtu)
+	l, err := dev.Listen(hci.PSMEATT)
+	if err != nil {
+		dev.Close()
+		return nil, errors.Wrap(err, "can't listen for EATT bearers")
+	}
+	servers := sharedServers(dev.BeaconLine())
+	go loop(dev, srv, mtu, servers)
+	go loopEATT(l, servers)
 
-	return &Device{HCI: dev, Server: srv}, nil
+	return &Device{HCI: dev, Server: srv, eatt: l, servers: servers}, nil
 }
 
-func loop(dev *hci.HCI, s *gatt.Server, mtu int) {
+func loop(dev *hci.HCI, s *gatt.Server, mtu int, servers *attServers) {
 	for {
 		l2c, err := dev.Accept()
 		if err != nil {
@@ -75,7 +84,117 @@ func loop(dev *hci.HCI, s *gatt.Server, mtu int) {
 			continue
 
 		}
+		as.SetSecurityRequest(dev.SecurityRequest())
+		servers.add(l2c, as, s)
 		go as.Loop()
+		s.Restore(l2c, as)
+	}
+}
+
+// attServers holds the ATT servers of the connections, which the Enhanced
+// ATT bearers are added to, and the updates are sent to. They're shared by the
+// anchors of a BeaconLine.
+type attServers struct {
+	sync.Mutex
+	m map[*hci.Conn]attServer
+
+	anchors int // Guarded by lineServers.
+}
+
+// attServer is the ATT server of a connection, and the GATT server of the
+// anchor, which its database belongs to.
+type attServer struct {
+	as  *att.Server
+	srv *gatt.Server
+}
+
+// lineServers holds the ATT servers of each BeaconLine, until its last anchor
+// is stopped.
+var lineServers = struct {
+	sync.Mutex
+	m map[*socket.BeaconLine]*attServers
+}{m: make(map[*socket.BeaconLine]*attServers)}
+
+// sharedServers returns the ATT servers of the anchors of a BeaconLine. A
+// device without a BeaconLine has servers of its own.
+func sharedServers(bl *socket.BeaconLine) *attServers {
+	if bl == nil {
+		return &attServers{m: make(map[*hci.Conn]attServer)}
+	}
+	lineServers.Lock()
+	defer lineServers.Unlock()
+	s, ok := lineServers.m[bl]
+	if !ok {
+		s = &attServers{m: make(map[*hci.Conn]attServer)}
+		lineServers.m[bl] = s
+	}
+	s.anchors++
+	return s
+}
+
+// releaseServers releases the ATT servers of a BeaconLine, once an anchor is
+// stopped.
+func releaseServers(bl *socket.BeaconLine) {
+	if bl == nil {
+		return
+	}
+	lineServers.Lock()
+	defer lineServers.Unlock()
+	s, ok := lineServers.m[bl]
+	if !ok {
+		return
+	}
+	if s.anchors--; s.anchors == 0 {
+		delete(lineServers.m, bl)
+	}
+}
+
+func (s *attServers) add(l2c ble.Conn, as *att.Server, srv *gatt.Server) {
+	c, ok := l2c.(*hci.Conn)
+	if !ok {
+		return
+	}
+	s.Lock()
+	s.m[c] = attServer{as: as, srv: srv}
+	s.Unlock()
+	go func() {
+		<-c.Disconnected()
+		s.Lock()
+		delete(s.m, c)
+		s.Unlock()
+	}()
+}
+
+func (s *attServers) get(c *hci.Conn) *att.Server {
+	s.Lock()
+	defer s.Unlock()
+	return s.m[c].as
+}
+
+func (s *attServers) all() map[*hci.Conn]attServer {
+	s.Lock()
+	defer s.Unlock()
+	m := make(map[*hci.Conn]attServer, len(s.m))
+	for c, as := range s.m {
+		m[c] = as
+	}
+	return m
+}
+
+// loopEATT serves the Enhanced ATT bearers, which centrals connect.
+func loopEATT(l *hci.ChannelListener, servers *attServers) {
+	for {
+		ch, err := l.Accept()
+		if err != nil {
+			return
+		}
+		as := servers.get(ch.Conn())
+		if as == nil {
+			log.Printf("no ATT server for EATT bearer")
+			ch.Close()
+			continue
+		}
+		go as.NewBearer(ch).Loop()
 	}
 }
 
@@ -83,6 +202,64 @@ func loop(dev *hci.HCI, s *gatt.Server, mtu int) {
 type Device struct {
 	HCI    *hci.HCI
 	Server *gatt.Server
+
+	eatt    *hci.ChannelListener
+	servers *attServers
+	stop    sync.Once
+}
+
+// A Delivery is the result of an update sent to a central.
+type Delivery struct {
+	Addr ble.Addr
+	Err  error
+}
+
+// Notify sends the value v of characteristic c to every connected central,
+// which subscribed to its notifications, on any anchor of the BeaconLine of
+// the device. The value is queued for each of
+// them, so a slow link doesn't hold up the others. Notify returns the number
+// of the centrals, which the value is queued for.
+//
+// The characteristic of another anchor is the one of the UUID of c, at its
+// position in a service of the same UUID and position as on the device.
+func (d *Device) Notify(c *ble.Characteristic, v []byte) int {
+	n := 0
+	for _, s := range d.servers.all() {
+		if lc := s.srv.Counterpart(d.Server, c); lc != nil && s.as.Update(lc, v, false, nil) {
+			n++
+		}
+	}
+	return n
+}
+
+// Indicate sends the value v of characteristic c to every connected central,
+// which subscribed to its indications, on any anchor of the BeaconLine of the
+// device, like Notify. The result for each of
+// them is delivered on the returned channel, once the indication is
+// confirmed, or failed; the channel is closed after the last one.
+func (d *Device) Indicate(c *ble.Characteristic, v []byte) <-chan Delivery {
+	servers := d.servers.all()
+	ch := make(chan Delivery, len(servers))
+	var wg sync.WaitGroup
+	for cn, s := range servers {
+		lc := s.srv.Counterpart(d.Server, c)
+		if lc == nil {
+			continue
+		}
+		a := cn.RemoteAddr()
+		wg.Add(1)
+		if !s.as.Update(lc, v, true, func(err error) {
+			ch <- Delivery{Addr: a, Err: err}
+			wg.Done()
+		}) {
+			wg.Done()
+		}
+	}
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	return ch
 }
 
 // AddService adds a service to database.
@@ -103,6 +280,10 @@ func (d *Device) SetServices(svcs []*ble.Service) error {
 
 // Stop stops gatt server.
 func (d *Device) Stop() error {
+	if d.eatt != nil {
+		d.eatt.Close()
+	}
+	d.stop.Do(func() { releaseServers(d.HCI.BeaconLine()) })
 	return d.HCI.Close()
 }
 
@@ -181,6 +362,19 @@ func (d *Device) Scan(ctx context.Context, allowDup bool, h ble.AdvHandler) erro
 	return ctx.Err()
 }
 
+// ScanAcceptList starts scanning, and only reports devices in the accept list of the HCI.
+func (d *Device) ScanAcceptList(ctx context.Context, allowDup bool, h ble.AdvHandler) error {
+	if err := d.HCI.SetAdvHandler(h); err != nil {
+		return err
+	}
+	if err := d.HCI.ScanAcceptList(allowDup); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	d.HCI.StopScanning()
+	return ctx.Err()
+}
+
 // Dial ...
 func (d *Device) Dial(ctx context.Context, a ble.Addr) (ble.Client, error) {
 	// d.HCI.Dial is a blocking call, although most of time it should return immediately.
@@ -189,6 +383,19 @@ func (d *Device) Dial(ctx context.Context, a ble.Addr) (ble.Client, error) {
 	return cln, errors.Wrap(err, "can't dial")
 }
 
+// DialAcceptList connects to the first device in the accept list of the HCI which is found advertising.
+func (d *Device) DialAcceptList(ctx context.Context) (ble.Client, error) {
+	cln, err := d.HCI.DialAcceptList(ctx)
+	return cln, errors.Wrap(err, "can't dial")
+}
+
+// AutoConnect connects to the devices in addrs, whenever any of them advertises,
+// until ctx is done. The connections are delivered on the returned channel.
+func (d *Device) AutoConnect(ctx context.Context, addrs ...ble.Addr) (<-chan ble.Client, error) {
+	ch, err := d.HCI.AutoConnect(ctx, addrs...)
+	return ch, errors.Wrap(err, "can't auto-connect")
+}
+
 // Address returns the listener's device address.
 func (d *Device) Address() ble.Addr {
 	return d.HCI.Addr()
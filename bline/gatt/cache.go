@@ -0,0 +1,474 @@
+package gatt
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	ble "traulfs/Bline/ble"
+	"traulfs/Bline/ble/bline/att"
+)
+
+// Cache stores the discovered profiles of servers, keyed by the identity
+// address of the remote device, so the discovery isn't repeated on each
+// connection [Vol 3, Part G, 2.5.2]. It's shared by the clients of all the
+// anchors, so implementations must be safe for concurrent use.
+type Cache interface {
+	// Load returns the profile of a device, and the Database Hash of the
+	// server when the profile was saved, if any. The caller owns the profile.
+	Load(a ble.DeviceAddr) (p *ble.Profile, hash []byte, ok bool)
+
+	// Save adds or replaces the profile of a device. Only the attributes of
+	// the profile are saved, not the values or the handlers.
+	Save(a ble.DeviceAddr, p *ble.Profile, hash []byte) error
+
+	// Delete removes the profile of a device.
+	Delete(a ble.DeviceAddr) error
+}
+
+var defaultCache = struct {
+	sync.Mutex
+	set bool
+	c   Cache
+}{}
+
+// DefaultCache returns the cache of the clients, which aren't configured with
+// a cache of their own. Unless set with SetDefaultCache, it's a FileCache at
+// UserCachePath, or nil if that can't be loaded.
+func DefaultCache() Cache {
+	defaultCache.Lock()
+	defer defaultCache.Unlock()
+	if !defaultCache.set {
+		defaultCache.set = true
+		path, err := UserCachePath()
+		if err != nil {
+			log.Printf("gatt: no cache directory: %s", err)
+			return nil
+		}
+		c, err := NewFileCache(path)
+		if err != nil {
+			log.Printf("gatt: can't load the cache: %s", err)
+			return nil
+		}
+		defaultCache.c = c
+	}
+	return defaultCache.c
+}
+
+// SetDefaultCache sets the cache of the clients created afterwards. A nil cache
+// disables caching.
+func SetDefaultCache(c Cache) {
+	defaultCache.Lock()
+	defer defaultCache.Unlock()
+	defaultCache.set, defaultCache.c = true, c
+}
+
+// UserCachePath returns the path of a FileCache in the user's cache directory.
+func UserCachePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "bline", "gatt.json"), nil
+}
+
+// cacheEntry is the saved profile of a device.
+type cacheEntry struct {
+	Addr     ble.DeviceAddr
+	Hash     []byte `json:",omitempty"`
+	Services []savedService
+}
+
+type savedService struct {
+	UUID      string
+	Handle    uint16
+	EndHandle uint16
+	Primary   bool     // The service was discovered as a primary service.
+	Included  []uint16 `json:",omitempty"` // Handles of the included services.
+
+	Characteristics []savedCharacteristic `json:",omitempty"`
+}
+
+type savedCharacteristic struct {
+	UUID        string
+	Property    ble.Property
+	Handle      uint16
+	ValueHandle uint16
+	EndHandle   uint16
+	Descriptors []savedDescriptor `json:",omitempty"`
+}
+
+type savedDescriptor struct {
+	UUID   string
+	Handle uint16
+}
+
+// encodeProfile returns the cache entry of a profile.
+func encodeProfile(a ble.DeviceAddr, p *ble.Profile, hash []byte) cacheEntry {
+	e := cacheEntry{Addr: a, Hash: hash}
+	seen := make(map[uint16]bool)
+	var add func(s *ble.Service, primary bool)
+	add = func(s *ble.Service, primary bool) {
+		if seen[s.Handle] {
+			return
+		}
+		seen[s.Handle] = true
+		cs := savedService{
+			UUID:      s.UUID.String(),
+			Handle:    s.Handle,
+			EndHandle: s.EndHandle,
+			Primary:   primary,
+		}
+		for _, c := range s.Characteristics {
+			cc := savedCharacteristic{
+				UUID:        c.UUID.String(),
+				Property:    c.Property,
+				Handle:      c.Handle,
+				ValueHandle: c.ValueHandle,
+				EndHandle:   c.EndHandle,
+			}
+			for _, d := range c.Descriptors {
+				cc.Descriptors = append(cc.Descriptors, savedDescriptor{UUID: d.UUID.String(), Handle: d.Handle})
+			}
+			cs.Characteristics = append(cs.Characteristics, cc)
+		}
+		for _, inc := range s.IncludedServices {
+			cs.Included = append(cs.Included, inc.Handle)
+		}
+		e.Services = append(e.Services, cs)
+		for _, inc := range s.IncludedServices {
+			add(inc, false)
+		}
+	}
+	for _, s := range p.Services {
+		add(s, true)
+	}
+	return e
+}
+
+// decodeProfile returns the profile of a cache entry.
+func decodeProfile(e cacheEntry) (*ble.Profile, error) {
+	p := &ble.Profile{}
+	svcs := make(map[uint16]*ble.Service)
+	for _, cs := range e.Services {
+		u, err := ble.Parse(cs.UUID)
+		if err != nil {
+			return nil, err
+		}
+		s := &ble.Service{UUID: u, Handle: cs.Handle, EndHandle: cs.EndHandle}
+		for _, cc := range cs.Characteristics {
+			u, err := ble.Parse(cc.UUID)
+			if err != nil {
+				return nil, err
+			}
+			c := &ble.Characteristic{
+				UUID:        u,
+				Property:    cc.Property,
+				Handle:      cc.Handle,
+				ValueHandle: cc.ValueHandle,
+				EndHandle:   cc.EndHandle,
+			}
+			for _, cd := range cc.Descriptors {
+				u, err := ble.Parse(cd.UUID)
+				if err != nil {
+					return nil, err
+				}
+				d := &ble.Descriptor{UUID: u, Handle: cd.Handle}
+				if u.Equal(ble.ClientCharacteristicConfigUUID) {
+					c.CCCD = d
+				}
+				c.Descriptors = append(c.Descriptors, d)
+			}
+			s.Characteristics = append(s.Characteristics, c)
+		}
+		svcs[s.Handle] = s
+		if cs.Primary {
+			p.Services = append(p.Services, s)
+		}
+	}
+	for _, cs := range e.Services {
+		for _, h := range cs.Included {
+			if inc, ok := svcs[h]; ok {
+				svcs[cs.Handle].IncludedServices = append(svcs[cs.Handle].IncludedServices, inc)
+			}
+		}
+	}
+	return p, nil
+}
+
+// FileCache is a Cache, which keeps the profiles in a JSON file.
+type FileCache struct {
+	sync.Mutex
+	path    string
+	entries map[string]cacheEntry
+}
+
+// NewFileCache returns a Cache backed by the file at path.
+// The file, and its directory, are created on the first Save.
+func NewFileCache(path string) (*FileCache, error) {
+	s := &FileCache{path: path, entries: make(map[string]cacheEntry)}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []cacheEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		s.entries[cacheKey(e.Addr)] = e
+	}
+	return s, nil
+}
+
+// cacheKey returns the key of an identity address, which includes its type.
+func cacheKey(a ble.DeviceAddr) string {
+	b, _ := a.MarshalText()
+	return string(b)
+}
+
+// Load returns the profile of a device, if any.
+func (s *FileCache) Load(a ble.DeviceAddr) (*ble.Profile, []byte, bool) {
+	s.Lock()
+	e, ok := s.entries[cacheKey(a)]
+	s.Unlock()
+	if !ok {
+		return nil, nil, false
+	}
+	p, err := decodeProfile(e)
+	if err != nil {
+		log.Printf("gatt: invalid cached profile of %s: %s", a, err)
+		return nil, nil, false
+	}
+	return p, e.Hash, true
+}
+
+// Save adds or replaces the profile of a device.
+func (s *FileCache) Save(a ble.DeviceAddr, p *ble.Profile, hash []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.entries[cacheKey(a)] = encodeProfile(a, p, hash)
+	return s.write()
+}
+
+// Delete removes the profile of a device.
+func (s *FileCache) Delete(a ble.DeviceAddr) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.entries[cacheKey(a)]; !ok {
+		return nil
+	}
+	delete(s.entries, cacheKey(a))
+	return s.write()
+}
+
+// write replaces the file atomically, so it's never left half written.
+func (s *FileCache) write() error {
+	entries := make([]cacheEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	b, err := json.MarshalIndent(entries, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+// cacheAddr returns the identity address of the server, which keys its cached
+// profile. Servers which use private addresses, that aren't resolved to their
+// identity, aren't cached.
+func (p *Client) cacheAddr() (ble.DeviceAddr, bool) {
+	a := p.conn.RemoteAddr()
+	if ic, ok := p.conn.(ble.IdentityConn); ok {
+		a = ic.IdentityAddr()
+	}
+	da, ok := a.(ble.DeviceAddr)
+	if !ok {
+		return ble.DeviceAddr{}, false
+	}
+	if da.Type == ble.AddrRPA || da.Type == ble.AddrNRPA {
+		return ble.DeviceAddr{}, false
+	}
+	return da, true
+}
+
+// bonded reports whether the devices are bonded.
+func (p *Client) bonded() bool {
+	ic, ok := p.conn.(ble.IdentityConn)
+	return ok && ic.Bonded()
+}
+
+// readDatabaseHash reads the Database Hash of the server [Vol 3, Part G, 7.3].
+func (p *Client) readDatabaseHash(ac *att.Client) ([]byte, error) {
+	length, b, err := ac.ReadByType(0x0001, 0xFFFF, ble.DatabaseHashUUID)
+	if err != nil {
+		return nil, err
+	}
+	if length != 2+16 || len(b) < length {
+		return nil, att.ErrInvalidResponse
+	}
+	return append([]byte(nil), b[2:length]...), nil
+}
+
+// loadCache reuses the cached profile of the server, if its Database Hash
+// matches the saved one. Servers without a Database Hash rely on Service
+// Changed indications to invalidate the cache, which are only retained for
+// bonded clients [Vol 3, Part G, 2.5.2], so their profile is reused only if
+// the devices are bonded. The cache is only looked up once, before the
+// profile is discovered.
+func (p *Client) loadCache(ac *att.Client) bool {
+	p.Lock()
+	cache := p.cache
+	checked := p.cacheChecked
+	p.cacheChecked = true
+	p.Unlock()
+	if cache == nil || checked {
+		return false
+	}
+	a, ok := p.cacheAddr()
+	if !ok {
+		return false
+	}
+	prof, hash, ok := cache.Load(a)
+	if !ok {
+		return false
+	}
+	cur, err := p.readDatabaseHash(ac)
+	switch {
+	case err == ble.ErrAttrNotFound:
+		cur = nil
+	case err != nil:
+		log.Printf("gatt: can't read the Database Hash: %s", err)
+		return false
+	}
+	if cur == nil && !p.bonded() {
+		return false
+	}
+	if !bytes.Equal(cur, hash) {
+		if err := cache.Delete(a); err != nil {
+			log.Printf("gatt: can't delete the cached profile: %s", err)
+		}
+		return false
+	}
+	p.Lock()
+	if p.profile != nil && len(p.profile.Services) != 0 {
+		// A discovery ran meanwhile; its attributes are kept.
+		p.Unlock()
+		return false
+	}
+	p.profile = prof
+	p.allServices, p.allProfile = true, true
+	p.Unlock()
+	p.watchServiceChanged(ac)
+	return true
+}
+
+// saveCache saves the profile of the server.
+func (p *Client) saveCache(ac *att.Client) {
+	p.RLock()
+	cache := p.cache
+	p.RUnlock()
+	if cache == nil {
+		return
+	}
+	a, ok := p.cacheAddr()
+	if !ok {
+		return
+	}
+	hash, err := p.readDatabaseHash(ac)
+	if err != nil && err != ble.ErrAttrNotFound {
+		log.Printf("gatt: can't read the Database Hash: %s", err)
+		return
+	}
+	if hash == nil && !p.bonded() {
+		// The profile couldn't be reused.
+		return
+	}
+	p.RLock()
+	defer p.RUnlock()
+	if err := cache.Save(a, p.profile, hash); err != nil {
+		log.Printf("gatt: can't save the profile: %s", err)
+	}
+}
+
+// watchServiceChanged subscribes to the indications of the Service Changed
+// characteristic, if the server has one [Vol 3, Part G, 7.1].
+func (p *Client) watchServiceChanged(ac *att.Client) {
+	p.RLock()
+	var sc *ble.Characteristic
+	if p.profile != nil {
+		for _, s := range p.profile.Services {
+			if !s.UUID.Equal(ble.GATTUUID) {
+				continue
+			}
+			for _, c := range s.Characteristics {
+				if c.UUID.Equal(ble.ServiceChangedUUID) {
+					sc = c
+				}
+			}
+		}
+	}
+	if sc == nil || sc.CCCD == nil {
+		p.RUnlock()
+		return
+	}
+	cccdh, vh := sc.CCCD.Handle, sc.ValueHandle
+	s, subscribed := p.subs[vh]
+	subscribed = subscribed && s.ccc&cccIndicate != 0
+	p.RUnlock()
+	if subscribed {
+		return
+	}
+	h := func([]byte) { p.serviceChanged() }
+	if err := p.setHandlers(ac, cccdh, vh, cccIndicate, h); err != nil {
+		log.Printf("gatt: can't subscribe to Service Changed: %s", err)
+	}
+}
+
+// serviceChanged drops the profile, and its cached copy, after the server
+// indicated a change of its attributes. It's discovered again on demand.
+func (p *Client) serviceChanged() {
+	p.Lock()
+	defer p.Unlock()
+	p.profile = nil
+	p.allServices, p.allProfile = false, false
+	if p.cache == nil {
+		return
+	}
+	if a, ok := p.cacheAddr(); ok {
+		if err := p.cache.Delete(a); err != nil {
+			log.Printf("gatt: can't delete the cached profile: %s", err)
+		}
+	}
+}
+
+// SetCache sets the cache of the profile of the server. A nil cache disables
+// caching.
+func (p *Client) SetCache(c Cache) {
+	p.Lock()
+	defer p.Unlock()
+	p.cache = c
+}
@@ -0,0 +1,203 @@
+package gatt
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ble "traulfs/Bline/ble"
+)
+
+func TestMain(m *testing.M) {
+	// The clients under test don't share the cache of the user.
+	SetDefaultCache(nil)
+	os.Exit(m.Run())
+}
+
+// testProfile returns a profile with a primary service, which includes a
+// secondary service with a 128-bit UUID, and characteristics with and without
+// descriptors.
+func testProfile() *ble.Profile {
+	cccd := &ble.Descriptor{UUID: ble.ClientCharacteristicConfigUUID, Handle: 0x0005}
+	inc := &ble.Service{
+		UUID:      ble.MustParse("6e400001-b5a3-f393-e0a9-e50e24dcca9e"),
+		Handle:    0x0010,
+		EndHandle: 0x0012,
+		Characteristics: []*ble.Characteristic{{
+			UUID:        ble.MustParse("6e400002-b5a3-f393-e0a9-e50e24dcca9e"),
+			Property:    ble.CharRead,
+			Handle:      0x0011,
+			ValueHandle: 0x0012,
+			EndHandle:   0x0012,
+			Value:       []byte{0x01},
+		}},
+	}
+	return &ble.Profile{Services: []*ble.Service{
+		{
+			UUID:             ble.UUID16(0x180D),
+			Handle:           0x0001,
+			EndHandle:        0x0006,
+			IncludedServices: []*ble.Service{inc},
+			Characteristics: []*ble.Characteristic{{
+				UUID:        ble.UUID16(0x2A37),
+				Property:    ble.CharNotify,
+				Handle:      0x0003,
+				ValueHandle: 0x0004,
+				EndHandle:   0x0006,
+				Descriptors: []*ble.Descriptor{cccd, {UUID: ble.UUID16(0x2901), Handle: 0x0006}},
+				CCCD:        cccd,
+			}},
+		},
+		{UUID: ble.UUID16(0x1801), Handle: 0x0007, EndHandle: 0x0009},
+	}}
+}
+
+func equalServices(t *testing.T, got, want []*ble.Service) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d services, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		g := got[i]
+		if !g.UUID.Equal(w.UUID) || g.Handle != w.Handle || g.EndHandle != w.EndHandle {
+			t.Errorf("service %d: got %s 0x%04X-0x%04X, want %s 0x%04X-0x%04X",
+				i, g.UUID, g.Handle, g.EndHandle, w.UUID, w.Handle, w.EndHandle)
+		}
+		equalServices(t, g.IncludedServices, w.IncludedServices)
+		if len(g.Characteristics) != len(w.Characteristics) {
+			t.Fatalf("service %d: got %d characteristics, want %d", i, len(g.Characteristics), len(w.Characteristics))
+		}
+		for j, wc := range w.Characteristics {
+			gc := g.Characteristics[j]
+			if !gc.UUID.Equal(wc.UUID) || gc.Property != wc.Property || gc.Handle != wc.Handle ||
+				gc.ValueHandle != wc.ValueHandle || gc.EndHandle != wc.EndHandle {
+				t.Errorf("characteristic %s: got %+v, want %+v", wc.UUID, gc, wc)
+			}
+			if gc.Value != nil {
+				t.Errorf("characteristic %s: the value was saved", wc.UUID)
+			}
+			if len(gc.Descriptors) != len(wc.Descriptors) {
+				t.Fatalf("characteristic %s: got %d descriptors, want %d", wc.UUID, len(gc.Descriptors), len(wc.Descriptors))
+			}
+			for k, wd := range wc.Descriptors {
+				if gd := gc.Descriptors[k]; !gd.UUID.Equal(wd.UUID) || gd.Handle != wd.Handle {
+					t.Errorf("descriptor %d of %s: got %s 0x%04X, want %s 0x%04X", k, wc.UUID, gd.UUID, gd.Handle, wd.UUID, wd.Handle)
+				}
+			}
+			if (gc.CCCD == nil) != (wc.CCCD == nil) || gc.CCCD != nil && gc.CCCD != gc.Descriptors[0] {
+				t.Errorf("characteristic %s: got CCCD %v, want the first descriptor", wc.UUID, gc.CCCD)
+			}
+		}
+	}
+}
+
+func TestProfileRoundTrip(t *testing.T) {
+	a := ble.NewDeviceAddr([]byte{0xc0, 0x01, 0x02, 0x03, 0x04, 0x05}, true)
+	hash := bytes.Repeat([]byte{0xAB}, 16)
+	want := testProfile()
+
+	e := encodeProfile(a, want, hash)
+	if len(e.Services) != 3 {
+		t.Fatalf("got %d saved services, want 3", len(e.Services))
+	}
+	if e.Services[1].Primary {
+		t.Error("the included service was saved as a primary service")
+	}
+	got, err := decodeProfile(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	equalServices(t, got.Services, want.Services)
+	if got.Services[0].IncludedServices[0] == nil {
+		t.Fatal("the included service wasn't linked")
+	}
+}
+
+func TestDecodeProfileInvalidUUID(t *testing.T) {
+	e := encodeProfile(ble.DeviceAddr{}, testProfile(), nil)
+	e.Services[0].Characteristics[0].UUID = "not a UUID"
+	if _, err := decodeProfile(e); err == nil {
+		t.Error("decodeProfile: got no error")
+	}
+}
+
+// TestDefaultCache checks that the clients share a FileCache in the user's
+// cache directory, unless set otherwise.
+func TestDefaultCache(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_CACHE_HOME", dir)
+	t.Setenv("LocalAppData", dir)
+	defaultCache.Lock()
+	set, c := defaultCache.set, defaultCache.c
+	defaultCache.set = false
+	defaultCache.Unlock()
+	t.Cleanup(func() {
+		defaultCache.Lock()
+		defaultCache.set, defaultCache.c = set, c
+		defaultCache.Unlock()
+	})
+
+	path, err := UserCachePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc, ok := DefaultCache().(*FileCache)
+	if !ok || fc.path != path {
+		t.Fatalf("got default cache %v, want a FileCache at %s", fc, path)
+	}
+	if DefaultCache() != fc {
+		t.Error("got another default cache")
+	}
+	SetDefaultCache(nil)
+	if DefaultCache() != nil {
+		t.Error("got a default cache, after it was disabled")
+	}
+}
+
+func TestFileCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bline", "gatt.json")
+	a := ble.NewDeviceAddr([]byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05}, false)
+	hash := bytes.Repeat([]byte{0x5A}, 16)
+
+	c, err := NewFileCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := c.Load(a); ok {
+		t.Fatal("Load: got a profile from an empty cache")
+	}
+	if err := c.Save(a, testProfile(), hash); err != nil {
+		t.Fatal(err)
+	}
+
+	// The profile is loaded back from the file.
+	c, err = NewFileCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, h, ok := c.Load(a)
+	if !ok {
+		t.Fatal("Load: no profile")
+	}
+	if !bytes.Equal(h, hash) {
+		t.Errorf("Load: got hash %X, want %X", h, hash)
+	}
+	equalServices(t, p.Services, testProfile().Services)
+
+	// The address type is part of the key.
+	if _, _, ok := c.Load(ble.NewDeviceAddr(a.MAC[:], true)); ok {
+		t.Error("Load: got the profile of a public address for a random one")
+	}
+
+	if err := c.Delete(a); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = NewFileCache(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := c.Load(a); ok {
+		t.Error("Load: got a deleted profile")
+	}
+}
@@ -1,6 +1,7 @@
 package gatt
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"log"
@@ -18,8 +19,9 @@ const (
 // NewClient returns a GATT Client.
 func NewClient(conn ble.Conn) (*Client, error) {
 	p := &Client{
-		subs: make(map[uint16]*sub),
-		conn: conn,
+		subs:  make(map[uint16]*sub),
+		conn:  conn,
+		cache: DefaultCache(),
 	}
 	p.ac = att.NewClient(conn, p)
 	go p.ac.Loop()
@@ -34,6 +36,20 @@ type Client struct {
 	name    string
 	subs    map[uint16]*sub
 
+	// The profile is discovered incrementally; these tell which parts of it
+	// are complete.
+	allServices bool // All the primary services are discovered.
+	allProfile  bool // The whole profile is discovered.
+
+	// muSubs serializes the changes of the subscriptions, so the CCCDs are
+	// written in order.
+	muSubs sync.Mutex
+
+	cache        Cache
+	cacheChecked bool // The cached profile was looked up.
+
+	noReadMultipleVariable bool // The server doesn't support Read Multiple Variable.
+
 	ac   *att.Client
 	conn ble.Conn
 }
@@ -59,44 +75,229 @@ func (p *Client) Profile() *ble.Profile {
 	return p.profile
 }
 
-// DiscoverProfile discovers the whole hierarchy of a server.
+// DiscoverProfile discovers the whole hierarchy of a server. The parts of the
+// profile, which were discovered earlier, are kept unless force is set.
 func (p *Client) DiscoverProfile(force bool) (*ble.Profile, error) {
-	if p.profile != nil && !force {
-		return p.profile, nil
+	return p.DiscoverProfileContext(context.Background(), force)
+}
+
+// DiscoverProfileContext is like DiscoverProfile, but gives up once ctx is done.
+func (p *Client) DiscoverProfileContext(ctx context.Context, force bool) (*ble.Profile, error) {
+	ac := p.ac.WithContext(ctx)
+	if !force {
+		p.loadCache(ac)
+		p.RLock()
+		profile, all := p.profile, p.allProfile
+		p.RUnlock()
+		if all {
+			return profile, nil
+		}
+	} else {
+		p.Lock()
+		p.profile = &ble.Profile{}
+		p.allServices = false
+		p.Unlock()
 	}
-	ss, err := p.DiscoverServices(nil)
+
+	ss, err := p.DiscoverServicesContext(ctx, nil)
 	if err != nil {
 		return nil, fmt.Errorf("can't discover services: %s", err)
 	}
 	for _, s := range ss {
-		cs, err := p.DiscoverCharacteristics(nil, s)
+		if _, err := p.DiscoverIncludedServicesContext(ctx, nil, s); err != nil {
+			return nil, fmt.Errorf("can't discover included services: %s", err)
+		}
+		cs, err := p.DiscoverCharacteristicsContext(ctx, nil, s)
 		if err != nil {
 			return nil, fmt.Errorf("can't discover characteristics: %s", err)
 		}
 		for _, c := range cs {
-			_, err := p.DiscoverDescriptors(nil, c)
+			_, err := p.DiscoverDescriptorsContext(ctx, nil, c)
 			if err != nil {
 				return nil, fmt.Errorf("can't discover descriptors: %s", err)
 			}
 		}
 	}
-	p.profile = &ble.Profile{Services: ss}
-	return p.profile, nil
+	p.Lock()
+	p.allProfile = true
+	profile := p.profile
+	p.Unlock()
+	p.saveCache(ac)
+	p.watchServiceChanged(ac)
+	return profile, nil
+}
+
+// FindService returns the primary service with UUID u. Unless it was
+// discovered earlier, only the service is discovered, by its UUID.
+func (p *Client) FindService(u ble.UUID) (*ble.Service, error) {
+	return p.FindServiceContext(context.Background(), u)
+}
+
+// FindServiceContext is like FindService, but gives up once ctx is done.
+func (p *Client) FindServiceContext(ctx context.Context, u ble.UUID) (*ble.Service, error) {
+	ac := p.ac.WithContext(ctx)
+	p.loadCache(ac)
+	p.RLock()
+	s, all := p.cachedService(u), p.allServices
+	p.RUnlock()
+	if s != nil {
+		return s, nil
+	}
+	if all {
+		return nil, ble.ErrAttrNotFound
+	}
+	ss, err := p.discoverServicesByUUID(ac, u)
+	if err != nil {
+		return nil, err
+	}
+	if len(ss) == 0 {
+		return nil, ble.ErrAttrNotFound
+	}
+	return ss[0], nil
+}
+
+// FindCharacteristic returns the characteristic with UUID u, and discovers its
+// descriptors. Only the service with UUID svc is searched, or every primary
+// service if svc is nil. The services and characteristics discovered on the
+// way are added to the profile, so a value can be accessed without a walk of
+// the whole profile.
+func (p *Client) FindCharacteristic(svc, u ble.UUID) (*ble.Characteristic, error) {
+	return p.FindCharacteristicContext(context.Background(), svc, u)
+}
+
+// FindCharacteristicContext is like FindCharacteristic, but gives up once ctx is done.
+func (p *Client) FindCharacteristicContext(ctx context.Context, svc, u ble.UUID) (*ble.Characteristic, error) {
+	p.loadCache(p.ac.WithContext(ctx))
+
+	var ss []*ble.Service
+	if svc != nil {
+		s, err := p.FindServiceContext(ctx, svc)
+		if err != nil {
+			return nil, err
+		}
+		ss = []*ble.Service{s}
+	} else {
+		var err error
+		if ss, err = p.DiscoverServicesContext(ctx, nil); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range ss {
+		p.RLock()
+		c := cachedCharacteristic(s, u)
+		p.RUnlock()
+		if c == nil {
+			cs, err := p.DiscoverCharacteristicsContext(ctx, []ble.UUID{u}, s)
+			if err != nil {
+				return nil, err
+			}
+			if len(cs) == 0 {
+				continue
+			}
+			c = cs[0]
+		}
+		p.RLock()
+		undiscovered := len(c.Descriptors) == 0 && c.ValueHandle < c.EndHandle
+		p.RUnlock()
+		if undiscovered {
+			if _, err := p.DiscoverDescriptorsContext(ctx, nil, c); err != nil {
+				return nil, err
+			}
+		}
+		return c, nil
+	}
+	return nil, ble.ErrAttrNotFound
+}
+
+// cachedService returns the discovered primary service with UUID u, if any.
+func (p *Client) cachedService(u ble.UUID) *ble.Service {
+	if p.profile == nil {
+		return nil
+	}
+	for _, s := range p.profile.Services {
+		if s.UUID.Equal(u) {
+			return s
+		}
+	}
+	return nil
+}
+
+// cachedCharacteristic returns the discovered characteristic of s with UUID u,
+// if any.
+func cachedCharacteristic(s *ble.Service, u ble.UUID) *ble.Characteristic {
+	for _, c := range s.Characteristics {
+		if c.UUID.Equal(u) {
+			return c
+		}
+	}
+	return nil
 }
 
 // DiscoverServices finds all the primary services on a server. [Vol 3, Part G, 4.4.1]
-// If filter is specified, only filtered services are returned.
+// If filter is specified, only filtered services are returned; they're found
+// by their UUIDs. [Vol 3, Part G, 4.4.2]
 func (p *Client) DiscoverServices(filter []ble.UUID) ([]*ble.Service, error) {
+	return p.DiscoverServicesContext(context.Background(), filter)
+}
+
+// DiscoverServicesContext is like DiscoverServices, but gives up once ctx is done.
+func (p *Client) DiscoverServicesContext(ctx context.Context, filter []ble.UUID) ([]*ble.Service, error) {
+	ac := p.ac.WithContext(ctx)
+	if filter != nil {
+		var ss []*ble.Service
+		for _, u := range filter {
+			found, err := p.discoverServicesByUUID(ac, u)
+			if err != nil {
+				return nil, err
+			}
+			ss = append(ss, found...)
+		}
+		return ss, nil
+	}
+	p.RLock()
+	if p.allServices {
+		defer p.RUnlock()
+		return p.profile.Services, nil
+	}
+	p.RUnlock()
+	var found []*ble.Service
+	for start := uint16(0x0001); start != 0; {
+		length, b, err := ac.ReadByGroupType(start, 0xFFFF, ble.PrimaryServiceUUID)
+		if err == ble.ErrAttrNotFound {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for len(b) != 0 {
+			h := binary.LittleEndian.Uint16(b[:2])
+			endh := binary.LittleEndian.Uint16(b[2:4])
+			found = append(found, &ble.Service{UUID: ble.UUID(b[4:length]), Handle: h, EndHandle: endh})
+			// The end handle 0xFFFF wraps start to 0, which ends the search.
+			start = endh + 1
+			b = b[length:]
+		}
+	}
 	p.Lock()
 	defer p.Unlock()
+	for _, s := range found {
+		p.addService(s.UUID, s.Handle, s.EndHandle)
+	}
 	if p.profile == nil {
 		p.profile = &ble.Profile{}
 	}
-	start := uint16(0x0001)
-	for {
-		length, b, err := p.ac.ReadByGroupType(start, 0xFFFF, ble.PrimaryServiceUUID)
+	p.allServices = true
+	return p.profile.Services, nil
+}
+
+// discoverServicesByUUID finds the primary services with UUID u, with Find By
+// Type Value. [Vol 3, Part G, 4.4.2]
+func (p *Client) discoverServicesByUUID(ac *att.Client, u ble.UUID) ([]*ble.Service, error) {
+	var hs [][2]uint16
+	for start := uint16(0x0001); start != 0; {
+		b, err := ac.FindByTypeValue(start, 0xFFFF, binary.LittleEndian.Uint16(ble.PrimaryServiceUUID), u)
 		if err == ble.ErrAttrNotFound {
-			return p.profile.Services, nil
+			break
 		}
 		if err != nil {
 			return nil, err
@@ -104,80 +305,209 @@ func (p *Client) DiscoverServices(filter []ble.UUID) ([]*ble.Service, error) {
 		for len(b) != 0 {
 			h := binary.LittleEndian.Uint16(b[:2])
 			endh := binary.LittleEndian.Uint16(b[2:4])
-			u := ble.UUID(b[4:length])
-			if filter == nil || ble.Contains(filter, u) {
-				s := &ble.Service{
-					UUID:      u,
-					Handle:    h,
-					EndHandle: endh,
-				}
-				p.profile.Services = append(p.profile.Services, s)
-			}
-			if endh == 0xFFFF {
-				return p.profile.Services, nil
-			}
+			hs = append(hs, [2]uint16{h, endh})
 			start = endh + 1
-			b = b[length:]
+			b = b[4:]
+		}
+	}
+	p.Lock()
+	defer p.Unlock()
+	ss := make([]*ble.Service, len(hs))
+	for i, h := range hs {
+		ss[i] = p.addService(u, h[0], h[1])
+	}
+	return ss, nil
+}
+
+// addService adds a primary service to the profile, unless it was discovered
+// earlier, and returns it. The caller holds the lock of p.
+func (p *Client) addService(u ble.UUID, h, endh uint16) *ble.Service {
+	if p.profile == nil {
+		p.profile = &ble.Profile{}
+	}
+	for _, s := range p.profile.Services {
+		if s.Handle == h {
+			return s
 		}
 	}
+	s := &ble.Service{
+		UUID:      u,
+		Handle:    h,
+		EndHandle: endh,
+	}
+	p.profile.Services = append(p.profile.Services, s)
+	return s
 }
 
 // DiscoverIncludedServices finds the included services of a service. [Vol 3, Part G, 4.5.1]
 // If filter is specified, only filtered services are returned.
-func (p *Client) DiscoverIncludedServices(ss []ble.UUID, s *ble.Service) ([]*ble.Service, error) {
+func (p *Client) DiscoverIncludedServices(filter []ble.UUID, s *ble.Service) ([]*ble.Service, error) {
+	return p.DiscoverIncludedServicesContext(context.Background(), filter, s)
+}
+
+// DiscoverIncludedServicesContext is like DiscoverIncludedServices, but gives up once ctx is done.
+func (p *Client) DiscoverIncludedServicesContext(ctx context.Context, filter []ble.UUID, s *ble.Service) ([]*ble.Service, error) {
+	ac := p.ac.WithContext(ctx)
+	var found []*ble.Service
+	start := s.Handle
+	for start <= s.EndHandle {
+		length, b, err := ac.ReadByType(start, s.EndHandle, ble.IncludeUUID)
+		if err == ble.ErrAttrNotFound {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if length != 8 && length != 6 {
+			return nil, fmt.Errorf("invalid include declaration length %d", length)
+		}
+		for len(b) != 0 {
+			h := binary.LittleEndian.Uint16(b[:2])
+			inch := binary.LittleEndian.Uint16(b[2:4])
+			endh := binary.LittleEndian.Uint16(b[4:6])
+			var u ble.UUID
+			if length == 8 {
+				u = ble.UUID(b[6:8])
+			} else {
+				// A 128-bit UUID is left out of the include declaration, so
+				// it's read from the service declaration.
+				v, err := ac.Read(inch)
+				if err != nil {
+					return nil, err
+				}
+				if len(v) != 16 {
+					return nil, fmt.Errorf("invalid service declaration of handle 0x%04X", inch)
+				}
+				u = ble.UUID(v)
+			}
+			found = append(found, &ble.Service{UUID: u, Handle: inch, EndHandle: endh})
+			start = h + 1
+			b = b[length:]
+		}
+	}
 	p.Lock()
 	defer p.Unlock()
-	return nil, nil
+	var ss []*ble.Service
+	for _, f := range found {
+		inc := p.service(f.UUID, f.Handle, f.EndHandle)
+		if !containsService(s.IncludedServices, inc) {
+			s.IncludedServices = append(s.IncludedServices, inc)
+		}
+		if filter == nil || ble.Contains(filter, f.UUID) {
+			ss = append(ss, inc)
+		}
+	}
+	return ss, nil
+}
+
+// service returns the discovered service with handle h, or a new one. The
+// caller holds the lock of p.
+func (p *Client) service(u ble.UUID, h, endh uint16) *ble.Service {
+	if p.profile != nil {
+		for _, s := range p.profile.Services {
+			if s.Handle == h {
+				return s
+			}
+		}
+	}
+	return &ble.Service{
+		UUID:      u,
+		Handle:    h,
+		EndHandle: endh,
+	}
+}
+
+func containsService(ss []*ble.Service, s *ble.Service) bool {
+	for _, x := range ss {
+		if x.Handle == s.Handle {
+			return true
+		}
+	}
+	return false
 }
 
 // DiscoverCharacteristics finds all the characteristics within a service. [Vol 3, Part G, 4.6.1]
-// If filter is specified, only filtered characteristics are returned.
+// If filter is specified, only filtered characteristics are returned; they're
+// found by their UUIDs. [Vol 3, Part G, 4.6.2]
+// The characteristics, which were discovered earlier, aren't added again.
 func (p *Client) DiscoverCharacteristics(filter []ble.UUID, s *ble.Service) ([]*ble.Characteristic, error) {
-	p.Lock()
-	defer p.Unlock()
+	return p.DiscoverCharacteristicsContext(context.Background(), filter, s)
+}
+
+// DiscoverCharacteristicsContext is like DiscoverCharacteristics, but gives up once ctx is done.
+func (p *Client) DiscoverCharacteristicsContext(ctx context.Context, filter []ble.UUID, s *ble.Service) ([]*ble.Characteristic, error) {
+	ac := p.ac.WithContext(ctx)
+	var found []*ble.Characteristic
 	start := s.Handle
-	var lastChar *ble.Characteristic
 	for start <= s.EndHandle {
-		length, b, err := p.ac.ReadByType(start, s.EndHandle, ble.CharacteristicUUID)
+		length, b, err := ac.ReadByType(start, s.EndHandle, ble.CharacteristicUUID)
 		if err == ble.ErrAttrNotFound {
 			break
 		} else if err != nil {
 			return nil, err
 		}
 		for len(b) != 0 {
-			h := binary.LittleEndian.Uint16(b[:2])
-			p := ble.Property(b[2])
 			vh := binary.LittleEndian.Uint16(b[3:5])
-			u := ble.UUID(b[5:length])
-			c := &ble.Characteristic{
-				UUID:        u,
-				Property:    p,
-				Handle:      h,
+			found = append(found, &ble.Characteristic{
+				UUID:        ble.UUID(b[5:length]),
+				Property:    ble.Property(b[2]),
+				Handle:      binary.LittleEndian.Uint16(b[:2]),
 				ValueHandle: vh,
 				EndHandle:   s.EndHandle,
+			})
+			start = vh + 1
+			b = b[length:]
+		}
+	}
+	p.Lock()
+	defer p.Unlock()
+	var cs []*ble.Characteristic
+	var lastChar *ble.Characteristic
+	for _, c := range found {
+		for _, x := range s.Characteristics {
+			if x.Handle == c.Handle {
+				c = x
+				break
 			}
-			if filter == nil || ble.Contains(filter, u) {
+		}
+		if filter == nil || ble.Contains(filter, c.UUID) {
+			if !containsCharacteristic(s.Characteristics, c) {
 				s.Characteristics = append(s.Characteristics, c)
 			}
-			if lastChar != nil {
-				lastChar.EndHandle = c.Handle - 1
-			}
-			lastChar = c
-			start = vh + 1
-			b = b[length:]
+			cs = append(cs, c)
+		}
+		if lastChar != nil {
+			lastChar.EndHandle = c.Handle - 1
+		}
+		lastChar = c
+	}
+	return cs, nil
+}
+
+func containsCharacteristic(cs []*ble.Characteristic, c *ble.Characteristic) bool {
+	for _, x := range cs {
+		if x == c {
+			return true
 		}
 	}
-	return s.Characteristics, nil
+	return false
 }
 
 // DiscoverDescriptors finds all the descriptors within a characteristic. [Vol 3, Part G, 4.7.1]
 // If filter is specified, only filtered descriptors are returned.
+// The descriptors, which were discovered earlier, aren't added again.
 func (p *Client) DiscoverDescriptors(filter []ble.UUID, c *ble.Characteristic) ([]*ble.Descriptor, error) {
-	p.Lock()
-	defer p.Unlock()
-	start := c.ValueHandle + 1
-	for start <= c.EndHandle {
-		fmt, b, err := p.ac.FindInformation(start, c.EndHandle)
+	return p.DiscoverDescriptorsContext(context.Background(), filter, c)
+}
+
+// DiscoverDescriptorsContext is like DiscoverDescriptors, but gives up once ctx is done.
+func (p *Client) DiscoverDescriptorsContext(ctx context.Context, filter []ble.UUID, c *ble.Characteristic) ([]*ble.Descriptor, error) {
+	ac := p.ac.WithContext(ctx)
+	p.RLock()
+	start, end := c.ValueHandle+1, c.EndHandle
+	p.RUnlock()
+	var found []*ble.Descriptor
+	for start <= end {
+		fmt, b, err := ac.FindInformation(start, end)
 		if err == ble.ErrAttrNotFound {
 			break
 		} else if err != nil {
@@ -189,133 +519,352 @@ func (p *Client) DiscoverDescriptors(filter []ble.UUID, c *ble.Characteristic) (
 		}
 		for len(b) != 0 {
 			h := binary.LittleEndian.Uint16(b[:2])
-			u := ble.UUID(b[2:length])
-			d := &ble.Descriptor{UUID: u, Handle: h}
-			if filter == nil || ble.Contains(filter, u) {
-				c.Descriptors = append(c.Descriptors, d)
-			}
-			if u.Equal(ble.ClientCharacteristicConfigUUID) {
-				c.CCCD = d
-			}
+			found = append(found, &ble.Descriptor{UUID: ble.UUID(b[2:length]), Handle: h})
 			start = h + 1
 			b = b[length:]
 		}
 	}
-	return c.Descriptors, nil
+	p.Lock()
+	defer p.Unlock()
+	var ds []*ble.Descriptor
+	for _, d := range found {
+		if x := cachedDescriptor(c, d.Handle); x != nil {
+			d = x
+		} else {
+			c.Descriptors = append(c.Descriptors, d)
+		}
+		if filter == nil || ble.Contains(filter, d.UUID) {
+			ds = append(ds, d)
+		}
+		if d.UUID.Equal(ble.ClientCharacteristicConfigUUID) {
+			c.CCCD = d
+		}
+	}
+	return ds, nil
+}
+
+// cachedDescriptor returns the discovered descriptor of c with handle h, if any.
+func cachedDescriptor(c *ble.Characteristic, h uint16) *ble.Descriptor {
+	for _, d := range c.Descriptors {
+		if d.Handle == h {
+			return d
+		}
+	}
+	return nil
 }
 
 // ReadCharacteristic reads a characteristic value from a server. [Vol 3, Part G, 4.8.1]
 func (p *Client) ReadCharacteristic(c *ble.Characteristic) ([]byte, error) {
-	p.Lock()
-	defer p.Unlock()
-	val, err := p.ac.Read(c.ValueHandle)
+	return p.ReadCharacteristicContext(context.Background(), c)
+}
+
+// ReadCharacteristicContext is like ReadCharacteristic, but gives up once ctx is done.
+func (p *Client) ReadCharacteristicContext(ctx context.Context, c *ble.Characteristic) ([]byte, error) {
+	val, err := p.ac.WithContext(ctx).Read(c.ValueHandle)
 	if err != nil {
 		return nil, err
 	}
-
+	p.Lock()
 	c.Value = val
+	p.Unlock()
 	return val, nil
 }
 
 // ReadLongCharacteristic reads a characteristic value which is longer than the MTU. [Vol 3, Part G, 4.8.3]
 func (p *Client) ReadLongCharacteristic(c *ble.Characteristic) ([]byte, error) {
+	return p.ReadLongCharacteristicContext(context.Background(), c)
+}
+
+// ReadLongCharacteristicContext is like ReadLongCharacteristic, but gives up once ctx is done.
+func (p *Client) ReadLongCharacteristicContext(ctx context.Context, c *ble.Characteristic) ([]byte, error) {
+	buffer, err := p.readLong(p.ac.WithContext(ctx), c.ValueHandle)
+	if err != nil {
+		return nil, err
+	}
 	p.Lock()
-	defer p.Unlock()
+	c.Value = buffer
+	p.Unlock()
+	return buffer, nil
+}
 
+// readLong reads a value, which may be longer than the MTU.
+func (p *Client) readLong(ac *att.Client, h uint16) ([]byte, error) {
 	// The maximum length of an attribute value shall be 512 octects [Vol 3, 3.2.9]
 	buffer := make([]byte, 0, 512)
 
-	read, err := p.ac.Read(c.ValueHandle)
+	read, err := ac.Read(h)
 	if err != nil {
 		return nil, err
 	}
 	buffer = append(buffer, read...)
+	if len(read) < p.conn.TxMTU()-1 {
+		return buffer, nil
+	}
+	return p.readRest(ac, h, buffer)
+}
 
-	for len(read) >= p.conn.TxMTU()-1 {
-		if read, err = p.ac.ReadBlob(c.ValueHandle, uint16(len(buffer))); err != nil {
+// readRest reads the rest of a value, which was truncated to v, with Read Blob
+// Requests. [Vol 3, Part G, 4.8.3]
+func (p *Client) readRest(ac *att.Client, h uint16, v []byte) ([]byte, error) {
+	for {
+		read, err := ac.ReadBlob(h, uint16(len(v)))
+		if err != nil {
 			return nil, err
 		}
-		buffer = append(buffer, read...)
+		v = append(v, read...)
+		if len(read) < p.conn.TxMTU()-1 {
+			return v, nil
+		}
 	}
+}
 
-	c.Value = buffer
-	return buffer, nil
+// ReadCharacteristics reads the values of several characteristics. The reads
+// are batched into as few Read Multiple Variable Requests as the MTU allows,
+// and values truncated to fit in a response are read to their end. Servers
+// which don't support the request are read one value at a time.
+// [Vol 3, Part G, 4.8.5]
+func (p *Client) ReadCharacteristics(cs []*ble.Characteristic) ([][]byte, error) {
+	return p.ReadCharacteristicsContext(context.Background(), cs)
+}
+
+// ReadCharacteristicsContext is like ReadCharacteristics, but gives up once ctx is done.
+func (p *Client) ReadCharacteristicsContext(ctx context.Context, cs []*ble.Characteristic) ([][]byte, error) {
+	ac := p.ac.WithContext(ctx)
+	vs := make([][]byte, len(cs))
+	for i := 0; i < len(cs); {
+		n := len(cs) - i
+		if max := (p.conn.TxMTU() - 1) / 2; n > max {
+			n = max
+		}
+		var values [][]byte
+		p.RLock()
+		noReadMultipleVariable := p.noReadMultipleVariable
+		p.RUnlock()
+		if n >= 2 && !noReadMultipleVariable {
+			hs := make([]uint16, n)
+			for j, c := range cs[i : i+n] {
+				hs[j] = c.ValueHandle
+			}
+			var truncated bool
+			var err error
+			values, truncated, err = ac.ReadMultipleVariable(hs)
+			if err == ble.ErrReqNotSupp {
+				p.Lock()
+				p.noReadMultipleVariable = true
+				p.Unlock()
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if truncated {
+				last := len(values) - 1
+				if values[last], err = p.readRest(ac, hs[last], append([]byte(nil), values[last]...)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if len(values) == 0 {
+			// A single value, or none of the values fit in a response.
+			v, err := p.readLong(ac, cs[i].ValueHandle)
+			if err != nil {
+				return nil, err
+			}
+			values = [][]byte{v}
+		}
+		p.Lock()
+		for j, v := range values {
+			v = append([]byte(nil), v...)
+			cs[i+j].Value = v
+			vs[i+j] = v
+		}
+		p.Unlock()
+		i += len(values)
+	}
+	return vs, nil
+}
+
+// ReadMultiple reads the values of several characteristics, which have fixed
+// lengths except the last one, in a single Read Multiple Request. It returns
+// the concatenation of the values, which is truncated to fit in the MTU.
+// [Vol 3, Part G, 4.8.4]
+func (p *Client) ReadMultiple(cs ...*ble.Characteristic) ([]byte, error) {
+	return p.ReadMultipleContext(context.Background(), cs...)
+}
+
+// ReadMultipleContext is like ReadMultiple, but gives up once ctx is done.
+func (p *Client) ReadMultipleContext(ctx context.Context, cs ...*ble.Characteristic) ([]byte, error) {
+	ac := p.ac.WithContext(ctx)
+	hs := make([]uint16, len(cs))
+	for i, c := range cs {
+		hs[i] = c.ValueHandle
+	}
+	return ac.ReadMultiple(hs)
 }
 
 // WriteCharacteristic writes a characteristic value to a server. [Vol 3, Part G, 4.9.3]
+// Without response, the value is signed if the characteristic supports signed
+// writes and the link is not encrypted [Vol 3, Part G, 4.9.2]. It's written
+// unsigned, if no CSRK was distributed, and the characteristic supports writes
+// without response.
+// With response, values longer than the MTU are written with prepared writes.
 func (p *Client) WriteCharacteristic(c *ble.Characteristic, v []byte, noRsp bool) error {
-	p.Lock()
-	defer p.Unlock()
+	return p.WriteCharacteristicContext(context.Background(), c, v, noRsp)
+}
+
+// WriteCharacteristicContext is like WriteCharacteristic, but gives up once ctx is done.
+func (p *Client) WriteCharacteristicContext(ctx context.Context, c *ble.Characteristic, v []byte, noRsp bool) error {
+	ac := p.ac.WithContext(ctx)
+	if noRsp && c.Property&ble.CharSignedWrite != 0 {
+		if sc, ok := p.conn.(ble.SecureConn); ok && sc.EncryptionKeySize() == 0 {
+			err := ac.SignedWrite(c.ValueHandle, v)
+			if err != ble.ErrNoCSRK || c.Property&ble.CharWriteNR == 0 {
+				return err
+			}
+		}
+	}
 	if noRsp {
-		return p.ac.WriteCommand(c.ValueHandle, v)
+		return ac.WriteCommand(c.ValueHandle, v)
+	}
+	if len(v) > p.conn.TxMTU()-3 {
+		return ac.WriteQueued([]att.QueuedWrite{{Handle: c.ValueHandle, Value: v}}, false)
+	}
+	return ac.Write(c.ValueHandle, v)
+}
+
+// WriteLongCharacteristic writes a characteristic value, which is longer than
+// the MTU, with prepared writes. If reliable is set, each part echoed by the
+// server is verified before the value is written. [Vol 3, Part G, 4.9.4 & 4.9.5]
+func (p *Client) WriteLongCharacteristic(c *ble.Characteristic, v []byte, reliable bool) error {
+	return p.WriteLongCharacteristicContext(context.Background(), c, v, reliable)
+}
+
+// WriteLongCharacteristicContext is like WriteLongCharacteristic, but gives up once ctx is done.
+func (p *Client) WriteLongCharacteristicContext(ctx context.Context, c *ble.Characteristic, v []byte, reliable bool) error {
+	return p.ac.WithContext(ctx).WriteQueued([]att.QueuedWrite{{Handle: c.ValueHandle, Value: v}}, reliable)
+}
+
+// ReliableWrite writes the values vs of the characteristics cs atomically, with
+// prepared writes. Each part echoed by the server is verified, and none of the
+// values is written on a mismatch. [Vol 3, Part G, 4.9.5]
+func (p *Client) ReliableWrite(cs []*ble.Characteristic, vs [][]byte) error {
+	return p.ReliableWriteContext(context.Background(), cs, vs)
+}
+
+// ReliableWriteContext is like ReliableWrite, but gives up once ctx is done.
+func (p *Client) ReliableWriteContext(ctx context.Context, cs []*ble.Characteristic, vs [][]byte) error {
+	ac := p.ac.WithContext(ctx)
+	if len(cs) != len(vs) {
+		return fmt.Errorf("%d characteristics, but %d values", len(cs), len(vs))
 	}
-	return p.ac.Write(c.ValueHandle, v)
+	ws := make([]att.QueuedWrite, len(cs))
+	for i, c := range cs {
+		ws[i] = att.QueuedWrite{Handle: c.ValueHandle, Value: vs[i]}
+	}
+	return ac.WriteQueued(ws, true)
 }
 
 // ReadDescriptor reads a characteristic descriptor from a server. [Vol 3, Part G, 4.12.1]
 func (p *Client) ReadDescriptor(d *ble.Descriptor) ([]byte, error) {
-	p.Lock()
-	defer p.Unlock()
-	val, err := p.ac.Read(d.Handle)
+	return p.ReadDescriptorContext(context.Background(), d)
+}
+
+// ReadDescriptorContext is like ReadDescriptor, but gives up once ctx is done.
+func (p *Client) ReadDescriptorContext(ctx context.Context, d *ble.Descriptor) ([]byte, error) {
+	val, err := p.ac.WithContext(ctx).Read(d.Handle)
 	if err != nil {
 		return nil, err
 	}
-
+	p.Lock()
 	d.Value = val
+	p.Unlock()
 	return val, nil
 }
 
 // WriteDescriptor writes a characteristic descriptor to a server. [Vol 3, Part G, 4.12.3]
+// Values longer than the MTU are written with prepared writes.
 func (p *Client) WriteDescriptor(d *ble.Descriptor, v []byte) error {
-	p.Lock()
-	defer p.Unlock()
-	return p.ac.Write(d.Handle, v)
+	return p.WriteDescriptorContext(context.Background(), d, v)
+}
+
+// WriteDescriptorContext is like WriteDescriptor, but gives up once ctx is done.
+func (p *Client) WriteDescriptorContext(ctx context.Context, d *ble.Descriptor, v []byte) error {
+	ac := p.ac.WithContext(ctx)
+	if len(v) > p.conn.TxMTU()-3 {
+		return ac.WriteQueued([]att.QueuedWrite{{Handle: d.Handle, Value: v}}, false)
+	}
+	return ac.Write(d.Handle, v)
+}
+
+// WriteLongDescriptor writes a characteristic descriptor, which is longer than
+// the MTU, with prepared writes. [Vol 3, Part G, 4.12.4]
+func (p *Client) WriteLongDescriptor(d *ble.Descriptor, v []byte) error {
+	return p.WriteLongDescriptorContext(context.Background(), d, v)
+}
+
+// WriteLongDescriptorContext is like WriteLongDescriptor, but gives up once ctx is done.
+func (p *Client) WriteLongDescriptorContext(ctx context.Context, d *ble.Descriptor, v []byte) error {
+	return p.ac.WithContext(ctx).WriteQueued([]att.QueuedWrite{{Handle: d.Handle, Value: v}}, false)
 }
 
 // ReadRSSI retrieves the current RSSI value of remote peripheral. [Vol 2, Part E, 7.5.4]
 func (p *Client) ReadRSSI() int {
-	p.Lock()
-	defer p.Unlock()
 	return p.conn.ReadRSSI()
 }
 
 // ExchangeMTU informs the server of the client’s maximum receive MTU size and
 // request the server to respond with its maximum receive MTU size. [Vol 3, Part F, 3.4.2.1]
 func (p *Client) ExchangeMTU(mtu int) (int, error) {
-	p.Lock()
-	defer p.Unlock()
-	return p.ac.ExchangeMTU(mtu)
+	return p.ExchangeMTUContext(context.Background(), mtu)
+}
+
+// ExchangeMTUContext is like ExchangeMTU, but gives up once ctx is done.
+func (p *Client) ExchangeMTUContext(ctx context.Context, mtu int) (int, error) {
+	return p.ac.WithContext(ctx).ExchangeMTU(mtu)
 }
 
 // Subscribe subscribes to indication (if ind is set true), or notification of a
 // characteristic value. [Vol 3, Part G, 4.10 & 4.11]
 func (p *Client) Subscribe(c *ble.Characteristic, ind bool, h ble.NotificationHandler) error {
-	p.Lock()
-	defer p.Unlock()
+	return p.SubscribeContext(context.Background(), c, ind, h)
+}
+
+// SubscribeContext is like Subscribe, but gives up once ctx is done.
+func (p *Client) SubscribeContext(ctx context.Context, c *ble.Characteristic, ind bool, h ble.NotificationHandler) error {
+	ac := p.ac.WithContext(ctx)
 	if c.CCCD == nil {
 		return fmt.Errorf("CCCD not found")
 	}
 	if ind {
-		return p.setHandlers(c.CCCD.Handle, c.ValueHandle, cccIndicate, h)
+		return p.setHandlers(ac, c.CCCD.Handle, c.ValueHandle, cccIndicate, h)
 	}
-	return p.setHandlers(c.CCCD.Handle, c.ValueHandle, cccNotify, h)
+	return p.setHandlers(ac, c.CCCD.Handle, c.ValueHandle, cccNotify, h)
 }
 
 // Unsubscribe unsubscribes to indication (if ind is set true), or notification
 // of a specified characteristic value. [Vol 3, Part G, 4.10 & 4.11]
 func (p *Client) Unsubscribe(c *ble.Characteristic, ind bool) error {
-	p.Lock()
-	defer p.Unlock()
+	return p.UnsubscribeContext(context.Background(), c, ind)
+}
+
+// UnsubscribeContext is like Unsubscribe, but gives up once ctx is done.
+func (p *Client) UnsubscribeContext(ctx context.Context, c *ble.Characteristic, ind bool) error {
+	ac := p.ac.WithContext(ctx)
 	if c.CCCD == nil {
 		return fmt.Errorf("CCCD not found")
 	}
 	if ind {
-		return p.setHandlers(c.CCCD.Handle, c.ValueHandle, cccIndicate, nil)
+		return p.setHandlers(ac, c.CCCD.Handle, c.ValueHandle, cccIndicate, nil)
 	}
-	return p.setHandlers(c.CCCD.Handle, c.ValueHandle, cccNotify, nil)
+	return p.setHandlers(ac, c.CCCD.Handle, c.ValueHandle, cccNotify, nil)
 }
 
-func (p *Client) setHandlers(cccdh, vh, flag uint16, h ble.NotificationHandler) error {
+// setHandlers sets the handler of the notifications or the indications of the
+// value with handle vh, and writes its CCCD, if the subscription changed.
+func (p *Client) setHandlers(ac *att.Client, cccdh, vh, flag uint16, h ble.NotificationHandler) error {
+	p.muSubs.Lock()
+	defer p.muSubs.Unlock()
+	p.Lock()
 	s, ok := p.subs[vh]
 	if !ok {
 		s = &sub{cccdh, 0x0000, nil, nil}
@@ -323,8 +872,10 @@ func (p *Client) setHandlers(cccdh, vh, flag uint16, h ble.NotificationHandler)
 	}
 	switch {
 	case h == nil && (s.ccc&flag) == 0:
+		p.Unlock()
 		return nil
 	case h != nil && (s.ccc&flag) != 0:
+		p.Unlock()
 		return nil
 	case h == nil && (s.ccc&flag) != 0:
 		s.ccc &= ^uint16(flag)
@@ -339,19 +890,35 @@ func (p *Client) setHandlers(cccdh, vh, flag uint16, h ble.NotificationHandler)
 	} else {
 		s.iHandler = h
 	}
-	return p.ac.Write(s.cccdh, v)
+	cccdh = s.cccdh
+	p.Unlock()
+	return ac.Write(cccdh, v)
 }
 
 // ClearSubscriptions clears all subscriptions to notifications and indications.
 func (p *Client) ClearSubscriptions() error {
-	p.Lock()
-	defer p.Unlock()
-	zero := make([]byte, 2)
+	return p.ClearSubscriptionsContext(context.Background())
+}
+
+// ClearSubscriptionsContext is like ClearSubscriptions, but gives up once ctx is done.
+func (p *Client) ClearSubscriptionsContext(ctx context.Context) error {
+	ac := p.ac.WithContext(ctx)
+	p.muSubs.Lock()
+	defer p.muSubs.Unlock()
+	p.RLock()
+	cccdhs := make(map[uint16]uint16, len(p.subs))
 	for vh, s := range p.subs {
-		if err := p.ac.Write(s.cccdh, zero); err != nil {
+		cccdhs[vh] = s.cccdh
+	}
+	p.RUnlock()
+	zero := make([]byte, 2)
+	for vh, cccdh := range cccdhs {
+		if err := ac.Write(cccdh, zero); err != nil {
 			return err
 		}
+		p.Lock()
 		delete(p.subs, vh)
+		p.Unlock()
 	}
 	return nil
 }
@@ -375,13 +942,47 @@ func (p *Client) Conn() ble.Conn {
 	return p.conn
 }
 
+// AddBearer adds an Enhanced ATT bearer, which the client runs requests on
+// concurrently with the other bearers.
+func (p *Client) AddBearer(b att.Bearer) error {
+	return p.ac.AddBearer(b)
+}
+
+// ReadMultipleVariable reads the values of several characteristics at once,
+// in a single Read Multiple Variable Request. Only the values that fit in the
+// response are returned; the last of them is read to its end, if it's
+// truncated. [Vol 3, Part G, 4.8.5]
+func (p *Client) ReadMultipleVariable(cs ...*ble.Characteristic) ([][]byte, error) {
+	return p.ReadMultipleVariableContext(context.Background(), cs...)
+}
+
+// ReadMultipleVariableContext is like ReadMultipleVariable, but gives up once ctx is done.
+func (p *Client) ReadMultipleVariableContext(ctx context.Context, cs ...*ble.Characteristic) ([][]byte, error) {
+	ac := p.ac.WithContext(ctx)
+	hs := make([]uint16, len(cs))
+	for i, c := range cs {
+		hs[i] = c.ValueHandle
+	}
+	values, truncated, err := ac.ReadMultipleVariable(hs)
+	if err != nil {
+		return nil, err
+	}
+	if truncated {
+		last := len(values) - 1
+		if values[last], err = p.readRest(ac, hs[last], append([]byte(nil), values[last]...)); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
 // HandleNotification ...
 func (p *Client) HandleNotification(req []byte) {
-	p.Lock()
-	defer p.Unlock()
 	vh := att.HandleValueIndication(req).AttributeHandle()
+	p.RLock()
 	sub, ok := p.subs[vh]
 	if !ok {
+		p.RUnlock()
 		// FIXME: disconnects and propagate an error to the user.
 		log.Printf("Got an unregistered notification")
 		return
@@ -390,6 +991,7 @@ func (p *Client) HandleNotification(req []byte) {
 	if req[0] == att.HandleValueIndicationCode {
 		fn = sub.iHandler
 	}
+	p.RUnlock()
 	if fn != nil {
 		fn(req[3:])
 	}
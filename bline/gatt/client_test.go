@@ -0,0 +1,414 @@
+package gatt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"testing"
+
+	ble "traulfs/Bline/ble"
+	"traulfs/Bline/ble/bline/att"
+)
+
+// testConn is an end of a connection between a client and a server under
+// test. The PDUs written to it are read from the other end, and logged.
+type testConn struct {
+	ctx    context.Context
+	rx     <-chan []byte
+	tx     chan<- []byte
+	closed chan struct{}
+	once   *sync.Once
+	mtu    int
+
+	mu   sync.Mutex
+	pdus [][]byte
+}
+
+// newTestConns returns the two ends of a connection.
+func newTestConns() (*testConn, *testConn) {
+	a, b := make(chan []byte, 16), make(chan []byte, 16)
+	closed := make(chan struct{})
+	once := &sync.Once{}
+	return &testConn{ctx: context.Background(), rx: a, tx: b, closed: closed, once: once, mtu: ble.DefaultMTU},
+		&testConn{ctx: context.Background(), rx: b, tx: a, closed: closed, once: once, mtu: ble.DefaultMTU}
+}
+
+func (c *testConn) Read(b []byte) (int, error) {
+	select {
+	case p := <-c.rx:
+		return copy(b, p), nil
+	case <-c.closed:
+		return 0, io.EOF
+	}
+}
+
+func (c *testConn) Write(b []byte) (int, error) {
+	p := append([]byte(nil), b...)
+	c.mu.Lock()
+	c.pdus = append(c.pdus, p)
+	c.mu.Unlock()
+	select {
+	case c.tx <- p:
+		return len(b), nil
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (c *testConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *testConn) Context() context.Context       { return c.ctx }
+func (c *testConn) SetContext(ctx context.Context) { c.ctx = ctx }
+func (c *testConn) LocalAddr() ble.Addr            { return ble.NewAddr("00:00:00:00:00:01") }
+func (c *testConn) RemoteAddr() ble.Addr           { return ble.NewAddr("00:00:00:00:00:02") }
+func (c *testConn) RxMTU() int                     { return c.mtu }
+func (c *testConn) SetRxMTU(mtu int)               {}
+func (c *testConn) TxMTU() int                     { return c.mtu }
+func (c *testConn) SetTxMTU(mtu int)               {}
+func (c *testConn) ReadRSSI() int                  { return 0 }
+func (c *testConn) Disconnected() <-chan struct{}  { return c.closed }
+
+// opcodes returns the opcodes of the PDUs written, and clears the log.
+func (c *testConn) opcodes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ops := make([]byte, len(c.pdus))
+	for i, p := range c.pdus {
+		ops[i] = p[0]
+	}
+	c.pdus = nil
+	return ops
+}
+
+// newTestClient returns a client of an ATT server of the services ss, and
+// its end of the connection.
+func newTestClient(t *testing.T, ss ...*ble.Service) (*Client, *testConn) {
+	t.Helper()
+	cc, sc := newTestConns()
+	s, err := att.NewServer(att.NewDB(ss, 1), sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Loop()
+	return newClient(t, cc), cc
+}
+
+// newScriptedClient returns a client of a server, which answers each request
+// with serve.
+func newScriptedClient(t *testing.T, serve func(req []byte) []byte) (*Client, *testConn) {
+	t.Helper()
+	cc, sc := newTestConns()
+	go func() {
+		b := make([]byte, ble.MaxMTU)
+		for {
+			n, err := sc.Read(b)
+			if err != nil {
+				return
+			}
+			if rsp := serve(b[:n]); rsp != nil {
+				sc.Write(rsp)
+			}
+		}
+	}()
+	return newClient(t, cc), cc
+}
+
+func newClient(t *testing.T, cc *testConn) *Client {
+	t.Helper()
+	p, err := NewClient(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return p
+}
+
+func errorResponse(op byte, h uint16, e ble.ATTError) []byte {
+	return []byte{att.ErrorResponseCode, op, byte(h), byte(h >> 8), byte(e)}
+}
+
+func TestDiscoverServicesByUUID(t *testing.T) {
+	hrs := ble.NewService(ble.UUID16(0x180D))
+	bas := ble.NewService(ble.UUID16(0x180F))
+	hrs2 := ble.NewService(ble.UUID16(0x180D))
+	hrs2.NewCharacteristic(ble.UUID16(0x2A37)).SetValue([]byte{0x00})
+	p, cc := newTestClient(t, hrs, bas, hrs2)
+
+	ss, err := p.DiscoverServices([]ble.UUID{ble.UUID16(0x180D)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != 2 || ss[0].Handle != 0x0001 || ss[0].EndHandle != 0x0001 || ss[1].Handle != 0x0003 || ss[1].EndHandle != 0x0005 {
+		t.Fatalf("got %+v, want the services 0x0001-0x0001 and 0x0003-0x0005", ss)
+	}
+	for _, op := range cc.opcodes() {
+		if op != att.FindByTypeValueRequestCode {
+			t.Errorf("got request 0x%02X, want Find By Type Value Requests only", op)
+		}
+	}
+
+	// A service found earlier isn't discovered again.
+	s, err := p.FindService(ble.UUID16(0x180D))
+	if err != nil || s != ss[0] {
+		t.Errorf("FindService: got %v, %v, want the discovered service", s, err)
+	}
+	if ops := cc.opcodes(); len(ops) != 0 {
+		t.Errorf("FindService: sent % X, want nothing", ops)
+	}
+	if _, err := p.FindService(ble.UUID16(0x1811)); err != ble.ErrAttrNotFound {
+		t.Errorf("FindService of a missing service: got %v, want %v", err, ble.ErrAttrNotFound)
+	}
+}
+
+func TestDiscoverIncludedServices(t *testing.T) {
+	uuid128 := ble.MustParse("6e400001-b5a3-f393-e0a9-e50e24dcca9e")
+	p, _ := newScriptedClient(t, func(req []byte) []byte {
+		switch req[0] {
+		case att.ReadByTypeRequestCode:
+			start := binary.LittleEndian.Uint16(req[1:])
+			switch {
+			case start <= 0x0002:
+				// An include declaration with a 16-bit UUID.
+				return []byte{att.ReadByTypeResponseCode, 8, 0x02, 0x00, 0x10, 0x00, 0x12, 0x00, 0x0F, 0x18}
+			case start <= 0x0003:
+				// An include declaration, which leaves out a 128-bit UUID.
+				return []byte{att.ReadByTypeResponseCode, 6, 0x03, 0x00, 0x20, 0x00, 0x24, 0x00}
+			}
+			return errorResponse(req[0], start, ble.ErrAttrNotFound)
+		case att.ReadRequestCode:
+			if h := binary.LittleEndian.Uint16(req[1:]); h != 0x0020 {
+				return errorResponse(req[0], h, ble.ErrInvalidHandle)
+			}
+			return append([]byte{att.ReadResponseCode}, uuid128...)
+		}
+		return errorResponse(req[0], 0x0000, ble.ErrReqNotSupp)
+	})
+
+	s := &ble.Service{UUID: ble.UUID16(0x180D), Handle: 0x0001, EndHandle: 0x0008}
+	ss, err := p.DiscoverIncludedServices(nil, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*ble.Service{
+		{UUID: ble.UUID16(0x180F), Handle: 0x0010, EndHandle: 0x0012},
+		{UUID: uuid128, Handle: 0x0020, EndHandle: 0x0024},
+	}
+	equalServices(t, ss, want)
+	equalServices(t, s.IncludedServices, want)
+
+	// The filter doesn't change the included services of s.
+	ss, err = p.DiscoverIncludedServices([]ble.UUID{uuid128}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	equalServices(t, ss, want[1:])
+	if len(s.IncludedServices) != 2 {
+		t.Errorf("got %d included services, want 2", len(s.IncludedServices))
+	}
+}
+
+func TestDiscoverServicesWrap(t *testing.T) {
+	// The last service ends at 0xFFFF, which ends the discovery.
+	var reqs int
+	p, _ := newScriptedClient(t, func(req []byte) []byte {
+		reqs++
+		if req[0] != att.ReadByGroupTypeRequestCode || reqs > 1 {
+			return errorResponse(req[0], 0x0000, ble.ErrUnlikely)
+		}
+		return []byte{att.ReadByGroupTypeResponseCode, 6, 0x01, 0x00, 0xFF, 0xFF, 0x0D, 0x18}
+	})
+	ss, err := p.DiscoverServices(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	equalServices(t, ss, []*ble.Service{{UUID: ble.UUID16(0x180D), Handle: 0x0001, EndHandle: 0xFFFF}})
+}
+
+// testServices returns two services, whose attributes are:
+//
+//	0x0001 0x180D: 0x0003 0x2A37 (CCCD 0x0004), 0x0006 0x2A38
+//	0x0007 0x180F: 0x0009 0x2A19 (CCCD 0x000A)
+func testServices() []*ble.Service {
+	notify := ble.NotifyHandlerFunc(func(req ble.Request, n ble.Notifier) {})
+	hrs := ble.NewService(ble.UUID16(0x180D))
+	hrs.NewCharacteristic(ble.UUID16(0x2A37)).HandleNotify(notify)
+	hrs.NewCharacteristic(ble.UUID16(0x2A38)).SetValue([]byte{0x01})
+	bas := ble.NewService(ble.UUID16(0x180F))
+	c := bas.NewCharacteristic(ble.UUID16(0x2A19))
+	c.HandleRead(ble.ReadHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) { rsp.Write([]byte{100}) }))
+	c.HandleNotify(notify)
+	return []*ble.Service{hrs, bas}
+}
+
+func TestFindCharacteristic(t *testing.T) {
+	p, cc := newTestClient(t, testServices()...)
+
+	// Only the service of the characteristic is discovered.
+	c, err := p.FindCharacteristic(ble.UUID16(0x180F), ble.UUID16(0x2A19))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ValueHandle != 0x0009 || c.CCCD == nil || c.CCCD.Handle != 0x000A {
+		t.Errorf("got %+v, want the value handle 0x0009 and the CCCD 0x000A", c)
+	}
+	for _, op := range cc.opcodes() {
+		if op == att.ReadByGroupTypeRequestCode {
+			t.Error("all the services were discovered")
+		}
+	}
+	if n := len(p.Profile().Services); n != 1 {
+		t.Errorf("got %d services in the profile, want 1", n)
+	}
+
+	// A characteristic found earlier isn't discovered again.
+	if c2, err := p.FindCharacteristic(ble.UUID16(0x180F), ble.UUID16(0x2A19)); err != nil || c2 != c {
+		t.Errorf("FindCharacteristic: got %v, %v, want the discovered characteristic", c2, err)
+	}
+	if ops := cc.opcodes(); len(ops) != 0 {
+		t.Errorf("FindCharacteristic: sent % X, want nothing", ops)
+	}
+
+	// Without a service, each one is searched.
+	c, err = p.FindCharacteristic(nil, ble.UUID16(0x2A38))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ValueHandle != 0x0006 || c.EndHandle != 0x0006 || len(c.Descriptors) != 0 {
+		t.Errorf("got %+v, want the value handle 0x0006 without descriptors", c)
+	}
+	if _, err := p.FindCharacteristic(nil, ble.UUID16(0x2A00)); err != ble.ErrAttrNotFound {
+		t.Errorf("FindCharacteristic of a missing characteristic: got %v, want %v", err, ble.ErrAttrNotFound)
+	}
+}
+
+func TestDiscoverCharacteristics(t *testing.T) {
+	p, _ := newTestClient(t, testServices()...)
+	ss, err := p.DiscoverServices(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := ss[0]
+
+	cs, err := p.DiscoverCharacteristics([]ble.UUID{ble.UUID16(0x2A38)}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 1 || len(s.Characteristics) != 1 {
+		t.Fatalf("got %d characteristics, %d in the service, want 1", len(cs), len(s.Characteristics))
+	}
+	filtered := cs[0]
+
+	// The characteristics are discovered once, with their end handles.
+	cs, err = p.DiscoverCharacteristics(nil, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 2 || len(s.Characteristics) != 2 {
+		t.Fatalf("got %d characteristics, %d in the service, want 2", len(cs), len(s.Characteristics))
+	}
+	for _, tc := range []struct {
+		c          *ble.Characteristic
+		uuid       ble.UUID
+		h, vh, end uint16
+	}{
+		{cs[0], ble.UUID16(0x2A37), 0x0002, 0x0003, 0x0004},
+		{cs[1], ble.UUID16(0x2A38), 0x0005, 0x0006, 0x0006},
+	} {
+		if !tc.c.UUID.Equal(tc.uuid) || tc.c.Handle != tc.h || tc.c.ValueHandle != tc.vh || tc.c.EndHandle != tc.end {
+			t.Errorf("got %s 0x%04X 0x%04X-0x%04X, want %s 0x%04X 0x%04X-0x%04X",
+				tc.c.UUID, tc.c.Handle, tc.c.ValueHandle, tc.c.EndHandle, tc.uuid, tc.h, tc.vh, tc.end)
+		}
+	}
+	if cs[1] != filtered {
+		t.Error("the characteristic discovered earlier was replaced")
+	}
+
+	ds, err := p.DiscoverDescriptors(nil, cs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 1 || cs[0].CCCD != ds[0] || ds[0].Handle != 0x0004 {
+		t.Errorf("got descriptors %+v, want the CCCD 0x0004", ds)
+	}
+}
+
+// valueService returns a service with characteristics of the static values vs,
+// and the characteristics of a client, which read them.
+func valueService(vs ...[]byte) (*ble.Service, func() []*ble.Characteristic) {
+	svc := ble.NewService(ble.UUID16(0x180A))
+	for i, v := range vs {
+		svc.NewCharacteristic(ble.UUID16(0x2A24 + uint16(i))).SetValue(v)
+	}
+	return svc, func() []*ble.Characteristic {
+		var cs []*ble.Characteristic
+		for _, c := range svc.Characteristics {
+			cs = append(cs, &ble.Characteristic{UUID: c.UUID, ValueHandle: c.ValueHandle})
+		}
+		return cs
+	}
+}
+
+func TestReadCharacteristics(t *testing.T) {
+	long := bytes.Repeat([]byte{0x55}, 30)
+	for _, tc := range []struct {
+		name   string
+		values [][]byte
+		ops    []byte
+	}{
+		{"batched", [][]byte{{0x01}, {0x02, 0x03}, {0x04}}, []byte{att.ReadMultipleVariableRequestCode}},
+		{"single", [][]byte{{0x01}}, []byte{att.ReadRequestCode}},
+		{"truncated", [][]byte{{0x01}, long, {0x02}},
+			[]byte{att.ReadMultipleVariableRequestCode, att.ReadBlobRequestCode, att.ReadRequestCode}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, chars := valueService(tc.values...)
+			p, cc := newTestClient(t, svc)
+			cs := chars()
+			vs, err := p.ReadCharacteristics(cs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range tc.values {
+				if !bytes.Equal(vs[i], want) || !bytes.Equal(cs[i].Value, want) {
+					t.Errorf("%s: got % X, value % X, want % X", cs[i].UUID, vs[i], cs[i].Value, want)
+				}
+			}
+			if ops := cc.opcodes(); !bytes.Equal(ops, tc.ops) {
+				t.Errorf("sent % X, want % X", ops, tc.ops)
+			}
+		})
+	}
+}
+
+// TestReadCharacteristicsFallback checks that the values are read one at a
+// time from a server, which doesn't support Read Multiple Variable.
+func TestReadCharacteristicsFallback(t *testing.T) {
+	p, cc := newScriptedClient(t, func(req []byte) []byte {
+		if req[0] != att.ReadRequestCode {
+			return errorResponse(req[0], 0x0000, ble.ErrReqNotSupp)
+		}
+		return []byte{att.ReadResponseCode, req[1]}
+	})
+	cs := []*ble.Characteristic{{ValueHandle: 0x0003}, {ValueHandle: 0x0005}}
+
+	for _, want := range [][]byte{
+		{att.ReadMultipleVariableRequestCode, att.ReadRequestCode, att.ReadRequestCode},
+		{att.ReadRequestCode, att.ReadRequestCode}, // The lack of support is remembered.
+	} {
+		vs, err := p.ReadCharacteristics(cs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(vs[0], []byte{0x03}) || !bytes.Equal(vs[1], []byte{0x05}) {
+			t.Errorf("got % X, want 03 and 05", vs)
+		}
+		if ops := cc.opcodes(); !bytes.Equal(ops, want) {
+			t.Errorf("sent % X, want % X", ops, want)
+		}
+	}
+}
@@ -0,0 +1,771 @@
+package gatt
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	ble "traulfs/Bline/ble"
+)
+
+// ErrNotConnected is returned by a ReconnectingClient, while it reconnects.
+var ErrNotConnected = errors.New("not connected")
+
+// ConnState is the state of the link of a ReconnectingClient.
+type ConnState int
+
+// States of the link of a ReconnectingClient.
+const (
+	StateConnected    ConnState = iota // The link is up, and the subscriptions are restored.
+	StateDisconnected                  // The link dropped.
+	StateReconnecting                  // A dial failed; it's retried after a backoff.
+	StateClosed                        // The client gave up, or was canceled.
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// DialFunc dials a device, e.g. ble.Dial or the Dial method of a device.
+type DialFunc func(ctx context.Context, a ble.Addr) (ble.Client, error)
+
+// ReconnectOptions configures a ReconnectingClient.
+type ReconnectOptions struct {
+	// Rediscover discovers the profile again on each reconnection, instead of
+	// reusing the profile discovered on an earlier connection.
+	Rediscover bool
+
+	// MinBackoff and MaxBackoff bound the delay between failed dials, which
+	// doubles on each failure. They default to 1s and 1m.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// StateHandler is called on the changes of state of the link, with the
+	// error which caused the change, if any.
+	StateHandler func(s ConnState, err error)
+}
+
+// ReconnectingClient is a GATT client, which redials its device when the link
+// drops, and restores the profile and the subscriptions of the previous link.
+// Its methods return ErrNotConnected while the link is down.
+type ReconnectingClient struct {
+	addr ble.Addr
+	dial DialFunc
+	opts ReconnectOptions
+
+	mu  sync.RWMutex
+	cln *Client // nil while the link is down.
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewReconnectingClient dials the device with address a, and keeps the client
+// connected until ctx is done, or CancelConnection is called.
+func NewReconnectingClient(ctx context.Context, a ble.Addr, dial DialFunc, opts ReconnectOptions) (*ReconnectingClient, error) {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = time.Second
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = time.Minute
+	}
+	cln, err := dialClient(ctx, a, dial)
+	if err != nil {
+		return nil, err
+	}
+	r := &ReconnectingClient{
+		addr: a,
+		dial: dial,
+		opts: opts,
+		cln:  cln,
+		done: make(chan struct{}),
+	}
+	r.ctx, r.cancel = context.WithCancel(ctx)
+	go r.loop(cln)
+	r.setState(StateConnected, nil)
+	return r, nil
+}
+
+func dialClient(ctx context.Context, a ble.Addr, dial DialFunc) (*Client, error) {
+	c, err := dial(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+	cln, ok := c.(*Client)
+	if !ok {
+		c.CancelConnection()
+		return nil, errors.New("not a GATT client")
+	}
+	return cln, nil
+}
+
+func (r *ReconnectingClient) setState(s ConnState, err error) {
+	if r.opts.StateHandler != nil {
+		r.opts.StateHandler(s, err)
+	}
+}
+
+// loop redials the device, whenever the link drops.
+func (r *ReconnectingClient) loop(cln *Client) {
+	defer close(r.done)
+	for {
+		select {
+		case <-cln.Disconnected():
+		case <-r.ctx.Done():
+			cln.CancelConnection()
+			r.setState(StateClosed, r.ctx.Err())
+			return
+		}
+		r.mu.Lock()
+		r.cln = nil
+		r.mu.Unlock()
+		r.setState(StateDisconnected, nil)
+
+		next, err := r.reconnect(cln)
+		if err != nil {
+			r.setState(StateClosed, err)
+			return
+		}
+		r.mu.Lock()
+		r.cln = next
+		r.mu.Unlock()
+		r.setState(StateConnected, nil)
+		cln = next
+	}
+}
+
+// reconnect dials the device until it's connected, and restores the state of
+// the previous client. It only fails once the context is done.
+func (r *ReconnectingClient) reconnect(prev *Client) (*Client, error) {
+	backoff := r.opts.MinBackoff
+	for {
+		cln, err := dialClient(r.ctx, r.addr, r.dial)
+		if err == nil {
+			if err = r.restore(prev, cln); err == nil {
+				return cln, nil
+			}
+			cln.CancelConnection()
+		}
+		if r.ctx.Err() != nil {
+			return nil, r.ctx.Err()
+		}
+		r.setState(StateReconnecting, err)
+		select {
+		case <-time.After(backoff):
+		case <-r.ctx.Done():
+			return nil, r.ctx.Err()
+		}
+		if backoff *= 2; backoff > r.opts.MaxBackoff {
+			backoff = r.opts.MaxBackoff
+		}
+	}
+}
+
+// restore reuses or rediscovers the profile of the previous client, and
+// re-enables its subscriptions on the new one. The subscriptions are moved to
+// the handles of the rediscovered profile, which may differ from the previous
+// ones.
+func (r *ReconnectingClient) restore(prev, cln *Client) error {
+	prev.Lock()
+	profile := prev.profile
+	allServices, allProfile := prev.allServices, prev.allProfile
+	subs := make(map[uint16]sub, len(prev.subs))
+	for vh, s := range prev.subs {
+		subs[vh] = *s
+	}
+	prev.Unlock()
+
+	next := profile
+	if profile != nil {
+		if r.opts.Rediscover {
+			var err error
+			if next, err = cln.DiscoverProfile(true); err != nil {
+				return err
+			}
+		} else {
+			cln.Lock()
+			cln.profile = profile
+			cln.allServices, cln.allProfile = allServices, allProfile
+			cln.Unlock()
+		}
+	}
+
+	for vh, s := range subs {
+		if profile != nil {
+			c := findByValueHandle(profile, vh)
+			if c != nil && c.UUID.Equal(ble.ServiceChangedUUID) {
+				// The new client watches Service Changed itself.
+				continue
+			}
+			if next != profile {
+				nc := remap(profile, next, c)
+				if nc == nil || nc.CCCD == nil {
+					log.Printf("gatt: subscription of handle 0x%04X not found in the rediscovered profile", vh)
+					continue
+				}
+				vh, s.cccdh = nc.ValueHandle, nc.CCCD.Handle
+			}
+		}
+		if s.ccc&cccNotify != 0 {
+			if err := cln.setHandlers(cln.ac, s.cccdh, vh, cccNotify, s.nHandler); err != nil {
+				return err
+			}
+		}
+		if s.ccc&cccIndicate != 0 {
+			if err := cln.setHandlers(cln.ac, s.cccdh, vh, cccIndicate, s.iHandler); err != nil {
+				return err
+			}
+		}
+	}
+	if profile != nil {
+		cln.watchServiceChanged(cln.ac)
+	}
+	return nil
+}
+
+// findByValueHandle returns the characteristic of p with value handle vh, if any.
+func findByValueHandle(p *ble.Profile, vh uint16) *ble.Characteristic {
+	for _, s := range p.Services {
+		for _, c := range s.Characteristics {
+			if c.ValueHandle == vh {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// remap returns the characteristic of the profile next, which matches c of
+// the profile prev. The characteristics are matched by the UUIDs of their
+// services and their own, and by their order among the services and the
+// characteristics with the same UUIDs.
+func remap(prev, next *ble.Profile, c *ble.Characteristic) *ble.Characteristic {
+	if c == nil {
+		return nil
+	}
+	svc, n := ordinal(prev, c)
+	if svc == nil {
+		return nil
+	}
+	for _, s := range next.Services {
+		if !s.UUID.Equal(svc.UUID) {
+			continue
+		}
+		for _, x := range s.Characteristics {
+			if !x.UUID.Equal(c.UUID) {
+				continue
+			}
+			if n == 0 {
+				return x
+			}
+			n--
+		}
+	}
+	return nil
+}
+
+// ordinal returns the service of c, and the number of the characteristics
+// with the UUID of c, which precede it in the services with the same UUID.
+func ordinal(p *ble.Profile, c *ble.Characteristic) (*ble.Service, int) {
+	for _, s := range p.Services {
+		for _, x := range s.Characteristics {
+			if x != c {
+				continue
+			}
+			n := 0
+			for _, s2 := range p.Services {
+				if !s2.UUID.Equal(s.UUID) {
+					continue
+				}
+				for _, x2 := range s2.Characteristics {
+					if x2 == c {
+						return s, n
+					}
+					if x2.UUID.Equal(c.UUID) {
+						n++
+					}
+				}
+			}
+		}
+	}
+	return nil, 0
+}
+
+// client returns the current client, or ErrNotConnected.
+func (r *ReconnectingClient) client() (*Client, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cln == nil {
+		return nil, ErrNotConnected
+	}
+	return r.cln, nil
+}
+
+// Addr returns the address of the device.
+func (r *ReconnectingClient) Addr() ble.Addr { return r.addr }
+
+// Name returns the name of the client.
+func (r *ReconnectingClient) Name() string {
+	cln, err := r.client()
+	if err != nil {
+		return ""
+	}
+	return cln.Name()
+}
+
+// Profile returns the discovered profile.
+func (r *ReconnectingClient) Profile() *ble.Profile {
+	cln, err := r.client()
+	if err != nil {
+		return nil
+	}
+	return cln.Profile()
+}
+
+// DiscoverProfile discovers the whole hierarchy of a server.
+func (r *ReconnectingClient) DiscoverProfile(force bool) (*ble.Profile, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.DiscoverProfile(force)
+}
+
+// DiscoverProfileContext is like DiscoverProfile, but gives up once ctx is done.
+func (r *ReconnectingClient) DiscoverProfileContext(ctx context.Context, force bool) (*ble.Profile, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.DiscoverProfileContext(ctx, force)
+}
+
+// FindService returns the primary service with UUID u.
+func (r *ReconnectingClient) FindService(u ble.UUID) (*ble.Service, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.FindService(u)
+}
+
+// FindServiceContext is like FindService, but gives up once ctx is done.
+func (r *ReconnectingClient) FindServiceContext(ctx context.Context, u ble.UUID) (*ble.Service, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.FindServiceContext(ctx, u)
+}
+
+// FindCharacteristic returns the characteristic with UUID u, within the
+// service with UUID svc, or within any service if svc is nil.
+func (r *ReconnectingClient) FindCharacteristic(svc, u ble.UUID) (*ble.Characteristic, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.FindCharacteristic(svc, u)
+}
+
+// FindCharacteristicContext is like FindCharacteristic, but gives up once ctx is done.
+func (r *ReconnectingClient) FindCharacteristicContext(ctx context.Context, svc, u ble.UUID) (*ble.Characteristic, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.FindCharacteristicContext(ctx, svc, u)
+}
+
+// DiscoverServices finds all the primary services on a server.
+func (r *ReconnectingClient) DiscoverServices(filter []ble.UUID) ([]*ble.Service, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.DiscoverServices(filter)
+}
+
+// DiscoverServicesContext is like DiscoverServices, but gives up once ctx is done.
+func (r *ReconnectingClient) DiscoverServicesContext(ctx context.Context, filter []ble.UUID) ([]*ble.Service, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.DiscoverServicesContext(ctx, filter)
+}
+
+// DiscoverIncludedServices finds the included services of a service.
+func (r *ReconnectingClient) DiscoverIncludedServices(filter []ble.UUID, s *ble.Service) ([]*ble.Service, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.DiscoverIncludedServices(filter, s)
+}
+
+// DiscoverIncludedServicesContext is like DiscoverIncludedServices, but gives up once ctx is done.
+func (r *ReconnectingClient) DiscoverIncludedServicesContext(ctx context.Context, filter []ble.UUID, s *ble.Service) ([]*ble.Service, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.DiscoverIncludedServicesContext(ctx, filter, s)
+}
+
+// DiscoverCharacteristics finds all the characteristics within a service.
+func (r *ReconnectingClient) DiscoverCharacteristics(filter []ble.UUID, s *ble.Service) ([]*ble.Characteristic, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.DiscoverCharacteristics(filter, s)
+}
+
+// DiscoverCharacteristicsContext is like DiscoverCharacteristics, but gives up once ctx is done.
+func (r *ReconnectingClient) DiscoverCharacteristicsContext(ctx context.Context, filter []ble.UUID, s *ble.Service) ([]*ble.Characteristic, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.DiscoverCharacteristicsContext(ctx, filter, s)
+}
+
+// DiscoverDescriptors finds all the descriptors within a characteristic.
+func (r *ReconnectingClient) DiscoverDescriptors(filter []ble.UUID, c *ble.Characteristic) ([]*ble.Descriptor, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.DiscoverDescriptors(filter, c)
+}
+
+// DiscoverDescriptorsContext is like DiscoverDescriptors, but gives up once ctx is done.
+func (r *ReconnectingClient) DiscoverDescriptorsContext(ctx context.Context, filter []ble.UUID, c *ble.Characteristic) ([]*ble.Descriptor, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.DiscoverDescriptorsContext(ctx, filter, c)
+}
+
+// ReadCharacteristic reads a characteristic value from a server.
+func (r *ReconnectingClient) ReadCharacteristic(c *ble.Characteristic) ([]byte, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.ReadCharacteristic(c)
+}
+
+// ReadCharacteristicContext is like ReadCharacteristic, but gives up once ctx is done.
+func (r *ReconnectingClient) ReadCharacteristicContext(ctx context.Context, c *ble.Characteristic) ([]byte, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.ReadCharacteristicContext(ctx, c)
+}
+
+// ReadLongCharacteristic reads a characteristic value which is longer than the MTU.
+func (r *ReconnectingClient) ReadLongCharacteristic(c *ble.Characteristic) ([]byte, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.ReadLongCharacteristic(c)
+}
+
+// ReadLongCharacteristicContext is like ReadLongCharacteristic, but gives up once ctx is done.
+func (r *ReconnectingClient) ReadLongCharacteristicContext(ctx context.Context, c *ble.Characteristic) ([]byte, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.ReadLongCharacteristicContext(ctx, c)
+}
+
+// ReadCharacteristics reads the values of several characteristics.
+func (r *ReconnectingClient) ReadCharacteristics(cs []*ble.Characteristic) ([][]byte, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.ReadCharacteristics(cs)
+}
+
+// ReadCharacteristicsContext is like ReadCharacteristics, but gives up once ctx is done.
+func (r *ReconnectingClient) ReadCharacteristicsContext(ctx context.Context, cs []*ble.Characteristic) ([][]byte, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.ReadCharacteristicsContext(ctx, cs)
+}
+
+// ReadMultiple reads the values of several characteristics in a single Read
+// Multiple Request, and returns their concatenation.
+func (r *ReconnectingClient) ReadMultiple(cs ...*ble.Characteristic) ([]byte, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.ReadMultiple(cs...)
+}
+
+// ReadMultipleContext is like ReadMultiple, but gives up once ctx is done.
+func (r *ReconnectingClient) ReadMultipleContext(ctx context.Context, cs ...*ble.Characteristic) ([]byte, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.ReadMultipleContext(ctx, cs...)
+}
+
+// ReadMultipleVariable reads the values of several characteristics in a
+// single Read Multiple Variable Request.
+func (r *ReconnectingClient) ReadMultipleVariable(cs ...*ble.Characteristic) ([][]byte, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.ReadMultipleVariable(cs...)
+}
+
+// ReadMultipleVariableContext is like ReadMultipleVariable, but gives up once ctx is done.
+func (r *ReconnectingClient) ReadMultipleVariableContext(ctx context.Context, cs ...*ble.Characteristic) ([][]byte, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.ReadMultipleVariableContext(ctx, cs...)
+}
+
+// WriteCharacteristic writes a characteristic value to a server.
+func (r *ReconnectingClient) WriteCharacteristic(c *ble.Characteristic, value []byte, noRsp bool) error {
+	cln, err := r.client()
+	if err != nil {
+		return err
+	}
+	return cln.WriteCharacteristic(c, value, noRsp)
+}
+
+// WriteCharacteristicContext is like WriteCharacteristic, but gives up once ctx is done.
+func (r *ReconnectingClient) WriteCharacteristicContext(ctx context.Context, c *ble.Characteristic, value []byte, noRsp bool) error {
+	cln, err := r.client()
+	if err != nil {
+		return err
+	}
+	return cln.WriteCharacteristicContext(ctx, c, value, noRsp)
+}
+
+// WriteLongCharacteristic writes a characteristic value, which is longer than the MTU.
+func (r *ReconnectingClient) WriteLongCharacteristic(c *ble.Characteristic, v []byte, reliable bool) error {
+	cln, err := r.client()
+	if err != nil {
+		return err
+	}
+	return cln.WriteLongCharacteristic(c, v, reliable)
+}
+
+// WriteLongCharacteristicContext is like WriteLongCharacteristic, but gives up once ctx is done.
+func (r *ReconnectingClient) WriteLongCharacteristicContext(ctx context.Context, c *ble.Characteristic, v []byte, reliable bool) error {
+	cln, err := r.client()
+	if err != nil {
+		return err
+	}
+	return cln.WriteLongCharacteristicContext(ctx, c, v, reliable)
+}
+
+// ReliableWrite writes the values of several characteristics atomically.
+func (r *ReconnectingClient) ReliableWrite(cs []*ble.Characteristic, vs [][]byte) error {
+	cln, err := r.client()
+	if err != nil {
+		return err
+	}
+	return cln.ReliableWrite(cs, vs)
+}
+
+// ReliableWriteContext is like ReliableWrite, but gives up once ctx is done.
+func (r *ReconnectingClient) ReliableWriteContext(ctx context.Context, cs []*ble.Characteristic, vs [][]byte) error {
+	cln, err := r.client()
+	if err != nil {
+		return err
+	}
+	return cln.ReliableWriteContext(ctx, cs, vs)
+}
+
+// ReadDescriptor reads a characteristic descriptor from a server.
+func (r *ReconnectingClient) ReadDescriptor(d *ble.Descriptor) ([]byte, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.ReadDescriptor(d)
+}
+
+// ReadDescriptorContext is like ReadDescriptor, but gives up once ctx is done.
+func (r *ReconnectingClient) ReadDescriptorContext(ctx context.Context, d *ble.Descriptor) ([]byte, error) {
+	cln, err := r.client()
+	if err != nil {
+		return nil, err
+	}
+	return cln.ReadDescriptorContext(ctx, d)
+}
+
+// WriteDescriptor writes a characteristic descriptor to a server.
+func (r *ReconnectingClient) WriteDescriptor(d *ble.Descriptor, v []byte) error {
+	cln, err := r.client()
+	if err != nil {
+		return err
+	}
+	return cln.WriteDescriptor(d, v)
+}
+
+// WriteDescriptorContext is like WriteDescriptor, but gives up once ctx is done.
+func (r *ReconnectingClient) WriteDescriptorContext(ctx context.Context, d *ble.Descriptor, v []byte) error {
+	cln, err := r.client()
+	if err != nil {
+		return err
+	}
+	return cln.WriteDescriptorContext(ctx, d, v)
+}
+
+// WriteLongDescriptor writes a characteristic descriptor, which is longer than the MTU.
+func (r *ReconnectingClient) WriteLongDescriptor(d *ble.Descriptor, v []byte) error {
+	cln, err := r.client()
+	if err != nil {
+		return err
+	}
+	return cln.WriteLongDescriptor(d, v)
+}
+
+// WriteLongDescriptorContext is like WriteLongDescriptor, but gives up once ctx is done.
+func (r *ReconnectingClient) WriteLongDescriptorContext(ctx context.Context, d *ble.Descriptor, v []byte) error {
+	cln, err := r.client()
+	if err != nil {
+		return err
+	}
+	return cln.WriteLongDescriptorContext(ctx, d, v)
+}
+
+// ReadRSSI retrieves the current RSSI value of remote peripheral, or 0 while
+// the link is down.
+func (r *ReconnectingClient) ReadRSSI() int {
+	cln, err := r.client()
+	if err != nil {
+		return 0
+	}
+	return cln.ReadRSSI()
+}
+
+// ExchangeMTU informs the server of the client’s maximum receive MTU size and
+// request the server to respond with its maximum receive MTU size. The MTU
+// isn't exchanged again on reconnections.
+func (r *ReconnectingClient) ExchangeMTU(rxMTU int) (int, error) {
+	cln, err := r.client()
+	if err != nil {
+		return 0, err
+	}
+	return cln.ExchangeMTU(rxMTU)
+}
+
+// ExchangeMTUContext is like ExchangeMTU, but gives up once ctx is done.
+func (r *ReconnectingClient) ExchangeMTUContext(ctx context.Context, rxMTU int) (int, error) {
+	cln, err := r.client()
+	if err != nil {
+		return 0, err
+	}
+	return cln.ExchangeMTUContext(ctx, rxMTU)
+}
+
+// Subscribe subscribes to indication (if ind is set true), or notification of a
+// characteristic value. The subscription is restored on reconnections.
+func (r *ReconnectingClient) Subscribe(c *ble.Characteristic, ind bool, h ble.NotificationHandler) error {
+	cln, err := r.client()
+	if err != nil {
+		return err
+	}
+	return cln.Subscribe(c, ind, h)
+}
+
+// SubscribeContext is like Subscribe, but gives up once ctx is done.
+func (r *ReconnectingClient) SubscribeContext(ctx context.Context, c *ble.Characteristic, ind bool, h ble.NotificationHandler) error {
+	cln, err := r.client()
+	if err != nil {
+		return err
+	}
+	return cln.SubscribeContext(ctx, c, ind, h)
+}
+
+// Unsubscribe unsubscribes to indication (if ind is set true), or notification
+// of a specified characteristic value.
+func (r *ReconnectingClient) Unsubscribe(c *ble.Characteristic, ind bool) error {
+	cln, err := r.client()
+	if err != nil {
+		return err
+	}
+	return cln.Unsubscribe(c, ind)
+}
+
+// UnsubscribeContext is like Unsubscribe, but gives up once ctx is done.
+func (r *ReconnectingClient) UnsubscribeContext(ctx context.Context, c *ble.Characteristic, ind bool) error {
+	cln, err := r.client()
+	if err != nil {
+		return err
+	}
+	return cln.UnsubscribeContext(ctx, c, ind)
+}
+
+// ClearSubscriptions clears all subscriptions to notifications and indications.
+func (r *ReconnectingClient) ClearSubscriptions() error {
+	cln, err := r.client()
+	if err != nil {
+		return err
+	}
+	return cln.ClearSubscriptions()
+}
+
+// ClearSubscriptionsContext is like ClearSubscriptions, but gives up once ctx is done.
+func (r *ReconnectingClient) ClearSubscriptionsContext(ctx context.Context) error {
+	cln, err := r.client()
+	if err != nil {
+		return err
+	}
+	return cln.ClearSubscriptionsContext(ctx)
+}
+
+// CancelConnection stops reconnecting, and disconnects the link.
+func (r *ReconnectingClient) CancelConnection() error {
+	r.cancel()
+	<-r.done
+	return nil
+}
+
+// Disconnected returns a receiving channel, which is closed when the client
+// stops reconnecting; not when the link drops.
+func (r *ReconnectingClient) Disconnected() <-chan struct{} {
+	return r.done
+}
+
+// Conn returns the current connection, or nil while the link is down.
+func (r *ReconnectingClient) Conn() ble.Conn {
+	cln, err := r.client()
+	if err != nil {
+		return nil
+	}
+	return cln.Conn()
+}
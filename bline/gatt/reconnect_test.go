@@ -0,0 +1,201 @@
+package gatt
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	ble "traulfs/Bline/ble"
+)
+
+func TestRemap(t *testing.T) {
+	char := func(u uint16, vh uint16) *ble.Characteristic {
+		return &ble.Characteristic{
+			UUID:        ble.UUID16(u),
+			Handle:      vh - 1,
+			ValueHandle: vh,
+			CCCD:        &ble.Descriptor{UUID: ble.ClientCharacteristicConfigUUID, Handle: vh + 1},
+		}
+	}
+	prev := &ble.Profile{Services: []*ble.Service{
+		{UUID: ble.UUID16(0x180F), Characteristics: []*ble.Characteristic{char(0x2A19, 0x0003)}},
+		{UUID: ble.UUID16(0x180F), Characteristics: []*ble.Characteristic{char(0x2A19, 0x0007)}},
+		{UUID: ble.UUID16(0x180D), Characteristics: []*ble.Characteristic{char(0x2A37, 0x000B), char(0x2A37, 0x000E)}},
+	}}
+	// A service was added in front, which shifted the handles.
+	next := &ble.Profile{Services: []*ble.Service{
+		{UUID: ble.UUID16(0x1811), Characteristics: []*ble.Characteristic{char(0x2A19, 0x0003)}},
+		{UUID: ble.UUID16(0x180F), Characteristics: []*ble.Characteristic{char(0x2A19, 0x0013)}},
+		{UUID: ble.UUID16(0x180F), Characteristics: []*ble.Characteristic{char(0x2A19, 0x0017)}},
+		{UUID: ble.UUID16(0x180D), Characteristics: []*ble.Characteristic{char(0x2A37, 0x001B), char(0x2A37, 0x001E)}},
+	}}
+
+	for _, tc := range []struct {
+		vh, want uint16
+	}{
+		{0x0003, 0x0013},
+		{0x0007, 0x0017},
+		{0x000B, 0x001B},
+		{0x000E, 0x001E},
+	} {
+		c := remap(prev, next, findByValueHandle(prev, tc.vh))
+		if c == nil {
+			t.Errorf("0x%04X: not found", tc.vh)
+			continue
+		}
+		if c.ValueHandle != tc.want || c.CCCD.Handle != tc.want+1 {
+			t.Errorf("0x%04X: got 0x%04X, CCCD 0x%04X, want 0x%04X", tc.vh, c.ValueHandle, c.CCCD.Handle, tc.want)
+		}
+	}
+
+	// A characteristic, which was removed, isn't found.
+	gone := &ble.Profile{Services: next.Services[:3]}
+	if c := remap(prev, gone, findByValueHandle(prev, 0x000E)); c != nil {
+		t.Errorf("got 0x%04X for a removed characteristic", c.ValueHandle)
+	}
+}
+
+// TestReconnectingClient drops the link of a ReconnectingClient, and checks
+// that its methods work again on the new link, with the subscriptions moved
+// onto it.
+func TestReconnectingClient(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		rediscover bool
+		shift      bool // A service is added in front on the new link.
+	}{
+		{"profile reused", false, false},
+		{"profile rediscovered", true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			notifiers := make(chan ble.Notifier, 4)
+			services := func(shift bool) []*ble.Service {
+				s := ble.NewService(ble.UUID16(0x180D))
+				c := s.NewCharacteristic(ble.UUID16(0x2A37))
+				c.HandleRead(ble.ReadHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
+					rsp.Write([]byte("hr"))
+				}))
+				c.HandleNotify(ble.NotifyHandlerFunc(func(req ble.Request, n ble.Notifier) { notifiers <- n }))
+				if shift {
+					x := ble.NewService(ble.UUID16(0x1811))
+					x.NewCharacteristic(ble.UUID16(0x2A00)).SetValue([]byte{0x00})
+					return []*ble.Service{x, s}
+				}
+				return []*ble.Service{s}
+			}
+
+			var mu sync.Mutex
+			var conns []*testConn
+			release := make(chan struct{})
+			dial := func(ctx context.Context, a ble.Addr) (ble.Client, error) {
+				mu.Lock()
+				n := len(conns)
+				mu.Unlock()
+				if n == 1 {
+					// The link stays down, until the test releases it.
+					select {
+					case <-release:
+					case <-ctx.Done():
+						return nil, ctx.Err()
+					}
+				}
+				cln, cc := newTestClient(t, services(tc.shift && n > 0)...)
+				mu.Lock()
+				conns = append(conns, cc)
+				mu.Unlock()
+				return cln, nil
+			}
+			states := make(chan ConnState, 8)
+			opts := ReconnectOptions{
+				Rediscover:   tc.rediscover,
+				MinBackoff:   time.Millisecond,
+				StateHandler: func(s ConnState, err error) { states <- s },
+			}
+			r, err := NewReconnectingClient(context.Background(), ble.NewAddr("00:00:00:00:00:02"), dial, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.CancelConnection()
+			waitState := func(want ConnState) {
+				t.Helper()
+				select {
+				case s := <-states:
+					if s != want {
+						t.Fatalf("got state %s, want %s", s, want)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatalf("no state %s", want)
+				}
+			}
+			waitState(StateConnected)
+
+			if _, err := r.DiscoverProfile(true); err != nil {
+				t.Fatal(err)
+			}
+			c, err := r.FindCharacteristic(ble.UUID16(0x180D), ble.UUID16(0x2A37))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(chan string, 4)
+			if err := r.Subscribe(c, false, func(b []byte) { got <- string(b) }); err != nil {
+				t.Fatal(err)
+			}
+			notify := func(v string) {
+				t.Helper()
+				select {
+				case n := <-notifiers:
+					n.Write([]byte(v))
+				case <-time.After(2 * time.Second):
+					t.Fatal("not subscribed")
+				}
+				select {
+				case s := <-got:
+					if s != v {
+						t.Errorf("got notification %q, want %q", s, v)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatalf("no notification %q", v)
+				}
+			}
+			notify("1")
+
+			// The link drops.
+			mu.Lock()
+			conns[0].Close()
+			mu.Unlock()
+			waitState(StateDisconnected)
+			if _, err := r.ReadCharacteristic(c); err != ErrNotConnected {
+				t.Errorf("ReadCharacteristic while down: got %v, want ErrNotConnected", err)
+			}
+			if r.Conn() != nil {
+				t.Error("got a connection while down")
+			}
+			close(release)
+			waitState(StateConnected)
+
+			notify("2")
+			if c, err = r.FindCharacteristic(ble.UUID16(0x180D), ble.UUID16(0x2A37)); err != nil {
+				t.Fatal(err)
+			}
+			want := uint16(0x0003)
+			if tc.shift {
+				want = 0x0006
+			}
+			if c.ValueHandle != want {
+				t.Errorf("got value handle 0x%04X, want 0x%04X", c.ValueHandle, want)
+			}
+			if v, err := r.ReadCharacteristicContext(context.Background(), c); err != nil || string(v) != "hr" {
+				t.Errorf("ReadCharacteristic: got %q, %v, want hr", v, err)
+			}
+
+			r.CancelConnection()
+			waitState(StateClosed)
+			select {
+			case <-r.Disconnected():
+			default:
+				t.Error("not done after CancelConnection")
+			}
+		})
+	}
+}
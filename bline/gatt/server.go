@@ -1,6 +1,7 @@
 package gatt
 
 import (
+	"encoding/binary"
 	"log"
 	"sync"
 
@@ -15,11 +16,16 @@ func NewServerWithName(name string) (*Server, error) {
 
 // NewServerWithNameAndHandler allow to specify a custom NotifyHandler
 func NewServerWithNameAndHandler(name string, notifyHandler ble.NotifyHandler) (*Server, error) {
-	return &Server{
-		name: name,
-		svcs: defaultServicesWithHandler(name, notifyHandler),
-		db:   att.NewDB(defaultServices(name), uint16(1)),
-	}, nil
+	s := &Server{
+		name:    name,
+		handler: notifyHandler,
+		subs:    make(map[ble.Notifier]ble.Conn),
+		pending: make(map[string]handleRange),
+	}
+	s.defaults = s.defaultServices()
+	s.svcs = append([]*ble.Service(nil), s.defaults...)
+	s.db = att.NewDB(s.svcs, uint16(1))
+	return s, nil
 }
 
 // NewServer ...
@@ -32,8 +38,26 @@ type Server struct {
 	sync.Mutex
 	name string
 
-	svcs []*ble.Service
-	db   *att.DB
+	defaults []*ble.Service
+	svcs     []*ble.Service
+	db       *att.DB
+
+	// handler serves the Service Changed indications, along with the server.
+	handler ble.NotifyHandler
+	sc      *ble.Characteristic // The Service Changed characteristic.
+
+	// The clients, which subscribed to the Service Changed indications, and
+	// the changes pending for the bonded ones, while they're disconnected.
+	// The subscriptions of the bonded clients are kept by their identities,
+	// and restored on their next connections.
+	muSubs  sync.Mutex
+	subs    map[ble.Notifier]ble.Conn
+	pending map[string]handleRange
+}
+
+// handleRange is a range of handles, which were changed.
+type handleRange struct {
+	start, end uint16
 }
 
 // AddService ...
@@ -41,7 +65,7 @@ func (s *Server) AddService(svc *ble.Service) error {
 	s.Lock()
 	defer s.Unlock()
 	s.svcs = append(s.svcs, svc)
-	s.db = att.NewDB(s.svcs, uint16(1)) // ble attrs start at 1
+	s.setServices()
 	return nil
 }
 
@@ -49,8 +73,8 @@ func (s *Server) AddService(svc *ble.Service) error {
 func (s *Server) RemoveAllServices() error {
 	s.Lock()
 	defer s.Unlock()
-	s.svcs = defaultServices(s.name)
-	s.db = att.NewDB(s.svcs, uint16(1)) // ble attrs start at 1
+	s.svcs = append([]*ble.Service(nil), s.defaults...)
+	s.setServices()
 	return nil
 }
 
@@ -58,47 +82,211 @@ func (s *Server) RemoveAllServices() error {
 func (s *Server) SetServices(svcs []*ble.Service) error {
 	s.Lock()
 	defer s.Unlock()
-	s.svcs = append(defaultServices(s.name), svcs...)
-	s.db = att.NewDB(s.svcs, uint16(1)) // ble attrs start at 1
+	s.svcs = append(append([]*ble.Service(nil), s.defaults...), svcs...)
+	s.setServices()
 	return nil
 }
 
+// setServices updates the database, which the connections share, and
+// indicates the changed handles to the clients.
+func (s *Server) setServices() {
+	if start, end, ok := s.db.SetServices(s.svcs); ok {
+		s.serviceChanged(handleRange{start, end})
+	}
+}
+
 // DB ...
 func (s *Server) DB() *att.DB {
 	return s.db
 }
 
-func defaultServices(name string) []*ble.Service {
-	return defaultServicesWithHandler(name, nil)
+// Counterpart returns the characteristic of s, which corresponds to the
+// characteristic c of the server from: c itself, if from is s, or else the
+// characteristic of the UUID of c, at its position in a service of the same
+// UUID and position. It returns nil, if s has no such characteristic.
+func (s *Server) Counterpart(from *Server, c *ble.Characteristic) *ble.Characteristic {
+	if from == s {
+		return c
+	}
+	from.Lock()
+	p, ok := findCharPath(from.svcs, c)
+	from.Unlock()
+	if !ok {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	return p.find(s.svcs)
+}
+
+// charPath locates a characteristic as the n-th one of its UUID in the n-th
+// service of its UUID, so it's found in the services of another server.
+type charPath struct {
+	svc  ble.UUID
+	si   int
+	char ble.UUID
+	ci   int
+}
+
+// findCharPath returns the path of characteristic c in the services svcs.
+func findCharPath(svcs []*ble.Service, c *ble.Characteristic) (charPath, bool) {
+	sn := make(map[string]int)
+	for _, svc := range svcs {
+		si := sn[svc.UUID.String()]
+		sn[svc.UUID.String()]++
+		cn := make(map[string]int)
+		for _, x := range svc.Characteristics {
+			ci := cn[x.UUID.String()]
+			cn[x.UUID.String()]++
+			if x == c {
+				return charPath{svc: svc.UUID, si: si, char: c.UUID, ci: ci}, true
+			}
+		}
+	}
+	return charPath{}, false
+}
+
+// find returns the characteristic at the path in the services svcs, if any.
+func (p charPath) find(svcs []*ble.Service) *ble.Characteristic {
+	si := 0
+	for _, svc := range svcs {
+		if !svc.UUID.Equal(p.svc) {
+			continue
+		}
+		if si != p.si {
+			si++
+			continue
+		}
+		ci := 0
+		for _, x := range svc.Characteristics {
+			if !x.UUID.Equal(p.char) {
+				continue
+			}
+			if ci == p.ci {
+				return x
+			}
+			ci++
+		}
+		return nil
+	}
+	return nil
 }
-func defaultServicesWithHandler(name string, handler ble.NotifyHandler) []*ble.Service {
+
+func (s *Server) defaultServices() []*ble.Service {
 	// https://developer.bluetooth.org/gatt/characteristics/Pages/CharacteristicViewer.aspx?u=org.bluetooth.characteristic.ble.appearance.xml
 	var gapCharAppearanceGenericComputer = []byte{0x00, 0x80}
 
 	gapSvc := ble.NewService(ble.GAPUUID)
-	gapSvc.NewCharacteristic(ble.DeviceNameUUID).SetValue([]byte(name))
+	gapSvc.NewCharacteristic(ble.DeviceNameUUID).SetValue([]byte(s.name))
 	gapSvc.NewCharacteristic(ble.AppearanceUUID).SetValue(gapCharAppearanceGenericComputer)
 	gapSvc.NewCharacteristic(ble.PeripheralPrivacyUUID).SetValue([]byte{0x00})
 	gapSvc.NewCharacteristic(ble.ReconnectionAddrUUID).SetValue([]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
 	gapSvc.NewCharacteristic(ble.PeferredParamsUUID).SetValue([]byte{0x06, 0x00, 0x06, 0x00, 0x00, 0x00, 0xd0, 0x07})
 
 	gattSvc := ble.NewService(ble.GATTUUID)
-	var indicationHandler ble.NotifyHandlerFunc
-	indicationHandler = defaultHanderFunc
-	if handler != nil {
-		indicationHandler = handler.ServeNotify
-	}
-	gattSvc.NewCharacteristic(ble.ServiceChangedUUID).HandleIndicate(indicationHandler)
+	s.sc = gattSvc.NewCharacteristic(ble.ServiceChangedUUID)
+	s.sc.HandleIndicate(ble.NotifyHandlerFunc(s.serveServiceChanged))
 	return []*ble.Service{gapSvc, gattSvc}
 }
 
-func defaultHanderFunc(r ble.Request, n ble.Notifier) {
-	log.Printf("TODO: indicate client when the services are changed")
-	for {
-		select {
-		case <-n.Context().Done():
-			log.Printf("count: Notification unsubscribed")
-			return
+// Restore restores the subscription to the Service Changed indications of a
+// bonded client, which subscribed on an earlier connection, on the ATT server
+// as of its new connection cn. The changes made while it was disconnected are
+// indicated at once, without waiting for the client to write the CCCD again.
+// [Vol 3, Part G, 7.1]
+func (s *Server) Restore(cn ble.Conn, as *att.Server) {
+	key, bonded := bondKey(cn)
+	if !bonded {
+		return
+	}
+	s.muSubs.Lock()
+	_, ok := s.pending[key]
+	s.muSubs.Unlock()
+	if !ok {
+		return
+	}
+	if err := as.RestoreCCC(s.sc, cccIndicate); err != nil {
+		log.Printf("can't restore the Service Changed subscription: %s", err)
+	}
+}
+
+// serveServiceChanged serves a client, which subscribed to the Service Changed
+// indications. A bonded client is told the changes made while it was
+// disconnected, once it subscribes again. [Vol 3, Part G, 7.1]
+func (s *Server) serveServiceChanged(req ble.Request, n ble.Notifier) {
+	cn := req.Conn()
+	key, bonded := bondKey(cn)
+
+	s.muSubs.Lock()
+	s.subs[n] = cn
+	r, ok := s.pending[key]
+	delete(s.pending, key)
+	s.muSubs.Unlock()
+
+	if bonded && ok && r.start != 0 {
+		if _, err := n.Write(r.value()); err != nil {
+			log.Printf("can't indicate service changed: %s", err)
+		}
+	}
+	if s.handler != nil {
+		go s.handler.ServeNotify(req, n)
+	}
+	<-n.Context().Done()
+
+	s.muSubs.Lock()
+	defer s.muSubs.Unlock()
+	delete(s.subs, n)
+	select {
+	case <-cn.Disconnected():
+		// The subscription of a bonded client lasts across connections.
+		if bonded {
+			s.pending[key] = handleRange{}
 		}
+	default:
+	}
+}
+
+// serviceChanged indicates the changed handles to the subscribed clients, and
+// keeps them for the bonded clients, which are disconnected.
+func (s *Server) serviceChanged(r handleRange) {
+	s.muSubs.Lock()
+	defer s.muSubs.Unlock()
+	for n := range s.subs {
+		// The indications are confirmed in turn by each client.
+		go func(n ble.Notifier) {
+			if _, err := n.Write(r.value()); err != nil {
+				log.Printf("can't indicate service changed: %s", err)
+			}
+		}(n)
+	}
+	for key, p := range s.pending {
+		if p.start == 0 {
+			s.pending[key] = r
+			continue
+		}
+		if r.start < p.start {
+			p.start = r.start
+		}
+		if r.end > p.end {
+			p.end = r.end
+		}
+		s.pending[key] = p
+	}
+}
+
+// value returns the value of the Service Changed characteristic.
+func (r handleRange) value() []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint16(b, r.start)
+	binary.LittleEndian.PutUint16(b[2:], r.end)
+	return b
+}
+
+// bondKey returns the key of a client, and whether it's bonded.
+func bondKey(cn ble.Conn) (string, bool) {
+	ic, ok := cn.(ble.IdentityConn)
+	if !ok || !ic.Bonded() {
+		return "", false
 	}
+	return ic.IdentityAddr().String(), true
 }
@@ -0,0 +1,54 @@
+package gatt
+
+import (
+	"testing"
+
+	ble "traulfs/Bline/ble"
+)
+
+// TestCounterpart checks that a characteristic is found on another server by
+// the UUIDs and positions of its service and itself.
+func TestCounterpart(t *testing.T) {
+	services := func() []*ble.Service {
+		bas := ble.NewService(ble.UUID16(0x180F))
+		bas.NewCharacteristic(ble.UUID16(0x2A19))
+		var ss []*ble.Service
+		for i := 0; i < 2; i++ {
+			hrs := ble.NewService(ble.UUID16(0x180D))
+			hrs.AddCharacteristic(&ble.Characteristic{UUID: ble.UUID16(0x2A37)})
+			hrs.AddCharacteristic(&ble.Characteristic{UUID: ble.UUID16(0x2A38)})
+			ss = append(ss, hrs)
+		}
+		return append(ss, bas)
+	}
+	from, _ := NewServerWithName("from")
+	from.SetServices(services())
+	// The other server has the services in another order, and an extra one
+	// in front.
+	to, _ := NewServerWithName("to")
+	ss := services()
+	extra := ble.NewService(ble.UUID16(0x180A))
+	extra.NewCharacteristic(ble.UUID16(0x2A37))
+	to.SetServices([]*ble.Service{extra, ss[2], ss[0], ss[1]})
+	other, _ := NewServerWithName("other")
+	other.SetServices(services()[2:])
+
+	fs := from.svcs[len(from.defaults):]
+	for _, tc := range []struct {
+		name   string
+		c      *ble.Characteristic
+		server *Server
+		want   *ble.Characteristic
+	}{
+		{"same server", fs[1].Characteristics[0], from, fs[1].Characteristics[0]},
+		{"first service", fs[0].Characteristics[1], to, ss[0].Characteristics[1]},
+		{"second service", fs[1].Characteristics[0], to, ss[1].Characteristics[0]},
+		{"other service", fs[2].Characteristics[0], to, ss[2].Characteristics[0]},
+		{"missing service", fs[0].Characteristics[0], other, nil},
+		{"unknown characteristic", &ble.Characteristic{UUID: ble.UUID16(0x2A37)}, to, nil},
+	} {
+		if got := tc.server.Counterpart(from, tc.c); got != tc.want {
+			t.Errorf("%s: got %p, want %p", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package hci
+
+import (
+	"context"
+
+	ble "traulfs/Bline/ble"
+	"traulfs/Bline/ble/bline/hci/cmd"
+)
+
+// Scanning filter policies [Vol 2, Part E, 7.8.10].
+const (
+	ScanFilterNone       = 0x00 // Accept all advertising packets.
+	ScanFilterAcceptList = 0x01 // Accept only advertising packets from devices in the accept list.
+)
+
+// Advertising filter policies [Vol 2, Part E, 7.8.5].
+const (
+	AdvFilterNone = 0x00 // Process scan and connection requests from all devices.
+	AdvFilterScan = 0x01 // Process scan requests only from devices in the accept list.
+	AdvFilterConn = 0x02 // Process connection requests only from devices in the accept list.
+	AdvFilterAll  = 0x03 // Process scan and connection requests only from devices in the accept list.
+)
+
+// acceptEntry is an entry of the Filter Accept List (formerly White List) [Vol 6, Part B, 4.3.1].
+type acceptEntry struct {
+	addrType uint8
+	addr     [6]byte
+}
+
+// AcceptListSize returns the total number of accept list entries the controller can store.
+func (h *HCI) AcceptListSize() (int, error) {
+	h.muAcceptList.Lock()
+	defer h.muAcceptList.Unlock()
+	return h.acceptListSize()
+}
+
+func (h *HCI) acceptListSize() (int, error) {
+	if h.acceptListCap > 0 {
+		return h.acceptListCap, nil
+	}
+	var rp cmd.LEReadWhiteListSizeRP
+	if err := h.Send(&cmd.LEReadWhiteListSize{}, &rp); err != nil {
+		return 0, err
+	}
+	h.acceptListCap = int(rp.WhiteListSize)
+	return h.acceptListCap, nil
+}
+
+// AcceptList returns the addresses currently in the accept list.
+func (h *HCI) AcceptList() []ble.Addr {
+	h.muAcceptList.Lock()
+	defer h.muAcceptList.Unlock()
+	addrs := make([]ble.Addr, 0, len(h.acceptList))
+	for _, e := range h.acceptList {
+		addrs = append(addrs, deviceAddr(e.addrType, e.addr))
+	}
+	return addrs
+}
+
+// AddToAcceptList adds devices to the accept list.
+// Devices which are already in the list are skipped.
+func (h *HCI) AddToAcceptList(addrs ...ble.Addr) error {
+	h.muAcceptList.Lock()
+	defer h.muAcceptList.Unlock()
+	entries, err := toAcceptEntries(addrs)
+	if err != nil {
+		return err
+	}
+	return h.pauseScanAndAdv(func() error {
+		return h.addAcceptEntries(entries)
+	})
+}
+
+// RemoveFromAcceptList removes devices from the accept list.
+// Devices which are not in the list are skipped.
+func (h *HCI) RemoveFromAcceptList(addrs ...ble.Addr) error {
+	h.muAcceptList.Lock()
+	defer h.muAcceptList.Unlock()
+	entries, err := toAcceptEntries(addrs)
+	if err != nil {
+		return err
+	}
+	return h.pauseScanAndAdv(func() error {
+		for _, e := range entries {
+			i := h.findAcceptEntry(e)
+			if i < 0 {
+				continue
+			}
+			err := h.Send(&cmd.LERemoveDeviceFromWhiteList{
+				AddressType: e.addrType,
+				Address:     e.addr,
+			}, nil)
+			if err != nil {
+				return err
+			}
+			h.acceptList = append(h.acceptList[:i], h.acceptList[i+1:]...)
+		}
+		return nil
+	})
+}
+
+// ClearAcceptList removes all devices from the accept list.
+func (h *HCI) ClearAcceptList() error {
+	h.muAcceptList.Lock()
+	defer h.muAcceptList.Unlock()
+	return h.pauseScanAndAdv(h.clearAcceptList)
+}
+
+// SyncAcceptList replaces the content of the accept list with the given devices.
+func (h *HCI) SyncAcceptList(addrs ...ble.Addr) error {
+	h.muAcceptList.Lock()
+	defer h.muAcceptList.Unlock()
+	entries, err := toAcceptEntries(addrs)
+	if err != nil {
+		return err
+	}
+	return h.pauseScanAndAdv(func() error {
+		if err := h.clearAcceptList(); err != nil {
+			return err
+		}
+		return h.addAcceptEntries(entries)
+	})
+}
+
+func toAcceptEntries(addrs []ble.Addr) ([]acceptEntry, error) {
+	entries := make([]acceptEntry, 0, len(addrs))
+	for _, a := range addrs {
+		t, b, err := peerAddr(a)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, acceptEntry{addrType: t, addr: b})
+	}
+	return entries, nil
+}
+
+func (h *HCI) findAcceptEntry(e acceptEntry) int {
+	for i, x := range h.acceptList {
+		if x == e {
+			return i
+		}
+	}
+	return -1
+}
+
+func (h *HCI) clearAcceptList() error {
+	if err := h.Send(&cmd.LEClearWhiteList{}, nil); err != nil {
+		return err
+	}
+	h.acceptList = nil
+	return nil
+}
+
+func (h *HCI) addAcceptEntries(entries []acceptEntry) error {
+	size, err := h.acceptListSize()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if h.findAcceptEntry(e) >= 0 {
+			continue
+		}
+		if len(h.acceptList) >= size {
+			return ErrAcceptListFull
+		}
+		err := h.Send(&cmd.LEAddDeviceToWhiteList{
+			AddressType: e.addrType,
+			Address:     e.addr,
+		}, nil)
+		if err != nil {
+			return err
+		}
+		h.acceptList = append(h.acceptList, e)
+	}
+	return nil
+}
+
+// pauseScanAndAdv runs f with scanning, advertising and initiating paused.
+// The accept list and the resolving list shall not be modified while they are
+// in use by advertising, scanning or initiating [Vol 2, Part E, 7.8.16, 7.8.38].
+// A pending dial cancels its LE Create Connection, runs f itself, and
+// initiates the connection again afterwards.
+func (h *HCI) pauseScanAndAdv(f func() error) error {
+	for {
+		h.muInit.Lock()
+		h.muDial.Lock()
+		d := h.dialing
+		h.muDial.Unlock()
+		if d == nil {
+			err := h.runPaused(f)
+			h.muInit.Unlock()
+			return err
+		}
+		h.muInit.Unlock()
+
+		req := pauseReq{f: f, done: make(chan error, 1)}
+		select {
+		case d.chPause <- req:
+			return <-req.done
+		case <-d.done:
+			// The dial is over; no connection is initiating anymore.
+		case <-h.done:
+			return h.err
+		}
+	}
+}
+
+// runPaused runs f with scanning and advertising paused. The caller holds
+// h.muInit, so no connection is initiating meanwhile.
+func (h *HCI) runPaused(f func() error) error {
+	h.params.RLock()
+	scanning := h.params.scanEnable.LEScanEnable == 1
+	advertising := h.params.advEnable.AdvertisingEnable == 1
+	h.params.RUnlock()
+
+	if scanning {
+		if err := h.Send(&cmd.LESetScanEnable{LEScanEnable: 0}, nil); err != nil {
+			return err
+		}
+	}
+	if advertising {
+		if err := h.Send(&cmd.LESetAdvertiseEnable{AdvertisingEnable: 0}, nil); err != nil {
+			return err
+		}
+	}
+
+	err := f()
+
+	if advertising {
+		h.Send(&h.params.advEnable, nil)
+	}
+	if scanning {
+		h.Send(&h.params.scanEnable, nil)
+	}
+	return err
+}
+
+// ScanAcceptList starts scanning, and only reports devices in the accept list.
+func (h *HCI) ScanAcceptList(allowDup bool) error {
+	if err := h.setScanFilterPolicy(ScanFilterAcceptList); err != nil {
+		return err
+	}
+	return h.scan(allowDup)
+}
+
+// setScanFilterPolicy updates the scanning filter policy of the controller, if it changed.
+func (h *HCI) setScanFilterPolicy(policy uint8) error {
+	if h.params.scanParams.ScanningFilterPolicy == policy {
+		return nil
+	}
+	// Scan parameters shall not be changed while scanning is enabled [Vol 2, Part E, 7.8.10].
+	if h.params.scanEnable.LEScanEnable == 1 {
+		if err := h.StopScanning(); err != nil {
+			return err
+		}
+	}
+	h.params.scanParams.ScanningFilterPolicy = policy
+	return h.Send(&h.params.scanParams, nil)
+}
+
+// SetAdvFilterPolicy sets the advertising filter policy, which restricts the
+// devices allowed to scan and connect to the accept list.
+func (h *HCI) SetAdvFilterPolicy(policy uint8) error {
+	if policy > AdvFilterAll {
+		return ErrInvalidFilterPolicy
+	}
+	h.params.RLock()
+	advertising := h.params.advEnable.AdvertisingEnable == 1
+	h.params.RUnlock()
+
+	// Advertising parameters shall not be changed while advertising is enabled [Vol 2, Part E, 7.8.5].
+	if advertising {
+		if err := h.Send(&cmd.LESetAdvertiseEnable{AdvertisingEnable: 0}, nil); err != nil {
+			return err
+		}
+	}
+	h.params.advParams.AdvertisingFilterPolicy = policy
+	if err := h.Send(&h.params.advParams, nil); err != nil {
+		return err
+	}
+	if advertising {
+		return h.Send(&h.params.advEnable, nil)
+	}
+	return nil
+}
+
+// DialAcceptList connects to the first device in the accept list which is found advertising.
+// It fails with ErrAcceptListBusy, while an AutoConnect owns the accept list.
+func (h *HCI) DialAcceptList(ctx context.Context) (ble.Client, error) {
+	h.muDial.Lock()
+	busy := h.autoConns > 0
+	h.muDial.Unlock()
+	if busy {
+		return nil, ErrAcceptListBusy
+	}
+	p := h.connParams()
+	p.InitiatorFilterPolicy = 0x01 // Use the accept list, and ignore the peer address.
+	return h.dial(ctx, p, nil)
+}
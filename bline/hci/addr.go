@@ -0,0 +1,43 @@
+package hci
+
+import (
+	"net"
+
+	ble "traulfs/Bline/ble"
+)
+
+// RandomAddress is a Random Device Address.
+// Deprecated: use ble.DeviceAddr, which carries the address type.
+type RandomAddress struct {
+	ble.Addr
+}
+
+// peerAddr converts a ble.Addr into the address type and the address (in HCI
+// byte order) used by HCI commands. Addresses without a type are public.
+func peerAddr(a ble.Addr) (uint8, [6]byte, error) {
+	var t uint8
+	var b []byte
+	switch a := a.(type) {
+	case ble.DeviceAddr:
+		if a.Type.Random() {
+			t = AddrTypeRandom
+		}
+		b = a.MAC[:]
+	case RandomAddress:
+		t = AddrTypeRandom
+		b, _ = net.ParseMAC(a.String())
+	default:
+		b, _ = net.ParseMAC(a.String())
+	}
+	if len(b) != 6 {
+		return 0, [6]byte{}, ErrInvalidAddr
+	}
+	return t, [6]byte{b[5], b[4], b[3], b[2], b[1], b[0]}, nil
+}
+
+// deviceAddr returns the ble.DeviceAddr of an address (in HCI byte order)
+// reported by the controller.
+func deviceAddr(t uint8, b [6]byte) ble.DeviceAddr {
+	random := t == AddrTypeRandom || t == AddrTypeRandomIdentity
+	return ble.NewDeviceAddr([]byte{b[5], b[4], b[3], b[2], b[1], b[0]}, random)
+}
@@ -1,18 +1,11 @@
 package hci
 
 import (
-	"net"
-
 	ble "traulfs/Bline/ble"
 	"traulfs/Bline/ble/bline/adv"
 	"traulfs/Bline/ble/bline/hci/evt"
 )
 
-// RandomAddress is a Random Device Address.
-type RandomAddress struct {
-	ble.Addr
-}
-
 // [Vol 6, Part B, 4.4.2] [Vol 3, Part C, 11]
 const (
 	evtTypAdvInd        = 0x00 // Connectable undirected advertising (ADV_IND).
@@ -33,6 +26,10 @@ type Advertisement struct {
 	i  int
 	sr *Advertisement
 
+	// id is the identity of the remote device, if its resolvable private
+	// address was resolved by the host.
+	id *Identity
+
 	// cached packets.
 	p *adv.Packet
 }
@@ -99,12 +96,23 @@ func (a *Advertisement) RSSI() int {
 
 // Addr returns the address of the remote peripheral.
 func (a *Advertisement) Addr() ble.Addr {
-	b := a.e.Address(a.i)
-	addr := net.HardwareAddr([]byte{b[5], b[4], b[3], b[2], b[1], b[0]})
-	if a.e.AddressType(a.i) == 1 {
-		return RandomAddress{addr}
+	return deviceAddr(a.e.AddressType(a.i), a.e.Address(a.i))
+}
+
+// IdentityAddr returns the identity address of the remote peripheral.
+// It is the same as Addr, unless a resolvable private address was resolved
+// by either the host or the controller.
+func (a *Advertisement) IdentityAddr() ble.Addr {
+	if a.id != nil {
+		return a.id.Addr
 	}
-	return addr
+	return a.Addr()
+}
+
+// Resolved reports whether the address of the remote peripheral was resolved to its identity.
+func (a *Advertisement) Resolved() bool {
+	t := a.e.AddressType(a.i)
+	return a.id != nil || t == AddrTypePublicIdentity || t == AddrTypeRandomIdentity
 }
 
 // EventType returns the event type of Advertisement.
@@ -113,8 +121,8 @@ func (a *Advertisement) EventType() uint8 {
 	return a.e.EventType(a.i)
 }
 
-// AddressType returns the address type of the Advertisement.
-// This is linux sepcific.
+// AddressType returns the address type of the Advertisement, which is one of
+// the AddrType constants. This is linux sepcific.
 func (a *Advertisement) AddressType() uint8 {
 	return a.e.AddressType(a.i)
 }
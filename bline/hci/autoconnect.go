@@ -0,0 +1,154 @@
+package hci
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	ble "traulfs/Bline/ble"
+
+	"github.com/pkg/errors"
+)
+
+// autoConnectRetry is the delay before re-arming a background connection,
+// which failed.
+const autoConnectRetry = time.Second
+
+// autoConn connects to a set of target devices in the background, with the
+// accept list of the controller [Vol 3, Part C, 9.3.5].
+type autoConn struct {
+	h       *HCI
+	targets []ble.Addr
+	peers   [][6]byte // Addresses of the targets, in HCI byte order.
+
+	mu        sync.Mutex
+	connected map[[6]byte]bool
+
+	chRearm chan struct{} // A target disconnected.
+}
+
+// AutoConnect connects to the devices in addrs, whenever any of them
+// advertises, until ctx is done. The connections are delivered as clients on
+// the returned channel, which is closed when ctx is done.
+//
+// The accept list is owned by the background connection meanwhile: connected
+// devices are removed from it, and added back once they disconnect. Dials of
+// other callers take precedence over the background connection.
+func (h *HCI) AutoConnect(ctx context.Context, addrs ...ble.Addr) (<-chan ble.Client, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no devices to connect")
+	}
+	a := &autoConn{
+		h:         h,
+		targets:   addrs,
+		peers:     make([][6]byte, len(addrs)),
+		connected: make(map[[6]byte]bool),
+		chRearm:   make(chan struct{}, 1),
+	}
+	for i, x := range addrs {
+		_, b, err := peerAddr(x)
+		if err != nil {
+			return nil, err
+		}
+		a.peers[i] = b
+	}
+	h.muDial.Lock()
+	h.autoConns++
+	h.muDial.Unlock()
+	ch := make(chan ble.Client)
+	go a.loop(ctx, ch)
+	return ch, nil
+}
+
+func (a *autoConn) loop(ctx context.Context, ch chan<- ble.Client) {
+	defer close(ch)
+	h := a.h
+	defer func() {
+		h.muDial.Lock()
+		h.autoConns--
+		h.muDial.Unlock()
+	}()
+	for ctx.Err() == nil {
+		pending := a.pending()
+		if len(pending) == 0 {
+			// All the targets are connected; wait for one to disconnect.
+			select {
+			case <-a.chRearm:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		// The accept list can't be changed while initiating, so it's synced
+		// once it's the turn of the background connection, after the dials
+		// of other callers are done.
+		p := h.connParams()
+		p.InitiatorFilterPolicy = 0x01 // Use the accept list, and ignore the peer address.
+		cln, err := h.dial(ctx, p, &bgDial{
+			preempt: a.chRearm,
+			prepare: func() error { return h.SyncAcceptList(pending...) },
+		})
+		if err == nil {
+			a.watch(cln)
+			select {
+			case ch <- cln:
+			case <-ctx.Done():
+				cln.CancelConnection()
+				return
+			}
+			continue
+		}
+		if err == errPreempted || ctx.Err() != nil {
+			continue
+		}
+		logger.Warn("autoconnect", "connect", err)
+		select {
+		case <-time.After(autoConnectRetry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pending returns the targets, which aren't connected.
+func (a *autoConn) pending() []ble.Addr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var addrs []ble.Addr
+	for i, b := range a.peers {
+		if !a.connected[b] {
+			addrs = append(addrs, a.targets[i])
+		}
+	}
+	return addrs
+}
+
+// watch marks the target of a client connected, until it disconnects.
+func (a *autoConn) watch(cln ble.Client) {
+	_, b, err := peerAddr(cln.Addr())
+	if err != nil {
+		return
+	}
+	if id, ok := a.h.resolve(b); ok {
+		if _, ib, err := peerAddr(id.Addr); err == nil {
+			b = ib
+		}
+	}
+	a.mu.Lock()
+	a.connected[b] = true
+	a.mu.Unlock()
+
+	go func() {
+		<-cln.Disconnected()
+		a.mu.Lock()
+		delete(a.connected, b)
+		a.mu.Unlock()
+
+		// Re-arm the background connection with the target.
+		select {
+		case a.chRearm <- struct{}{}:
+		default:
+		}
+	}()
+}
@@ -0,0 +1,372 @@
+package hci
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	ble "traulfs/Bline/ble"
+	"traulfs/Bline/ble/bline/hci/cmd"
+	"traulfs/Bline/ble/bline/hci/socket"
+
+	"github.com/pkg/errors"
+)
+
+// Bond holds the keys exchanged with a bonded device.
+type Bond struct {
+	Addr   ble.DeviceAddr // Identity address of the remote device.
+	Local  Keys           // Keys distributed by the local device.
+	Remote Keys           // Keys distributed by the remote device.
+}
+
+// BondStore stores the bonds, keyed by the identity address of the remote
+// device. It's shared by the anchors of a BeaconLine, so implementations
+// must be safe for concurrent use.
+type BondStore interface {
+	// Load returns the bond of a device, if any.
+	Load(a ble.DeviceAddr) (Bond, bool)
+
+	// Save adds or replaces the bond of a device.
+	Save(b Bond) error
+
+	// Delete removes the bond of a device.
+	Delete(a ble.DeviceAddr) error
+
+	// Bonds returns all the bonds.
+	Bonds() []Bond
+}
+
+// bondKey returns the key of an identity address, which includes its type.
+func bondKey(a ble.DeviceAddr) string {
+	b, _ := a.MarshalText()
+	return string(b)
+}
+
+// FileBondStore is a BondStore, which keeps the bonds in a JSON file.
+type FileBondStore struct {
+	sync.Mutex
+	path  string
+	bonds map[string]Bond
+}
+
+// NewFileBondStore returns a BondStore backed by the file at path.
+// The file is created on the first Save, if it doesn't exist.
+func NewFileBondStore(path string) (*FileBondStore, error) {
+	s := &FileBondStore{path: path, bonds: make(map[string]Bond)}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var bonds []Bond
+	if err := json.Unmarshal(b, &bonds); err != nil {
+		return nil, err
+	}
+	for _, x := range bonds {
+		s.bonds[bondKey(x.Addr)] = x
+	}
+	return s, nil
+}
+
+// Load returns the bond of a device, if any.
+func (s *FileBondStore) Load(a ble.DeviceAddr) (Bond, bool) {
+	s.Lock()
+	defer s.Unlock()
+	b, ok := s.bonds[bondKey(a)]
+	return b, ok
+}
+
+// Save adds or replaces the bond of a device.
+func (s *FileBondStore) Save(b Bond) error {
+	s.Lock()
+	defer s.Unlock()
+	s.bonds[bondKey(b.Addr)] = b
+	return s.write()
+}
+
+// Delete removes the bond of a device.
+func (s *FileBondStore) Delete(a ble.DeviceAddr) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.bonds[bondKey(a)]; !ok {
+		return nil
+	}
+	delete(s.bonds, bondKey(a))
+	return s.write()
+}
+
+// Bonds returns all the bonds.
+func (s *FileBondStore) Bonds() []Bond {
+	s.Lock()
+	defer s.Unlock()
+	bonds := make([]Bond, 0, len(s.bonds))
+	for _, b := range s.bonds {
+		bonds = append(bonds, b)
+	}
+	return bonds
+}
+
+// write replaces the file atomically, so it's never left half written.
+func (s *FileBondStore) write() error {
+	bonds := make([]Bond, 0, len(s.bonds))
+	for _, b := range s.bonds {
+		bonds = append(bonds, b)
+	}
+	b, err := json.MarshalIndent(bonds, "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+// sharedBonds holds the bond store of each BeaconLine, which is used by the
+// anchors not configured with a store of their own. The store is forgotten,
+// once the last anchor of the BeaconLine is closed.
+var sharedBonds = struct {
+	sync.Mutex
+	m map[*socket.BeaconLine]*lineBonds
+}{m: make(map[*socket.BeaconLine]*lineBonds)}
+
+// lineBonds is the bond store shared by the anchors of a BeaconLine.
+type lineBonds struct {
+	store   BondStore
+	anchors int
+}
+
+// shareBondStore adds the HCI to the anchors of its BeaconLine, and makes its
+// bond store available to the others. The first anchor configured with a
+// store wins.
+func (h *HCI) shareBondStore() {
+	if h.bl == nil {
+		return
+	}
+	sharedBonds.Lock()
+	defer sharedBonds.Unlock()
+	if h.shared {
+		return
+	}
+	lb, ok := sharedBonds.m[h.bl]
+	if !ok {
+		lb = &lineBonds{}
+		sharedBonds.m[h.bl] = lb
+	}
+	lb.anchors++
+	if lb.store == nil {
+		lb.store = h.bonds
+	}
+	h.shared = true
+}
+
+// unshareBondStore removes the HCI from the anchors of its BeaconLine.
+func (h *HCI) unshareBondStore() {
+	sharedBonds.Lock()
+	defer sharedBonds.Unlock()
+	if !h.shared {
+		return
+	}
+	h.shared = false
+	lb := sharedBonds.m[h.bl]
+	if lb.anchors--; lb.anchors == 0 {
+		delete(sharedBonds.m, h.bl)
+	}
+}
+
+// bondStore returns the bond store of the HCI, or the one shared by its BeaconLine.
+func (h *HCI) bondStore() BondStore {
+	if h.bonds != nil {
+		return h.bonds
+	}
+	sharedBonds.Lock()
+	defer sharedBonds.Unlock()
+	if lb, ok := sharedBonds.m[h.bl]; ok {
+		return lb.store
+	}
+	return nil
+}
+
+// identityAddr returns the DeviceAddr of an address.
+func identityAddr(a ble.Addr) (ble.DeviceAddr, error) {
+	t, b, err := peerAddr(a)
+	if err != nil {
+		return ble.DeviceAddr{}, err
+	}
+	return deviceAddr(t, b), nil
+}
+
+// loadBond returns the bond of a remote device. Resolvable private addresses
+// are resolved with the known identities, or with the IRKs of the bonds,
+// which might have been distributed to another anchor.
+func (h *HCI) loadBond(a ble.Addr) (Bond, bool) {
+	s := h.bondStore()
+	if s == nil {
+		return Bond{}, false
+	}
+	t, b, err := peerAddr(a)
+	if err != nil {
+		return Bond{}, false
+	}
+	if t == AddrTypeRandom && isRPA(b) {
+		id, ok := h.resolve(b)
+		if !ok {
+			for _, x := range s.Bonds() {
+				if x.Remote.Dist&keyDistID != 0 && resolveRPA(x.Remote.IRK, b) {
+					return x, true
+				}
+			}
+			return Bond{}, false
+		}
+		a = id.Addr
+	}
+	ia, err := identityAddr(a)
+	if err != nil {
+		return Bond{}, false
+	}
+	return s.Load(ia)
+}
+
+// saveBond stores the keys exchanged with a remote device.
+// The IRK distributed by the remote device is added to its identities.
+func (h *HCI) saveBond(a ble.Addr, local, remote Keys) error {
+	s := h.bondStore()
+	if s == nil {
+		return nil
+	}
+	ia, err := h.bondAddr(a, remote)
+	if err != nil {
+		return err
+	}
+	if remote.Dist&keyDistID != 0 {
+		if err := h.AddIdentity(Identity{Addr: ia, IRK: remote.IRK}); err != nil {
+			logger.Warn("bond", "add identity", err)
+		}
+	}
+	return s.Save(Bond{Addr: ia, Local: local, Remote: remote})
+}
+
+// bondAddr returns the identity address of a remote device, which is either
+// distributed by the device, or resolved from its address.
+func (h *HCI) bondAddr(a ble.Addr, remote Keys) (ble.DeviceAddr, error) {
+	if remote.Dist&keyDistID != 0 {
+		return remote.IdentityAddr, nil
+	}
+	if t, b, _ := peerAddr(a); t == AddrTypeRandom && isRPA(b) {
+		if id, ok := h.resolve(b); ok {
+			return identityAddr(id.Addr)
+		}
+	}
+	return identityAddr(a)
+}
+
+// loadBond loads the keys of the bond with the remote device, unless the keys
+// were exchanged already. The caller holds the lock of s.
+func (s *smp) loadBond() {
+	if s.bonded || s.local.Dist|s.remote.Dist != 0 {
+		return
+	}
+	if b, ok := s.c.hci.loadBond(s.c.RemoteAddr()); ok {
+		s.local, s.remote, s.bonded = b.Local, b.Remote, true
+	}
+}
+
+// bondSaveDelay batches the saves of the sign counters, which change on each
+// signed write, so the bond store isn't written each time.
+const bondSaveDelay = time.Second
+
+// updateBond stores the keys of the bond with the remote device, after their
+// sign counters changed. They're stored once bondSaveDelay passed, or the link
+// is disconnected. The caller holds the lock of s.
+func (s *smp) updateBond() {
+	if !s.bonded || s.saveBond != nil {
+		return
+	}
+	s.saveBond = time.AfterFunc(bondSaveDelay, s.flushBond)
+}
+
+// flushBond stores the keys of the bond with the remote device, if their
+// sign counters changed since they were stored.
+func (s *smp) flushBond() {
+	s.Lock()
+	defer s.Unlock()
+	if s.saveBond == nil {
+		return
+	}
+	s.saveBond.Stop()
+	s.saveBond = nil
+	bs := s.c.hci.bondStore()
+	if bs == nil {
+		return
+	}
+	a, err := s.c.hci.bondAddr(s.c.RemoteAddr(), s.remote)
+	if err != nil {
+		return
+	}
+	if err := bs.Save(Bond{Addr: a, Local: s.local, Remote: s.remote}); err != nil {
+		logger.Warn("bond", "save", err)
+	}
+}
+
+// resume encrypts the link with the LTK distributed by a bonded slave,
+// when the local device is the master [Vol 3, Part H, 2.4.4.1]. It runs in
+// the background, and a pairing waits for it to be done.
+func (s *smp) resume() {
+	done := make(chan struct{})
+	s.Lock()
+	s.resumed = done
+	s.Unlock()
+	go func() {
+		defer close(done)
+		b, ok := s.c.hci.loadBond(s.c.RemoteAddr())
+		if !ok || b.Remote.Dist&keyDistEnc == 0 {
+			return
+		}
+		if err := s.encryptBond(b); err != nil {
+			logger.Warn("smp", "resume encryption", err)
+		}
+	}()
+}
+
+// encryptBond encrypts the link with the LTK of bond b, and waits for the
+// Encryption Change event.
+func (s *smp) encryptBond(b Bond) error {
+	s.Lock()
+	s.local, s.remote, s.bonded = b.Local, b.Remote, true
+	s.auth = b.Remote.Authenticated
+	s.sc = b.Remote.SecureConnections
+	s.keySize = b.Remote.KeySize
+	s.Unlock()
+	s.drainEncryption()
+	if err := s.c.hci.Send(&cmd.LEStartEncryption{
+		ConnectionHandle:     s.c.param.ConnectionHandle(),
+		RandomNumber:         b.Remote.Rand,
+		EncryptedDiversifier: b.Remote.EDIV,
+		LongTermKey:          swap16(b.Remote.LTK),
+	}, nil); err != nil {
+		return err
+	}
+	select {
+	case err := <-s.chEnc:
+		return err
+	case <-s.c.Disconnected():
+		return io.ErrClosedPipe
+	case <-time.After(smpTimeout):
+		return errors.New("smp: encryption timed out")
+	}
+}
@@ -0,0 +1,176 @@
+package hci
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ble "traulfs/Bline/ble"
+	"traulfs/Bline/ble/bline/hci/socket"
+)
+
+func TestFileBondStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bonds.json")
+	s, err := NewFileBondStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same address bytes of both types are distinct identities.
+	b := []byte{0x11, 0x22, 0x33, 0x44, 0x55, 0xc6}
+	pub := Bond{Addr: ble.NewDeviceAddr(b, false), Remote: Keys{LTK: h16("0102030405060708090a0b0c0d0e0f10"), Dist: keyDistEnc}}
+	rnd := Bond{Addr: ble.NewDeviceAddr(b, true), Local: Keys{CSRK: h16("0f0e0d0c0b0a09080706050403020100"), SignCounter: 7, Dist: keyDistSign}}
+	counted := rnd
+	counted.Local.SignCounter++
+	for _, x := range []Bond{pub, rnd} {
+		if err := s.Save(x); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		update func(s *FileBondStore) error
+		want   []Bond
+	}{
+		{"reopened", func(*FileBondStore) error { return nil }, []Bond{pub, rnd}},
+		{"deleted", func(s *FileBondStore) error { return s.Delete(pub.Addr) }, []Bond{rnd}},
+		{"deleted twice", func(s *FileBondStore) error { return s.Delete(pub.Addr) }, []Bond{rnd}},
+		{"replaced", func(s *FileBondStore) error { return s.Save(counted) }, []Bond{counted}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.update(s); err != nil {
+				t.Fatal(err)
+			}
+			if s, err = NewFileBondStore(path); err != nil {
+				t.Fatal(err)
+			}
+			if n := len(s.Bonds()); n != len(tc.want) {
+				t.Errorf("got %d bonds, want %d", n, len(tc.want))
+			}
+			for _, w := range tc.want {
+				if got, ok := s.Load(w.Addr); !ok || got != w {
+					t.Errorf("%s: got %+v, %v, want %+v", w.Addr, got, ok, w)
+				}
+			}
+			if _, ok := s.Load(pub.Addr); ok != (len(tc.want) == 2) {
+				t.Errorf("%s: got bond %v", pub.Addr, ok)
+			}
+		})
+	}
+}
+
+// TestSharedBondStore checks that the anchors of a BeaconLine share a bond
+// store, until the last of them is closed.
+func TestSharedBondStore(t *testing.T) {
+	store, err := NewFileBondStore(filepath.Join(t.TempDir(), "bonds.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl := &socket.BeaconLine{}
+	a, b := &HCI{bl: bl, bonds: store}, &HCI{bl: bl}
+	for _, h := range []*HCI{b, a, a} {
+		h.shareBondStore()
+	}
+	if b.bondStore() != store {
+		t.Fatal("the store isn't shared")
+	}
+	a.close(nil)
+	a.close(nil)
+	if b.bondStore() != store {
+		t.Error("the store isn't shared, after another anchor was closed")
+	}
+	b.close(nil)
+	sharedBonds.Lock()
+	_, ok := sharedBonds.m[bl]
+	sharedBonds.Unlock()
+	if ok {
+		t.Error("the store is kept, after the last anchor was closed")
+	}
+}
+
+// TestLTKRequest checks that the key of the bond is handed out, when a bonded
+// master encrypts the link again.
+func TestLTKRequest(t *testing.T) {
+	local := Keys{LTK: h16("000102030405060708090a0b0c0d0e0f"), EDIV: 0xabcd, Rand: 0x1122334455667788, KeySize: 16, Authenticated: true, Dist: keyDistEnc}
+	for _, tc := range []struct {
+		name   string
+		rand   uint64
+		ediv   uint16
+		bonded bool
+		level  int
+	}{
+		{"bonded", local.Rand, local.EDIV, true, SecurityAuthenticated},
+		{"other EDIV", local.Rand, 0x0001, true, SecurityNone},
+		{"other Rand", 0x01, local.EDIV, true, SecurityNone},
+		{"not bonded", local.Rand, local.EDIV, false, SecurityNone},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, f := newTestHCI(t)
+			store, err := NewFileBondStore(filepath.Join(t.TempDir(), "bonds.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.SetBondStore(store)
+			if tc.bonded {
+				store.Save(Bond{Addr: peerKeys.IdentityAddr, Local: local})
+			}
+
+			// The peer connects to the host.
+			at, a, _ := peerAddr(peerKeys.IdentityAddr)
+			handle := f.accept(at, a)
+			c := <-h.chSlaveConn
+			p := make([]byte, 13)
+			p[0] = 0x05
+			binary.LittleEndian.PutUint16(p[1:], handle)
+			binary.LittleEndian.PutUint64(p[3:], tc.rand)
+			binary.LittleEndian.PutUint16(p[11:], tc.ediv)
+			f.event(0x3E, p...)
+
+			if tc.level == SecurityNone {
+				f.waitParams(t, opLELTKRequestNegReply)
+				if f.sent(opLELTKRequestReply) {
+					t.Error("got LE Long Term Key Request Reply")
+				}
+				return
+			}
+			ltk := swap16(local.LTK)
+			if p := f.waitParams(t, opLELTKRequestReply); !bytes.Equal(p[2:18], ltk[:]) {
+				t.Errorf("got key % X, want % X", p[2:18], ltk)
+			}
+			for end := time.Now().Add(2 * time.Second); c.SecurityLevel() != tc.level && time.Now().Before(end); {
+				time.Sleep(time.Millisecond)
+			}
+			if l := c.SecurityLevel(); l != tc.level {
+				t.Errorf("got security level %d, want %d", l, tc.level)
+			}
+		})
+	}
+}
+
+// TestResumeEncryption checks that the link to a bonded slave is encrypted
+// with the key of its bond, once connected.
+func TestResumeEncryption(t *testing.T) {
+	h, f := newTestHCI(t)
+	store, err := NewFileBondStore(filepath.Join(t.TempDir(), "bonds.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetBondStore(store)
+	remote := Keys{LTK: h16("000102030405060708090a0b0c0d0e0f"), EDIV: 0xabcd, Rand: 0x1122334455667788, KeySize: 16, Dist: keyDistEnc}
+	store.Save(Bond{Addr: peerKeys.IdentityAddr, Remote: remote})
+
+	c, _ := testConn(t, h, f)
+	p := f.waitParams(t, opLEStartEncryption)
+	ltk := swap16(remote.LTK)
+	if binary.LittleEndian.Uint64(p[2:]) != remote.Rand || binary.LittleEndian.Uint16(p[10:]) != remote.EDIV || !bytes.Equal(p[12:28], ltk[:]) {
+		t.Errorf("got LE Start Encryption % X", p)
+	}
+	for end := time.Now().Add(2 * time.Second); c.SecurityLevel() != SecurityEncrypted && time.Now().Before(end); {
+		time.Sleep(time.Millisecond)
+	}
+	if l := c.SecurityLevel(); l != SecurityEncrypted {
+		t.Errorf("got security level %d, want %d", l, SecurityEncrypted)
+	}
+}
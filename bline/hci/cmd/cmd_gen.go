@@ -1560,3 +1560,218 @@ type LERemoteConnectionParameterRequestNegativeReplyRP struct {
 func (c *LERemoteConnectionParameterRequestNegativeReplyRP) Unmarshal(b []byte) error {
 	return unmarshal(c, b)
 }
+
+// LEAddDeviceToResolvingList implements LE Add Device To Resolving List (0x08|0x0027) [Vol 2, Part E, 7.8.38]
+type LEAddDeviceToResolvingList struct {
+	PeerIdentityAddressType uint8
+	PeerIdentityAddress     [6]byte
+	PeerIRK                 [16]byte
+	LocalIRK                [16]byte
+}
+
+func (c *LEAddDeviceToResolvingList) String() string {
+	return "LE Add Device To Resolving List (0x08|0x0027)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LEAddDeviceToResolvingList) OpCode() int { return 0x08<<10 | 0x0027 }
+
+// Len returns the length of the command.
+func (c *LEAddDeviceToResolvingList) Len() int { return 39 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LEAddDeviceToResolvingList) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LEAddDeviceToResolvingListRP returns the return parameter of LE Add Device To Resolving List
+type LEAddDeviceToResolvingListRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LEAddDeviceToResolvingListRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LERemoveDeviceFromResolvingList implements LE Remove Device From Resolving List (0x08|0x0028) [Vol 2, Part E, 7.8.39]
+type LERemoveDeviceFromResolvingList struct {
+	PeerIdentityAddressType uint8
+	PeerIdentityAddress     [6]byte
+}
+
+func (c *LERemoveDeviceFromResolvingList) String() string {
+	return "LE Remove Device From Resolving List (0x08|0x0028)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LERemoveDeviceFromResolvingList) OpCode() int { return 0x08<<10 | 0x0028 }
+
+// Len returns the length of the command.
+func (c *LERemoveDeviceFromResolvingList) Len() int { return 7 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LERemoveDeviceFromResolvingList) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LERemoveDeviceFromResolvingListRP returns the return parameter of LE Remove Device From Resolving List
+type LERemoveDeviceFromResolvingListRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LERemoveDeviceFromResolvingListRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LEClearResolvingList implements LE Clear Resolving List (0x08|0x0029) [Vol 2, Part E, 7.8.40]
+type LEClearResolvingList struct {
+}
+
+func (c *LEClearResolvingList) String() string {
+	return "LE Clear Resolving List (0x08|0x0029)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LEClearResolvingList) OpCode() int { return 0x08<<10 | 0x0029 }
+
+// Len returns the length of the command.
+func (c *LEClearResolvingList) Len() int { return 0 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LEClearResolvingList) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LEClearResolvingListRP returns the return parameter of LE Clear Resolving List
+type LEClearResolvingListRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LEClearResolvingListRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LEReadResolvingListSize implements LE Read Resolving List Size (0x08|0x002A) [Vol 2, Part E, 7.8.41]
+type LEReadResolvingListSize struct {
+}
+
+func (c *LEReadResolvingListSize) String() string {
+	return "LE Read Resolving List Size (0x08|0x002A)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LEReadResolvingListSize) OpCode() int { return 0x08<<10 | 0x002A }
+
+// Len returns the length of the command.
+func (c *LEReadResolvingListSize) Len() int { return 0 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LEReadResolvingListSize) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LEReadResolvingListSizeRP returns the return parameter of LE Read Resolving List Size
+type LEReadResolvingListSizeRP struct {
+	Status            uint8
+	ResolvingListSize uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LEReadResolvingListSizeRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LESetAddressResolutionEnable implements LE Set Address Resolution Enable (0x08|0x002D) [Vol 2, Part E, 7.8.44]
+type LESetAddressResolutionEnable struct {
+	AddressResolutionEnable uint8
+}
+
+func (c *LESetAddressResolutionEnable) String() string {
+	return "LE Set Address Resolution Enable (0x08|0x002D)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetAddressResolutionEnable) OpCode() int { return 0x08<<10 | 0x002D }
+
+// Len returns the length of the command.
+func (c *LESetAddressResolutionEnable) Len() int { return 1 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetAddressResolutionEnable) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LESetAddressResolutionEnableRP returns the return parameter of LE Set Address Resolution Enable
+type LESetAddressResolutionEnableRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetAddressResolutionEnableRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LESetResolvablePrivateAddressTimeout implements LE Set Resolvable Private Address Timeout (0x08|0x002E) [Vol 2, Part E, 7.8.45]
+type LESetResolvablePrivateAddressTimeout struct {
+	RPATimeout uint16
+}
+
+func (c *LESetResolvablePrivateAddressTimeout) String() string {
+	return "LE Set Resolvable Private Address Timeout (0x08|0x002E)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetResolvablePrivateAddressTimeout) OpCode() int { return 0x08<<10 | 0x002E }
+
+// Len returns the length of the command.
+func (c *LESetResolvablePrivateAddressTimeout) Len() int { return 2 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetResolvablePrivateAddressTimeout) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LESetResolvablePrivateAddressTimeoutRP returns the return parameter of LE Set Resolvable Private Address Timeout
+type LESetResolvablePrivateAddressTimeoutRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetResolvablePrivateAddressTimeoutRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LESetPrivacyMode implements LE Set Privacy Mode (0x08|0x004E) [Vol 2, Part E, 7.8.77]
+type LESetPrivacyMode struct {
+	PeerIdentityAddressType uint8
+	PeerIdentityAddress     [6]byte
+	PrivacyMode             uint8
+}
+
+func (c *LESetPrivacyMode) String() string {
+	return "LE Set Privacy Mode (0x08|0x004E)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetPrivacyMode) OpCode() int { return 0x08<<10 | 0x004E }
+
+// Len returns the length of the command.
+func (c *LESetPrivacyMode) Len() int { return 8 }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetPrivacyMode) Marshal(b []byte) error {
+	return marshal(c, b)
+}
+
+// LESetPrivacyModeRP returns the return parameter of LE Set Privacy Mode
+type LESetPrivacyModeRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetPrivacyModeRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
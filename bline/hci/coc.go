@@ -0,0 +1,641 @@
+package hci
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	ble "traulfs/Bline/ble"
+
+	"github.com/pkg/errors"
+)
+
+// LE Credit Based Flow Control Mode [Vol 3, Part A, 10.2].
+// Each K-frame sent consumes a credit, which the receiving device grants
+// back once it has room for more.
+
+// Parameters of the local endpoint of the channels.
+const (
+	cocMTU     = 2048 // Maximum SDU size.
+	cocMPS     = 247  // Maximum K-frame payload size; fits in a single LE data PDU.
+	cocCredits = 16   // K-frames buffered per channel.
+)
+
+// Results of LE Credit Based Connection Response [Vol 3, Part A, 4.23].
+const (
+	ErrChannelPSMNotSupported    ChannelError = 0x0002 // LE_PSM not supported
+	ErrChannelNoResources        ChannelError = 0x0004 // No resources available
+	ErrChannelAuthentication     ChannelError = 0x0005 // Insufficient Authentication
+	ErrChannelAuthorization      ChannelError = 0x0006 // Insufficient Authorization
+	ErrChannelEncryptionKeySize  ChannelError = 0x0007 // Insufficient Encryption Key Size
+	ErrChannelEncryption         ChannelError = 0x0008 // Insufficient Encryption
+	ErrChannelInvalidSourceCID   ChannelError = 0x0009 // Invalid Source CID
+	ErrChannelSourceCIDAllocated ChannelError = 0x000A // Source CID already allocated
+	ErrChannelParameters         ChannelError = 0x000B // Unacceptable parameters
+)
+
+// ChannelError is the result of a refused LE Credit Based Connection Request.
+type ChannelError uint16
+
+var channelErrStr = map[ChannelError]string{
+	0x0002: "LE_PSM not supported",
+	0x0004: "no resources available",
+	0x0005: "insufficient authentication",
+	0x0006: "insufficient authorization",
+	0x0007: "insufficient encryption key size",
+	0x0008: "insufficient encryption",
+	0x0009: "invalid source CID",
+	0x000A: "source CID already allocated",
+	0x000B: "unacceptable parameters",
+}
+
+func (e ChannelError) Error() string {
+	if s, ok := channelErrStr[e]; ok {
+		return "channel refused: " + s
+	}
+	return fmt.Sprintf("channel refused: result 0x%04X", uint16(e))
+}
+
+// ChannelAddr is the address of an endpoint of a Channel.
+type ChannelAddr struct {
+	Addr ble.Addr
+	PSM  uint16
+}
+
+// Network returns "l2cap".
+func (a ChannelAddr) Network() string { return "l2cap" }
+
+func (a ChannelAddr) String() string { return fmt.Sprintf("%s/%d", a.Addr, a.PSM) }
+
+// sdu is a reassembled SDU, and the number of K-frames it took.
+type sdu struct {
+	b      []byte
+	frames int
+}
+
+// Channel is an LE Credit Based Connection-oriented Channel [Vol 3, Part A, 10.2].
+// It implements net.Conn, with SDUs of the stream broken down to the MTU of
+// the remote device.
+type Channel struct {
+	c    *Conn
+	psm  uint16
+	scid uint16 // Local CID.
+	dcid uint16 // Remote CID.
+
+	txMTU int
+	txMPS int
+
+	muWrite sync.Mutex
+
+	mu        sync.Mutex
+	txCredits int
+	rxCredits int    // Credits granted to the remote device, and not used yet.
+	cur       []byte // SDU being reassembled.
+	slen      int
+	frames    int
+	sdus      []sdu
+	rbuf      []byte // Remains of the SDU being read.
+
+	chTx   chan struct{} // Credits received.
+	chRx   chan struct{} // SDU received.
+	closed chan struct{}
+	once   sync.Once
+
+	muDeadline    sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newChannel(c *Conn, psm, scid, dcid uint16, mtu, mps, credits int) *Channel {
+	return &Channel{
+		c:         c,
+		psm:       psm,
+		scid:      scid,
+		dcid:      dcid,
+		txMTU:     mtu,
+		txMPS:     mps,
+		txCredits: credits,
+		rxCredits: cocCredits,
+		chTx:      make(chan struct{}, 1),
+		chRx:      make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+	}
+}
+
+// OpenChannel connects an LE Credit Based Connection-oriented Channel to the
+// remote device, which listens on the LE_PSM [Vol 3, Part A, 4.22].
+func (c *Conn) OpenChannel(psm uint16) (*Channel, error) {
+	if psm == 0 || psm > 0x00FF {
+		return nil, errors.New("invalid LE_PSM")
+	}
+	ch, err := c.addChannel(func(scid uint16) *Channel {
+		return newChannel(c, psm, scid, 0, 0, 0, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var rsp LECreditBasedConnectionResponse
+	err = c.Signal(&LECreditBasedConnectionRequest{
+		LEPSM:          psm,
+		SourceCID:      ch.scid,
+		MTU:            cocMTU,
+		MPS:            cocMPS,
+		InitialCredits: cocCredits,
+	}, &rsp)
+	switch {
+	case err != nil:
+	case rsp.Result != 0x0000:
+		err = ChannelError(rsp.Result)
+	case rsp.DestinationCID < cidDynamicFirst || rsp.MTU < 23 || rsp.MPS < 23:
+		err = ErrChannelParameters
+	}
+	if err != nil {
+		c.removeChannel(ch.scid)
+		return nil, err
+	}
+
+	ch.mu.Lock()
+	ch.dcid = rsp.DestinationCID
+	ch.txMTU = int(rsp.MTU)
+	ch.txMPS = int(rsp.MPS)
+	ch.txCredits = int(rsp.InitialCreditsCID)
+	ch.mu.Unlock()
+	return ch, nil
+}
+
+// ChannelListener accepts the LE Credit Based Connection-oriented Channels,
+// which remote devices connect to an LE_PSM.
+type ChannelListener struct {
+	h      *HCI
+	psm    uint16
+	chAcpt chan *Channel
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Listen listens for channels connected to the LE_PSM by remote devices.
+func (h *HCI) Listen(psm uint16) (*ChannelListener, error) {
+	if psm == 0 || psm > 0x00FF {
+		return nil, errors.New("invalid LE_PSM")
+	}
+	h.muListeners.Lock()
+	defer h.muListeners.Unlock()
+	if _, ok := h.listeners[psm]; ok {
+		return nil, errors.Errorf("LE_PSM 0x%02X in use", psm)
+	}
+	if h.listeners == nil {
+		h.listeners = make(map[uint16]*ChannelListener)
+	}
+	l := &ChannelListener{
+		h:      h,
+		psm:    psm,
+		chAcpt: make(chan *Channel, 8),
+		closed: make(chan struct{}),
+	}
+	h.listeners[psm] = l
+	return l, nil
+}
+
+// Accept waits for and returns the next channel connected to the LE_PSM.
+func (l *ChannelListener) Accept() (*Channel, error) {
+	select {
+	case ch := <-l.chAcpt:
+		return ch, nil
+	case <-l.closed:
+		return nil, io.ErrClosedPipe
+	}
+}
+
+// Close stops listening. Channels already accepted are not closed.
+func (l *ChannelListener) Close() error {
+	l.once.Do(func() {
+		l.h.muListeners.Lock()
+		delete(l.h.listeners, l.psm)
+		l.h.muListeners.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+// PSM returns the LE_PSM, which the listener listens on.
+func (l *ChannelListener) PSM() uint16 { return l.psm }
+
+// deliver hands a channel, which was just opened, to Accept. The channel is
+// disconnected if the listener filled up meanwhile.
+func (l *ChannelListener) deliver(ch *Channel) {
+	select {
+	case l.chAcpt <- ch:
+	default:
+		go ch.Close()
+	}
+}
+
+// handleLECreditBasedConnectionRequest accepts a channel for a listener of the LE_PSM [Vol 3, Part A, 4.22].
+func (c *Conn) handleLECreditBasedConnectionRequest(s sigCmd) {
+	var req LECreditBasedConnectionRequest
+	if err := req.Unmarshal(s.data()); err != nil {
+		return
+	}
+	reply := func(rsp *LECreditBasedConnectionResponse) {
+		c.sendResponse(SignalLECreditBasedConnectionResponse, s.id(), rsp)
+	}
+
+	c.hci.muListeners.Lock()
+	l := c.hci.listeners[req.LEPSM]
+	c.hci.muListeners.Unlock()
+	switch {
+	case l == nil:
+		reply(&LECreditBasedConnectionResponse{Result: uint16(ErrChannelPSMNotSupported)})
+		return
+	case req.SourceCID < cidDynamicFirst || req.SourceCID > cidDynamicLast:
+		reply(&LECreditBasedConnectionResponse{Result: uint16(ErrChannelInvalidSourceCID)})
+		return
+	case c.remoteChannel(req.SourceCID) != nil:
+		reply(&LECreditBasedConnectionResponse{Result: uint16(ErrChannelSourceCIDAllocated)})
+		return
+	case req.MTU < 23 || req.MPS < 23 || req.MPS > 65533:
+		reply(&LECreditBasedConnectionResponse{Result: uint16(ErrChannelParameters)})
+		return
+	}
+
+	ch, err := c.addChannel(func(scid uint16) *Channel {
+		return newChannel(c, req.LEPSM, scid, req.SourceCID, int(req.MTU), int(req.MPS), int(req.InitialCredits))
+	})
+	if err != nil {
+		reply(&LECreditBasedConnectionResponse{Result: uint16(ErrChannelNoResources)})
+		return
+	}
+	if len(l.chAcpt) == cap(l.chAcpt) {
+		c.removeChannel(ch.scid)
+		reply(&LECreditBasedConnectionResponse{Result: uint16(ErrChannelNoResources)})
+		return
+	}
+
+	// The channel is open once the response is sent. It's delivered only
+	// then, so that nothing is sent on it before.
+	reply(&LECreditBasedConnectionResponse{
+		DestinationCID:    ch.scid,
+		MTU:               cocMTU,
+		MPS:               cocMPS,
+		InitialCreditsCID: cocCredits,
+		Result:            0x0000,
+	})
+	l.deliver(ch)
+}
+
+// handleLEFlowControlCredit adds the credits granted by the remote device [Vol 3, Part A, 4.24].
+func (c *Conn) handleLEFlowControlCredit(s sigCmd) {
+	var req LEFlowControlCredit
+	if err := req.Unmarshal(s.data()); err != nil {
+		return
+	}
+	ch := c.remoteChannel(req.CID)
+	if ch == nil {
+		return
+	}
+	ch.mu.Lock()
+	ch.txCredits += int(req.Credits)
+	overflow := ch.txCredits > 65535
+	ch.mu.Unlock()
+	if overflow {
+		// The credit count shall not exceed 65535 [Vol 3, Part A, 10.1].
+		go ch.Close()
+		return
+	}
+	select {
+	case ch.chTx <- struct{}{}:
+	default:
+	}
+}
+
+// addChannel allocates a local CID, and adds the channel created with it.
+func (c *Conn) addChannel(f func(scid uint16) *Channel) (*Channel, error) {
+	c.muChannels.Lock()
+	defer c.muChannels.Unlock()
+	if c.channels == nil {
+		c.channels = make(map[uint16]*Channel)
+	}
+	for cid := cidDynamicFirst; cid <= cidDynamicLast; cid++ {
+		if _, ok := c.channels[cid]; !ok {
+			ch := f(cid)
+			c.channels[cid] = ch
+			return ch, nil
+		}
+	}
+	return nil, ErrChannelNoResources
+}
+
+func (c *Conn) removeChannel(cid uint16) {
+	c.muChannels.Lock()
+	delete(c.channels, cid)
+	c.muChannels.Unlock()
+}
+
+// channel returns the channel of a local CID.
+func (c *Conn) channel(cid uint16) *Channel {
+	c.muChannels.Lock()
+	defer c.muChannels.Unlock()
+	return c.channels[cid]
+}
+
+// remoteChannel returns the channel of a remote CID.
+func (c *Conn) remoteChannel(cid uint16) *Channel {
+	c.muChannels.Lock()
+	defer c.muChannels.Unlock()
+	for _, ch := range c.channels {
+		if ch.remoteCID() == cid {
+			return ch
+		}
+	}
+	return nil
+}
+
+// closeChannels closes the channels, when the connection is closed.
+func (c *Conn) closeChannels() {
+	c.muChannels.Lock()
+	chs := make([]*Channel, 0, len(c.channels))
+	for _, ch := range c.channels {
+		chs = append(chs, ch)
+	}
+	c.muChannels.Unlock()
+	for _, ch := range chs {
+		ch.shutdown()
+	}
+}
+
+// receive reassembles the SDUs from K-frames [Vol 3, Part A, 3.4.3].
+// It's called by the recombine goroutine, so it must not block.
+func (ch *Channel) receive(b []byte) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	// The channel is disconnected, if the remote device sends a K-frame
+	// without credits, or a malformed one [Vol 3, Part A, 10.1].
+	fail := func(reason string) {
+		logger.Warn("coc", "receive", fmt.Sprintf("0x%04X: %s", ch.scid, reason))
+		go ch.Close()
+	}
+	if ch.rxCredits == 0 {
+		fail("no credits")
+		return
+	}
+	ch.rxCredits--
+	if len(b) > cocMPS {
+		fail("K-frame exceeds MPS")
+		return
+	}
+	if ch.cur == nil {
+		if len(b) < 2 {
+			fail("missing SDU length")
+			return
+		}
+		ch.slen = int(binary.LittleEndian.Uint16(b))
+		if ch.slen > cocMTU {
+			fail("SDU exceeds MTU")
+			return
+		}
+		ch.cur = make([]byte, 0, ch.slen)
+		b = b[2:]
+	}
+	ch.frames++
+	if len(ch.cur)+len(b) > ch.slen {
+		fail("SDU exceeds SDU length")
+		return
+	}
+	ch.cur = append(ch.cur, b...)
+	if len(ch.cur) < ch.slen {
+		return
+	}
+	ch.sdus = append(ch.sdus, sdu{b: ch.cur, frames: ch.frames})
+	ch.cur, ch.frames = nil, 0
+	select {
+	case ch.chRx <- struct{}{}:
+	default:
+	}
+}
+
+// Read reads the data of the received SDUs.
+func (ch *Channel) Read(b []byte) (int, error) {
+	for {
+		ch.mu.Lock()
+		if len(ch.rbuf) == 0 && len(ch.sdus) > 0 {
+			s := ch.sdus[0]
+			ch.sdus = ch.sdus[1:]
+			ch.rbuf = s.b
+			ch.rxCredits += s.frames
+			go ch.grantCredits(s.frames)
+		}
+		if len(ch.rbuf) > 0 {
+			n := copy(b, ch.rbuf)
+			ch.rbuf = ch.rbuf[n:]
+			ch.mu.Unlock()
+			return n, nil
+		}
+		ch.mu.Unlock()
+
+		ch.muDeadline.Lock()
+		timeout := deadline(ch.readDeadline)
+		ch.muDeadline.Unlock()
+		select {
+		case <-ch.chRx:
+		case <-ch.closed:
+			return 0, io.EOF
+		case <-timeout:
+			return 0, errTimeout
+		}
+	}
+}
+
+// grantCredits grants credits back to the remote device for the K-frames,
+// which have been read.
+func (ch *Channel) grantCredits(n int) {
+	select {
+	case <-ch.closed:
+		return
+	default:
+	}
+	r := &LEFlowControlCredit{CID: ch.scid, Credits: uint16(n)}
+	if _, err := ch.c.sendResponse(SignalLEFlowControlCredit, ch.c.newSigID(), r); err != nil {
+		logger.Warn("coc", "grant credits", err)
+	}
+}
+
+// Write sends the data in SDUs of at most the MTU of the remote device,
+// segmented into K-frames [Vol 3, Part A, 7.3.1]. It blocks while the remote
+// device grants no credits.
+func (ch *Channel) Write(b []byte) (int, error) {
+	ch.muWrite.Lock()
+	defer ch.muWrite.Unlock()
+	ch.mu.Lock()
+	mtu, mps := ch.txMTU, ch.txMPS
+	ch.mu.Unlock()
+	n := 0
+	for len(b) > 0 {
+		l := len(b)
+		if l > mtu {
+			l = mtu
+		}
+		if err := ch.writeSDU(b[:l], mps); err != nil {
+			return n, err
+		}
+		n += l
+		b = b[l:]
+	}
+	return n, nil
+}
+
+func (ch *Channel) writeSDU(b []byte, mps int) error {
+	first := true
+	for first || len(b) > 0 {
+		if err := ch.takeCredit(); err != nil {
+			return err
+		}
+		hlen := 4
+		if first {
+			hlen = 6
+		}
+		l := len(b)
+		if l > mps-(hlen-4) {
+			l = mps - (hlen - 4)
+		}
+		f := make([]byte, hlen+l)
+		binary.LittleEndian.PutUint16(f[0:2], uint16(hlen-4+l))
+		binary.LittleEndian.PutUint16(f[2:4], ch.remoteCID())
+		if first {
+			binary.LittleEndian.PutUint16(f[4:6], uint16(len(b)))
+		}
+		copy(f[hlen:], b[:l])
+		if _, err := ch.c.writePDU(f); err != nil {
+			return err
+		}
+		b = b[l:]
+		first = false
+	}
+	return nil
+}
+
+// takeCredit waits for a credit to send a K-frame.
+func (ch *Channel) takeCredit() error {
+	for {
+		ch.mu.Lock()
+		if ch.txCredits > 0 {
+			ch.txCredits--
+			ch.mu.Unlock()
+			return nil
+		}
+		ch.mu.Unlock()
+
+		ch.muDeadline.Lock()
+		timeout := deadline(ch.writeDeadline)
+		ch.muDeadline.Unlock()
+		select {
+		case <-ch.chTx:
+		case <-ch.closed:
+			return io.ErrClosedPipe
+		case <-timeout:
+			return errTimeout
+		}
+	}
+}
+
+// Close disconnects the channel [Vol 3, Part A, 4.6].
+func (ch *Channel) Close() error {
+	if !ch.shutdown() {
+		return nil
+	}
+	select {
+	case <-ch.c.chDone:
+		return nil
+	default:
+	}
+	return ch.c.Signal(&DisconnectRequest{
+		DestinationCID: ch.remoteCID(),
+		SourceCID:      ch.scid,
+	}, &DisconnectResponse{})
+}
+
+// shutdown closes the channel locally. It tells if the channel was open.
+func (ch *Channel) shutdown() bool {
+	closed := false
+	ch.once.Do(func() {
+		ch.c.removeChannel(ch.scid)
+		close(ch.closed)
+		closed = true
+	})
+	return closed
+}
+
+// remoteCID returns the CID of the remote endpoint, which is known once the
+// channel is open.
+func (ch *Channel) remoteCID() uint16 {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.dcid
+}
+
+// Conn returns the connection, which carries the channel.
+func (ch *Channel) Conn() *Conn { return ch.c }
+
+// PSM returns the LE_PSM of the channel.
+func (ch *Channel) PSM() uint16 { return ch.psm }
+
+// RxMTU returns the maximum SDU size, which the local device accepts.
+func (ch *Channel) RxMTU() int { return cocMTU }
+
+// TxMTU returns the maximum SDU size, which the remote device accepts.
+func (ch *Channel) TxMTU() int {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.txMTU
+}
+
+// LocalAddr returns the address of the local endpoint.
+func (ch *Channel) LocalAddr() net.Addr { return ChannelAddr{Addr: ch.c.LocalAddr(), PSM: ch.psm} }
+
+// RemoteAddr returns the address of the remote endpoint.
+func (ch *Channel) RemoteAddr() net.Addr { return ChannelAddr{Addr: ch.c.RemoteAddr(), PSM: ch.psm} }
+
+// SetDeadline sets the read and write deadlines.
+func (ch *Channel) SetDeadline(t time.Time) error {
+	ch.muDeadline.Lock()
+	ch.readDeadline, ch.writeDeadline = t, t
+	ch.muDeadline.Unlock()
+	return nil
+}
+
+// SetReadDeadline sets the deadline of Read calls.
+func (ch *Channel) SetReadDeadline(t time.Time) error {
+	ch.muDeadline.Lock()
+	ch.readDeadline = t
+	ch.muDeadline.Unlock()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of Write calls.
+func (ch *Channel) SetWriteDeadline(t time.Time) error {
+	ch.muDeadline.Lock()
+	ch.writeDeadline = t
+	ch.muDeadline.Unlock()
+	return nil
+}
+
+// timeoutError is returned by Read and Write after their deadlines.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var errTimeout net.Error = timeoutError{}
+
+// deadline returns a channel, which is closed at t; or nil if t is zero.
+func deadline(t time.Time) <-chan time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return time.After(time.Until(t))
+}
@@ -0,0 +1,306 @@
+package hci
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+const testPSM = 0x0080
+
+// acceptChannel connects a channel from the peer to a listener, with the
+// parameters of the peer, and returns the host's end.
+func acceptChannel(t *testing.T, f *fakeController, handle uint16, l *ChannelListener, mtu, mps, credits uint16) *Channel {
+	t.Helper()
+	f.signal(handle, 0x01, &LECreditBasedConnectionRequest{
+		LEPSM:          l.PSM(),
+		SourceCID:      0x0040,
+		MTU:            mtu,
+		MPS:            mps,
+		InitialCredits: credits,
+	})
+	var rsp LECreditBasedConnectionResponse
+	f.recvSignal(t, &rsp)
+	if rsp.Result != 0x0000 {
+		t.Fatalf("channel refused: 0x%04X", rsp.Result)
+	}
+	ch, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+// recvKFrame returns the payload of the next K-frame sent by the host on the
+// channel with the remote CID 0x0040.
+func recvKFrame(t *testing.T, f *fakeController) []byte {
+	t.Helper()
+	for {
+		if cid, p := f.recvL2CAP(t); cid == 0x0040 {
+			return p
+		}
+	}
+}
+
+func TestChannelRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		req  LECreditBasedConnectionRequest
+		want ChannelError
+	}{
+		{"accepted", LECreditBasedConnectionRequest{testPSM, 0x0040, 64, 23, 1}, 0x0000},
+		{"LE_PSM not supported", LECreditBasedConnectionRequest{0x0081, 0x0040, 64, 23, 1}, ErrChannelPSMNotSupported},
+		{"invalid source CID", LECreditBasedConnectionRequest{testPSM, 0x0004, 64, 23, 1}, ErrChannelInvalidSourceCID},
+		{"MTU too small", LECreditBasedConnectionRequest{testPSM, 0x0040, 22, 23, 1}, ErrChannelParameters},
+		{"MPS too small", LECreditBasedConnectionRequest{testPSM, 0x0040, 64, 22, 1}, ErrChannelParameters},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, f := newTestHCI(t)
+			_, handle := testConn(t, h, f)
+			l, err := h.Listen(testPSM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.signal(handle, 0x01, &tc.req)
+			var rsp LECreditBasedConnectionResponse
+			if id := f.recvSignal(t, &rsp); id != 0x01 {
+				t.Errorf("got identifier 0x%02X, want 0x01", id)
+			}
+			if ChannelError(rsp.Result) != tc.want {
+				t.Fatalf("got result 0x%04X, want 0x%04X", rsp.Result, uint16(tc.want))
+			}
+			if tc.want != 0x0000 {
+				return
+			}
+			if rsp.DestinationCID < cidDynamicFirst || rsp.MTU != cocMTU || rsp.MPS != cocMPS || rsp.InitialCreditsCID != cocCredits {
+				t.Errorf("got response %+v", rsp)
+			}
+			ch, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ch.TxMTU() != 64 || ch.PSM() != testPSM {
+				t.Errorf("got TxMTU %d, PSM 0x%02X", ch.TxMTU(), ch.PSM())
+			}
+		})
+	}
+}
+
+// TestChannelListenerFull checks that channels are refused while the backlog
+// of the listener is full.
+func TestChannelListenerFull(t *testing.T) {
+	h, f := newTestHCI(t)
+	_, handle := testConn(t, h, f)
+	l, err := h.Listen(testPSM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= cap(l.chAcpt); i++ {
+		f.signal(handle, byte(i+1), &LECreditBasedConnectionRequest{testPSM, 0x0040 + uint16(i), 64, 23, 1})
+		var rsp LECreditBasedConnectionResponse
+		f.recvSignal(t, &rsp)
+		want := ChannelError(0x0000)
+		if i == cap(l.chAcpt) {
+			want = ErrChannelNoResources
+		}
+		if ChannelError(rsp.Result) != want {
+			t.Fatalf("channel %d: got result 0x%04X, want 0x%04X", i, rsp.Result, uint16(want))
+		}
+	}
+}
+
+// TestChannelWrite checks that an SDU is segmented into K-frames of the MPS of
+// the peer, and sent as it grants credits.
+func TestChannelWrite(t *testing.T) {
+	h, f := newTestHCI(t)
+	_, handle := testConn(t, h, f)
+	l, err := h.Listen(testPSM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := acceptChannel(t, f, handle, l, 64, 23, 1)
+
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := ch.Write(data)
+		done <- err
+	}()
+
+	// SDUs of at most 64 bytes, in K-frames of at most 23 bytes.
+	var sdus [][]byte
+	var sdu []byte
+	slen, frames := 0, 0
+	for len(sdus) < 2 {
+		if frames == 1 {
+			select {
+			case err := <-done:
+				t.Fatalf("Write completed without credits: %v", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+			f.signal(handle, 0x02, &LEFlowControlCredit{CID: 0x0040, Credits: 10})
+		}
+		p := recvKFrame(t, f)
+		frames++
+		if len(p) > 23 {
+			t.Fatalf("K-frame %d: got %d bytes, exceeds MPS", frames, len(p))
+		}
+		if sdu == nil {
+			slen = int(binary.LittleEndian.Uint16(p))
+			sdu, p = []byte{}, p[2:]
+		}
+		sdu = append(sdu, p...)
+		if len(sdu) == slen {
+			sdus = append(sdus, sdu)
+			sdu = nil
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(sdus[0]) != 64 || !bytes.Equal(append(sdus[0], sdus[1]...), data) {
+		t.Errorf("got SDUs % X", sdus)
+	}
+	// 64 bytes take 3 K-frames with the SDU length, 36 bytes take 2.
+	if frames != 5 {
+		t.Errorf("got %d K-frames, want 5", frames)
+	}
+}
+
+// TestChannelRead checks that the K-frames of an SDU are reassembled, and their
+// credits granted back once it's read.
+func TestChannelRead(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		frames [][]byte
+		want   []byte
+	}{
+		{"single K-frame", [][]byte{{0x03, 0x00, 0x01, 0x02, 0x03}}, []byte{0x01, 0x02, 0x03}},
+		{"segmented", [][]byte{{0x05, 0x00, 0x01, 0x02}, {0x03, 0x04}, {0x05}}, []byte{0x01, 0x02, 0x03, 0x04, 0x05}},
+		{"empty", [][]byte{{0x00, 0x00}, {0x01, 0x00, 0x01}}, []byte{0x01}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, f := newTestHCI(t)
+			_, handle := testConn(t, h, f)
+			l, err := h.Listen(testPSM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ch := acceptChannel(t, f, handle, l, 64, 23, 1)
+			for _, p := range tc.frames {
+				f.sendL2CAP(handle, ch.scid, p...)
+			}
+
+			var got []byte
+			b := make([]byte, 2)
+			for len(got) < len(tc.want) {
+				ch.SetReadDeadline(time.Now().Add(2 * time.Second))
+				n, err := ch.Read(b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, b[:n]...)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("got % X, want % X", got, tc.want)
+			}
+
+			credits := 0
+			for credits < len(tc.frames) {
+				var c LEFlowControlCredit
+				f.recvSignal(t, &c)
+				if c.CID != ch.scid {
+					t.Fatalf("got credits for CID 0x%04X, want 0x%04X", c.CID, ch.scid)
+				}
+				credits += int(c.Credits)
+			}
+			if credits != len(tc.frames) {
+				t.Errorf("got %d credits, want %d", credits, len(tc.frames))
+			}
+		})
+	}
+}
+
+// TestChannelReadNoCredits checks that the channel is disconnected if the peer
+// sends a K-frame without credits.
+func TestChannelReadNoCredits(t *testing.T) {
+	h, f := newTestHCI(t)
+	_, handle := testConn(t, h, f)
+	l, err := h.Listen(testPSM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := acceptChannel(t, f, handle, l, 64, 23, 1)
+	for i := 0; i <= cocCredits; i++ {
+		f.sendL2CAP(handle, ch.scid, 0x01, 0x00, byte(i))
+	}
+	var req DisconnectRequest
+	id := f.recvSignal(t, &req)
+	if req.DestinationCID != 0x0040 || req.SourceCID != ch.scid {
+		t.Errorf("got %+v", req)
+	}
+	f.signal(handle, id, &DisconnectResponse{DestinationCID: 0x0040, SourceCID: ch.scid})
+
+	// The SDUs received before are still read.
+	b := make([]byte, 1)
+	for i := 0; i < cocCredits; i++ {
+		if _, err := ch.Read(b); err != nil {
+			break
+		}
+	}
+	if _, err := ch.Read(b); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
+
+func TestOpenChannel(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		rsp  LECreditBasedConnectionResponse
+		err  error
+	}{
+		{"success", LECreditBasedConnectionResponse{0x0041, 100, 50, 3, 0x0000}, nil},
+		{"refused", LECreditBasedConnectionResponse{Result: 0x0002}, ErrChannelPSMNotSupported},
+		{"invalid destination CID", LECreditBasedConnectionResponse{0x0001, 100, 50, 3, 0x0000}, ErrChannelParameters},
+		{"MTU too small", LECreditBasedConnectionResponse{0x0041, 22, 50, 3, 0x0000}, ErrChannelParameters},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, f := newTestHCI(t)
+			c, handle := testConn(t, h, f)
+			type result struct {
+				ch  *Channel
+				err error
+			}
+			done := make(chan result, 1)
+			go func() {
+				ch, err := c.OpenChannel(testPSM)
+				done <- result{ch, err}
+			}()
+
+			var req LECreditBasedConnectionRequest
+			id := f.recvSignal(t, &req)
+			if req.LEPSM != testPSM || req.MTU != cocMTU || req.MPS != cocMPS || req.InitialCredits != cocCredits {
+				t.Errorf("got request %+v", req)
+			}
+			f.signal(handle, id, &tc.rsp)
+			r := <-done
+			if r.err != tc.err {
+				t.Fatalf("got %v, want %v", r.err, tc.err)
+			}
+			if r.err != nil {
+				if c.channel(req.SourceCID) != nil {
+					t.Error("channel not removed")
+				}
+				return
+			}
+			if r.ch.scid != req.SourceCID || r.ch.remoteCID() != 0x0041 || r.ch.TxMTU() != 100 {
+				t.Errorf("got channel 0x%04X-0x%04X, TxMTU %d", r.ch.scid, r.ch.remoteCID(), r.ch.TxMTU())
+			}
+		})
+	}
+}
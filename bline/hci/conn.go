@@ -6,7 +6,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"net"
+	"sync"
+	"time"
 
 	ble "traulfs/Bline/ble"
 	"traulfs/Bline/ble/bline/hci/cmd"
@@ -22,6 +23,10 @@ type Conn struct {
 
 	param evt.LEConnectionComplete
 
+	// localAddr is the own address of the connection, which stays as the
+	// random address rotates.
+	localAddr ble.Addr
+
 	// While MTU is the maximum size of payload data that the upper layer (ATT)
 	// can accept, the MPS is the maximum PDU payload size this L2CAP implementation
 	// supports. When segmantation is not used, the MPS should be made to the same
@@ -46,7 +51,11 @@ type Conn struct {
 	sigTxMTU int
 
 	sigSent chan []byte
-	// smpSent chan []byte
+	muSig   sync.Mutex
+	muSigID sync.Mutex
+
+	// smp is the state of the Security Manager of the connection.
+	smp *smp
 
 	chInPkt chan packet
 	chInPDU chan pdu
@@ -64,6 +73,25 @@ type Conn struct {
 
 	// leFrame is set to be true when the LE Credit based flow control is used.
 	leFrame bool
+
+	// channels are the LE Credit Based Connection-oriented Channels, keyed by
+	// their local CIDs.
+	muChannels sync.Mutex
+	channels   map[uint16]*Channel
+
+	// connParams holds the currently active connection parameters, which are
+	// reported by LE Connection Complete and LE Connection Update Complete.
+	// chConnUpdate delivers the status of a pending UpdateConnParams.
+	muConnParams sync.RWMutex
+	connParams   ConnParams
+	chConnUpdate chan error
+}
+
+// ConnParams are the parameters of an active LE connection [Vol 6, Part B, 4.5.1].
+type ConnParams struct {
+	ConnInterval       uint16 // 0x0006 - 0x0C80; N * 1.25 msec
+	ConnLatency        uint16 // 0x0000 - 0x01F3; number of connection events
+	SupervisionTimeout uint16 // 0x000A - 0x0C80; N * 10 msec
 }
 
 func newConn(h *HCI, param evt.LEConnectionComplete) *Conn {
@@ -72,6 +100,8 @@ func newConn(h *HCI, param evt.LEConnectionComplete) *Conn {
 		ctx:   context.Background(),
 		param: param,
 
+		localAddr: h.Addr(),
+
 		rxMTU: ble.DefaultMTU,
 		txMTU: ble.DefaultMTU,
 
@@ -79,6 +109,7 @@ func newConn(h *HCI, param evt.LEConnectionComplete) *Conn {
 
 		sigRxMTU: ble.MaxMTU,
 		sigTxMTU: ble.DefaultMTU,
+		sigSent:  make(chan []byte, 1),
 
 		chInPkt: make(chan packet, 16),
 		chInPDU: make(chan pdu, 16),
@@ -86,7 +117,15 @@ func newConn(h *HCI, param evt.LEConnectionComplete) *Conn {
 		txBuffer: NewClient(h.pool),
 
 		chDone: make(chan struct{}),
+
+		connParams: ConnParams{
+			ConnInterval:       param.ConnInterval(),
+			ConnLatency:        param.ConnLatency(),
+			SupervisionTimeout: param.SupervisionTimeout(),
+		},
+		chConnUpdate: make(chan error, 1),
 	}
+	c.smp = newSMP(c)
 
 	go func() {
 		for {
@@ -97,6 +136,8 @@ func newConn(h *HCI, param evt.LEConnectionComplete) *Conn {
 					_ = logger.Error("recombine failed: ", "err", err)
 				}
 				close(c.chInPDU)
+				c.smp.close()
+				c.closeChannels()
 				return
 			}
 		}
@@ -279,7 +320,6 @@ func (c *Conn) recombine() error {
 		p = append(p, pdu(pkt.data())...)
 	}
 
-	// TODO: support dynamic or assigned channels for LE-Frames.
 	switch p.cid() {
 	case cidLEAtt:
 		c.chInPDU <- p
@@ -288,6 +328,10 @@ func (c *Conn) recombine() error {
 	case cidSMP:
 		c.handleSMP(p)
 	default:
+		if ch := c.channel(p.cid()); ch != nil {
+			ch.receive(p.payload())
+			return nil
+		}
 		logger.Info("recombine()", "unrecognized CID", fmt.Sprintf("%04X, [%X]", p.cid(), p))
 	}
 	return nil
@@ -307,6 +351,105 @@ func (c *Conn) ReadRSSI() int {
 	return int(rp.RSSI)
 }
 
+// ConnParams returns the currently active connection parameters.
+func (c *Conn) ConnParams() ConnParams {
+	c.muConnParams.RLock()
+	defer c.muConnParams.RUnlock()
+	return c.connParams
+}
+
+// UpdateConnParams requests new connection parameters for the connection.
+// As a master, the update is initiated with LE Connection Update [Vol 2, Part E, 7.8.18].
+// As a slave, a Connection Parameter Update Request is sent to the master over
+// the signaling channel [Vol 3, Part A, 4.20].
+// It returns when the controller reports the completion of the update.
+func (c *Conn) UpdateConnParams(intervalMin, intervalMax, latency, timeout uint16) error {
+	if !validConnParams(intervalMin, intervalMax, latency, timeout) {
+		return ErrConnParams
+	}
+
+	// Discard the result of an earlier update that nobody waited for.
+	select {
+	case <-c.chConnUpdate:
+	default:
+	}
+
+	if c.param.Role() == roleMaster {
+		err := c.hci.Send(&cmd.LEConnectionUpdate{
+			ConnectionHandle:   c.param.ConnectionHandle(),
+			ConnIntervalMin:    intervalMin,
+			ConnIntervalMax:    intervalMax,
+			ConnLatency:        latency,
+			SupervisionTimeout: timeout,
+			MinimumCELength:    0, // Informational, and spec doesn't specify the use.
+			MaximumCELength:    0, // Informational, and spec doesn't specify the use.
+		}, nil)
+		if err != nil {
+			return err
+		}
+	} else {
+		var rsp ConnectionParameterUpdateResponse
+		err := c.Signal(&ConnectionParameterUpdateRequest{
+			IntervalMin:       intervalMin,
+			IntervalMax:       intervalMax,
+			SlaveLatency:      latency,
+			TimeoutMultiplier: timeout,
+		}, &rsp)
+		if err != nil {
+			return errors.Wrap(err, "can't request connection parameters")
+		}
+		if rsp.Result != 0x0000 {
+			return ErrConnParams
+		}
+	}
+
+	// The update takes effect at an instant chosen by the master, which is
+	// at most a few connection intervals (with latency) away.
+	select {
+	case err := <-c.chConnUpdate:
+		return err
+	case <-c.chDone:
+		return io.ErrClosedPipe
+	case <-time.After(connUpdateTimeout):
+		return errors.New("connection update timed out")
+	}
+}
+
+// connUpdated records the result of a LE Connection Update Complete event.
+func (c *Conn) connUpdated(e evt.LEConnectionUpdateComplete) {
+	var err error
+	if e.Status() == 0x00 {
+		c.muConnParams.Lock()
+		c.connParams = ConnParams{
+			ConnInterval:       e.ConnInterval(),
+			ConnLatency:        e.ConnLatency(),
+			SupervisionTimeout: e.SupervisionTimeout(),
+		}
+		c.muConnParams.Unlock()
+	} else {
+		err = ErrCommand(e.Status())
+	}
+	select {
+	case c.chConnUpdate <- err:
+	default:
+	}
+}
+
+// validConnParams checks the connection parameters against the ranges of [Vol 2, Part E, 7.8.18].
+// The supervision timeout must be larger than (1 + latency) * intervalMax * 2.
+func validConnParams(intervalMin, intervalMax, latency, timeout uint16) bool {
+	switch {
+	case intervalMin < 0x0006 || intervalMax > 0x0C80 || intervalMin > intervalMax:
+		return false
+	case latency > 0x01F3:
+		return false
+	case timeout < 0x000A || timeout > 0x0C80:
+		return false
+	}
+	// timeout is in 10 msec, intervalMax in 1.25 msec.
+	return int(timeout)*8 > (1+int(latency))*int(intervalMax)*2
+}
+
 // Close disconnects the connection by sending hci disconnect command to the device.
 func (c *Conn) Close() error {
 	select {
@@ -323,12 +466,29 @@ func (c *Conn) Close() error {
 }
 
 // LocalAddr returns local device's MAC address.
-func (c *Conn) LocalAddr() ble.Addr { return c.hci.Addr() }
+func (c *Conn) LocalAddr() ble.Addr { return c.localAddr }
 
 // RemoteAddr returns remote device's MAC address.
 func (c *Conn) RemoteAddr() ble.Addr {
 	a := c.param.PeerAddress()
-	return net.HardwareAddr([]byte{a[5], a[4], a[3], a[2], a[1], a[0]})
+	return deviceAddr(c.param.PeerAddressType(), a)
+}
+
+// IdentityAddr returns the identity address of the remote device, if its
+// resolvable private address is resolved, or its address otherwise.
+func (c *Conn) IdentityAddr() ble.Addr {
+	if t, b := c.param.PeerAddressType(), c.param.PeerAddress(); t == AddrTypeRandom && isRPA(b) {
+		if id, ok := c.hci.resolve(b); ok {
+			return id.Addr
+		}
+	}
+	return c.RemoteAddr()
+}
+
+// Bonded reports whether the remote device is bonded.
+func (c *Conn) Bonded() bool {
+	_, ok := c.hci.loadBond(c.RemoteAddr())
+	return ok
 }
 
 // RxMTU returns the MTU which the upper layer is capable of accepting.
@@ -0,0 +1,204 @@
+package hci
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"traulfs/Bline/ble/bline/hci/cmd"
+)
+
+func TestValidConnParams(t *testing.T) {
+	for _, tc := range []struct {
+		name                                   string
+		intervalMin, intervalMax, latency, tmo uint16
+		want                                   bool
+	}{
+		{"valid", 0x0006, 0x0C80, 0x0000, 0x0C80, true},
+		{"interval too short", 0x0005, 0x0010, 0x0000, 0x0100, false},
+		{"interval too long", 0x0006, 0x0C81, 0x0000, 0x0C80, false},
+		{"intervals swapped", 0x0020, 0x0010, 0x0000, 0x0100, false},
+		{"latency", 0x0006, 0x0006, 0x01F3, 0x0C80, true},
+		{"latency too large", 0x0006, 0x0006, 0x01F4, 0x0C80, false},
+		{"timeout too short", 0x0006, 0x0006, 0x0000, 0x0009, false},
+		{"timeout too long", 0x0006, 0x0006, 0x0000, 0x0C81, false},
+		// The timeout must exceed (1 + latency) * intervalMax * 2.
+		{"timeout at the limit", 0x0050, 0x0050, 0x0004, 0x0064, false},
+		{"timeout above the limit", 0x0050, 0x0050, 0x0004, 0x0065, true},
+	} {
+		if got := validConnParams(tc.intervalMin, tc.intervalMax, tc.latency, tc.tmo); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// connUpdated sends the LE Connection Update Complete event of the link with
+// handle.
+func (f *fakeController) connUpdated(handle uint16, status byte, interval, latency, timeout uint16) {
+	p := make([]byte, 10)
+	p[0], p[1] = 0x03, status
+	binary.LittleEndian.PutUint16(p[2:], handle)
+	binary.LittleEndian.PutUint16(p[4:], interval)
+	binary.LittleEndian.PutUint16(p[6:], latency)
+	binary.LittleEndian.PutUint16(p[8:], timeout)
+	f.event(0x3E, p...)
+}
+
+// TestUpdateConnParams checks that the master updates the parameters with the
+// Link Layer, and the slave requests them with L2CAP signaling.
+func TestUpdateConnParams(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		slave  bool
+		params [4]uint16
+		result uint16 // Of the Connection Parameter Update Response.
+		status byte   // Of the LE Connection Update Complete event.
+		err    error
+	}{
+		{name: "master", params: [4]uint16{0x0018, 0x0028, 0x0000, 0x01F4}},
+		{name: "master failed", params: [4]uint16{0x0018, 0x0028, 0x0000, 0x01F4}, status: 0x3B, err: ErrCommand(0x3B)},
+		{name: "master invalid", params: [4]uint16{0x0028, 0x0018, 0x0000, 0x01F4}, err: ErrConnParams},
+		{name: "slave", slave: true, params: [4]uint16{0x0018, 0x0028, 0x0001, 0x01F4}},
+		{name: "slave rejected", slave: true, params: [4]uint16{0x0018, 0x0028, 0x0001, 0x01F4}, result: 0x0001, err: ErrConnParams},
+		{name: "slave invalid", slave: true, params: [4]uint16{0x0018, 0x0028, 0x0200, 0x01F4}, err: ErrConnParams},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, f := newTestHCI(t)
+			var c *Conn
+			var handle uint16
+			if tc.slave {
+				at, a, _ := peerAddr(peerKeys.IdentityAddr)
+				handle = f.accept(at, a)
+				c = <-h.chSlaveConn
+			} else {
+				c, handle = testConn(t, h, f)
+			}
+			before := c.ConnParams()
+			done := make(chan error, 1)
+			p := tc.params
+			go func() { done <- c.UpdateConnParams(p[0], p[1], p[2], p[3]) }()
+
+			invalid := !validConnParams(p[0], p[1], p[2], p[3])
+			switch {
+			case invalid:
+			case tc.slave:
+				var req ConnectionParameterUpdateRequest
+				id := f.recvSignal(t, &req)
+				if req != (ConnectionParameterUpdateRequest{p[0], p[1], p[2], p[3]}) {
+					t.Errorf("got request %+v", req)
+				}
+				f.signal(handle, id, &ConnectionParameterUpdateResponse{Result: tc.result})
+			default:
+				b := f.waitParams(t, opLEConnectionUpdate)
+				for i, want := range p {
+					if got := binary.LittleEndian.Uint16(b[2+2*i:]); got != want {
+						t.Errorf("parameter %d: got 0x%04X, want 0x%04X", i, got, want)
+					}
+				}
+			}
+			if !invalid && tc.result == 0x0000 {
+				// The master chooses the interval in the range.
+				f.connUpdated(handle, tc.status, p[1], p[2], p[3])
+			}
+
+			if err := <-done; err != tc.err {
+				t.Fatalf("got %v, want %v", err, tc.err)
+			}
+			want := before
+			if tc.err == nil {
+				want = ConnParams{ConnInterval: p[1], ConnLatency: p[2], SupervisionTimeout: p[3]}
+			}
+			if got := c.ConnParams(); got != want {
+				t.Errorf("got parameters %+v, want %+v", got, want)
+			}
+			if invalid && (f.sent(opLEConnectionUpdate) || len(f.acl) != 0) {
+				t.Error("invalid parameters were sent")
+			}
+		})
+	}
+}
+
+// TestConnParamsRequest checks the answers of the host to the connection
+// parameters requested by the peer, with L2CAP signaling or the Link Layer.
+func TestConnParamsRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		slave  bool // The host is the slave of the link.
+		ll     bool // Requested with the Link Layer.
+		params [4]uint16
+		policy func(*cmd.LERemoteConnectionParameterRequestReply) bool
+		accept bool
+	}{
+		{name: "accepted", params: [4]uint16{0x0018, 0x0028, 0x0000, 0x01F4}, accept: true},
+		{name: "invalid", params: [4]uint16{0x0018, 0x0028, 0x0000, 0x0009}},
+		{name: "refused by policy", params: [4]uint16{0x0018, 0x0028, 0x0000, 0x01F4},
+			policy: func(*cmd.LERemoteConnectionParameterRequestReply) bool { return false }},
+		{name: "narrowed by policy", params: [4]uint16{0x0006, 0x0C80, 0x0000, 0x0C80}, accept: true,
+			policy: func(rp *cmd.LERemoteConnectionParameterRequestReply) bool {
+				rp.IntervalMin, rp.IntervalMax = 0x0018, 0x0028
+				return true
+			}},
+		{name: "to the slave", slave: true, params: [4]uint16{0x0018, 0x0028, 0x0000, 0x01F4}},
+		{name: "link layer", ll: true, params: [4]uint16{0x0018, 0x0028, 0x0000, 0x01F4}, accept: true},
+		{name: "link layer invalid", ll: true, params: [4]uint16{0x0018, 0x0028, 0x0000, 0x0009}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, f := newTestHCI(t)
+			if tc.policy != nil {
+				h.SetConnParamsRequestHandler(tc.policy)
+			}
+			var handle uint16
+			if tc.slave {
+				at, a, _ := peerAddr(peerKeys.IdentityAddr)
+				handle = f.accept(at, a)
+				<-h.chSlaveConn
+			} else {
+				_, handle = testConn(t, h, f)
+			}
+			p := tc.params
+
+			if tc.ll {
+				e := make([]byte, 11)
+				e[0] = 0x06
+				binary.LittleEndian.PutUint16(e[1:], handle)
+				for i, v := range p {
+					binary.LittleEndian.PutUint16(e[3+2*i:], v)
+				}
+				f.event(0x3E, e...)
+				op := opLERemoteConnParamNeg
+				if tc.accept {
+					op = opLERemoteConnParamReply
+				}
+				if b := f.waitParams(t, op); binary.LittleEndian.Uint16(b) != handle {
+					t.Errorf("got reply % X", b)
+				}
+				return
+			}
+
+			f.signal(handle, 0x07, &ConnectionParameterUpdateRequest{p[0], p[1], p[2], p[3]})
+			if tc.slave {
+				var rej CommandReject
+				if id := f.recvSignal(t, &rej); id != 0x07 || rej.Reason != 0x0000 {
+					t.Errorf("got Command Reject 0x%02X %+v", id, rej)
+				}
+				return
+			}
+			var rsp ConnectionParameterUpdateResponse
+			if id := f.recvSignal(t, &rsp); id != 0x07 {
+				t.Errorf("got identifier 0x%02X, want 0x07", id)
+			}
+			if accepted := rsp.Result == 0x0000; accepted != tc.accept {
+				t.Fatalf("got result 0x%04X", rsp.Result)
+			}
+			if !tc.accept {
+				if f.sent(opLEConnectionUpdate) {
+					t.Error("got LE Connection Update")
+				}
+				return
+			}
+			b := f.waitParams(t, opLEConnectionUpdate)
+			if min, max := binary.LittleEndian.Uint16(b[2:]), binary.LittleEndian.Uint16(b[4:]); min != 0x0018 || max != 0x0028 {
+				t.Errorf("got interval 0x%04X-0x%04X", min, max)
+			}
+		})
+	}
+}
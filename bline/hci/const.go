@@ -1,5 +1,7 @@
 package hci
 
+import "time"
+
 // HCI Packet types
 const (
 	pktTypeCommand uint8 = 0x01
@@ -22,6 +24,15 @@ const (
 	cidLEAtt    uint16 = 0x04 // Attribute Protocol [Vol 3, Part F].
 	cidLESignal uint16 = 0x05 // Low Energy L2CAP Signaling channel [Vol 3, Part A, 4].
 	cidSMP      uint16 = 0x06 // SecurityManager Protocol [Vol 3, Part H].
+
+	cidDynamicFirst uint16 = 0x40 // Dynamically allocated channels.
+	cidDynamicLast  uint16 = 0x7F
+)
+
+// Timeouts of the signaling and link layer procedures.
+const (
+	sigRTXTimeout     = time.Second      // Response Timeout eXpired [Vol 3, Part A, 6.2.1].
+	connUpdateTimeout = 10 * time.Second // Connection Update procedure [Vol 6, Part B, 5.1.1].
 )
 
 const (
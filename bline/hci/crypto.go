@@ -0,0 +1,191 @@
+package hci
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+)
+
+// Cryptographic toolbox of the Security Manager [Vol 3, Part H, 2.2].
+// All the values are presented most significant octet first, as in the spec,
+// while HCI and SMP transfer them least significant octet first.
+
+// e implements the security function e [Vol 3, Part H, 2.2.1].
+func e(key, plaintext [16]byte) [16]byte {
+	c, _ := aes.NewCipher(key[:]) // Never fails with a 16 bytes key.
+	var out [16]byte
+	c.Encrypt(out[:], plaintext[:])
+	return out
+}
+
+// ah implements the random address hash function ah [Vol 3, Part H, 2.2.2].
+func ah(k [16]byte, r [3]byte) [3]byte {
+	var rp [16]byte
+	copy(rp[13:], r[:])
+	out := e(k, rp)
+	return [3]byte{out[13], out[14], out[15]}
+}
+
+// swap16 reverses the byte order of a 128-bit value between the spec and the air.
+func swap16(b [16]byte) [16]byte {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
+
+// encryptFunc is the security function e, which is either performed by the
+// controller with LE Encrypt, or in software.
+type encryptFunc func(key, plaintext [16]byte) ([16]byte, error)
+
+// c1 implements the confirm value generation function c1 for LE Legacy Pairing [Vol 3, Part H, 2.2.3].
+// preq and pres are the Pairing Request and Response commands, and ia and ra
+// the initiating and responding device addresses.
+func c1(e encryptFunc, k, r [16]byte, preq, pres [7]byte, iat, rat uint8, ia, ra [6]byte) ([16]byte, error) {
+	var p1, p2 [16]byte
+	copy(p1[0:7], pres[:])
+	copy(p1[7:14], preq[:])
+	p1[14] = rat
+	p1[15] = iat
+	copy(p2[4:10], ia[:])
+	copy(p2[10:16], ra[:])
+
+	v, err := e(k, xor16(r, p1))
+	if err != nil {
+		return v, err
+	}
+	return e(k, xor16(v, p2))
+}
+
+// s1 implements the key generation function s1 for LE Legacy Pairing [Vol 3, Part H, 2.2.4].
+func s1(e encryptFunc, k, r1, r2 [16]byte) ([16]byte, error) {
+	var r [16]byte
+	copy(r[0:8], r1[8:16])
+	copy(r[8:16], r2[8:16])
+	return e(k, r)
+}
+
+func xor16(a, b [16]byte) [16]byte {
+	for i := range a {
+		a[i] ^= b[i]
+	}
+	return a
+}
+
+// softEncrypt performs the security function e in software.
+func softEncrypt(key, plaintext [16]byte) ([16]byte, error) {
+	return e(key, plaintext), nil
+}
+
+// aesCMAC implements AES-CMAC [RFC 4493], which is the MAC function of the
+// LE Secure Connections toolbox [Vol 3, Part H, 2.2.5].
+func aesCMAC(key [16]byte, m []byte) [16]byte {
+	// Subkey generation.
+	l := e(key, [16]byte{})
+	k1 := shift16(l)
+	if l[0]&0x80 != 0 {
+		k1[15] ^= 0x87
+	}
+	k2 := shift16(k1)
+	if k1[0]&0x80 != 0 {
+		k2[15] ^= 0x87
+	}
+
+	n := (len(m) + 15) / 16
+	var last [16]byte
+	if n > 0 && len(m)%16 == 0 {
+		copy(last[:], m[(n-1)*16:])
+		last = xor16(last, k1)
+	} else {
+		if n == 0 {
+			n = 1
+		}
+		r := m[(n-1)*16:]
+		copy(last[:], r)
+		last[len(r)] = 0x80
+		last = xor16(last, k2)
+	}
+
+	var x [16]byte
+	for i := 0; i < n-1; i++ {
+		var b [16]byte
+		copy(b[:], m[i*16:])
+		x = e(key, xor16(x, b))
+	}
+	return e(key, xor16(x, last))
+}
+
+// shift16 shifts a 128-bit value left by one bit.
+func shift16(b [16]byte) [16]byte {
+	var r [16]byte
+	for i := 0; i < 15; i++ {
+		r[i] = b[i]<<1 | b[i+1]>>7
+	}
+	r[15] = b[15] << 1
+	return r
+}
+
+// sign generates the signature of signed data with the CSRK [Vol 3, Part H, 2.4.5].
+// m and the signature are in the byte order of the air. The signature holds
+// the sign counter, followed by the 64 most significant bits of the MAC.
+func sign(csrk [16]byte, counter uint32, m []byte) [12]byte {
+	b := make([]byte, len(m)+4)
+	copy(b, m)
+	binary.LittleEndian.PutUint32(b[len(m):], counter)
+	mac := aesCMAC(csrk, reverse(b))
+
+	var sig [12]byte
+	binary.LittleEndian.PutUint32(sig[:], counter)
+	copy(sig[4:], reverse(mac[:8]))
+	return sig
+}
+
+// f4 implements the confirm value generation function f4 for LE Secure Connections [Vol 3, Part H, 2.2.6].
+func f4(u, v [32]byte, x [16]byte, z uint8) [16]byte {
+	m := make([]byte, 0, 65)
+	m = append(m, u[:]...)
+	m = append(m, v[:]...)
+	m = append(m, z)
+	return aesCMAC(x, m)
+}
+
+// f5 implements the key generation function f5 for LE Secure Connections [Vol 3, Part H, 2.2.7].
+// a1 and a2 are the device addresses, with the address type as the most significant octet.
+func f5(w [32]byte, n1, n2 [16]byte, a1, a2 [7]byte) (macKey, ltk [16]byte) {
+	salt := [16]byte{0x6c, 0x88, 0x83, 0x91, 0xaa, 0xf5, 0xa5, 0x38, 0x60, 0x37, 0x0b, 0xdb, 0x5a, 0x60, 0x83, 0xbe}
+	t := aesCMAC(salt, w[:])
+
+	m := make([]byte, 0, 53)
+	m = append(m, 0x00)                   // Counter
+	m = append(m, 0x62, 0x74, 0x6c, 0x65) // KeyID "btle"
+	m = append(m, n1[:]...)
+	m = append(m, n2[:]...)
+	m = append(m, a1[:]...)
+	m = append(m, a2[:]...)
+	m = append(m, 0x01, 0x00) // Length 256
+	macKey = aesCMAC(t, m)
+	m[0] = 0x01
+	ltk = aesCMAC(t, m)
+	return macKey, ltk
+}
+
+// f6 implements the check value generation function f6 for LE Secure Connections [Vol 3, Part H, 2.2.8].
+func f6(w, n1, n2, r [16]byte, ioCap [3]byte, a1, a2 [7]byte) [16]byte {
+	m := make([]byte, 0, 65)
+	m = append(m, n1[:]...)
+	m = append(m, n2[:]...)
+	m = append(m, r[:]...)
+	m = append(m, ioCap[:]...)
+	m = append(m, a1[:]...)
+	m = append(m, a2[:]...)
+	return aesCMAC(w, m)
+}
+
+// g2 implements the numeric comparison value generation function g2 for LE Secure Connections [Vol 3, Part H, 2.2.9].
+func g2(u, v [32]byte, x, y [16]byte) uint32 {
+	m := make([]byte, 0, 80)
+	m = append(m, u[:]...)
+	m = append(m, v[:]...)
+	m = append(m, y[:]...)
+	out := aesCMAC(x, m)
+	return binary.BigEndian.Uint32(out[12:])
+}
@@ -0,0 +1,153 @@
+package hci
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// Sample data of the Security Manager Toolbox [Vol 3, Part H, Appendix D].
+
+func h16(s string) [16]byte {
+	var b [16]byte
+	hex.Decode(b[:], []byte(s))
+	return b
+}
+
+func TestAh(t *testing.T) {
+	irk := h16("ec0234a357c8ad05341010a60a397d9b")
+	if got := ah(irk, [3]byte{0x70, 0x81, 0x94}); got != [3]byte{0x0d, 0xfb, 0xaa} {
+		t.Errorf("ah: got %x, want 0dfbaa", got)
+	}
+
+	// 70:81:94:0D:FB:AA in HCI byte order.
+	rpa := [6]byte{0xaa, 0xfb, 0x0d, 0x94, 0x81, 0x70}
+	if !isRPA(rpa) {
+		t.Errorf("%x should be a resolvable private address", rpa)
+	}
+	if !resolveRPA(irk, rpa) {
+		t.Errorf("%x should be resolved with IRK %x", rpa, irk)
+	}
+	rpa[0] ^= 0x01
+	if resolveRPA(irk, rpa) {
+		t.Errorf("%x shouldn't be resolved with IRK %x", rpa, irk)
+	}
+}
+
+func TestC1(t *testing.T) {
+	k := [16]byte{}
+	r := h16("5783d52156ad6f0e6388274ec6702ee0")
+	preq := [7]byte{0x07, 0x07, 0x10, 0x00, 0x00, 0x01, 0x01}
+	pres := [7]byte{0x05, 0x00, 0x08, 0x00, 0x00, 0x03, 0x02}
+	ia := [6]byte{0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6}
+	ra := [6]byte{0xb1, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6}
+	got, err := c1(softEncrypt, k, r, preq, pres, 1, 0, ia, ra)
+	if want := h16("1e1e3fef878988ead2a74dc5bef13b86"); err != nil || got != want {
+		t.Errorf("c1: got %x, %v, want %x", got, err, want)
+	}
+}
+
+func TestS1(t *testing.T) {
+	k := [16]byte{}
+	r1 := h16("000f0e0d0c0b0a091122334455667788")
+	r2 := h16("010203040506070899aabbccddeeff00")
+	got, err := s1(softEncrypt, k, r1, r2)
+	if want := h16("9a1fe1f0e8b0f49b5b4216ae796da062"); err != nil || got != want {
+		t.Errorf("s1: got %x, %v, want %x", got, err, want)
+	}
+}
+
+func h32(s string) [32]byte {
+	var b [32]byte
+	hex.Decode(b[:], []byte(s))
+	return b
+}
+
+func h7(s string) [7]byte {
+	var b [7]byte
+	hex.Decode(b[:], []byte(s))
+	return b
+}
+
+func TestAesCMAC(t *testing.T) {
+	// Test vectors of RFC 4493, 4.
+	k := h16("2b7e151628aed2a6abf7158809cf4f3c")
+	m, _ := hex.DecodeString("6bc1bee22e409f96e93d7e117393172a" +
+		"ae2d8a571e03ac9c9eb76fac45af8e51" +
+		"30c81c46a35ce411e5fbc1191a0a52ef" +
+		"f69f2445df4f9b17ad2b417be66c3710")
+	tests := []struct {
+		len  int
+		want string
+	}{
+		{0, "bb1d6929e95937287fa37d129b756746"},
+		{16, "070a16b46b4d4144f79bdd9dd04a287c"},
+		{40, "dfa66747de9ae63030ca32611497c827"},
+		{64, "51f0bebf7e3b9d92fc49741779363cfe"},
+	}
+	for _, tt := range tests {
+		if got := aesCMAC(k, m[:tt.len]); got != h16(tt.want) {
+			t.Errorf("AES-CMAC (len %d): got %x, want %s", tt.len, got, tt.want)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	// The 40 octets of the AES-CMAC test vector of RFC 4493 are the signed
+	// data, followed by the sign counter, in reverse (air) order.
+	csrk := h16("2b7e151628aed2a6abf7158809cf4f3c")
+	msb, _ := hex.DecodeString("6bc1bee22e409f96e93d7e117393172a" +
+		"ae2d8a571e03ac9c9eb76fac45af8e51" +
+		"30c81c46a35ce411")
+	air := reverse(msb)
+	m, counter := air[:36], uint32(0x6bc1bee2)
+
+	want, _ := hex.DecodeString("e2bec16b" + "30e69ade4767a6df")
+	if got := sign(csrk, counter, m); string(got[:]) != string(want) {
+		t.Errorf("sign: got %x, want %x", got, want)
+	}
+	if got := sign(csrk, counter+1, m); string(got[4:]) == string(want[4:]) {
+		t.Error("sign: the MAC doesn't depend on the sign counter")
+	}
+}
+
+// Sample data of LE Secure Connections [Vol 3, Part H, Appendix D].
+var (
+	scU  = h32("20b003d2f297be2c5e2c83a7e9f9a5b9eff49111acf4fddbcc0301480e359de6")
+	scV  = h32("55188b3d32f6bb9a900afcfbeed4e72a59cb9ac2f19d7cfb6b4fdd49f47fc5fd")
+	scN1 = h16("d5cb8454d177733effffb2ec712baeab")
+	scN2 = h16("a6e8e7cc25a75f6e216583f7ff3dc4cf")
+	scA1 = h7("0056123737bfce")
+	scA2 = h7("00a713702dcfc1")
+)
+
+func TestF4(t *testing.T) {
+	if got, want := f4(scU, scV, scN1, 0x00), h16("f2c916f107a9bd1cf1eda1bea974872d"); got != want {
+		t.Errorf("f4: got %x, want %x", got, want)
+	}
+}
+
+func TestF5(t *testing.T) {
+	w := h32("ec0234a357c8ad05341010a60a397d9b99796b13b4f866f1868d34f373bfa698")
+	macKey, ltk := f5(w, scN1, scN2, scA1, scA2)
+	if want := h16("2965f176a1084a02fd3f6a20ce636e20"); macKey != want {
+		t.Errorf("f5 MacKey: got %x, want %x", macKey, want)
+	}
+	if want := h16("6986791169d7cd23980522b594750a38"); ltk != want {
+		t.Errorf("f5 LTK: got %x, want %x", ltk, want)
+	}
+}
+
+func TestF6(t *testing.T) {
+	w := h16("2965f176a1084a02fd3f6a20ce636e20")
+	r := h16("12a3343bb453bb5408da42d20c2d0fc8")
+	got := f6(w, scN1, scN2, r, [3]byte{0x01, 0x01, 0x02}, scA1, scA2)
+	if want := h16("e3c473989cd0e8c5d26c0b09da958f61"); got != want {
+		t.Errorf("f6: got %x, want %x", got, want)
+	}
+}
+
+func TestG2(t *testing.T) {
+	if got := g2(scU, scV, scN1, scN2); got != 0x2f9ed5ba {
+		t.Errorf("g2: got %08x, want 2f9ed5ba", got)
+	}
+}
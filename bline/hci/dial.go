@@ -0,0 +1,308 @@
+package hci
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	ble "traulfs/Bline/ble"
+	"traulfs/Bline/ble/bline/gatt"
+	"traulfs/Bline/ble/bline/hci/cmd"
+	"traulfs/Bline/ble/bline/hci/evt"
+
+	"github.com/pkg/errors"
+)
+
+// The controller initiates a single connection at a time; a second LE Create
+// Connection is disallowed until the first completes [Vol 4, Part E, 7.8.12].
+// So the dials of an HCI take turns, and each LE Connection Complete event of
+// the master role completes the pending dial.
+
+// cancelTimeout bounds the wait for the LE Connection Complete event, which
+// follows LE Create Connection Cancel.
+const cancelTimeout = 2 * time.Second
+
+// dialReq is the pending dial of an HCI.
+type dialReq struct {
+	acceptList bool  // Any device in the accept list is connected.
+	peerType   uint8 // The device to connect, if not using the accept list.
+	peer       [6]byte
+	ch         chan dialResult
+
+	chPause chan pauseReq // Served while the dial is initiating.
+	done    chan struct{} // Closed once the dial returns.
+}
+
+// pauseReq asks a pending dial to run f with initiating paused.
+type pauseReq struct {
+	f    func() error
+	done chan error
+}
+
+type dialResult struct {
+	c   *Conn
+	err error
+}
+
+// match tells if a connection completes the dial. The identity address types
+// of a resolved peer (0x02, 0x03) match the public and random ones.
+func (d *dialReq) match(e evt.LEConnectionComplete) bool {
+	if d.acceptList || e.Status() != 0x00 {
+		return true
+	}
+	return e.PeerAddressType()&0x01 == d.peerType && e.PeerAddress() == d.peer
+}
+
+// Dial connects to the device with address a. Concurrent dials are queued,
+// and connected one at a time.
+func (h *HCI) Dial(ctx context.Context, a ble.Addr) (ble.Client, error) {
+	t, b, err := peerAddr(a)
+	if err != nil {
+		return nil, err
+	}
+	p := h.connParams()
+	p.PeerAddressType = t
+	p.PeerAddress = b
+	p.InitiatorFilterPolicy = 0x00 // Connect to the peer address only.
+	return h.dial(ctx, p, nil)
+}
+
+// connParams returns a copy of the current connection parameters.
+func (h *HCI) connParams() cmd.LECreateConnection {
+	h.params.RLock()
+	defer h.params.RUnlock()
+	return h.params.connParams
+}
+
+// masterLinks returns the number of master links.
+func (h *HCI) masterLinks() int {
+	h.muConns.Lock()
+	defer h.muConns.Unlock()
+	n := 0
+	for _, c := range h.conns {
+		if c.param.Role() == roleMaster {
+			n++
+		}
+	}
+	return n
+}
+
+// errPreempted is returned by a background dial, which gave way to another one.
+var errPreempted = errors.New("dial preempted")
+
+// bgDial is a background dial, which gives way to the other dials.
+type bgDial struct {
+	preempt <-chan struct{} // Cancels the dial, besides the dials queued.
+	prepare func() error    // Run once it's the turn of the dial, before initiating.
+}
+
+// dial initiates a connection with the connection parameters p, once the
+// dials queued before it are done. A background dial bg is canceled on a
+// signal of its preempt channel, or when another dial is queued.
+func (h *HCI) dial(ctx context.Context, p cmd.LECreateConnection, bg *bgDial) (ble.Client, error) {
+	var tmo <-chan time.Time
+	if h.dialerTmo != time.Duration(0) && bg == nil {
+		tmo = time.After(h.dialerTmo)
+	}
+	var preempt, queued <-chan struct{}
+	var giveWay chan<- struct{}
+	if bg == nil {
+		// Let a pending background dial give way, while waiting for the turn.
+		giveWay = h.chPreempt
+	} else {
+		preempt, queued = bg.preempt, h.chPreempt
+	}
+
+	// Wait for the turn, and for a free link.
+	for turn := false; !turn; {
+		select {
+		case h.chDialSlot <- struct{}{}:
+			turn = true
+		case giveWay <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-tmo:
+			return nil, fmt.Errorf("dial timed out")
+		case <-h.done:
+			return nil, h.err
+		}
+	}
+	defer func() { <-h.chDialSlot }()
+	for h.maxConns != 0 && h.masterLinks() >= h.maxConns {
+		select {
+		case <-h.chLinkFreed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-tmo:
+			return nil, fmt.Errorf("dial timed out")
+		case <-queued:
+			return nil, errPreempted
+		case <-h.done:
+			return nil, h.err
+		}
+	}
+	if bg != nil && bg.prepare != nil {
+		if err := bg.prepare(); err != nil {
+			return nil, err
+		}
+	}
+
+	d := &dialReq{
+		acceptList: p.InitiatorFilterPolicy == 0x01,
+		peerType:   p.PeerAddressType,
+		peer:       p.PeerAddress,
+		ch:         make(chan dialResult, 1),
+		chPause:    make(chan pauseReq),
+		done:       make(chan struct{}),
+	}
+	defer close(d.done)
+	h.muInit.Lock()
+	err := h.initiate(d, &p)
+	h.muInit.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+wait:
+	for {
+		select {
+		case r := <-d.ch:
+			if r.err != nil {
+				return nil, r.err
+			}
+			return gatt.NewClient(r.c)
+		case <-ctx.Done():
+			return h.cancelDial(d)
+		case <-tmo:
+			return h.cancelDial(d)
+		case <-preempt:
+			break wait
+		case <-queued:
+			break wait
+		case req := <-d.chPause:
+			c, err := h.pauseDial(d, &p, req)
+			switch {
+			case err != nil:
+				return nil, err
+			case c != nil:
+				return gatt.NewClient(c)
+			}
+		case <-h.done:
+			return nil, h.err
+		}
+	}
+	cln, err := h.cancelDial(d)
+	if err != nil {
+		return nil, errPreempted
+	}
+	return cln, nil
+}
+
+// initiate sends the LE Create Connection of the dial d. The caller holds
+// h.muInit.
+func (h *HCI) initiate(d *dialReq, p *cmd.LECreateConnection) error {
+	h.muDial.Lock()
+	h.dialing = d
+	h.muDial.Unlock()
+	if err := h.Send(p, nil); err != nil {
+		h.muDial.Lock()
+		h.dialing = nil
+		h.muDial.Unlock()
+		return err
+	}
+	return nil
+}
+
+// pauseDial cancels the pending LE Create Connection of the dial d, runs the
+// function of req with scanning and advertising paused too, and initiates the
+// connection with p again. If the connection completed before it was
+// canceled, it's returned instead.
+func (h *HCI) pauseDial(d *dialReq, p *cmd.LECreateConnection, req pauseReq) (*Conn, error) {
+	err := h.Send(&h.params.connCancel, nil)
+	if err != nil && err != ErrDisallowed {
+		// The connection is still initiating.
+		req.done <- errors.Wrap(err, "cancel connection failed")
+		return nil, nil
+	}
+
+	var r dialResult
+	select {
+	case r = <-d.ch:
+	case <-time.After(cancelTimeout):
+		h.muDial.Lock()
+		if h.dialing == d {
+			h.dialing = nil
+		}
+		h.muDial.Unlock()
+		r.err = fmt.Errorf("connection canceled")
+	case <-h.done:
+		req.done <- h.err
+		return nil, h.err
+	}
+
+	h.muInit.Lock()
+	defer h.muInit.Unlock()
+	req.done <- h.runPaused(req.f)
+	switch {
+	case r.c != nil:
+		return r.c, nil
+	case r.err != ErrConnID:
+		// The connection failed, rather than being canceled.
+		return nil, r.err
+	}
+	return nil, h.initiate(d, p)
+}
+
+// cancelDial cancels the pending dial d.
+func (h *HCI) cancelDial(d *dialReq) (ble.Client, error) {
+	err := h.Send(&h.params.connCancel, nil)
+	if err != nil && err != ErrDisallowed {
+		h.muDial.Lock()
+		h.dialing = nil
+		h.muDial.Unlock()
+		return nil, errors.Wrap(err, "cancel connection failed")
+	}
+
+	// Either the pending connection was canceled successfully, or it has been
+	// established and the cancel command failed with ErrDisallowed. In both
+	// cases, an LE Connection Complete event follows; wait for it, so it
+	// doesn't complete the next dial.
+	select {
+	case r := <-d.ch:
+		if r.c != nil {
+			return gatt.NewClient(r.c)
+		}
+		return nil, fmt.Errorf("connection canceled")
+	case <-time.After(cancelTimeout):
+		h.muDial.Lock()
+		h.dialing = nil
+		h.muDial.Unlock()
+		return nil, fmt.Errorf("connection canceled")
+	case <-h.done:
+		return nil, h.err
+	}
+}
+
+// dialed completes the pending dial with a connection, or with the status of
+// a failed one. It tells if the connection completed a dial; the connections
+// which don't are closed by the caller.
+func (h *HCI) dialed(e evt.LEConnectionComplete, c *Conn) bool {
+	h.muDial.Lock()
+	d := h.dialing
+	if d == nil || !d.match(e) {
+		h.muDial.Unlock()
+		if e.Status() == 0x00 {
+			logger.Warn("dial", "unexpected connection", fmt.Sprintf("%04X", e.ConnectionHandle()))
+		}
+		return false
+	}
+	h.dialing = nil
+	h.muDial.Unlock()
+
+	if e.Status() != 0x00 {
+		d.ch <- dialResult{err: ErrCommand(e.Status())}
+		return true
+	}
+	d.ch <- dialResult{c: c}
+	return true
+}
@@ -0,0 +1,263 @@
+package hci
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	ble "traulfs/Bline/ble"
+	"traulfs/Bline/ble/bline/hci/evt"
+)
+
+func TestDialPreemptsAutoConnect(t *testing.T) {
+	h, f := newTestHCI(t)
+	bg := ble.NewDeviceAddr([]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}, false)
+	fg := ble.NewDeviceAddr([]byte{0xc1, 0x22, 0x33, 0x44, 0x55, 0x77}, true)
+	_, fgPeer, _ := peerAddr(fg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := h.AutoConnect(ctx, bg); err != nil {
+		t.Fatal(err)
+	}
+	if policy, _, _ := f.pending(t); policy != 0x01 {
+		t.Fatalf("background dial: got filter policy %d, want 1", policy)
+	}
+	if _, err := h.DialAcceptList(ctx); err != ErrAcceptListBusy {
+		t.Errorf("DialAcceptList: got %v, want %v", err, ErrAcceptListBusy)
+	}
+
+	type result struct {
+		cln ble.Client
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		cln, err := h.Dial(ctx, fg)
+		ch <- result{cln, err}
+	}()
+
+	// The background dial gives way, and the foreground one initiates.
+	var policy, typ byte
+	var peer [6]byte
+	for end := time.Now().Add(2 * time.Second); ; time.Sleep(time.Millisecond) {
+		if policy, typ, peer = f.pending(t); policy == 0x00 {
+			break
+		}
+		if time.Now().After(end) {
+			t.Fatal("the background dial wasn't preempted")
+		}
+	}
+	if typ != AddrTypeRandom || peer != fgPeer {
+		t.Fatalf("foreground dial: got peer %d %x, want %d %x", typ, peer, AddrTypeRandom, fgPeer)
+	}
+	f.connect(typ, peer)
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatalf("Dial: %v", r.err)
+		}
+		if r.cln.Addr().String() != fg.String() {
+			t.Errorf("Dial: got %s, want %s", r.cln.Addr(), fg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Dial didn't complete")
+	}
+
+	// The background dial is re-armed afterwards.
+	for end := time.Now().Add(2 * time.Second); ; time.Sleep(time.Millisecond) {
+		if policy, _, _ = f.pending(t); policy == 0x01 {
+			break
+		}
+		if time.Now().After(end) {
+			t.Fatal("the background dial wasn't re-armed")
+		}
+	}
+}
+
+// TestAcceptListPausesDial checks that a pending dial is canceled while the
+// accept list changes, and initiated again afterwards.
+func TestAcceptListPausesDial(t *testing.T) {
+	h, f := newTestHCI(t)
+	fg := ble.NewDeviceAddr([]byte{0xc1, 0x22, 0x33, 0x44, 0x55, 0x77}, true)
+	_, fgPeer, _ := peerAddr(fg)
+
+	ch := make(chan error, 1)
+	go func() {
+		_, err := h.Dial(context.Background(), fg)
+		ch <- err
+	}()
+	f.pending(t)
+
+	if err := h.AddToAcceptList(ble.NewDeviceAddr([]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}, false)); err != nil {
+		t.Fatalf("AddToAcceptList: %v", err)
+	}
+	if !f.sent(opLECreateConnCancel) {
+		t.Error("the pending dial wasn't canceled")
+	}
+	if _, typ, peer := f.pending(t); typ != AddrTypeRandom || peer != fgPeer {
+		t.Fatalf("re-armed dial: got peer %d %x, want %d %x", typ, peer, AddrTypeRandom, fgPeer)
+	}
+
+	f.connect(AddrTypeRandom, fgPeer)
+	select {
+	case err := <-ch:
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Dial didn't complete")
+	}
+
+	// Without a pending dial, the accept list changes at once.
+	if err := h.ClearAcceptList(); err != nil {
+		t.Errorf("ClearAcceptList: %v", err)
+	}
+}
+
+func TestDialReqMatch(t *testing.T) {
+	peer := [6]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}
+	other := [6]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x07}
+	complete := func(status, typ byte, a [6]byte) evt.LEConnectionComplete {
+		b := []byte{0x01, status, 0x40, 0x00, roleMaster, typ}
+		b = append(b, a[:]...)
+		return evt.LEConnectionComplete(append(b, 0x18, 0x00, 0x00, 0x00, 0x48, 0x00, 0x00))
+	}
+	for _, tc := range []struct {
+		name string
+		d    dialReq
+		e    evt.LEConnectionComplete
+		want bool
+	}{
+		{"peer", dialReq{peerType: AddrTypeRandom, peer: peer}, complete(0x00, AddrTypeRandom, peer), true},
+		{"other address", dialReq{peerType: AddrTypeRandom, peer: peer}, complete(0x00, AddrTypeRandom, other), false},
+		{"other address type", dialReq{peerType: AddrTypeRandom, peer: peer}, complete(0x00, AddrTypePublic, peer), false},
+		{"resolved identity", dialReq{peerType: AddrTypeRandom, peer: peer}, complete(0x00, 0x03, peer), true},
+		{"failure", dialReq{peerType: AddrTypeRandom, peer: peer}, complete(byte(ErrConnID), AddrTypePublic, [6]byte{}), true},
+		{"accept list", dialReq{acceptList: true}, complete(0x00, AddrTypePublic, other), true},
+	} {
+		if got := tc.d.match(tc.e); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// dialAsync dials a, and delivers the result on the returned channel.
+func dialAsync(ctx context.Context, h *HCI, a ble.Addr) <-chan error {
+	ch := make(chan error, 1)
+	go func() {
+		cln, err := h.Dial(ctx, a)
+		if err == nil && cln.Addr().String() != a.String() {
+			err = fmt.Errorf("connected to %s", cln.Addr())
+		}
+		ch <- err
+	}()
+	return ch
+}
+
+func wait(t *testing.T, ch <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatal("Dial didn't complete")
+		return nil
+	}
+}
+
+// TestDialQueued checks that concurrent dials initiate one at a time, and
+// each completes with its own device.
+func TestDialQueued(t *testing.T) {
+	h, f := newTestHCI(t)
+	addrs := []ble.Addr{
+		ble.NewDeviceAddr([]byte{0xc1, 0x00, 0x00, 0x00, 0x00, 0x01}, true),
+		ble.NewDeviceAddr([]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x02}, false),
+		ble.NewDeviceAddr([]byte{0xc1, 0x00, 0x00, 0x00, 0x00, 0x03}, true),
+	}
+	chs := make(map[[6]byte]<-chan error)
+	for _, a := range addrs {
+		_, b, _ := peerAddr(a)
+		chs[b] = dialAsync(context.Background(), h, a)
+	}
+	for range addrs {
+		_, typ, peer := f.pending(t)
+		ch, ok := chs[peer]
+		if !ok {
+			t.Fatalf("unexpected dial of %x", peer)
+		}
+		delete(chs, peer)
+		f.connect(typ, peer)
+		if err := wait(t, ch); err != nil {
+			t.Fatalf("Dial %x: %v", peer, err)
+		}
+	}
+	if len(chs) != 0 {
+		t.Errorf("%d dials didn't initiate", len(chs))
+	}
+}
+
+// TestDialCancelRace checks that a dial, which is canceled as its connection
+// completes, returns the connection.
+func TestDialCancelRace(t *testing.T) {
+	h, f := newTestHCI(t)
+	f.late = true
+	a := ble.NewDeviceAddr([]byte{0xc1, 0x00, 0x00, 0x00, 0x00, 0x01}, true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := dialAsync(ctx, h, a)
+	f.pending(t)
+	cancel()
+	if err := wait(t, ch); err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if !f.sent(opLECreateConnCancel) {
+		t.Error("the dial wasn't canceled")
+	}
+	if f.sent(opDisconnect) {
+		t.Error("the connection was closed")
+	}
+
+	// The next dial isn't completed by the connection.
+	f.late = false
+	ch = dialAsync(context.Background(), h, ble.NewDeviceAddr([]byte{0xc1, 0x00, 0x00, 0x00, 0x00, 0x02}, true))
+	_, typ, peer := f.pending(t)
+	f.connect(typ, peer)
+	if err := wait(t, ch); err != nil {
+		t.Fatalf("next Dial: %v", err)
+	}
+}
+
+// TestDialMaxConns checks that a dial waits for a link to disconnect, while
+// the maximum number of links is reached.
+func TestDialMaxConns(t *testing.T) {
+	h, f := newTestHCI(t)
+	h.SetMaxConnections(1)
+	a := ble.NewDeviceAddr([]byte{0xc1, 0x00, 0x00, 0x00, 0x00, 0x01}, true)
+	b := ble.NewDeviceAddr([]byte{0xc1, 0x00, 0x00, 0x00, 0x00, 0x02}, true)
+
+	ch := dialAsync(context.Background(), h, a)
+	_, typ, peer := f.pending(t)
+	handle := f.connect(typ, peer)
+	if err := wait(t, ch); err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	ch = dialAsync(context.Background(), h, b)
+	time.Sleep(20 * time.Millisecond)
+	f.mu.Lock()
+	initiating := f.create != nil
+	f.mu.Unlock()
+	if initiating {
+		t.Fatal("the second dial initiated with the maximum number of links")
+	}
+
+	// The first link disconnects.
+	f.event(0x05, 0x00, byte(handle), byte(handle>>8), 0x13)
+	_, typ, peer = f.pending(t)
+	f.connect(typ, peer)
+	if err := wait(t, ch); err != nil {
+		t.Fatalf("second Dial: %v", err)
+	}
+}
@@ -0,0 +1,369 @@
+package hci
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"traulfs/Bline/ble/bline/gatt"
+
+	"github.com/pkg/errors"
+)
+
+// L2CAP Enhanced Credit Based Flow Control Mode [Vol 3, Part A, 10.2].
+// The K-frames are the same as the ones of LE Credit Based Flow Control Mode,
+// but up to five channels are connected and reconfigured at once.
+
+// PSMEATT is the SPSM of Enhanced ATT bearers [Assigned Numbers, 2.4].
+const PSMEATT = 0x0027
+
+// Maximum number of channels in an L2CAP_CREDIT_BASED_CONNECTION_REQ.
+const maxEnhancedChannels = 5
+
+// Minimum MTU and MPS of enhanced credit based channels [Vol 3, Part A, 4.25].
+const minEnhancedMTU = 64
+
+// SignalCreditBasedConnectionRequest is the code of Credit Based Connection Request signaling packet.
+const SignalCreditBasedConnectionRequest = 0x17
+
+// CreditBasedConnectionRequest implements Credit Based Connection Request (0x17) [Vol 3, Part A, 4.25].
+type CreditBasedConnectionRequest struct {
+	SPSM           uint16
+	MTU            uint16
+	MPS            uint16
+	InitialCredits uint16
+	SourceCIDs     []uint16
+}
+
+// Code returns the event code of the command.
+func (s CreditBasedConnectionRequest) Code() int { return 0x17 }
+
+// Marshal serializes the command parameters into binary form.
+func (s *CreditBasedConnectionRequest) Marshal() ([]byte, error) {
+	return marshalCIDs([]uint16{s.SPSM, s.MTU, s.MPS, s.InitialCredits}, s.SourceCIDs)
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (s *CreditBasedConnectionRequest) Unmarshal(b []byte) error {
+	f, cids, err := unmarshalCIDs(b, 4)
+	if err != nil {
+		return err
+	}
+	s.SPSM, s.MTU, s.MPS, s.InitialCredits, s.SourceCIDs = f[0], f[1], f[2], f[3], cids
+	return nil
+}
+
+// SignalCreditBasedConnectionResponse is the code of Credit Based Connection Response signaling packet.
+const SignalCreditBasedConnectionResponse = 0x18
+
+// CreditBasedConnectionResponse implements Credit Based Connection Response (0x18) [Vol 3, Part A, 4.26].
+type CreditBasedConnectionResponse struct {
+	MTU             uint16
+	MPS             uint16
+	InitialCredits  uint16
+	Result          uint16
+	DestinationCIDs []uint16
+}
+
+// Code returns the event code of the command.
+func (s CreditBasedConnectionResponse) Code() int { return 0x18 }
+
+// Marshal serializes the command parameters into binary form.
+func (s *CreditBasedConnectionResponse) Marshal() ([]byte, error) {
+	return marshalCIDs([]uint16{s.MTU, s.MPS, s.InitialCredits, s.Result}, s.DestinationCIDs)
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (s *CreditBasedConnectionResponse) Unmarshal(b []byte) error {
+	f, cids, err := unmarshalCIDs(b, 4)
+	if err != nil {
+		return err
+	}
+	s.MTU, s.MPS, s.InitialCredits, s.Result, s.DestinationCIDs = f[0], f[1], f[2], f[3], cids
+	return nil
+}
+
+// SignalCreditBasedReconfigureRequest is the code of Credit Based Reconfigure Request signaling packet.
+const SignalCreditBasedReconfigureRequest = 0x19
+
+// CreditBasedReconfigureRequest implements Credit Based Reconfigure Request (0x19) [Vol 3, Part A, 4.27].
+type CreditBasedReconfigureRequest struct {
+	MTU             uint16
+	MPS             uint16
+	DestinationCIDs []uint16
+}
+
+// Code returns the event code of the command.
+func (s CreditBasedReconfigureRequest) Code() int { return 0x19 }
+
+// Marshal serializes the command parameters into binary form.
+func (s *CreditBasedReconfigureRequest) Marshal() ([]byte, error) {
+	return marshalCIDs([]uint16{s.MTU, s.MPS}, s.DestinationCIDs)
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (s *CreditBasedReconfigureRequest) Unmarshal(b []byte) error {
+	f, cids, err := unmarshalCIDs(b, 2)
+	if err != nil {
+		return err
+	}
+	s.MTU, s.MPS, s.DestinationCIDs = f[0], f[1], cids
+	return nil
+}
+
+// SignalCreditBasedReconfigureResponse is the code of Credit Based Reconfigure Response signaling packet.
+const SignalCreditBasedReconfigureResponse = 0x1A
+
+// CreditBasedReconfigureResponse implements Credit Based Reconfigure Response (0x1A) [Vol 3, Part A, 4.28].
+type CreditBasedReconfigureResponse struct {
+	Result uint16
+}
+
+// Code returns the event code of the command.
+func (s CreditBasedReconfigureResponse) Code() int { return 0x1A }
+
+// Marshal serializes the command parameters into binary form.
+func (s *CreditBasedReconfigureResponse) Marshal() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	if err := binary.Write(buf, binary.LittleEndian, s); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (s *CreditBasedReconfigureResponse) Unmarshal(b []byte) error {
+	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, s)
+}
+
+// marshalCIDs serializes the fixed fields, followed by the list of CIDs.
+func marshalCIDs(fields, cids []uint16) ([]byte, error) {
+	b := make([]byte, 2*(len(fields)+len(cids)))
+	for i, v := range append(fields, cids...) {
+		binary.LittleEndian.PutUint16(b[2*i:], v)
+	}
+	return b, nil
+}
+
+// unmarshalCIDs de-serializes n fixed fields, followed by a list of CIDs.
+func unmarshalCIDs(b []byte, n int) ([]uint16, []uint16, error) {
+	if len(b) < 2*n || len(b)%2 != 0 {
+		return nil, nil, errors.New("invalid signaling packet length")
+	}
+	v := make([]uint16, len(b)/2)
+	for i := range v {
+		v[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return v[:n], v[n:], nil
+}
+
+// OpenChannels connects up to five enhanced credit based channels to the
+// remote device, which listens on the SPSM [Vol 3, Part A, 4.25]. The remote
+// device may accept fewer channels than requested.
+func (c *Conn) OpenChannels(spsm uint16, n int) ([]*Channel, error) {
+	if n < 1 || n > maxEnhancedChannels {
+		return nil, errors.New("invalid number of channels")
+	}
+	chs := make([]*Channel, 0, n)
+	scids := make([]uint16, 0, n)
+	for i := 0; i < n; i++ {
+		ch, err := c.addChannel(func(scid uint16) *Channel {
+			return newChannel(c, spsm, scid, 0, 0, 0, 0)
+		})
+		if err != nil {
+			break
+		}
+		chs = append(chs, ch)
+		scids = append(scids, ch.scid)
+	}
+	if len(chs) == 0 {
+		return nil, ErrChannelNoResources
+	}
+
+	var rsp CreditBasedConnectionResponse
+	err := c.Signal(&CreditBasedConnectionRequest{
+		SPSM:           spsm,
+		MTU:            cocMTU,
+		MPS:            cocMPS,
+		InitialCredits: cocCredits,
+		SourceCIDs:     scids,
+	}, &rsp)
+	if err == nil && (rsp.MTU < minEnhancedMTU || rsp.MPS < minEnhancedMTU) && rsp.Result == 0x0000 {
+		err = ErrChannelParameters
+	}
+	if err != nil {
+		for _, ch := range chs {
+			c.removeChannel(ch.scid)
+		}
+		return nil, err
+	}
+
+	// The channels refused by the remote device have a DCID of 0x0000.
+	open := chs[:0]
+	for i, ch := range chs {
+		if i >= len(rsp.DestinationCIDs) || rsp.DestinationCIDs[i] == 0x0000 {
+			c.removeChannel(ch.scid)
+			continue
+		}
+		ch.mu.Lock()
+		ch.dcid = rsp.DestinationCIDs[i]
+		ch.txMTU = int(rsp.MTU)
+		ch.txMPS = int(rsp.MPS)
+		ch.txCredits = int(rsp.InitialCredits)
+		ch.mu.Unlock()
+		open = append(open, ch)
+	}
+	if len(open) == 0 {
+		if rsp.Result == 0x0000 {
+			return nil, ErrChannelNoResources
+		}
+		return nil, ChannelError(rsp.Result)
+	}
+	return open, nil
+}
+
+// handleCreditBasedConnectionRequest accepts the channels for a listener of the SPSM [Vol 3, Part A, 4.25].
+func (c *Conn) handleCreditBasedConnectionRequest(s sigCmd) {
+	var req CreditBasedConnectionRequest
+	if err := req.Unmarshal(s.data()); err != nil {
+		return
+	}
+	rsp := &CreditBasedConnectionResponse{
+		MTU:             cocMTU,
+		MPS:             cocMPS,
+		InitialCredits:  cocCredits,
+		DestinationCIDs: make([]uint16, len(req.SourceCIDs)),
+	}
+	reply := func(result ChannelError) {
+		rsp.Result = uint16(result)
+		c.sendResponse(SignalCreditBasedConnectionResponse, s.id(), rsp)
+	}
+
+	c.hci.muListeners.Lock()
+	l := c.hci.listeners[req.SPSM]
+	c.hci.muListeners.Unlock()
+	switch {
+	case l == nil:
+		reply(ErrChannelPSMNotSupported)
+		return
+	case req.SPSM == PSMEATT && c.SecurityLevel() < 2:
+		// Enhanced ATT bearers require an encrypted link [Vol 3, Part G, 5.4].
+		reply(ErrChannelEncryption)
+		return
+	case len(req.SourceCIDs) == 0 || len(req.SourceCIDs) > maxEnhancedChannels:
+		reply(ErrChannelParameters)
+		return
+	case req.MTU < minEnhancedMTU || req.MPS < minEnhancedMTU || req.MPS > 65533:
+		reply(ErrChannelParameters)
+		return
+	}
+	for _, scid := range req.SourceCIDs {
+		if scid < cidDynamicFirst || scid > cidDynamicLast {
+			reply(ErrChannelInvalidSourceCID)
+			return
+		}
+		if c.remoteChannel(scid) != nil {
+			reply(ErrChannelSourceCIDAllocated)
+			return
+		}
+	}
+
+	// Accept as many channels as possible; the others are refused with a DCID of 0x0000.
+	var result ChannelError
+	var chs []*Channel
+	free := cap(l.chAcpt) - len(l.chAcpt)
+	for i, scid := range req.SourceCIDs {
+		if len(chs) == free {
+			result = ErrChannelNoResources
+			break
+		}
+		ch, err := c.addChannel(func(cid uint16) *Channel {
+			return newChannel(c, req.SPSM, cid, scid, int(req.MTU), int(req.MPS), int(req.InitialCredits))
+		})
+		if err != nil {
+			result = ErrChannelNoResources
+			continue
+		}
+		rsp.DestinationCIDs[i] = ch.scid
+		chs = append(chs, ch)
+	}
+
+	// The channels are delivered once they're open.
+	reply(result)
+	for _, ch := range chs {
+		l.deliver(ch)
+	}
+}
+
+// Results of Credit Based Reconfigure Response [Vol 3, Part A, 4.28].
+const (
+	reconfigureMTUReduced     = 0x0001
+	reconfigureMPSReduced     = 0x0002
+	reconfigureInvalidDCID    = 0x0003
+	reconfigureUnacceptParams = 0x0004
+)
+
+// handleCreditBasedReconfigureRequest applies the MTU and the MPS of the
+// remote endpoints of the channels [Vol 3, Part A, 4.27].
+func (c *Conn) handleCreditBasedReconfigureRequest(s sigCmd) {
+	var req CreditBasedReconfigureRequest
+	if err := req.Unmarshal(s.data()); err != nil {
+		return
+	}
+	reply := func(result uint16) {
+		c.sendResponse(SignalCreditBasedReconfigureResponse, s.id(), &CreditBasedReconfigureResponse{Result: result})
+	}
+	if req.MTU < minEnhancedMTU || req.MPS < minEnhancedMTU || len(req.DestinationCIDs) == 0 {
+		reply(reconfigureUnacceptParams)
+		return
+	}
+
+	// The DCIDs are the endpoints of the channels on the remote device.
+	chs := make([]*Channel, len(req.DestinationCIDs))
+	for i, cid := range req.DestinationCIDs {
+		if chs[i] = c.remoteChannel(cid); chs[i] == nil {
+			reply(reconfigureInvalidDCID)
+			return
+		}
+	}
+	for _, ch := range chs {
+		ch.mu.Lock()
+		mtu, mps := ch.txMTU, ch.txMPS
+		ch.mu.Unlock()
+		if int(req.MTU) < mtu {
+			reply(reconfigureMTUReduced)
+			return
+		}
+		if int(req.MPS) < mps && len(chs) > 1 {
+			reply(reconfigureMPSReduced)
+			return
+		}
+	}
+	for _, ch := range chs {
+		ch.mu.Lock()
+		ch.txMTU, ch.txMPS = int(req.MTU), int(req.MPS)
+		ch.mu.Unlock()
+	}
+	reply(0x0000)
+}
+
+// EnableEATT opens up to n Enhanced ATT bearers to the remote device of a GATT
+// client, and adds them to the client. It returns the number of bearers added.
+func EnableEATT(cln *gatt.Client, n int) (int, error) {
+	c, ok := cln.Conn().(*Conn)
+	if !ok {
+		return 0, errors.New("not an HCI connection")
+	}
+	chs, err := c.OpenChannels(PSMEATT, n)
+	if err != nil {
+		return 0, err
+	}
+	for i, ch := range chs {
+		if err := cln.AddBearer(ch); err != nil {
+			for _, ch := range chs[i:] {
+				ch.Close()
+			}
+			return i, err
+		}
+	}
+	return len(chs), nil
+}
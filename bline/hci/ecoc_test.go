@@ -0,0 +1,136 @@
+package hci
+
+import "testing"
+
+func TestEnhancedChannelRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		spsm     uint16
+		mtu      uint16
+		scids    []uint16
+		queued   int // Channels already waiting to be accepted.
+		result   ChannelError
+		accepted int
+	}{
+		{"accepted", testPSM, 64, []uint16{0x0040, 0x0041, 0x0042}, 0, 0x0000, 3},
+		{"listener nearly full", testPSM, 64, []uint16{0x0040, 0x0041, 0x0042}, 6, ErrChannelNoResources, 2},
+		{"listener full", testPSM, 64, []uint16{0x0040}, 8, ErrChannelNoResources, 0},
+		{"SPSM not supported", 0x0081, 64, []uint16{0x0040}, 0, ErrChannelPSMNotSupported, 0},
+		{"EATT without encryption", PSMEATT, 64, []uint16{0x0040}, 0, ErrChannelEncryption, 0},
+		{"too many channels", testPSM, 64, []uint16{0x0040, 0x0041, 0x0042, 0x0043, 0x0044, 0x0045}, 0, ErrChannelParameters, 0},
+		{"MTU too small", testPSM, 63, []uint16{0x0040}, 0, ErrChannelParameters, 0},
+		{"invalid source CID", testPSM, 64, []uint16{0x0040, 0x0004}, 0, ErrChannelInvalidSourceCID, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, f := newTestHCI(t)
+			c, handle := testConn(t, h, f)
+			psm := uint16(testPSM)
+			if tc.spsm == PSMEATT {
+				psm = PSMEATT
+			}
+			l, err := h.Listen(psm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tc.queued; i++ {
+				l.chAcpt <- &Channel{}
+			}
+
+			f.signal(handle, 0x01, &CreditBasedConnectionRequest{
+				SPSM:           tc.spsm,
+				MTU:            tc.mtu,
+				MPS:            64,
+				InitialCredits: 1,
+				SourceCIDs:     tc.scids,
+			})
+			var rsp CreditBasedConnectionResponse
+			f.recvSignal(t, &rsp)
+			if ChannelError(rsp.Result) != tc.result {
+				t.Errorf("got result 0x%04X, want 0x%04X", rsp.Result, uint16(tc.result))
+			}
+			if len(rsp.DestinationCIDs) != len(tc.scids) {
+				t.Fatalf("got %d DCIDs, want %d", len(rsp.DestinationCIDs), len(tc.scids))
+			}
+			for i, dcid := range rsp.DestinationCIDs {
+				if accepted := i < tc.accepted; accepted != (dcid != 0x0000) {
+					t.Errorf("channel %d: got DCID 0x%04X", i, dcid)
+				}
+			}
+
+			for i := 0; i < tc.queued; i++ {
+				<-l.chAcpt
+			}
+			for i := 0; i < tc.accepted; i++ {
+				ch, err := l.Accept()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ch.scid != rsp.DestinationCIDs[i] || ch.remoteCID() != tc.scids[i] || ch.TxMTU() != int(tc.mtu) {
+					t.Errorf("channel %d: got 0x%04X-0x%04X, TxMTU %d", i, ch.scid, ch.remoteCID(), ch.TxMTU())
+				}
+			}
+			if n := len(l.chAcpt); n != 0 {
+				t.Errorf("got %d more channels", n)
+			}
+			for i := tc.accepted; i < len(tc.scids); i++ {
+				if c.remoteChannel(tc.scids[i]) != nil {
+					t.Errorf("channel %d: refused, but added", i)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenChannels(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		rsp   CreditBasedConnectionResponse
+		err   error
+		dcids []uint16 // Of the open channels.
+	}{
+		{"accepted", CreditBasedConnectionResponse{100, 64, 3, 0x0000, []uint16{0x0050, 0x0051, 0x0052}}, nil, []uint16{0x0050, 0x0051, 0x0052}},
+		{"partially accepted", CreditBasedConnectionResponse{100, 64, 3, 0x0004, []uint16{0x0050, 0x0000, 0x0052}}, nil, []uint16{0x0050, 0x0052}},
+		{"refused", CreditBasedConnectionResponse{0, 0, 0, 0x0002, []uint16{0x0000, 0x0000, 0x0000}}, ErrChannelPSMNotSupported, nil},
+		{"no DCIDs", CreditBasedConnectionResponse{100, 64, 3, 0x0000, nil}, ErrChannelNoResources, nil},
+		{"MTU too small", CreditBasedConnectionResponse{63, 64, 3, 0x0000, []uint16{0x0050, 0x0051, 0x0052}}, ErrChannelParameters, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, f := newTestHCI(t)
+			c, handle := testConn(t, h, f)
+			type result struct {
+				chs []*Channel
+				err error
+			}
+			done := make(chan result, 1)
+			go func() {
+				chs, err := c.OpenChannels(testPSM, 3)
+				done <- result{chs, err}
+			}()
+
+			var req CreditBasedConnectionRequest
+			id := f.recvSignal(t, &req)
+			if req.SPSM != testPSM || len(req.SourceCIDs) != 3 || req.MTU != cocMTU || req.MPS != cocMPS {
+				t.Errorf("got request %+v", req)
+			}
+			f.signal(handle, id, &tc.rsp)
+			r := <-done
+			if r.err != tc.err {
+				t.Fatalf("got %v, want %v", r.err, tc.err)
+			}
+			if len(r.chs) != len(tc.dcids) {
+				t.Fatalf("got %d channels, want %d", len(r.chs), len(tc.dcids))
+			}
+			for i, ch := range r.chs {
+				if ch.remoteCID() != tc.dcids[i] || ch.TxMTU() != int(tc.rsp.MTU) {
+					t.Errorf("channel %d: got DCID 0x%04X, TxMTU %d", i, ch.remoteCID(), ch.TxMTU())
+				}
+			}
+			c.muChannels.Lock()
+			n := len(c.channels)
+			c.muChannels.Unlock()
+			if n != len(tc.dcids) {
+				t.Errorf("got %d channels on the connection, want %d", n, len(tc.dcids))
+			}
+		})
+	}
+}
@@ -9,6 +9,10 @@ var (
 	ErrBusyDialing     = errors.New("busy dialing")
 	ErrBusyListening   = errors.New("busy listening")
 	ErrInvalidAddr     = errors.New("invalid address")
+
+	ErrAcceptListFull      = errors.New("accept list full")
+	ErrInvalidFilterPolicy = errors.New("invalid filter policy")
+	ErrAcceptListBusy      = errors.New("accept list owned by AutoConnect")
 )
 
 // HCI Command Errors  [Vol2, Part D, 1.3 ]
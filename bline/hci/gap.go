@@ -1,21 +1,24 @@
 package hci
 
 import (
-	"context"
 	"encoding/binary"
 	"fmt"
-	"net"
 	"time"
 
 	ble "traulfs/Bline/ble"
 	"traulfs/Bline/ble/bline/adv"
-	"traulfs/Bline/ble/bline/gatt"
-
-	"github.com/pkg/errors"
 )
 
-// Addr ...
-func (h *HCI) Addr() ble.Addr { return h.addr }
+// Addr returns the own address, which is either the public or the random address in use.
+func (h *HCI) Addr() ble.Addr {
+	h.params.RLock()
+	defer h.params.RUnlock()
+	if h.params.ownAddrType == ownAddrRandom {
+		b := h.params.randomAddr
+		return deviceAddr(AddrTypeRandom, b)
+	}
+	return ble.NewDeviceAddr(h.addr, false)
+}
 
 // SetAdvHandler ...
 func (h *HCI) SetAdvHandler(ah ble.AdvHandler) error {
@@ -25,6 +28,13 @@ func (h *HCI) SetAdvHandler(ah ble.AdvHandler) error {
 
 // Scan starts scanning.
 func (h *HCI) Scan(allowDup bool) error {
+	if err := h.setScanFilterPolicy(ScanFilterNone); err != nil {
+		return err
+	}
+	return h.scan(allowDup)
+}
+
+func (h *HCI) scan(allowDup bool) error {
 	h.params.scanEnable.FilterDuplicates = 1
 	if allowDup {
 		h.params.scanEnable.FilterDuplicates = 0
@@ -199,56 +209,6 @@ func (h *HCI) Accept() (ble.Conn, error) {
 	}
 }
 
-// Dial ...
-func (h *HCI) Dial(ctx context.Context, a ble.Addr) (ble.Client, error) {
-	b, err := net.ParseMAC(a.String())
-	if err != nil {
-		return nil, ErrInvalidAddr
-	}
-	h.params.connParams.PeerAddress = [6]byte{b[5], b[4], b[3], b[2], b[1], b[0]}
-	if _, ok := a.(RandomAddress); ok {
-		h.params.connParams.PeerAddressType = 1
-		fmt.Printf("Dial with Random!\n")
-	} else {
-		h.params.connParams.PeerAddressType = 1
-		fmt.Printf("Dial with Public!\n")
-	}
-	if err = h.Send(&h.params.connParams, nil); err != nil {
-		return nil, err
-	}
-	var tmo <-chan time.Time
-	if h.dialerTmo != time.Duration(0) {
-		tmo = time.After(h.dialerTmo)
-	}
-
-	select {
-	case <-ctx.Done():
-		return h.cancelDial()
-	case <-tmo:
-		return h.cancelDial()
-	case <-h.done:
-		return nil, h.err
-	case c := <-h.chMasterConn:
-		return gatt.NewClient(c)
-
-	}
-}
-
-// cancelDial cancels the Dialing
-func (h *HCI) cancelDial() (ble.Client, error) {
-	err := h.Send(&h.params.connCancel, nil)
-	if err == nil {
-		// The pending connection was canceled successfully.
-		return nil, fmt.Errorf("connection canceled")
-	}
-	// The connection has been established, the cancel command
-	// failed with ErrDisallowed.
-	if err == ErrDisallowed {
-		return gatt.NewClient(<-h.chMasterConn)
-	}
-	return nil, errors.Wrap(err, "cancel connection failed")
-}
-
 // Advertise starts advertising.
 func (h *HCI) Advertise() error {
 	h.params.advEnable.AdvertisingEnable = 1
@@ -50,10 +50,14 @@ func NewHCI(opts ...ble.Option) (*HCI, error) {
 		evth: map[int]handlerFn{},
 		subh: map[int]handlerFn{},
 
-		muConns:      &sync.Mutex{},
-		conns:        make(map[uint16]*Conn),
-		chMasterConn: make(chan *Conn),
-		chSlaveConn:  make(chan *Conn),
+		muConns:     &sync.Mutex{},
+		conns:       make(map[uint16]*Conn),
+		chSlaveConn: make(chan *Conn),
+		chDialSlot:  make(chan struct{}, 1),
+		chPreempt:   make(chan struct{}),
+		chLinkFreed: make(chan struct{}, 1),
+
+		chRotation: make(chan struct{}, 1),
 
 		done: make(chan bool),
 	}
@@ -108,42 +112,73 @@ type HCI struct {
 	// Minimum 27 bytes. 4 bytes of L2CAP Header, and 23 bytes Payload from upper layer (ATT)
 	pool *Pool
 
+	// acceptList mirrors the Filter Accept List of the controller, which
+	// holds at most acceptListCap entries.
+	muAcceptList  sync.Mutex
+	acceptList    []acceptEntry
+	acceptListCap int
+
+	// identities are the IRKs of peer devices, which are used to resolve
+	// their private addresses. The resolving list of the controller holds at
+	// most rlCap of them, or none if reading its size failed with rlErr.
+	muIdentities sync.RWMutex
+	identities   []Identity
+	rlCap        int
+	rlErr        error
+
 	// L2CAP connections
-	muConns      *sync.Mutex
-	conns        map[uint16]*Conn
-	chMasterConn chan *Conn // Dial returns master connections.
-	chSlaveConn  chan *Conn // Peripheral accept slave connections.
+	muConns     *sync.Mutex
+	conns       map[uint16]*Conn
+	chSlaveConn chan *Conn // Peripheral accept slave connections.
+
+	// Dials take turns on chDialSlot, as the controller initiates a single
+	// connection at a time. The pending one completes its dial.
+	chDialSlot  chan struct{}
+	chPreempt   chan struct{} // A dial is queued behind a background dial.
+	muDial      sync.Mutex
+	dialing     *dialReq
+	muInit      sync.Mutex    // Serializes initiating, and the changes which pause it.
+	autoConns   int           // Number of AutoConnects, which own the accept list.
+	maxConns    int           // Maximum number of master links; 0 if unlimited.
+	chLinkFreed chan struct{} // A master link disconnected.
 
 	connectedHandler    func(evt.LEConnectionComplete)
 	disconnectedHandler func(evt.DisconnectionComplete)
 
+	// connParamsHandler decides on connection parameters requested by the
+	// remote device. connUpdatedHandler is called when they take effect.
+	connParamsHandler  func(*cmd.LERemoteConnectionParameterRequestReply) bool
+	connUpdatedHandler func(evt.LEConnectionUpdateComplete)
+
+	// pairing configures the Security Manager; pairing is not supported if nil.
+	pairing *PairingParams
+
+	// bonds stores the keys of bonded devices. If nil, the store shared by
+	// the BeaconLine is used, if any.
+	bonds  BondStore
+	shared bool // The HCI is one of the anchors of sharedBonds. Guarded by sharedBonds.
+
+	// securityRequest makes the ATT servers send a Security Request, when the
+	// central accesses an attribute which requires more security.
+	securityRequest bool
+
+	// listeners accept the channels connected by remote devices, by LE_PSM.
+	muListeners sync.Mutex
+	listeners   map[uint16]*ChannelListener
+
 	dialerTmo   time.Duration
 	listenerTmo time.Duration
 
+	chRotation chan struct{} // The rotation interval of the random address changed.
+
 	err  error
 	done chan bool
 }
 
 // Init ...
 func (h *HCI) Init() error {
-	h.evth[0x3E] = h.handleLEMeta
-	h.evth[evt.CommandCompleteCode] = h.handleCommandComplete
-	h.evth[evt.CommandStatusCode] = h.handleCommandStatus
-	h.evth[evt.DisconnectionCompleteCode] = h.handleDisconnectionComplete
-	h.evth[evt.NumberOfCompletedPacketsCode] = h.handleNumberOfCompletedPackets
-
-	h.subh[evt.LEAdvertisingReportSubCode] = h.handleLEAdvertisingReport
-	h.subh[evt.LEConnectionCompleteSubCode] = h.handleLEConnectionComplete
-	h.subh[evt.LEConnectionUpdateCompleteSubCode] = h.handleLEConnectionUpdateComplete
-	h.subh[evt.LELongTermKeyRequestSubCode] = h.handleLELongTermKeyRequest
-	// evt.EncryptionChangeCode:                     todo),
-	// evt.ReadRemoteVersionInformationCompleteCode: todo),
-	// evt.HardwareErrorCode:                        todo),
-	// evt.DataBufferOverflowCode:                   todo),
-	// evt.EncryptionKeyRefreshCompleteCode:         todo),
-	// evt.AuthenticatedPayloadTimeoutExpiredCode:   todo),
-	// evt.LEReadRemoteUsedFeaturesCompleteSubCode:   todo),
-	// evt.LERemoteConnectionParameterRequestSubCode: todo),
+	h.handleEvents()
+	h.shareBondStore()
 
 	skt, err := socket.NewSocket(h.bl, h.id)
 	if err != nil {
@@ -167,11 +202,35 @@ func (h *HCI) Init() error {
 	// HCI header (1 Byte) + ACL Data Header (4 bytes) + L2CAP PDU (or fragment)
 	h.pool = NewPool(1+4+h.bufSize, h.bufCnt-1)
 
-	h.Send(&h.params.advParams, nil)
-	h.Send(&h.params.scanParams, nil)
+	if err := h.setOwnAddr(); err != nil {
+		return err
+	}
+	go h.rotateRandomAddr()
 	return nil
 }
 
+// handleEvents registers the handlers of the events.
+func (h *HCI) handleEvents() {
+	h.evth[0x3E] = h.handleLEMeta
+	h.evth[evt.CommandCompleteCode] = h.handleCommandComplete
+	h.evth[evt.CommandStatusCode] = h.handleCommandStatus
+	h.evth[evt.DisconnectionCompleteCode] = h.handleDisconnectionComplete
+	h.evth[evt.NumberOfCompletedPacketsCode] = h.handleNumberOfCompletedPackets
+	h.evth[evt.EncryptionChangeCode] = h.handleEncryptionChange
+	h.evth[evt.EncryptionKeyRefreshCompleteCode] = h.handleEncryptionKeyRefreshComplete
+
+	h.subh[evt.LEAdvertisingReportSubCode] = h.handleLEAdvertisingReport
+	h.subh[evt.LEConnectionCompleteSubCode] = h.handleLEConnectionComplete
+	h.subh[evt.LEConnectionUpdateCompleteSubCode] = h.handleLEConnectionUpdateComplete
+	h.subh[evt.LELongTermKeyRequestSubCode] = h.handleLELongTermKeyRequest
+	h.subh[evt.LERemoteConnectionParameterRequestSubCode] = h.handleLERemoteConnectionParameterRequest
+	// evt.ReadRemoteVersionInformationCompleteCode: todo),
+	// evt.HardwareErrorCode:                        todo),
+	// evt.DataBufferOverflowCode:                   todo),
+	// evt.AuthenticatedPayloadTimeoutExpiredCode:   todo),
+	// evt.LEReadRemoteUsedFeaturesCompleteSubCode:   todo),
+}
+
 // Close ...
 func (h *HCI) Close() error {
 	return h.close(nil)
@@ -224,7 +283,7 @@ func (h *HCI) init() error {
 	h.txPwrLv = int(LEReadAdvertisingChannelTxPowerRP.TransmitPowerLevel)
 
 	LESetEventMaskRP := cmd.LESetEventMaskRP{}
-	h.Send(&cmd.LESetEventMask{LEEventMask: 0x000000000000001F}, &LESetEventMaskRP)
+	h.Send(&cmd.LESetEventMask{LEEventMask: 0x000000000000003F}, &LESetEventMaskRP)
 
 	SetEventMaskRP := cmd.SetEventMaskRP{}
 	h.Send(&cmd.SetEventMask{EventMask: 0x3dbff807fffbffff}, &SetEventMaskRP)
@@ -337,6 +396,7 @@ func (h *HCI) sktLoop() {
 
 func (h *HCI) close(err error) error {
 	h.err = err
+	h.unshareBondStore()
 	if h.skt != nil {
 		return h.skt.Close()
 	}
@@ -446,6 +506,11 @@ func (h *HCI) handleLEAdvertisingReport(b []byte) error {
 		default:
 			a = newAdvertisement(e, i)
 		}
+		if a.id == nil && e.AddressType(i) == AddrTypeRandom {
+			if id, ok := h.resolve(e.Address(i)); ok {
+				a.id = &id
+			}
+		}
 		go h.advHandler(a, h.bl, h.id)
 	}
 
@@ -487,8 +552,9 @@ func (h *HCI) handleCommandStatus(b []byte) error {
 
 func (h *HCI) handleLEConnectionComplete(b []byte) error {
 	e := evt.LEConnectionComplete(b)
-	if e.Role() == roleMaster && ErrCommand(e.Status()) == ErrConnID {
-		// The connection was canceled successfully.
+	if e.Role() == roleMaster && e.Status() != 0x00 {
+		// The connection was canceled, or failed to be established.
+		h.dialed(e, nil)
 		return nil
 	}
 	c := newConn(h, e)
@@ -496,13 +562,10 @@ func (h *HCI) handleLEConnectionComplete(b []byte) error {
 	h.conns[e.ConnectionHandle()] = c
 	h.muConns.Unlock()
 	if e.Role() == roleMaster {
-		if e.Status() == 0x00 {
-			select {
-			case h.chMasterConn <- c:
-			default:
-				go c.Close()
-			}
-			return nil
+		// Re-encrypt the link, if the slave is bonded.
+		c.smp.resume()
+		if !h.dialed(e, c) {
+			go c.Close()
 		}
 		return nil
 	}
@@ -530,9 +593,56 @@ func (h *HCI) handleLEConnectionComplete(b []byte) error {
 }
 
 func (h *HCI) handleLEConnectionUpdateComplete(b []byte) error {
+	e := evt.LEConnectionUpdateComplete(b)
+	h.muConns.Lock()
+	c, found := h.conns[e.ConnectionHandle()]
+	h.muConns.Unlock()
+	if !found {
+		logger.Warn("connection update", "unknown handle", fmt.Sprintf("%04X", e.ConnectionHandle()))
+		return nil
+	}
+	c.connUpdated(e)
+	if h.connUpdatedHandler != nil {
+		h.connUpdatedHandler(e)
+	}
+	return nil
+}
+
+// handleLERemoteConnectionParameterRequest answers the Connection Parameters
+// Request Procedure initiated by the remote device [Vol 6, Part B, 5.1.7].
+// The request is accepted as is, unless a handler rejects it.
+func (h *HCI) handleLERemoteConnectionParameterRequest(b []byte) error {
+	e := evt.LERemoteConnectionParameterRequest(b)
+	rp := &cmd.LERemoteConnectionParameterRequestReply{
+		ConnectionHandle: e.ConnectionHandle(),
+		IntervalMin:      e.IntervalMin(),
+		IntervalMax:      e.IntervalMax(),
+		Latency:          e.Latency(),
+		Timeout:          e.Timeout(),
+		MinimumCELength:  0, // Informational, and spec doesn't specify the use.
+		MaximumCELength:  0, // Informational, and spec doesn't specify the use.
+	}
+	if !h.acceptConnParams(rp) {
+		// Commands can't be sent synchronously from the event loop.
+		go h.Send(&cmd.LERemoteConnectionParameterRequestNegativeReply{
+			ConnectionHandle: e.ConnectionHandle(),
+			Reason:           uint8(ErrConnParams),
+		}, nil)
+		return nil
+	}
+	go h.Send(rp, nil)
 	return nil
 }
 
+// acceptConnParams consults the user policy on connection parameters requested
+// by the remote device. The policy may narrow the parameters in place.
+func (h *HCI) acceptConnParams(rp *cmd.LERemoteConnectionParameterRequestReply) bool {
+	if h.connParamsHandler != nil && !h.connParamsHandler(rp) {
+		return false
+	}
+	return validConnParams(rp.IntervalMin, rp.IntervalMax, rp.Latency, rp.Timeout)
+}
+
 func (h *HCI) handleDisconnectionComplete(b []byte) error {
 	e := evt.DisconnectionComplete(b)
 	h.muConns.Lock()
@@ -543,6 +653,8 @@ func (h *HCI) handleDisconnectionComplete(b []byte) error {
 		return fmt.Errorf("disconnecting an invalid handle %04X", e.ConnectionHandle())
 	}
 	close(c.chInPkt)
+	// Saving the bond does file I/O, which mustn't hold up the events.
+	go c.smp.flushBond()
 
 	if c.param.Role() == roleSlave {
 		// Re-enable advertising, if it was advertising. Refer to the
@@ -557,6 +669,12 @@ func (h *HCI) handleDisconnectionComplete(b []byte) error {
 	} else {
 		// remote peripheral disconnected
 		close(c.chDone)
+
+		// Let a dial waiting for a free link proceed.
+		select {
+		case h.chLinkFreed <- struct{}{}:
+		default:
+		}
 	}
 	// When a connection disconnects, all the sent packets and weren't acked yet
 	// will be recycled. [Vol2, Part E 4.1.1]
@@ -593,9 +711,45 @@ func (h *HCI) handleNumberOfCompletedPackets(b []byte) error {
 
 func (h *HCI) handleLELongTermKeyRequest(b []byte) error {
 	e := evt.LELongTermKeyRequest(b)
-	return h.Send(&cmd.LELongTermKeyRequestNegativeReply{
+	h.muConns.Lock()
+	c, found := h.conns[e.ConnectionHandle()]
+	h.muConns.Unlock()
+	if found {
+		if ltk, ok := c.smp.ltk(e.RandomNumber(), e.EncryptionDiversifier()); ok {
+			// Commands can't be sent synchronously from the event loop.
+			go h.Send(&cmd.LELongTermKeyRequestReply{
+				ConnectionHandle: e.ConnectionHandle(),
+				LongTermKey:      swap16(ltk),
+			}, nil)
+			return nil
+		}
+	}
+	go h.Send(&cmd.LELongTermKeyRequestNegativeReply{
 		ConnectionHandle: e.ConnectionHandle(),
 	}, nil)
+	return nil
+}
+
+func (h *HCI) handleEncryptionChange(b []byte) error {
+	e := evt.EncryptionChange(b)
+	h.muConns.Lock()
+	c, found := h.conns[e.ConnectionHandle()]
+	h.muConns.Unlock()
+	if found {
+		c.smp.encryptionChanged(e.Status(), e.EncryptionEnabled() != 0)
+	}
+	return nil
+}
+
+func (h *HCI) handleEncryptionKeyRefreshComplete(b []byte) error {
+	e := evt.EncryptionKeyRefreshComplete(b)
+	h.muConns.Lock()
+	c, found := h.conns[e.ConnectionHandle()]
+	h.muConns.Unlock()
+	if found {
+		c.smp.encryptionChanged(e.Status(), true)
+	}
+	return nil
 }
 
 func (h *HCI) setAllowedCommands(n int) {
@@ -0,0 +1,351 @@
+package hci
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	ble "traulfs/Bline/ble"
+)
+
+// fakeController stands in for the controller of an HCI. It completes the
+// commands, and keeps an LE Create Connection pending until the test connects
+// it, or the host cancels it; the accept list can't be changed meanwhile.
+// LE Encrypt and LE Rand are served in software, and a link is encrypted as
+// soon as the host starts encryption, or replies with an LTK. The ACL data
+// sent by the host is delivered on acl.
+type fakeController struct {
+	mu      sync.Mutex
+	rsp     map[int][]byte // Return parameters of the commands, by opcode.
+	ops     []int          // Opcodes of the commands sent.
+	last    map[int][]byte // Parameters of the last command sent, by opcode.
+	create  []byte         // Parameters of the pending LE Create Connection.
+	late    bool           // The connection is established before LE Create Connection Cancel.
+	handle  uint16         // Handle of the next connection.
+	rand    uint64         // Last random number of LE Rand.
+	rx      chan []byte    // Packets to the host.
+	acl     chan []byte
+	closed  chan struct{}
+	closeMu sync.Once
+}
+
+const (
+	opDisconnect             = 0x01<<10 | 0x0006
+	opLECreateConnection     = 0x08<<10 | 0x000D
+	opLECreateConnCancel     = 0x08<<10 | 0x000E
+	opLEReadWhiteListSize    = 0x08<<10 | 0x000F
+	opLEEncrypt              = 0x08<<10 | 0x0017
+	opLERand                 = 0x08<<10 | 0x0018
+	opLEStartEncryption      = 0x08<<10 | 0x0019
+	opLELTKRequestReply      = 0x08<<10 | 0x001A
+	opLELTKRequestNegReply   = 0x08<<10 | 0x001B
+	opLESetRandomAddress     = 0x08<<10 | 0x0005
+	opLEClearWhiteList       = 0x08<<10 | 0x0010
+	opLEAddDeviceToWhiteList = 0x08<<10 | 0x0011
+	opLEConnectionUpdate     = 0x08<<10 | 0x0013
+	opLERemoteConnParamReply = 0x08<<10 | 0x0020
+	opLERemoteConnParamNeg   = 0x08<<10 | 0x0021
+)
+
+func newFakeController() *fakeController {
+	return &fakeController{
+		rsp: map[int][]byte{
+			opLEReadWhiteListSize: {0x00, 0x08},
+		},
+		last:   make(map[int][]byte),
+		handle: 0x0040,
+		rx:     make(chan []byte, 64),
+		acl:    make(chan []byte, 64),
+		closed: make(chan struct{}),
+	}
+}
+
+// newTestHCI returns an HCI, which runs on a fake controller.
+func newTestHCI(t *testing.T) (*HCI, *fakeController) {
+	h, err := NewHCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newFakeController()
+	h.handleEvents()
+	h.skt = f
+	h.setAllowedCommands(1)
+	h.bufSize, h.bufCnt = 27, 8
+	h.pool = NewPool(1+4+h.bufSize, h.bufCnt-1)
+	go h.sktLoop()
+	t.Cleanup(func() { f.Close() })
+	return h, f
+}
+
+func (f *fakeController) Read(b []byte) (int, error) {
+	select {
+	case p := <-f.rx:
+		return copy(b, p), nil
+	case <-f.closed:
+		return 0, io.EOF
+	}
+}
+
+func (f *fakeController) Write(b []byte) (int, error) {
+	switch b[0] {
+	case pktTypeCommand:
+		op := int(binary.LittleEndian.Uint16(b[1:]))
+		f.command(op, append([]byte(nil), b[4:]...))
+	case pktTypeACLData:
+		f.acl <- append([]byte(nil), b[1:]...)
+		// Free the buffer of the controller at once.
+		h := binary.LittleEndian.Uint16(b[1:]) & 0x0FFF
+		f.event(0x13, 0x01, byte(h), byte(h>>8), 0x01, 0x00)
+	}
+	return len(b), nil
+}
+
+func (f *fakeController) Close() error {
+	f.closeMu.Do(func() { close(f.closed) })
+	return nil
+}
+
+func (f *fakeController) command(op int, params []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ops = append(f.ops, op)
+	f.last[op] = params
+	switch op {
+	case opLECreateConnection:
+		if f.create != nil {
+			f.commandStatus(op, byte(ErrDisallowed))
+			return
+		}
+		f.create = params
+		f.commandStatus(op, 0x00)
+	case opLECreateConnCancel:
+		if f.create != nil && f.late {
+			var a [6]byte
+			copy(a[:], f.create[6:12])
+			f.connComplete(0x00, roleMaster, f.create[5], a)
+			f.create = nil
+		}
+		if f.create == nil {
+			f.commandComplete(op, byte(ErrDisallowed))
+			return
+		}
+		f.create = nil
+		f.commandComplete(op, 0x00)
+		f.connComplete(byte(ErrConnID), roleMaster, 0, [6]byte{})
+	case opLEClearWhiteList, opLEAddDeviceToWhiteList:
+		if f.create != nil {
+			f.commandComplete(op, byte(ErrDisallowed))
+			return
+		}
+		f.commandComplete(op, 0x00)
+	case opLEConnectionUpdate:
+		// The update completes, once the test sends the event.
+		f.commandStatus(op, 0x00)
+	case opDisconnect:
+		f.commandStatus(op, 0x00)
+		f.event(0x05, 0x00, params[0], params[1], 0x16)
+	case opLEEncrypt:
+		var k, p [16]byte
+		copy(k[:], params[:16])
+		copy(p[:], params[16:32])
+		e, _ := softEncrypt(swap16(k), swap16(p))
+		e = swap16(e)
+		f.commandComplete(op, append([]byte{0x00}, e[:]...)...)
+	case opLERand:
+		f.rand++
+		r := make([]byte, 9)
+		binary.LittleEndian.PutUint64(r[1:], f.rand)
+		f.commandComplete(op, r...)
+	case opLEStartEncryption:
+		// The link is encrypted at once; the key is checked by the test.
+		f.commandStatus(op, 0x00)
+		f.event(0x08, 0x00, params[0], params[1], 0x01)
+	case opLELTKRequestReply:
+		f.commandComplete(op, 0x00, params[0], params[1])
+		f.event(0x08, 0x00, params[0], params[1], 0x01)
+	case opLELTKRequestNegReply:
+		f.commandComplete(op, 0x00, params[0], params[1])
+	default:
+		if rsp, ok := f.rsp[op]; ok {
+			f.commandComplete(op, rsp...)
+			return
+		}
+		f.commandComplete(op, 0x00)
+	}
+}
+
+func (f *fakeController) event(code byte, params ...byte) {
+	f.rx <- append([]byte{pktTypeEvent, code, byte(len(params))}, params...)
+}
+
+func (f *fakeController) commandComplete(op int, ret ...byte) {
+	f.event(0x0E, append([]byte{0x01, byte(op), byte(op >> 8)}, ret...)...)
+}
+
+func (f *fakeController) commandStatus(op int, status byte) {
+	f.event(0x0F, status, 0x01, byte(op), byte(op>>8))
+}
+
+func (f *fakeController) connComplete(status, role, typ byte, a [6]byte) uint16 {
+	h := f.handle
+	if status == 0x00 {
+		f.handle++
+	}
+	p := []byte{0x01, status, byte(h), byte(h >> 8), role, typ}
+	p = append(p, a[:]...)
+	p = append(p, 0x18, 0x00, 0x00, 0x00, 0x48, 0x00, 0x00)
+	f.event(0x3E, p...)
+	return h
+}
+
+// pending returns the initiator filter policy, and the peer of the pending
+// LE Create Connection, once there's one.
+func (f *fakeController) pending(t *testing.T) (policy, typ byte, a [6]byte) {
+	t.Helper()
+	for end := time.Now().Add(2 * time.Second); time.Now().Before(end); time.Sleep(time.Millisecond) {
+		f.mu.Lock()
+		p := f.create
+		f.mu.Unlock()
+		if p != nil {
+			copy(a[:], p[6:12])
+			return p[4], p[5], a
+		}
+	}
+	t.Fatal("no pending LE Create Connection")
+	return
+}
+
+// connect completes the pending LE Create Connection with the device a, as
+// if it advertised.
+func (f *fakeController) connect(typ byte, a [6]byte) uint16 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.create = nil
+	return f.connComplete(0x00, roleMaster, typ, a)
+}
+
+// accept completes a connection of the device a to the host, as if the host
+// advertised.
+func (f *fakeController) accept(typ byte, a [6]byte) uint16 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connComplete(0x00, roleSlave, typ, a)
+}
+
+// lastParams returns the parameters of the last command sent with opcode op.
+func (f *fakeController) lastParams(op int) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.last[op]
+}
+
+// sent tells whether a command was sent with opcode op.
+func (f *fakeController) sent(op int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, x := range f.ops {
+		if x == op {
+			return true
+		}
+	}
+	return false
+}
+
+// sendL2CAP sends an L2CAP PDU to the host, on the connection with handle.
+func (f *fakeController) sendL2CAP(handle, cid uint16, payload ...byte) {
+	p := make([]byte, 4, 4+len(payload))
+	binary.LittleEndian.PutUint16(p, uint16(len(payload)))
+	binary.LittleEndian.PutUint16(p[2:], cid)
+	p = append(p, payload...)
+
+	// A single fragment, which starts the PDU.
+	b := make([]byte, 5, 5+len(p))
+	b[0] = pktTypeACLData
+	binary.LittleEndian.PutUint16(b[1:], handle|0x02<<12)
+	binary.LittleEndian.PutUint16(b[3:], uint16(len(p)))
+	f.rx <- append(b, p...)
+}
+
+// signal sends a signaling command to the host.
+func (f *fakeController) signal(handle uint16, id byte, s Signal) {
+	b, _ := s.Marshal()
+	p := append([]byte{byte(s.Code()), id, byte(len(b)), byte(len(b) >> 8)}, b...)
+	f.sendL2CAP(handle, cidLESignal, p...)
+}
+
+// recvL2CAP returns the CID and the payload of the next L2CAP PDU sent by the
+// host, once its fragments are recombined.
+func (f *fakeController) recvL2CAP(t *testing.T) (uint16, []byte) {
+	t.Helper()
+	var p []byte
+	for len(p) < 4 || len(p) < 4+int(binary.LittleEndian.Uint16(p)) {
+		select {
+		case b := <-f.acl:
+			p = append(p, b[4:]...)
+		case <-time.After(2 * time.Second):
+			t.Fatal("no L2CAP PDU from the host")
+		}
+	}
+	return binary.LittleEndian.Uint16(p[2:]), p[4:]
+}
+
+// recvSignal returns the identifier of the next signaling command sent by the
+// host, which must have the code of s, and unmarshals it into s.
+func (f *fakeController) recvSignal(t *testing.T, s Signal) uint8 {
+	t.Helper()
+	for {
+		cid, p := f.recvL2CAP(t)
+		if cid != cidLESignal {
+			continue
+		}
+		c := sigCmd(p)
+		if c.code() != s.Code() {
+			t.Fatalf("got signaling command 0x%02X, want 0x%02X", c.code(), s.Code())
+		}
+		if err := s.Unmarshal(c.data()); err != nil {
+			t.Fatal(err)
+		}
+		return c.id()
+	}
+}
+
+// testConn returns a connection of the host to a peer, in the master role,
+// and its handle.
+func testConn(t *testing.T, h *HCI, f *fakeController) (*Conn, uint16) {
+	t.Helper()
+	ch := dialAsync(context.Background(), h, ble.NewDeviceAddr([]byte{0xc1, 0x22, 0x33, 0x44, 0x55, 0x66}, true))
+	_, typ, peer := f.pending(t)
+	handle := f.connect(typ, peer)
+	if err := wait(t, ch); err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	h.muConns.Lock()
+	defer h.muConns.Unlock()
+	return h.conns[handle], handle
+}
+
+// recvSMP returns the next SMP command sent by the host.
+func (f *fakeController) recvSMP(t *testing.T) []byte {
+	t.Helper()
+	for {
+		if cid, p := f.recvL2CAP(t); cid == cidSMP {
+			return p
+		}
+	}
+}
+
+// waitParams returns the parameters of the command with opcode op, once the
+// host sent it.
+func (f *fakeController) waitParams(t *testing.T, op int) []byte {
+	t.Helper()
+	for end := time.Now().Add(2 * time.Second); time.Now().Before(end); time.Sleep(time.Millisecond) {
+		if p := f.lastParams(op); p != nil {
+			return p
+		}
+	}
+	t.Fatalf("no command 0x%04X", op)
+	return nil
+}
@@ -16,6 +16,11 @@ func (h *HCI) SetBeaconLine(bl *socket.BeaconLine) error {
 	return nil
 }
 
+// BeaconLine returns the BeaconLine of the HCI, if any.
+func (h *HCI) BeaconLine() *socket.BeaconLine {
+	return h.bl
+}
+
 // SetDeviceID sets HCI device ID.
 func (h *HCI) SetDeviceID(id int) error {
 	h.id = id
@@ -28,6 +33,17 @@ func (h *HCI) SetDialerTimeout(d time.Duration) error {
 	return nil
 }
 
+// SetMaxConnections limits the number of simultaneous master links. Dials
+// wait for a link to disconnect, while the limit is reached. The default 0
+// leaves the limit to the controller.
+func (h *HCI) SetMaxConnections(n int) error {
+	if n < 0 {
+		return errors.New("invalid maximum number of connections")
+	}
+	h.maxConns = n
+	return nil
+}
+
 // SetListenerTimeout sets dialing timeout for Listener.
 func (h *HCI) SetListenerTimeout(d time.Duration) error {
 	h.listenerTmo = d
@@ -58,6 +74,46 @@ func (h *HCI) SetDisconnectedHandler(f func(evt.DisconnectionComplete)) error {
 	return nil
 }
 
+// SetConnParamsRequestHandler sets the policy for connection parameters requested by the remote device.
+func (h *HCI) SetConnParamsRequestHandler(f func(*cmd.LERemoteConnectionParameterRequestReply) bool) error {
+	h.connParamsHandler = f
+	return nil
+}
+
+// SetConnUpdatedHandler sets handler to be called when connection parameters are updated.
+func (h *HCI) SetConnUpdatedHandler(f func(evt.LEConnectionUpdateComplete)) error {
+	h.connUpdatedHandler = f
+	return nil
+}
+
+// SetPairingParams enables pairing with the given parameters.
+func (h *HCI) SetPairingParams(p PairingParams) error {
+	if p.MaxKeySize != 0 && (p.MaxKeySize < 7 || p.MaxKeySize > 16) {
+		return ErrEncryptionKeySize
+	}
+	h.pairing = &p
+	return nil
+}
+
+// SetSecurityRequest sets whether a Security Request is sent, when the central
+// accesses an attribute which requires more security than the link has.
+func (h *HCI) SetSecurityRequest(b bool) error {
+	h.securityRequest = b
+	return nil
+}
+
+// SecurityRequest tells if a Security Request is sent on insufficient security.
+func (h *HCI) SecurityRequest() bool {
+	return h.securityRequest
+}
+
+// SetBondStore sets the store of the bonds, which is shared by the anchors
+// of the BeaconLine not configured with a store of their own.
+func (h *HCI) SetBondStore(s BondStore) error {
+	h.bonds = s
+	return nil
+}
+
 // SetAdvParams overrides default advertising parameters.
 func (h *HCI) SetAdvParams(param cmd.LESetAdvertisingParameters) error {
 	h.params.advParams = param
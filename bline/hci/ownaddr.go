@@ -0,0 +1,185 @@
+package hci
+
+import (
+	"crypto/rand"
+	"net"
+	"time"
+
+	ble "traulfs/Bline/ble"
+	"traulfs/Bline/ble/bline/hci/cmd"
+)
+
+// Own address types used by advertising, scanning and initiating [Vol 2, Part E, 7.8.5].
+const (
+	ownAddrPublic = 0x00
+	ownAddrRandom = 0x01
+)
+
+// NewStaticAddr returns a new random static device address [Vol 6, Part B, 1.3.2.1].
+func NewStaticAddr() ble.Addr {
+	return newRandomAddr(0xC0)
+}
+
+// NewNonResolvableAddr returns a new non-resolvable private address [Vol 6, Part B, 1.3.2.2].
+func NewNonResolvableAddr() ble.Addr {
+	return newRandomAddr(0x00)
+}
+
+// newRandomAddr returns a random address with the two most significant bits set to sub.
+// The random part of the address shall not be all 0s or all 1s.
+func newRandomAddr(sub byte) ble.Addr {
+	b := make([]byte, 6)
+	for {
+		rand.Read(b)
+		b[0] = b[0]&0x3F | sub
+		if !allBits(b, 0x00) && !allBits(b, 0xFF) {
+			return ble.NewDeviceAddr(b, true)
+		}
+	}
+}
+
+// allBits reports whether the random part of the address b (most significant octet first) equals v.
+func allBits(b []byte, v byte) bool {
+	if b[0]&0x3F != v&0x3F {
+		return false
+	}
+	for _, x := range b[1:] {
+		if x != v {
+			return false
+		}
+	}
+	return true
+}
+
+// randomAddr validates a random address to be used as the own address, and
+// returns it in HCI byte order. Resolvable private addresses are not supported,
+// since the host doesn't have a local IRK.
+func randomAddr(a ble.Addr) ([6]byte, error) {
+	b, err := net.ParseMAC(a.String())
+	if err != nil || len(b) != 6 {
+		return [6]byte{}, ErrInvalidAddr
+	}
+	switch sub := b[0] & 0xC0; {
+	case sub == 0xC0 && !allBits(b, 0xFF): // Static
+	case sub == 0x00 && !allBits(b, 0x00): // Non-resolvable private
+	default:
+		return [6]byte{}, ErrInvalidAddr
+	}
+	return [6]byte{b[5], b[4], b[3], b[2], b[1], b[0]}, nil
+}
+
+// SetRandomAddr sets a random static or non-resolvable private address, and
+// uses it as the own address for advertising, scanning and initiating.
+// If the HCI is running, advertising and scanning are paused while the address changes.
+func (h *HCI) SetRandomAddr(a ble.Addr) error {
+	b, err := randomAddr(a)
+	if err != nil {
+		return err
+	}
+	h.params.Lock()
+	h.params.randomAddr = b
+	h.params.ownAddrType = ownAddrRandom
+	h.params.Unlock()
+	if h.skt == nil {
+		// Not initialized yet, Init takes care of it.
+		return nil
+	}
+	return h.pauseScanAndAdv(h.setOwnAddr)
+}
+
+// SetPublicAddr uses the public address as the own address for advertising, scanning and initiating.
+func (h *HCI) SetPublicAddr() error {
+	h.params.Lock()
+	h.params.ownAddrType = ownAddrPublic
+	h.params.Unlock()
+	if h.skt == nil {
+		return nil
+	}
+	return h.pauseScanAndAdv(h.setOwnAddr)
+}
+
+// SetRandomAddrRotation sets the interval to replace a non-resolvable private
+// random address with a new one. A static address is left unchanged, as it
+// must not change until the device is power cycled [Vol 6, Part B, 1.3.2.1].
+// Rotation is disabled if d is zero. If the HCI is running, the rotation
+// restarts with the new interval.
+func (h *HCI) SetRandomAddrRotation(d time.Duration) error {
+	h.params.Lock()
+	h.params.rotation = d
+	h.params.Unlock()
+	select {
+	case h.chRotation <- struct{}{}:
+	default:
+		// The rotation restarts already.
+	}
+	return nil
+}
+
+// setOwnAddr configures the controller with the own address type and the random
+// address, if used. Advertising and scanning must be disabled by the caller.
+func (h *HCI) setOwnAddr() error {
+	h.params.Lock()
+	t := h.params.ownAddrType
+	h.params.advParams.OwnAddressType = t
+	h.params.scanParams.OwnAddressType = t
+	h.params.connParams.OwnAddressType = t
+	rnd := cmd.LESetRandomAddress{RandomAddress: h.params.randomAddr}
+	h.params.Unlock()
+
+	if t == ownAddrRandom {
+		if err := h.Send(&rnd, nil); err != nil {
+			return err
+		}
+	}
+	if err := h.Send(&h.params.advParams, nil); err != nil {
+		return err
+	}
+	return h.Send(&h.params.scanParams, nil)
+}
+
+// rotateRandomAddr periodically replaces the random address until the HCI is
+// closed. It restarts, whenever the interval of the rotation changes.
+func (h *HCI) rotateRandomAddr() {
+	var t *time.Ticker
+	var tick <-chan time.Time
+	restart := func() {
+		if t != nil {
+			t.Stop()
+			t, tick = nil, nil
+		}
+		h.params.RLock()
+		d := h.params.rotation
+		h.params.RUnlock()
+		if d > 0 {
+			t = time.NewTicker(d)
+			tick = t.C
+		}
+	}
+	restart()
+	defer func() {
+		if t != nil {
+			t.Stop()
+		}
+	}()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-h.chRotation:
+			restart()
+			continue
+		case <-tick:
+		}
+		h.params.RLock()
+		nonResolvable := h.params.randomAddr[5]&0xC0 == 0x00
+		random := h.params.ownAddrType == ownAddrRandom
+		h.params.RUnlock()
+		if !random || !nonResolvable {
+			continue
+		}
+		// Fails with ErrDisallowed while initiating, and will be retried with the next tick.
+		if err := h.SetRandomAddr(NewNonResolvableAddr()); err != nil {
+			logger.Warn("rotate random address", "err", err)
+		}
+	}
+}
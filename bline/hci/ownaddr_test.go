@@ -0,0 +1,95 @@
+package hci
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRandomAddrRotation(t *testing.T) {
+	h, f := newTestHCI(t)
+	go h.rotateRandomAddr()
+
+	a := NewNonResolvableAddr()
+	if err := h.SetRandomAddr(a); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := randomAddr(a)
+	if p := f.lastParams(opLESetRandomAddress); !bytes.Equal(p, want[:]) {
+		t.Fatalf("got random address % X, want % X", p, want)
+	}
+
+	// The own address of a connection is the one it was made with.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	ch := make(chan error, 1)
+	var local string
+	go func() {
+		cln, err := h.Dial(ctx, NewStaticAddr())
+		if err == nil {
+			local = cln.Conn().LocalAddr().String()
+		}
+		ch <- err
+	}()
+	_, typ, peer := f.pending(t)
+	f.connect(typ, peer)
+	if err := <-ch; err != nil {
+		t.Fatal(err)
+	}
+
+	// The rotation starts on a running HCI.
+	if err := h.SetRandomAddrRotation(5 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	for end := time.Now().Add(2 * time.Second); ; time.Sleep(time.Millisecond) {
+		if p := f.lastParams(opLESetRandomAddress); !bytes.Equal(p, want[:]) {
+			if p[5]&0xC0 != 0x00 {
+				t.Errorf("got random address % X, want a non-resolvable one", p)
+			}
+			break
+		}
+		if time.Now().After(end) {
+			t.Fatal("the random address wasn't rotated")
+		}
+	}
+	if local != a.String() {
+		t.Errorf("got local address %s, want %s", local, a)
+	}
+	if h.Addr().String() == a.String() {
+		t.Error("the own address wasn't rotated")
+	}
+
+	// And stops, once disabled.
+	if err := h.SetRandomAddrRotation(0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	p := f.lastParams(opLESetRandomAddress)
+	time.Sleep(50 * time.Millisecond)
+	if q := f.lastParams(opLESetRandomAddress); !bytes.Equal(p, q) {
+		t.Errorf("the random address rotated after the rotation was disabled")
+	}
+}
+
+// TestStaticAddrNotRotated checks that a static address is kept, while the
+// rotation is enabled.
+func TestStaticAddrNotRotated(t *testing.T) {
+	h, f := newTestHCI(t)
+	go h.rotateRandomAddr()
+	a := NewStaticAddr()
+	if err := h.SetRandomAddr(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetRandomAddrRotation(5 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	want, _ := randomAddr(a)
+	if p := f.lastParams(opLESetRandomAddress); !bytes.Equal(p, want[:]) {
+		t.Errorf("got random address % X, want % X", p, want)
+	}
+	if h.Addr().String() != a.String() {
+		t.Errorf("got own address %s, want %s", h.Addr(), a)
+	}
+}
@@ -0,0 +1,1028 @@
+package hci
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	ble "traulfs/Bline/ble"
+	"traulfs/Bline/ble/bline/hci/cmd"
+
+	"github.com/pkg/errors"
+)
+
+// smpTimeout is the timeout of the SMP procedures [Vol 3, Part H, 3.4].
+const smpTimeout = 30 * time.Second
+
+// Security levels of LE security mode 1 [Vol 3, Part C, 10.2.1].
+const (
+	SecurityNone              = 1 // No security (no authentication and no encryption).
+	SecurityEncrypted         = 2 // Unauthenticated pairing with encryption.
+	SecurityAuthenticated     = 3 // Authenticated pairing with encryption.
+	SecuritySecureConnections = 4 // Authenticated LE Secure Connections pairing with a 128-bit key.
+)
+
+// PairingParams configures the Security Manager of the HCI.
+// Pairing requests are rejected with Pairing Not Supported, unless it is set.
+type PairingParams struct {
+	IOCapability uint8 // One of the IOCap constants.
+	Bonding      bool  // Exchange keys to be stored for later reconnections.
+	MITM         bool  // Require protection against man-in-the-middle attacks.
+	MaxKeySize   int   // Maximum encryption key size, 7 - 16 octets; 16 if zero.
+
+	// SecureConnections enables LE Secure Connections pairing, which is used
+	// if the remote device supports it as well. Out of band data is only used
+	// by LE legacy pairing.
+	SecureConnections bool
+
+	// DisplayPasskey shows the passkey to the user, who enters it on the remote device.
+	DisplayPasskey func(a ble.Addr, passkey uint32)
+
+	// InputPasskey returns the passkey entered by the user, as displayed by the remote device.
+	InputPasskey func(a ble.Addr) (uint32, error)
+
+	// OOBData returns the Temporary Key shared with the remote device out of band, if any.
+	OOBData func(a ble.Addr) ([16]byte, bool)
+
+	// CompareNumeric shows the value of Numeric Comparison to the user, and
+	// tells if the user confirmed it matches the value of the remote device.
+	CompareNumeric func(a ble.Addr, value uint32) bool
+}
+
+func (p *PairingParams) maxKeySize() int {
+	if p.MaxKeySize == 0 {
+		return 16
+	}
+	return p.MaxKeySize
+}
+
+// Keys are the keys distributed by a device during pairing [Vol 3, Part H, 3.6].
+// All the keys are stored most significant octet first.
+type Keys struct {
+	LTK               [16]byte // Long Term Key.
+	EDIV              uint16   // Encrypted Diversifier.
+	Rand              uint64   // Random Number.
+	KeySize           int      // Size of the encryption key in octets.
+	Authenticated     bool     // The LTK was generated with MITM protection.
+	SecureConnections bool     // The LTK was generated with LE Secure Connections.
+
+	IRK          [16]byte       // Identity Resolving Key.
+	IdentityAddr ble.DeviceAddr // Public or static random identity address, if distributed.
+
+	CSRK [16]byte // Connection Signature Resolving Key.
+
+	// SignCounter is the counter of the next data signed with the local CSRK,
+	// or the lowest counter accepted with the remote CSRK.
+	SignCounter uint32
+
+	Dist uint8 // Key distribution flags of the keys which are valid.
+}
+
+// Pairing methods [Vol 3, Part H, 2.3.5.1].
+const (
+	justWorks = iota
+	passkeyEntry
+	outOfBand
+	numericComparison
+)
+
+// smp is the per-connection state of the Security Manager.
+type smp struct {
+	sync.Mutex
+	c *Conn
+
+	// in receives the SMP PDUs while a pairing procedure is running.
+	in      chan pdu
+	running bool
+
+	// chEnc delivers the status of the Encryption Change event.
+	chEnc chan error
+
+	// resumed is closed, once the encryption of the link with the key of
+	// its bond is done; it's nil, unless the link is resumed.
+	resumed chan struct{}
+
+	// stk is the key, which the master uses to encrypt the link at the end of
+	// phase 2. It is handed out on LE Long Term Key Request.
+	stk      [16]byte
+	stkValid bool
+
+	// auth, sc and keySize describe the key of the pending encryption.
+	auth    bool
+	sc      bool
+	keySize int
+	level   int
+
+	local  Keys // Keys distributed by the local device.
+	remote Keys // Keys distributed by the remote device.
+
+	// bonded tells if the keys are stored in the bond store.
+	bonded bool
+
+	// saveBond stores the keys, after their sign counters changed.
+	saveBond *time.Timer
+}
+
+func newSMP(c *Conn) *smp {
+	return &smp{
+		c:     c,
+		in:    make(chan pdu, 8),
+		chEnc: make(chan error, 1),
+		level: SecurityNone,
+	}
+}
+
+// close terminates the running pairing procedure, if any.
+// It's called when the connection is closed, and no more PDUs are received.
+func (s *smp) close() {
+	close(s.in)
+}
+
+func (s *smp) handle(p pdu) error {
+	s.Lock()
+	running := s.running
+	s.Unlock()
+	if running {
+		select {
+		case s.in <- p:
+		default:
+			logger.Warn("smp", "drop", p)
+		}
+		return nil
+	}
+
+	switch p[0] {
+	case pairingRequest:
+		if s.c.param.Role() != roleSlave {
+			return s.c.sendSMP([]byte{pairingFailed, uint8(ErrSMPCommandNotSupported)})
+		}
+		params := s.c.hci.pairing
+		if params == nil {
+			// C.5.1 Pairing Not Supported by Slave
+			return s.c.sendSMP([]byte{pairingFailed, uint8(ErrPairingNotSupported)})
+		}
+		s.start(func() error { return s.respond(params, p) })
+	case securityRequest:
+		// The slave requests the master to initiate security [Vol 3, Part H, 3.6.7].
+		if s.c.param.Role() != roleMaster || s.c.hci.pairing == nil {
+			return s.c.sendSMP([]byte{pairingFailed, uint8(ErrPairingNotSupported)})
+		}
+		if len(p) != 2 {
+			return s.c.sendSMP([]byte{pairingFailed, uint8(ErrInvalidParameters)})
+		}
+		go s.securityRequested(p[1])
+	}
+	return nil
+}
+
+// securityRequested serves a Security Request of the slave. The link is
+// encrypted with the LTK of the bond, if it meets the security requested with
+// authReq, and paired otherwise [Vol 3, Part H, 2.4.6].
+func (s *smp) securityRequested(authReq uint8) {
+	s.Lock()
+	resumed := s.resumed
+	s.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+	if b, ok := s.c.hci.loadBond(s.c.RemoteAddr()); ok && s.meets(b.Remote, authReq) {
+		s.Lock()
+		encrypted := s.bonded && s.level >= SecurityEncrypted
+		s.Unlock()
+		if encrypted {
+			// The link is encrypted with the key already.
+			return
+		}
+		done := make(chan error, 1)
+		if !s.start(func() error {
+			err := s.encryptBond(b)
+			done <- err
+			return err
+		}) {
+			// A pairing is in progress.
+			return
+		}
+		if err := <-done; err == nil {
+			return
+		}
+	}
+	if err := s.c.Pair(); err != nil {
+		logger.Info("smp", "security request", err)
+	}
+}
+
+// meets tells whether the LTK distributed by the slave meets the security
+// requested with authReq. Secure Connections are required, only if both
+// devices support them.
+func (s *smp) meets(k Keys, authReq uint8) bool {
+	switch {
+	case k.Dist&keyDistEnc == 0:
+		return false
+	case authReq&authReqMITM != 0 && !k.Authenticated:
+		return false
+	case authReq&authReqSC != 0 && s.c.hci.pairing.SecureConnections && !k.SecureConnections:
+		return false
+	}
+	return true
+}
+
+// start runs a pairing procedure in the background.
+func (s *smp) start(f func() error) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.running {
+		return false
+	}
+	s.running = true
+	go func() {
+		err := f()
+		s.Lock()
+		s.running = false
+		s.Unlock()
+		if err != nil {
+			logger.Info("smp", "pairing", err)
+		}
+	}()
+	return true
+}
+
+// Pair initiates pairing as the master, and returns when the link is
+// encrypted and the keys are distributed.
+func (c *Conn) Pair() error {
+	if c.param.Role() != roleMaster {
+		return errors.New("pairing is initiated by the master")
+	}
+	params := c.hci.pairing
+	if params == nil {
+		return ErrPairingNotSupported
+	}
+	// The encryption with the key of a bond goes first.
+	c.smp.Lock()
+	resumed := c.smp.resumed
+	c.smp.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+	done := make(chan error, 1)
+	if !c.smp.start(func() error {
+		err := c.smp.initiate(params)
+		done <- err
+		return err
+	}) {
+		return errors.New("pairing in progress")
+	}
+	return <-done
+}
+
+// SecurityLevel returns the security level of the link.
+func (c *Conn) SecurityLevel() int {
+	c.smp.Lock()
+	defer c.smp.Unlock()
+	return c.smp.level
+}
+
+// EncryptionKeySize returns the size of the encryption key in octets, or 0 if
+// the link is not encrypted.
+func (c *Conn) EncryptionKeySize() int {
+	c.smp.Lock()
+	defer c.smp.Unlock()
+	if c.smp.level < SecurityEncrypted {
+		return 0
+	}
+	return c.smp.keySize
+}
+
+// RequestSecurity sends a Security Request to the master, which either pairs
+// or encrypts the link with the key of its bond [Vol 3, Part H, 3.6.7].
+func (c *Conn) RequestSecurity() error {
+	if c.param.Role() != roleSlave {
+		return errors.New("security is requested by the slave")
+	}
+	params := c.hci.pairing
+	if params == nil {
+		return ErrPairingNotSupported
+	}
+	c.smp.Lock()
+	running := c.smp.running
+	c.smp.Unlock()
+	if running {
+		return nil
+	}
+	return c.sendSMP([]byte{securityRequest, params.authReq()})
+}
+
+// pairingCtx holds the state of a running pairing procedure.
+type pairingCtx struct {
+	s        *smp
+	params   *PairingParams
+	deadline <-chan time.Time
+
+	// pending holds the PDUs received while waiting for encryption.
+	pending []pdu
+
+	preq, pres [7]byte // Pairing Request and Response; most significant octet first.
+	initDist   uint8
+	respDist   uint8
+	keySize    int
+
+	method     int
+	initInputs bool
+	respInputs bool
+	tk         [16]byte
+
+	// bonding tells if both devices request bonding.
+	bonding bool
+
+	// LE Secure Connections.
+	sc     bool
+	ioCapA [3]byte // AuthReq, OOB data flag and IO capability of the initiator.
+	ioCapB [3]byte // AuthReq, OOB data flag and IO capability of the responder.
+	pka    [32]byte
+	pkb    [32]byte
+	dhkey  [32]byte
+	ltk    [16]byte
+}
+
+func (s *smp) newPairingCtx(params *PairingParams) *pairingCtx {
+	return &pairingCtx{
+		s:        s,
+		params:   params,
+		deadline: time.After(smpTimeout),
+	}
+}
+
+// features returns the Pairing Request or Response command of the local device.
+func (pc *pairingCtx) features(code uint8, initDist, respDist uint8) []byte {
+	p := pc.params
+	var oob uint8
+	if p.OOBData != nil && !p.SecureConnections {
+		if _, ok := p.OOBData(pc.s.c.RemoteAddr()); ok {
+			oob = 0x01
+		}
+	}
+	return []byte{code, p.IOCapability, oob, p.authReq(), uint8(p.maxKeySize()), initDist, respDist}
+}
+
+// authReq returns the AuthReq flags of the parameters.
+func (p *PairingParams) authReq() uint8 {
+	var authReq uint8
+	if p.Bonding {
+		authReq |= authReqBonding
+	}
+	if p.MITM {
+		authReq |= authReqMITM
+	}
+	if p.SecureConnections {
+		authReq |= authReqSC
+	}
+	return authReq
+}
+
+// initiate runs the pairing procedure as the initiator (master).
+func (s *smp) initiate(params *PairingParams) error {
+	pc := s.newPairingCtx(params)
+	var initDist, respDist uint8
+	if params.Bonding {
+		initDist = keyDistEnc | keyDistSign
+		respDist = keyDistEnc | keyDistID | keyDistSign
+	}
+	req := pc.features(pairingRequest, initDist, respDist)
+	copy(pc.preq[:], reverse(req))
+	if err := s.c.sendSMP(req); err != nil {
+		return err
+	}
+
+	// Phase 1: Pairing Feature Exchange.
+	rsp, err := pc.expect(pairingResponse, 7)
+	if err != nil {
+		return err
+	}
+	copy(pc.pres[:], reverse(rsp))
+	pc.initDist = initDist & rsp[5]
+	pc.respDist = respDist & rsp[6]
+	if err := pc.negotiate(req, rsp); err != nil {
+		return pc.fail(err)
+	}
+
+	// Phase 2: Short Term Key Generation, or Long Term Key Generation with
+	// LE Secure Connections.
+	if err := pc.getTK(true); err != nil {
+		return pc.fail(err)
+	}
+	var key [16]byte
+	if pc.sc {
+		key, err = pc.scInitiator()
+	} else {
+		key, err = pc.legacyInitiator()
+	}
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	s.auth = pc.method != justWorks
+	s.sc = pc.sc
+	s.keySize = pc.keySize
+	s.Unlock()
+	s.drainEncryption()
+	if err := s.c.hci.Send(&cmd.LEStartEncryption{
+		ConnectionHandle:     s.c.param.ConnectionHandle(),
+		RandomNumber:         0,
+		EncryptedDiversifier: 0,
+		LongTermKey:          swap16(key),
+	}, nil); err != nil {
+		return pc.fail(ErrUnspecifiedReason)
+	}
+	if err := pc.waitEncryption(); err != nil {
+		return err
+	}
+
+	// Phase 3: Transport Specific Key Distribution.
+	// The slave distributes its keys first.
+	if err := pc.receiveKeys(pc.respDist); err != nil {
+		return err
+	}
+	if err := pc.distributeKeys(pc.initDist); err != nil {
+		return err
+	}
+	return pc.bond()
+}
+
+// respond runs the pairing procedure as the responder (slave).
+func (s *smp) respond(params *PairingParams, req pdu) error {
+	pc := s.newPairingCtx(params)
+	// Drop the status of an earlier encryption, with the key of the bond.
+	s.drainEncryption()
+	if len(req) != 7 {
+		return pc.fail(ErrInvalidParameters)
+	}
+	copy(pc.preq[:], reverse(req))
+
+	// Phase 1: Pairing Feature Exchange.
+	// The IRK of the local device is not distributed, since it doesn't use privacy.
+	var initDist, respDist uint8
+	if params.Bonding {
+		initDist = req[5] & (keyDistEnc | keyDistID | keyDistSign)
+		respDist = req[6] & (keyDistEnc | keyDistSign)
+	}
+	rsp := pc.features(pairingResponse, initDist, respDist)
+	copy(pc.pres[:], reverse(rsp))
+	pc.initDist = initDist
+	pc.respDist = respDist
+	if err := pc.negotiate(req, rsp); err != nil {
+		return pc.fail(err)
+	}
+	if err := s.c.sendSMP(rsp); err != nil {
+		return err
+	}
+
+	// Phase 2: Short Term Key Generation, or Long Term Key Generation with
+	// LE Secure Connections.
+	if err := pc.getTK(false); err != nil {
+		return pc.fail(err)
+	}
+	var err error
+	if pc.sc {
+		err = pc.scResponder()
+	} else {
+		err = pc.legacyResponder()
+	}
+	if err == nil {
+		err = pc.waitEncryption()
+	}
+	s.Lock()
+	s.stkValid = false
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Phase 3: Transport Specific Key Distribution.
+	if err := pc.distributeKeys(pc.respDist); err != nil {
+		return err
+	}
+	if err := pc.receiveKeys(pc.initDist); err != nil {
+		return err
+	}
+	return pc.bond()
+}
+
+// bond stores the distributed keys, if both devices request bonding.
+func (pc *pairingCtx) bond() error {
+	if !pc.bonding {
+		return nil
+	}
+	s := pc.s
+	s.Lock()
+	local, remote := s.local, s.remote
+	s.Unlock()
+	if err := s.c.hci.saveBond(s.c.RemoteAddr(), local, remote); err != nil {
+		return err
+	}
+	s.Lock()
+	s.bonded = true
+	s.Unlock()
+	return nil
+}
+
+// legacyInitiator generates the STK with LE legacy pairing as the initiator [Vol 3, Part H, 2.3.5.5].
+func (pc *pairingCtx) legacyInitiator() ([16]byte, error) {
+	var stk [16]byte
+	mrand, err := pc.s.c.hci.random16()
+	if err != nil {
+		return stk, pc.fail(ErrUnspecifiedReason)
+	}
+	mconfirm, err := pc.confirm(mrand)
+	if err != nil {
+		return stk, pc.fail(ErrUnspecifiedReason)
+	}
+	if err := pc.send(pairingConfirm, val2air(mconfirm)); err != nil {
+		return stk, err
+	}
+	b, err := pc.expect(pairingConfirm, 17)
+	if err != nil {
+		return stk, err
+	}
+	sconfirm := air2val(b[1:])
+	if err := pc.send(pairingRandom, val2air(mrand)); err != nil {
+		return stk, err
+	}
+	b, err = pc.expect(pairingRandom, 17)
+	if err != nil {
+		return stk, err
+	}
+	srand := air2val(b[1:])
+	if v, err := pc.confirm(srand); err != nil || v != sconfirm {
+		return stk, pc.fail(ErrConfirmValueFailed)
+	}
+	if stk, err = s1(pc.s.c.hci.encrypt, pc.tk, srand, mrand); err != nil {
+		return stk, pc.fail(ErrUnspecifiedReason)
+	}
+	return truncateKey(stk, pc.keySize), nil
+}
+
+// legacyResponder generates the STK with LE legacy pairing as the responder [Vol 3, Part H, 2.3.5.5].
+func (pc *pairingCtx) legacyResponder() error {
+	b, err := pc.expect(pairingConfirm, 17)
+	if err != nil {
+		return err
+	}
+	mconfirm := air2val(b[1:])
+	srand, err := pc.s.c.hci.random16()
+	if err != nil {
+		return pc.fail(ErrUnspecifiedReason)
+	}
+	sconfirm, err := pc.confirm(srand)
+	if err != nil {
+		return pc.fail(ErrUnspecifiedReason)
+	}
+	if err := pc.send(pairingConfirm, val2air(sconfirm)); err != nil {
+		return err
+	}
+	b, err = pc.expect(pairingRandom, 17)
+	if err != nil {
+		return err
+	}
+	mrand := air2val(b[1:])
+	if v, err := pc.confirm(mrand); err != nil || v != mconfirm {
+		return pc.fail(ErrConfirmValueFailed)
+	}
+	stk, err := s1(pc.s.c.hci.encrypt, pc.tk, srand, mrand)
+	if err != nil {
+		return pc.fail(ErrUnspecifiedReason)
+	}
+
+	// The master starts encryption once it receives the Srand.
+	pc.setKey(truncateKey(stk, pc.keySize))
+	return pc.send(pairingRandom, val2air(srand))
+}
+
+// setKey sets the key handed out on LE Long Term Key Request, when the master
+// starts encryption at the end of phase 2.
+func (pc *pairingCtx) setKey(k [16]byte) {
+	s := pc.s
+	s.Lock()
+	s.stk = k
+	s.stkValid = true
+	s.auth = pc.method != justWorks
+	s.sc = pc.sc
+	s.keySize = pc.keySize
+	s.Unlock()
+}
+
+// negotiate checks the pairing features of both devices, and selects the
+// pairing method [Vol 3, Part H, 2.3.5.1].
+func (pc *pairingCtx) negotiate(req, rsp []byte) error {
+	pc.keySize = int(req[4])
+	if int(rsp[4]) < pc.keySize {
+		pc.keySize = int(rsp[4])
+	}
+	if pc.keySize < 7 || pc.keySize > 16 {
+		return ErrEncryptionKeySize
+	}
+	if req[1] > IOCapKeyboardDisplay || rsp[1] > IOCapKeyboardDisplay {
+		return ErrInvalidParameters
+	}
+
+	pc.ioCapA = [3]byte{req[3], req[2], req[1]}
+	pc.ioCapB = [3]byte{rsp[3], rsp[2], rsp[1]}
+	pc.sc = req[3]&rsp[3]&authReqSC != 0
+	pc.bonding = req[3]&rsp[3]&authReqBonding != 0
+
+	switch {
+	case pc.sc && (req[2] == 0x01 || rsp[2] == 0x01):
+		return ErrOOBNotAvailable
+	case !pc.sc && req[2] == 0x01 && rsp[2] == 0x01:
+		pc.method = outOfBand
+	case (req[3]|rsp[3])&authReqMITM == 0:
+		pc.method = justWorks
+	case pc.sc && yesNo(req[1]) && yesNo(rsp[1]):
+		pc.method = numericComparison
+	default:
+		pc.initInputs, pc.respInputs = passkeyInputs(req[1], rsp[1])
+		pc.method = justWorks
+		if pc.initInputs || pc.respInputs {
+			pc.method = passkeyEntry
+		}
+	}
+	if pc.params.MITM && pc.method == justWorks {
+		return ErrAuthRequirements
+	}
+	if pc.sc {
+		// The LTK is generated in phase 2 instead of being distributed [Vol 3, Part H, 3.6.1].
+		pc.initDist &^= keyDistEnc
+		pc.respDist &^= keyDistEnc
+	}
+	return nil
+}
+
+// yesNo tells if a device with the IO capability can confirm Numeric
+// Comparison [Vol 3, Part H, Table 2.8].
+func yesNo(io uint8) bool {
+	return io == IOCapDisplayYesNo || io == IOCapKeyboardDisplay
+}
+
+// passkeyInputs tells which devices input the passkey, given the IO
+// capabilities of the initiator and the responder. If neither does,
+// Just Works is used [Vol 3, Part H, Table 2.8].
+func passkeyInputs(initIO, respIO uint8) (initInputs, respInputs bool) {
+	if initIO == IOCapNoInputNoOutput || respIO == IOCapNoInputNoOutput {
+		return false, false
+	}
+	initKbd := initIO == IOCapKeyboardOnly || initIO == IOCapKeyboardDisplay
+	respKbd := respIO == IOCapKeyboardOnly || respIO == IOCapKeyboardDisplay
+	switch {
+	case initIO == IOCapKeyboardOnly && respIO == IOCapKeyboardOnly:
+		return true, true
+	case respIO == IOCapKeyboardOnly:
+		return false, true
+	case initKbd && respIO != IOCapKeyboardOnly:
+		return true, false
+	case respKbd:
+		return false, true
+	}
+	return false, false
+}
+
+// getTK obtains the Temporary Key of the selected pairing method.
+func (pc *pairingCtx) getTK(initiator bool) error {
+	p := pc.params
+	addr := pc.s.c.RemoteAddr()
+	pc.tk = [16]byte{}
+	switch pc.method {
+	case outOfBand:
+		if p.OOBData == nil {
+			return ErrOOBNotAvailable
+		}
+		tk, ok := p.OOBData(addr)
+		if !ok {
+			return ErrOOBNotAvailable
+		}
+		pc.tk = tk
+	case passkeyEntry:
+		inputs := pc.respInputs
+		if initiator {
+			inputs = pc.initInputs
+		}
+		var passkey uint32
+		if inputs {
+			if p.InputPasskey == nil {
+				return ErrPasskeyEntryFailed
+			}
+			v, err := p.InputPasskey(addr)
+			if err != nil || v > 999999 {
+				return ErrPasskeyEntryFailed
+			}
+			passkey = v
+		} else {
+			if p.DisplayPasskey == nil {
+				return ErrPasskeyEntryFailed
+			}
+			v, err := pc.s.c.hci.random()
+			if err != nil {
+				return ErrUnspecifiedReason
+			}
+			passkey = uint32(v % 1000000)
+			p.DisplayPasskey(addr, passkey)
+		}
+		binary.BigEndian.PutUint32(pc.tk[12:], passkey)
+	}
+	return nil
+}
+
+// addrs returns the addresses (most significant octet first) and address
+// types of the initiating and responding devices.
+func (pc *pairingCtx) addrs() (iat uint8, ia [6]byte, rat uint8, ra [6]byte) {
+	c := pc.s.c
+	lt, la, _ := peerAddr(c.LocalAddr())
+	rt, rb, _ := peerAddr(c.RemoteAddr())
+	if c.param.Role() == roleSlave {
+		return rt, reverse6(rb), lt, reverse6(la)
+	}
+	return lt, reverse6(la), rt, reverse6(rb)
+}
+
+// confirm calculates the confirm value of a random value with c1.
+func (pc *pairingCtx) confirm(r [16]byte) ([16]byte, error) {
+	iat, ia, rat, ra := pc.addrs()
+	return c1(pc.s.c.hci.encrypt, pc.tk, r, pc.preq, pc.pres, iat, rat, ia, ra)
+}
+
+// receiveKeys receives the keys distributed by the remote device.
+func (pc *pairingCtx) receiveKeys(dist uint8) error {
+	var k Keys
+	if dist&keyDistEnc != 0 {
+		b, err := pc.expect(encryptionInformation, 17)
+		if err != nil {
+			return err
+		}
+		k.LTK = air2val(b[1:])
+		if b, err = pc.expect(masterIdentification, 11); err != nil {
+			return err
+		}
+		k.EDIV = binary.LittleEndian.Uint16(b[1:])
+		k.Rand = binary.LittleEndian.Uint64(b[3:])
+	}
+	if dist&keyDistID != 0 {
+		b, err := pc.expect(identiInformation, 17)
+		if err != nil {
+			return err
+		}
+		k.IRK = air2val(b[1:])
+		if b, err = pc.expect(identityAddreInformation, 8); err != nil {
+			return err
+		}
+		var a [6]byte
+		copy(a[:], b[2:8])
+		k.IdentityAddr = deviceAddr(b[1], a)
+	}
+	if dist&keyDistSign != 0 {
+		b, err := pc.expect(signingInformation, 17)
+		if err != nil {
+			return err
+		}
+		k.CSRK = air2val(b[1:])
+	}
+	if pc.sc {
+		k.LTK = pc.ltk
+		dist |= keyDistEnc
+	}
+	k.Dist = dist
+	k.KeySize = pc.keySize
+	k.Authenticated = pc.method != justWorks
+	k.SecureConnections = pc.sc
+
+	pc.s.Lock()
+	pc.s.remote = k
+	pc.s.Unlock()
+	return nil
+}
+
+// distributeKeys generates and distributes the keys of the local device.
+func (pc *pairingCtx) distributeKeys(dist uint8) error {
+	h := pc.s.c.hci
+	var k Keys
+	var err error
+	if dist&keyDistEnc != 0 {
+		if k.LTK, err = h.random16(); err != nil {
+			return pc.fail(ErrUnspecifiedReason)
+		}
+		k.LTK = truncateKey(k.LTK, pc.keySize)
+		v, err := h.random()
+		if err != nil {
+			return pc.fail(ErrUnspecifiedReason)
+		}
+		k.EDIV = uint16(v)
+		if k.Rand, err = h.random(); err != nil {
+			return pc.fail(ErrUnspecifiedReason)
+		}
+		if err := pc.send(encryptionInformation, val2air(k.LTK)); err != nil {
+			return err
+		}
+		b := make([]byte, 10)
+		binary.LittleEndian.PutUint16(b, k.EDIV)
+		binary.LittleEndian.PutUint64(b[2:], k.Rand)
+		if err := pc.send(masterIdentification, b); err != nil {
+			return err
+		}
+	}
+	if dist&keyDistSign != 0 {
+		if k.CSRK, err = h.random16(); err != nil {
+			return pc.fail(ErrUnspecifiedReason)
+		}
+		if err := pc.send(signingInformation, val2air(k.CSRK)); err != nil {
+			return err
+		}
+	}
+	if pc.sc {
+		k.LTK = pc.ltk
+		dist |= keyDistEnc
+	}
+	k.Dist = dist &^ keyDistID
+	k.KeySize = pc.keySize
+	k.Authenticated = pc.method != justWorks
+	k.SecureConnections = pc.sc
+
+	pc.s.Lock()
+	pc.s.local = k
+	pc.s.Unlock()
+	return nil
+}
+
+// waitEncryption waits for the link to be encrypted.
+func (pc *pairingCtx) waitEncryption() error {
+	for {
+		select {
+		case err := <-pc.s.chEnc:
+			return err
+		case p, ok := <-pc.s.in:
+			if !ok {
+				return io.ErrClosedPipe
+			}
+			if p[0] == pairingFailed && len(p) > 1 {
+				return PairingError(p[1])
+			}
+			// Keys distributed by the remote device might arrive before the event.
+			pc.pending = append(pc.pending, p)
+		case <-pc.deadline:
+			return errors.New("smp: timed out")
+		}
+	}
+}
+
+// expect waits for a PDU of the given code and length from the remote device.
+func (pc *pairingCtx) expect(code uint8, n int) (pdu, error) {
+	var p pdu
+	if len(pc.pending) > 0 {
+		p, pc.pending = pc.pending[0], pc.pending[1:]
+	} else {
+		var ok bool
+		select {
+		case p, ok = <-pc.s.in:
+			if !ok {
+				return nil, io.ErrClosedPipe
+			}
+		case <-pc.deadline:
+			// No further SMP commands shall be sent after a timeout [Vol 3, Part H, 3.4].
+			return nil, errors.New("smp: timed out")
+		}
+	}
+	switch {
+	case p[0] == pairingFailed && len(p) > 1:
+		return nil, PairingError(p[1])
+	case p[0] != code:
+		return nil, pc.fail(ErrUnspecifiedReason)
+	case len(p) != n:
+		return nil, pc.fail(ErrInvalidParameters)
+	}
+	return p, nil
+}
+
+func (pc *pairingCtx) send(code uint8, b []byte) error {
+	return pc.s.c.sendSMP(append([]byte{code}, b...))
+}
+
+// fail aborts the pairing procedure with Pairing Failed.
+func (pc *pairingCtx) fail(err error) error {
+	reason, ok := err.(PairingError)
+	if !ok {
+		reason = ErrUnspecifiedReason
+	}
+	pc.s.c.sendSMP([]byte{pairingFailed, uint8(reason)})
+	return err
+}
+
+// encryptionChanged is called on Encryption Change and Encryption Key Refresh
+// Complete events of the connection.
+func (s *smp) encryptionChanged(status uint8, enabled bool) {
+	var err error
+	s.Lock()
+	switch {
+	case status != 0x00:
+		err = ErrCommand(status)
+	case enabled && s.auth && s.sc && s.keySize == 16:
+		s.level = SecuritySecureConnections
+	case enabled && s.auth:
+		s.level = SecurityAuthenticated
+	case enabled:
+		s.level = SecurityEncrypted
+	default:
+		s.level = SecurityNone
+	}
+	s.Unlock()
+	select {
+	case s.chEnc <- err:
+	default:
+	}
+}
+
+// drainEncryption drops the status of an earlier Encryption Change event,
+// which nobody waited for, before the link is encrypted again.
+func (s *smp) drainEncryption() {
+	select {
+	case <-s.chEnc:
+	default:
+	}
+}
+
+// ltk returns the key requested by the master to encrypt the link.
+func (s *smp) ltk(rand uint64, ediv uint16) ([16]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if rand == 0 && ediv == 0 && s.stkValid {
+		return s.stk, true
+	}
+	// The master reconnects to encrypt the link with the key of its bond.
+	s.loadBond()
+	if s.local.Dist&keyDistEnc != 0 && s.local.Rand == rand && s.local.EDIV == ediv {
+		s.auth = s.local.Authenticated
+		s.sc = s.local.SecureConnections
+		s.keySize = s.local.KeySize
+		return s.local.LTK, true
+	}
+	return [16]byte{}, false
+}
+
+// encrypt performs the security function e with LE Encrypt.
+func (h *HCI) encrypt(key, plaintext [16]byte) ([16]byte, error) {
+	var rp cmd.LEEncryptRP
+	err := h.Send(&cmd.LEEncrypt{
+		Key:           swap16(key),
+		PlaintextData: swap16(plaintext),
+	}, &rp)
+	return swap16(rp.EncryptedData), err
+}
+
+// random returns a random number generated by the controller with LE Rand.
+func (h *HCI) random() (uint64, error) {
+	var rp cmd.LERandRP
+	err := h.Send(&cmd.LERand{}, &rp)
+	return rp.RandomNumber, err
+}
+
+// random16 returns a 128-bit random number generated by the controller.
+func (h *HCI) random16() ([16]byte, error) {
+	var b [16]byte
+	for i := 0; i < 2; i++ {
+		v, err := h.random()
+		if err != nil {
+			return b, err
+		}
+		binary.BigEndian.PutUint64(b[i*8:], v)
+	}
+	return b, nil
+}
+
+// truncateKey masks a key to the negotiated size [Vol 3, Part H, 2.3.4].
+func truncateKey(k [16]byte, n int) [16]byte {
+	for i := 0; i < 16-n; i++ {
+		k[i] = 0
+	}
+	return k
+}
+
+// air2val converts a 128-bit value from the air (least significant octet first).
+func air2val(b []byte) [16]byte {
+	var v [16]byte
+	copy(v[:], b)
+	return swap16(v)
+}
+
+// val2air converts a 128-bit value to the air (least significant octet first).
+func val2air(v [16]byte) []byte {
+	v = swap16(v)
+	return v[:]
+}
+
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+func reverse6(b [6]byte) [6]byte {
+	return [6]byte{b[5], b[4], b[3], b[2], b[1], b[0]}
+}
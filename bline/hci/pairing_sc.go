@@ -0,0 +1,234 @@
+package hci
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"math/big"
+)
+
+// LE Secure Connections pairing phase 2 [Vol 3, Part H, 2.3.5.6].
+// The public keys and the DHKey are stored most significant octet first.
+
+// scInitiator generates the LTK with LE Secure Connections as the initiator.
+func (pc *pairingCtx) scInitiator() ([16]byte, error) {
+	if err := pc.exchangePublicKeys(true); err != nil {
+		return [16]byte{}, err
+	}
+	na, nb, r, err := pc.authStage1(true)
+	if err != nil {
+		return [16]byte{}, err
+	}
+	ea, eb := pc.checkValues(na, nb, r)
+	if err := pc.send(pairingDHKeyCheck, val2air(ea)); err != nil {
+		return [16]byte{}, err
+	}
+	b, err := pc.expect(pairingDHKeyCheck, 17)
+	if err != nil {
+		return [16]byte{}, err
+	}
+	if air2val(b[1:]) != eb {
+		return [16]byte{}, pc.fail(ErrDHKeyCheckFailed)
+	}
+	return pc.ltk, nil
+}
+
+// scResponder generates the LTK with LE Secure Connections as the responder.
+func (pc *pairingCtx) scResponder() error {
+	if err := pc.exchangePublicKeys(false); err != nil {
+		return err
+	}
+	na, nb, r, err := pc.authStage1(false)
+	if err != nil {
+		return err
+	}
+	ea, eb := pc.checkValues(na, nb, r)
+	b, err := pc.expect(pairingDHKeyCheck, 17)
+	if err != nil {
+		return err
+	}
+	if air2val(b[1:]) != ea {
+		return pc.fail(ErrDHKeyCheckFailed)
+	}
+
+	// The master starts encryption once it receives the DHKey check of the slave.
+	pc.setKey(pc.ltk)
+	return pc.send(pairingDHKeyCheck, val2air(eb))
+}
+
+// exchangePublicKeys generates the P-256 key pair of the local device,
+// exchanges the public keys, and computes the DHKey.
+func (pc *pairingCtx) exchangePublicKeys(initiator bool) error {
+	curve := elliptic.P256()
+	priv, x, y, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return pc.fail(ErrUnspecifiedReason)
+	}
+	var local [32]byte
+	x.FillBytes(local[:])
+	pub := make([]byte, 64)
+	copy(pub, reverse(local[:]))
+	var ly [32]byte
+	y.FillBytes(ly[:])
+	copy(pub[32:], reverse(ly[:]))
+
+	var b pdu
+	if initiator {
+		if err := pc.send(pairingPublicKey, pub); err != nil {
+			return err
+		}
+		if b, err = pc.expect(pairingPublicKey, 65); err != nil {
+			return err
+		}
+	} else {
+		if b, err = pc.expect(pairingPublicKey, 65); err != nil {
+			return err
+		}
+		if err := pc.send(pairingPublicKey, pub); err != nil {
+			return err
+		}
+	}
+
+	var remote [32]byte
+	copy(remote[:], reverse(b[1:33]))
+	px := new(big.Int).SetBytes(remote[:])
+	py := new(big.Int).SetBytes(reverse(b[33:65]))
+	if !curve.IsOnCurve(px, py) || px.Cmp(x) == 0 {
+		// Reject invalid keys, and keys reflected by the remote device.
+		return pc.fail(ErrDHKeyCheckFailed)
+	}
+	dx, _ := curve.ScalarMult(px, py, priv)
+	dx.FillBytes(pc.dhkey[:])
+
+	pc.pka, pc.pkb = local, remote
+	if !initiator {
+		pc.pka, pc.pkb = remote, local
+	}
+	return nil
+}
+
+// authStage1 runs the authentication stage 1, and returns the nonces of both
+// devices and the value r used by the check values.
+func (pc *pairingCtx) authStage1(initiator bool) (na, nb, r [16]byte, err error) {
+	if pc.method == passkeyEntry {
+		na, nb, err = pc.passkeyRounds(initiator)
+		return na, nb, pc.tk, err
+	}
+
+	// Just Works and Numeric Comparison [Vol 3, Part H, 2.3.5.6.2].
+	if initiator {
+		var b pdu
+		if b, err = pc.expect(pairingConfirm, 17); err != nil {
+			return
+		}
+		cb := air2val(b[1:])
+		if na, err = pc.s.c.hci.random16(); err != nil {
+			return na, nb, r, pc.fail(ErrUnspecifiedReason)
+		}
+		if err = pc.send(pairingRandom, val2air(na)); err != nil {
+			return
+		}
+		if b, err = pc.expect(pairingRandom, 17); err != nil {
+			return
+		}
+		nb = air2val(b[1:])
+		if f4(pc.pkb, pc.pka, nb, 0) != cb {
+			return na, nb, r, pc.fail(ErrConfirmValueFailed)
+		}
+	} else {
+		if nb, err = pc.s.c.hci.random16(); err != nil {
+			return na, nb, r, pc.fail(ErrUnspecifiedReason)
+		}
+		if err = pc.send(pairingConfirm, val2air(f4(pc.pkb, pc.pka, nb, 0))); err != nil {
+			return
+		}
+		var b pdu
+		if b, err = pc.expect(pairingRandom, 17); err != nil {
+			return
+		}
+		na = air2val(b[1:])
+		if err = pc.send(pairingRandom, val2air(nb)); err != nil {
+			return
+		}
+	}
+
+	if pc.method == numericComparison {
+		v := g2(pc.pka, pc.pkb, na, nb) % 1000000
+		p := pc.params
+		if p.CompareNumeric == nil || !p.CompareNumeric(pc.s.c.RemoteAddr(), v) {
+			return na, nb, r, pc.fail(ErrNumericComparisonFailed)
+		}
+	}
+	return na, nb, r, nil
+}
+
+// passkeyRounds runs the 20 rounds of Passkey Entry, one for each bit of the
+// passkey, and returns the nonces of the last round [Vol 3, Part H, 2.3.5.6.3].
+func (pc *pairingCtx) passkeyRounds(initiator bool) (na, nb [16]byte, err error) {
+	passkey := uint32(pc.tk[12])<<24 | uint32(pc.tk[13])<<16 | uint32(pc.tk[14])<<8 | uint32(pc.tk[15])
+	h := pc.s.c.hci
+	for i := 0; i < 20; i++ {
+		ri := uint8(0x80 | (passkey>>i)&0x01)
+		var b pdu
+		if initiator {
+			if na, err = h.random16(); err != nil {
+				return na, nb, pc.fail(ErrUnspecifiedReason)
+			}
+			if err = pc.send(pairingConfirm, val2air(f4(pc.pka, pc.pkb, na, ri))); err != nil {
+				return
+			}
+			if b, err = pc.expect(pairingConfirm, 17); err != nil {
+				return
+			}
+			cb := air2val(b[1:])
+			if err = pc.send(pairingRandom, val2air(na)); err != nil {
+				return
+			}
+			if b, err = pc.expect(pairingRandom, 17); err != nil {
+				return
+			}
+			nb = air2val(b[1:])
+			if f4(pc.pkb, pc.pka, nb, ri) != cb {
+				return na, nb, pc.fail(ErrConfirmValueFailed)
+			}
+			continue
+		}
+
+		if b, err = pc.expect(pairingConfirm, 17); err != nil {
+			return
+		}
+		ca := air2val(b[1:])
+		if nb, err = h.random16(); err != nil {
+			return na, nb, pc.fail(ErrUnspecifiedReason)
+		}
+		if err = pc.send(pairingConfirm, val2air(f4(pc.pkb, pc.pka, nb, ri))); err != nil {
+			return
+		}
+		if b, err = pc.expect(pairingRandom, 17); err != nil {
+			return
+		}
+		na = air2val(b[1:])
+		if f4(pc.pka, pc.pkb, na, ri) != ca {
+			return na, nb, pc.fail(ErrConfirmValueFailed)
+		}
+		if err = pc.send(pairingRandom, val2air(nb)); err != nil {
+			return
+		}
+	}
+	return na, nb, nil
+}
+
+// checkValues generates the LTK, and calculates the DHKey check values of the
+// initiator and the responder [Vol 3, Part H, 2.3.5.6.5].
+func (pc *pairingCtx) checkValues(na, nb, r [16]byte) (ea, eb [16]byte) {
+	iat, ia, rat, ra := pc.addrs()
+	var a, b [7]byte
+	a[0], b[0] = iat, rat
+	copy(a[1:], ia[:])
+	copy(b[1:], ra[:])
+
+	macKey, ltk := f5(pc.dhkey, na, nb, a, b)
+	pc.ltk = truncateKey(ltk, pc.keySize)
+	ea = f6(macKey, na, nb, r, pc.ioCapA, a, b)
+	eb = f6(macKey, nb, na, r, pc.ioCapB, b, a)
+	return ea, eb
+}
@@ -0,0 +1,196 @@
+package hci
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	ble "traulfs/Bline/ble"
+)
+
+// TestPairSC runs LE Secure Connections pairing initiated by the host, with
+// the test as the slave.
+func TestPairSC(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		params  PairingParams
+		rsp     []byte // Pairing Response of the peer.
+		confirm bool   // The host confirms the value of Numeric Comparison.
+		fail    int    // The peer sends a Nb, or an Eb, which doesn't match.
+		err     error
+		level   int
+	}{
+		{
+			name:   "just works",
+			params: PairingParams{IOCapability: IOCapNoInputNoOutput, SecureConnections: true},
+			rsp:    []byte{pairingResponse, IOCapNoInputNoOutput, 0x00, authReqSC, 16, 0x00, 0x00},
+			level:  SecurityEncrypted,
+		},
+		{
+			name:    "numeric comparison",
+			params:  PairingParams{IOCapability: IOCapDisplayYesNo, MITM: true, SecureConnections: true},
+			rsp:     []byte{pairingResponse, IOCapDisplayYesNo, 0x00, authReqMITM | authReqSC, 16, 0x00, 0x00},
+			confirm: true,
+			level:   SecuritySecureConnections,
+		},
+		{
+			name:   "key size",
+			params: PairingParams{IOCapability: IOCapNoInputNoOutput, SecureConnections: true},
+			rsp:    []byte{pairingResponse, IOCapNoInputNoOutput, 0x00, authReqSC, 7, 0x00, 0x00},
+			level:  SecurityEncrypted,
+		},
+		{
+			name:   "confirm value failed",
+			params: PairingParams{IOCapability: IOCapNoInputNoOutput, SecureConnections: true},
+			rsp:    []byte{pairingResponse, IOCapNoInputNoOutput, 0x00, authReqSC, 16, 0x00, 0x00},
+			fail:   pairingRandom,
+			err:    ErrConfirmValueFailed,
+			level:  SecurityNone,
+		},
+		{
+			name:   "DHKey check failed",
+			params: PairingParams{IOCapability: IOCapNoInputNoOutput, SecureConnections: true},
+			rsp:    []byte{pairingResponse, IOCapNoInputNoOutput, 0x00, authReqSC, 16, 0x00, 0x00},
+			fail:   pairingDHKeyCheck,
+			err:    ErrDHKeyCheckFailed,
+			level:  SecurityNone,
+		},
+		{
+			name:   "numeric comparison failed",
+			params: PairingParams{IOCapability: IOCapDisplayYesNo, MITM: true, SecureConnections: true},
+			rsp:    []byte{pairingResponse, IOCapDisplayYesNo, 0x00, authReqMITM | authReqSC, 16, 0x00, 0x00},
+			err:    ErrNumericComparisonFailed,
+			level:  SecurityNone,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, f := newTestHCI(t)
+			params := tc.params
+			compared := make(chan uint32, 1)
+			params.CompareNumeric = func(a ble.Addr, v uint32) bool {
+				compared <- v
+				return tc.confirm
+			}
+			h.SetPairingParams(params)
+			c, handle := testConn(t, h, f)
+			done := make(chan error, 1)
+			go func() { done <- c.Pair() }()
+
+			req := f.recvSMP(t)
+			if req[0] != pairingRequest || len(req) != 7 || req[3]&authReqSC == 0 {
+				t.Fatalf("got % X, want Pairing Request with Secure Connections", req)
+			}
+			f.sendL2CAP(handle, cidSMP, tc.rsp...)
+			pairSlaveSC(t, f, c, handle, req, tc.rsp, tc.fail, compared)
+
+			if err := <-done; err != tc.err {
+				t.Errorf("got %v, want %v", err, tc.err)
+			}
+			if l := c.SecurityLevel(); l != tc.level {
+				t.Errorf("got security level %d, want %d", l, tc.level)
+			}
+		})
+	}
+}
+
+// pairSlaveSC runs phase 2 of LE Secure Connections pairing as the slave with
+// Just Works, or Numeric Comparison, after the Pairing Request preq and the
+// Pairing Response pres were exchanged. The value of Numeric Comparison shown
+// by the host is received on compared.
+func pairSlaveSC(t *testing.T, f *fakeController, c *Conn, handle uint16, preq, pres []byte, fail int, compared <-chan uint32) {
+	t.Helper()
+	expect := func(code uint8) []byte {
+		t.Helper()
+		p := f.recvSMP(t)
+		if p[0] != code {
+			t.Fatalf("got % X, want code 0x%02X", p, code)
+		}
+		return p
+	}
+	send := func(code uint8, v [16]byte) {
+		f.sendL2CAP(handle, cidSMP, append([]byte{code}, val2air(v)...)...)
+	}
+
+	// Public Key Exchange.
+	p := expect(pairingPublicKey)
+	curve := elliptic.P256()
+	priv, x, y, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pka, pkb, ay [32]byte
+	copy(pka[:], reverse(p[1:33]))
+	copy(ay[:], reverse(p[33:65]))
+	x.FillBytes(pkb[:])
+	var by [32]byte
+	y.FillBytes(by[:])
+	f.sendL2CAP(handle, cidSMP, append(append([]byte{pairingPublicKey}, reverse(pkb[:])...), reverse(by[:])...)...)
+	var dhkey [32]byte
+	dx, _ := curve.ScalarMult(x.SetBytes(pka[:]), y.SetBytes(ay[:]), priv)
+	dx.FillBytes(dhkey[:])
+
+	// Authentication stage 1.
+	nb := h16("a6e8e7cc25a75f6e216583f7ff3dc4cf")
+	send(pairingConfirm, f4(pkb, pka, nb, 0))
+	na := air2val(expect(pairingRandom)[1:])
+	if fail == pairingRandom {
+		nb[15] ^= 0x01
+	}
+	send(pairingRandom, nb)
+	if fail == pairingRandom {
+		if p := expect(pairingFailed); p[1] != uint8(ErrConfirmValueFailed) {
+			t.Errorf("got reason 0x%02X", p[1])
+		}
+		return
+	}
+	if pres[3]&authReqMITM != 0 {
+		if v, want := <-compared, g2(pka, pkb, na, nb)%1000000; v != want {
+			t.Errorf("got value %06d to compare, want %06d", v, want)
+		}
+	}
+
+	// Authentication stage 2.
+	p = f.recvSMP(t)
+	if p[0] == pairingFailed {
+		if p[1] != uint8(ErrNumericComparisonFailed) {
+			t.Errorf("got reason 0x%02X", p[1])
+		}
+		return
+	}
+	if p[0] != pairingDHKeyCheck {
+		t.Fatalf("got % X, want Pairing DHKey Check", p)
+	}
+	iat, ia, rat, ra := (&pairingCtx{s: c.smp}).addrs()
+	var a, b [7]byte
+	a[0], b[0] = iat, rat
+	copy(a[1:], ia[:])
+	copy(b[1:], ra[:])
+	macKey, ltk := f5(dhkey, na, nb, a, b)
+	ioCapA := [3]byte{preq[3], preq[2], preq[1]}
+	ioCapB := [3]byte{pres[3], pres[2], pres[1]}
+	if ea := f6(macKey, na, nb, [16]byte{}, ioCapA, a, b); air2val(p[1:]) != ea {
+		t.Error("Ea doesn't match")
+	}
+	eb := f6(macKey, nb, na, [16]byte{}, ioCapB, b, a)
+	if fail == pairingDHKeyCheck {
+		eb[0] ^= 0x01
+	}
+	send(pairingDHKeyCheck, eb)
+	if fail == pairingDHKeyCheck {
+		if p := expect(pairingFailed); p[1] != uint8(ErrDHKeyCheckFailed) {
+			t.Errorf("got reason 0x%02X", p[1])
+		}
+		return
+	}
+
+	// The host encrypts the link with the LTK.
+	keySize := int(pres[4])
+	if int(preq[4]) < keySize {
+		keySize = int(preq[4])
+	}
+	ltk = swap16(truncateKey(ltk, keySize))
+	if p := f.waitParams(t, opLEStartEncryption); !bytes.Equal(p[12:28], ltk[:]) {
+		t.Errorf("got key % X, want % X", p[12:28], ltk)
+	}
+}
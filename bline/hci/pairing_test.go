@@ -0,0 +1,210 @@
+package hci
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	ble "traulfs/Bline/ble"
+)
+
+// peerKeys are the keys distributed by the peer in TestPair.
+var peerKeys = Keys{
+	LTK:          h16("00000000000000000102030405060708"),
+	EDIV:         0x1234,
+	Rand:         0x0102030405060708,
+	IRK:          h16("ec0234a357c8ad05341010a60a397d9b"),
+	IdentityAddr: ble.NewDeviceAddr([]byte{0xc1, 0x22, 0x33, 0x44, 0x55, 0x66}, true),
+	CSRK:         h16("0f0e0d0c0b0a09080706050403020100"),
+}
+
+// TestPair runs LE legacy pairing initiated by the host, with the test as the
+// slave.
+func TestPair(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		params  PairingParams
+		rsp     []byte // Pairing Response, or Pairing Failed of the peer.
+		passkey uint32 // Displayed by the peer.
+		bad     bool   // The peer sends a Srand, which doesn't match its Sconfirm.
+		err     error
+		level   int
+	}{
+		{
+			name:   "just works",
+			params: PairingParams{IOCapability: IOCapNoInputNoOutput},
+			rsp:    []byte{pairingResponse, IOCapNoInputNoOutput, 0x00, 0x00, 16, 0x00, 0x00},
+			level:  SecurityEncrypted,
+		},
+		{
+			name:    "passkey entry",
+			params:  PairingParams{IOCapability: IOCapKeyboardOnly, MITM: true},
+			rsp:     []byte{pairingResponse, IOCapDisplayOnly, 0x00, authReqMITM, 16, 0x00, 0x00},
+			passkey: 123456,
+			level:   SecurityAuthenticated,
+		},
+		{
+			name:   "key size",
+			params: PairingParams{IOCapability: IOCapNoInputNoOutput},
+			rsp:    []byte{pairingResponse, IOCapNoInputNoOutput, 0x00, 0x00, 7, 0x00, 0x00},
+			level:  SecurityEncrypted,
+		},
+		{
+			name:   "bonding",
+			params: PairingParams{IOCapability: IOCapNoInputNoOutput, Bonding: true},
+			rsp:    []byte{pairingResponse, IOCapNoInputNoOutput, 0x00, authReqBonding, 16, keyDistEnc | keyDistSign, keyDistEnc | keyDistID | keyDistSign},
+			level:  SecurityEncrypted,
+		},
+		{
+			name:   "confirm value failed",
+			params: PairingParams{IOCapability: IOCapNoInputNoOutput},
+			rsp:    []byte{pairingResponse, IOCapNoInputNoOutput, 0x00, 0x00, 16, 0x00, 0x00},
+			bad:    true,
+			err:    ErrConfirmValueFailed,
+			level:  SecurityNone,
+		},
+		{
+			name:   "MITM not possible",
+			params: PairingParams{IOCapability: IOCapNoInputNoOutput, MITM: true},
+			rsp:    []byte{pairingResponse, IOCapNoInputNoOutput, 0x00, 0x00, 16, 0x00, 0x00},
+			err:    ErrAuthRequirements,
+			level:  SecurityNone,
+		},
+		{
+			name:   "not supported",
+			params: PairingParams{IOCapability: IOCapNoInputNoOutput},
+			rsp:    []byte{pairingFailed, uint8(ErrPairingNotSupported)},
+			err:    ErrPairingNotSupported,
+			level:  SecurityNone,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h, f := newTestHCI(t)
+			params := tc.params
+			params.InputPasskey = func(ble.Addr) (uint32, error) { return tc.passkey, nil }
+			h.SetPairingParams(params)
+			store, err := NewFileBondStore(filepath.Join(t.TempDir(), "bonds.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.SetBondStore(store)
+			c, handle := testConn(t, h, f)
+			done := make(chan error, 1)
+			go func() { done <- c.Pair() }()
+
+			req := f.recvSMP(t)
+			if req[0] != pairingRequest || len(req) != 7 {
+				t.Fatalf("got % X, want Pairing Request", req)
+			}
+			f.sendL2CAP(handle, cidSMP, tc.rsp...)
+			if tc.rsp[0] == pairingResponse {
+				pairSlave(t, f, c, handle, req, tc.rsp, tc.passkey, tc.bad)
+			}
+
+			if err := <-done; err != tc.err {
+				t.Errorf("got %v, want %v", err, tc.err)
+			}
+			if l := c.SecurityLevel(); l != tc.level {
+				t.Errorf("got security level %d, want %d", l, tc.level)
+			}
+			b, ok := store.Load(peerKeys.IdentityAddr)
+			if ok != tc.params.Bonding {
+				t.Fatalf("got bond %v, want %v", ok, tc.params.Bonding)
+			}
+			if ok && (b.Remote.LTK != peerKeys.LTK || b.Remote.IRK != peerKeys.IRK || b.Remote.CSRK != peerKeys.CSRK || b.Local.Dist != keyDistEnc|keyDistSign) {
+				t.Errorf("got bond %+v", b)
+			}
+		})
+	}
+}
+
+// pairSlave runs phase 2 and 3 of LE legacy pairing as the slave, after the
+// Pairing Request preq and the Pairing Response pres were exchanged.
+func pairSlave(t *testing.T, f *fakeController, c *Conn, handle uint16, preq, pres []byte, passkey uint32, bad bool) {
+	t.Helper()
+	var tk [16]byte
+	binary.BigEndian.PutUint32(tk[12:], passkey)
+	var req, rsp [7]byte
+	copy(req[:], reverse(preq))
+	copy(rsp[:], reverse(pres))
+	iat, ia, rat, ra := (&pairingCtx{s: c.smp}).addrs()
+	confirm := func(r [16]byte) [16]byte {
+		v, err := c1(softEncrypt, tk, r, req, rsp, iat, rat, ia, ra)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	expect := func(code uint8) []byte {
+		t.Helper()
+		p := f.recvSMP(t)
+		if p[0] != code {
+			t.Fatalf("got % X, want code 0x%02X", p, code)
+		}
+		return p
+	}
+
+	p := f.recvSMP(t)
+	if p[0] == pairingFailed {
+		// The host refused the features.
+		return
+	}
+	if p[0] != pairingConfirm {
+		t.Fatalf("got % X, want Pairing Confirm", p)
+	}
+	mconfirm := air2val(p[1:])
+	srand := h16("2b5c7e0a4d8f1e3c6a9b0c1d2e3f4051")
+	f.sendL2CAP(handle, cidSMP, append([]byte{pairingConfirm}, val2air(confirm(srand))...)...)
+	mrand := air2val(expect(pairingRandom)[1:])
+	if confirm(mrand) != mconfirm {
+		t.Error("Mconfirm doesn't match Mrand")
+	}
+	if bad {
+		srand[15] ^= 0x01
+	}
+	f.sendL2CAP(handle, cidSMP, append([]byte{pairingRandom}, val2air(srand)...)...)
+	if bad {
+		if p := expect(pairingFailed); p[1] != uint8(ErrConfirmValueFailed) {
+			t.Errorf("got reason 0x%02X", p[1])
+		}
+		return
+	}
+
+	// The host encrypts the link with the STK.
+	stk, err := s1(softEncrypt, tk, srand, mrand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keySize := int(pres[4])
+	if int(preq[4]) < keySize {
+		keySize = int(preq[4])
+	}
+	stk = swap16(truncateKey(stk, keySize))
+	if p := f.waitParams(t, opLEStartEncryption); !bytes.Equal(p[12:28], stk[:]) {
+		t.Errorf("got key % X, want % X", p[12:28], stk)
+	}
+	if preq[3]&pres[3]&authReqBonding == 0 {
+		return
+	}
+
+	// The slave distributes its keys first.
+	k := peerKeys
+	mid := make([]byte, 11)
+	mid[0] = masterIdentification
+	binary.LittleEndian.PutUint16(mid[1:], k.EDIV)
+	binary.LittleEndian.PutUint64(mid[3:], k.Rand)
+	at, a, _ := peerAddr(k.IdentityAddr)
+	for _, p := range [][]byte{
+		append([]byte{encryptionInformation}, val2air(k.LTK)...),
+		mid,
+		append([]byte{identiInformation}, val2air(k.IRK)...),
+		append([]byte{identityAddreInformation, at}, a[:]...),
+		append([]byte{signingInformation}, val2air(k.CSRK)...),
+	} {
+		f.sendL2CAP(handle, cidSMP, p...)
+	}
+	for _, code := range []uint8{encryptionInformation, masterIdentification, signingInformation} {
+		expect(code)
+	}
+}
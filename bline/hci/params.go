@@ -2,6 +2,7 @@ package hci
 
 import (
 	"sync"
+	"time"
 
 	"traulfs/Bline/ble/bline/hci/cmd"
 )
@@ -18,6 +19,12 @@ type params struct {
 	advParams  cmd.LESetAdvertisingParameters
 	scanParams cmd.LESetScanParameters
 	connParams cmd.LECreateConnection
+
+	// ownAddrType is used consistently for advertising, scanning and initiating.
+	// randomAddr (in HCI byte order) is replaced every rotation, if set and non-resolvable.
+	ownAddrType uint8
+	randomAddr  [6]byte
+	rotation    time.Duration
 }
 
 func (p *params) init() {
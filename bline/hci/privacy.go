@@ -0,0 +1,165 @@
+package hci
+
+import (
+	ble "traulfs/Bline/ble"
+	"traulfs/Bline/ble/bline/hci/cmd"
+)
+
+// Address types reported by the controller [Vol 2, Part E, 7.7.65.2].
+// The identity address types are reported when the controller resolved
+// a resolvable private address with its resolving list.
+const (
+	AddrTypePublic         = 0x00
+	AddrTypeRandom         = 0x01
+	AddrTypePublicIdentity = 0x02
+	AddrTypeRandomIdentity = 0x03
+)
+
+// Identity is the identity of a peer device which uses resolvable private addresses.
+type Identity struct {
+	Addr ble.Addr // Public or static random identity address.
+	IRK  [16]byte // Identity Resolving Key; most significant octet first.
+}
+
+// isRPA reports whether a random device address is resolvable private [Vol 6, Part B, 1.3.2.2].
+// b is in HCI byte order.
+func isRPA(b [6]byte) bool {
+	return b[5]&0xC0 == 0x40
+}
+
+// resolveRPA reports whether the resolvable private address b (in HCI byte
+// order) was generated from the IRK [Vol 3, Part C, 10.8.2.3].
+func resolveRPA(irk [16]byte, b [6]byte) bool {
+	hash := ah(irk, [3]byte{b[5], b[4], b[3]})
+	return hash == [3]byte{b[2], b[1], b[0]}
+}
+
+// AddIdentity adds the IRK of a peer device, so that its resolvable private
+// addresses can be mapped back to its identity address. The IRK is also added
+// to the resolving list of the controller, if it has one with space left.
+func (h *HCI) AddIdentity(id Identity) error {
+	t, b, err := peerAddr(id.Addr)
+	if err != nil {
+		return err
+	}
+	h.muIdentities.Lock()
+	defer h.muIdentities.Unlock()
+	for i, x := range h.identities {
+		if x.Addr.String() == id.Addr.String() {
+			h.identities = append(h.identities[:i], h.identities[i+1:]...)
+			break
+		}
+	}
+	h.identities = append(h.identities, id)
+
+	size, err := h.resolvingListSize()
+	if err != nil || len(h.identities) > size {
+		// Resolved by the host only.
+		return nil
+	}
+	return h.pauseScanAndAdv(func() error {
+		return h.withAddrResolution(func() error {
+			h.Send(&cmd.LERemoveDeviceFromResolvingList{
+				PeerIdentityAddressType: t,
+				PeerIdentityAddress:     b,
+			}, nil)
+			return h.Send(&cmd.LEAddDeviceToResolvingList{
+				PeerIdentityAddressType: t,
+				PeerIdentityAddress:     b,
+				PeerIRK:                 swap16(id.IRK),
+				LocalIRK:                [16]byte{}, // Local privacy is not used.
+			}, nil)
+		})
+	})
+}
+
+// RemoveIdentity removes the IRK of a peer device.
+func (h *HCI) RemoveIdentity(a ble.Addr) error {
+	t, b, err := peerAddr(a)
+	if err != nil {
+		return err
+	}
+	h.muIdentities.Lock()
+	defer h.muIdentities.Unlock()
+	for i, x := range h.identities {
+		if x.Addr.String() == a.String() {
+			h.identities = append(h.identities[:i], h.identities[i+1:]...)
+			break
+		}
+	}
+	if size, err := h.resolvingListSize(); err != nil || size == 0 {
+		return nil
+	}
+	return h.pauseScanAndAdv(func() error {
+		return h.withAddrResolution(func() error {
+			err := h.Send(&cmd.LERemoveDeviceFromResolvingList{
+				PeerIdentityAddressType: t,
+				PeerIdentityAddress:     b,
+			}, nil)
+			if err == ErrConnID {
+				// The peer was resolved by the host only.
+				return nil
+			}
+			return err
+		})
+	})
+}
+
+// Identities returns the identities of the peer devices known to the host.
+func (h *HCI) Identities() []Identity {
+	h.muIdentities.RLock()
+	defer h.muIdentities.RUnlock()
+	return append([]Identity(nil), h.identities...)
+}
+
+// ResolveAddr maps a resolvable private address back to the identity of the peer device.
+func (h *HCI) ResolveAddr(a ble.Addr) (Identity, bool) {
+	t, b, err := peerAddr(a)
+	if err != nil || t != AddrTypeRandom {
+		return Identity{}, false
+	}
+	return h.resolve(b)
+}
+
+func (h *HCI) resolve(b [6]byte) (Identity, bool) {
+	if !isRPA(b) {
+		return Identity{}, false
+	}
+	h.muIdentities.RLock()
+	defer h.muIdentities.RUnlock()
+	for _, id := range h.identities {
+		if resolveRPA(id.IRK, b) {
+			return id, true
+		}
+	}
+	return Identity{}, false
+}
+
+// resolvingListSize returns the capacity of the resolving list of the controller.
+// Controllers which don't support LL Privacy report an error.
+func (h *HCI) resolvingListSize() (int, error) {
+	if h.rlErr != nil || h.rlCap > 0 {
+		return h.rlCap, h.rlErr
+	}
+	var rp cmd.LEReadResolvingListSizeRP
+	if err := h.Send(&cmd.LEReadResolvingListSize{}, &rp); err != nil {
+		h.rlErr = err
+		return 0, err
+	}
+	h.rlCap = int(rp.ResolvingListSize)
+	return h.rlCap, nil
+}
+
+// withAddrResolution runs f with address resolution disabled, which is
+// required to modify the resolving list [Vol 2, Part E, 7.8.38].
+// Address resolution is (re-)enabled afterwards.
+func (h *HCI) withAddrResolution(f func() error) error {
+	if err := h.Send(&cmd.LESetAddressResolutionEnable{AddressResolutionEnable: 0}, nil); err != nil {
+		return err
+	}
+	err := f()
+	if err := h.Send(&cmd.LESetAddressResolutionEnable{AddressResolutionEnable: 1}, nil); err != nil {
+		return err
+	}
+	return err
+}
@@ -26,6 +26,11 @@ func (s sigCmd) data() []byte { return s[4 : 4+s.len()] }
 
 // Signal ...
 func (c *Conn) Signal(req Signal, rsp Signal) error {
+	// Only one request is outstanding at a time [Vol 3, Part A, 4].
+	c.muSig.Lock()
+	defer c.muSig.Unlock()
+	id := c.newSigID()
+
 	data, err := req.Marshal()
 	if err != nil {
 		return err
@@ -41,7 +46,7 @@ func (c *Conn) Signal(req Signal, rsp Signal) error {
 	if err := binary.Write(buf, binary.LittleEndian, uint8(req.Code())); err != nil {
 		return err
 	}
-	if err := binary.Write(buf, binary.LittleEndian, uint8(c.sigID)); err != nil {
+	if err := binary.Write(buf, binary.LittleEndian, id); err != nil {
 		return err
 	}
 	if err := binary.Write(buf, binary.LittleEndian, uint16(len(data))); err != nil {
@@ -51,32 +56,52 @@ func (c *Conn) Signal(req Signal, rsp Signal) error {
 		return err
 	}
 
-	c.sigSent = make(chan []byte)
-	defer close(c.sigSent)
+	// Discard a late response to an earlier request, if any.
+	select {
+	case <-c.sigSent:
+	default:
+	}
 	if _, err := c.writePDU(buf.Bytes()); err != nil {
 		return err
 	}
 	var s sigCmd
-	select {
-	case s = <-c.sigSent:
-	case <-time.After(time.Second):
-		// TODO: Find the proper timed out defined in spec, if any.
-		return errors.New("signaling request timed out")
+	for {
+		select {
+		case s = <-c.sigSent:
+		case <-time.After(sigRTXTimeout):
+			return errors.New("signaling request timed out")
+		}
+		// Responses with a mismatched identifier are silently discarded.
+		if s.id() == id {
+			break
+		}
 	}
 
-	if s.code() != req.Code() {
-		return errors.New("mismatched signaling response")
+	if s.code() == SignalCommandReject {
+		return errors.New("signaling request rejected")
 	}
-	if s.id() != c.sigID {
-		return errors.New("mismatched signaling id")
+	if rsp != nil && s.code() != rsp.Code() {
+		return errors.New("mismatched signaling response")
 	}
-	c.sigID++
 	if rsp == nil {
 		return nil
 	}
 	return rsp.Unmarshal(s.data())
 }
 
+// newSigID returns the identifier of a new signaling command.
+func (c *Conn) newSigID() uint8 {
+	c.muSigID.Lock()
+	defer c.muSigID.Unlock()
+
+	// Identifier 0x00 is an illegal identifier [Vol 3, Part A, 4].
+	c.sigID++
+	if c.sigID == 0 {
+		c.sigID++
+	}
+	return c.sigID
+}
+
 func (c *Conn) sendResponse(code uint8, id uint8, r Signal) (int, error) {
 	data, err := r.Marshal()
 	if err != nil {
@@ -135,17 +160,25 @@ func (c *Conn) handleSignal(p pdu) error {
 		case SignalConnectionParameterUpdateRequest:
 			c.handleConnectionParameterUpdateRequest(s)
 		case SignalLECreditBasedConnectionRequest:
-			c.LECreditBasedConnectionRequest(s)
+			c.handleLECreditBasedConnectionRequest(s)
 		case SignalLEFlowControlCredit:
-			c.LEFlowControlCredit(s)
-		default:
-			// Check if it's a response to a sent command.
+			c.handleLEFlowControlCredit(s)
+		case SignalCreditBasedConnectionRequest:
+			c.handleCreditBasedConnectionRequest(s)
+		case SignalCreditBasedReconfigureRequest:
+			c.handleCreditBasedReconfigureRequest(s)
+		case SignalCommandReject,
+			SignalDisconnectResponse,
+			SignalConnectionParameterUpdateResponse,
+			SignalLECreditBasedConnectionResponse,
+			SignalCreditBasedConnectionResponse,
+			SignalCreditBasedReconfigureResponse:
+			// Pass the response to the pending request, if any.
 			select {
-			case c.sigSent <- s:
-				continue
+			case c.sigSent <- s[:4+s.len()]:
 			default:
 			}
-
+		default:
 			c.sendResponse(
 				SignalCommandReject,
 				s.id(),
@@ -166,6 +199,22 @@ func (c *Conn) handleDisconnectRequest(s sigCmd) {
 		return
 	}
 
+	// Dynamic channels are disconnected by either device.
+	if ch := c.channel(req.DestinationCID); ch != nil {
+		if req.SourceCID != ch.remoteCID() {
+			return
+		}
+		c.sendResponse(
+			SignalDisconnectResponse,
+			s.id(),
+			&DisconnectResponse{
+				DestinationCID: req.DestinationCID,
+				SourceCID:      req.SourceCID,
+			})
+		ch.shutdown()
+		return
+	}
+
 	// Send Command Reject when the DCID is unrecognized.
 	if req.DestinationCID != cidLEAtt {
 		endpoints := make([]byte, 4)
@@ -219,36 +268,43 @@ func (c *Conn) handleConnectionParameterUpdateRequest(s sigCmd) {
 		return
 	}
 
-	// LE Connection Update (0x08|0x0013) [Vol 2, Part E, 7.8.18]
-	c.hci.Send(&cmd.LEConnectionUpdate{
-		ConnectionHandle:   c.param.ConnectionHandle(),
-		ConnIntervalMin:    req.IntervalMin,
-		ConnIntervalMax:    req.IntervalMax,
-		ConnLatency:        req.SlaveLatency,
-		SupervisionTimeout: req.TimeoutMultiplier,
-		MinimumCELength:    0, // Informational, and spec doesn't specify the use.
-		MaximumCELength:    0, // Informational, and spec doesn't specify the use.
-	}, nil)
+	// The request is subject to the same policy as the LE Remote Connection
+	// Parameter Request event, which may also narrow the parameters.
+	rp := &cmd.LERemoteConnectionParameterRequestReply{
+		ConnectionHandle: c.param.ConnectionHandle(),
+		IntervalMin:      req.IntervalMin,
+		IntervalMax:      req.IntervalMax,
+		Latency:          req.SlaveLatency,
+		Timeout:          req.TimeoutMultiplier,
+	}
+	if !c.hci.acceptConnParams(rp) {
+		c.sendResponse(
+			SignalConnectionParameterUpdateResponse,
+			s.id(),
+			&ConnectionParameterUpdateResponse{
+				Result: 1, // Reject.
+			})
+		return
+	}
 
-	// Currently, we (as a slave host) accept all the parameters and forward
-	// it to the controller. The controller might update all, partial or even
-	// none (ignore) of the parameters. The slave(remote) host will be indicated
-	// by its controller if the update actually happens.
-	// TODO: allow users to implement what parameters to accept.
 	c.sendResponse(
 		SignalConnectionParameterUpdateResponse,
 		s.id(),
 		&ConnectionParameterUpdateResponse{
 			Result: 0, // Accept.
 		})
-}
 
-// LECreditBasedConnectionRequest ...
-func (c *Conn) LECreditBasedConnectionRequest(s sigCmd) {
-	// TODO:
-}
-
-// LEFlowControlCredit ...
-func (c *Conn) LEFlowControlCredit(s sigCmd) {
-	// TODO:
+	// LE Connection Update (0x08|0x0013) [Vol 2, Part E, 7.8.18]
+	// The controller might update all, partial or even none (ignore) of the
+	// parameters. The slave(remote) host will be indicated by its controller
+	// if the update actually happens.
+	c.hci.Send(&cmd.LEConnectionUpdate{
+		ConnectionHandle:   c.param.ConnectionHandle(),
+		ConnIntervalMin:    rp.IntervalMin,
+		ConnIntervalMax:    rp.IntervalMax,
+		ConnLatency:        rp.Latency,
+		SupervisionTimeout: rp.Timeout,
+		MinimumCELength:    0, // Informational, and spec doesn't specify the use.
+		MaximumCELength:    0, // Informational, and spec doesn't specify the use.
+	}, nil)
 }
@@ -0,0 +1,50 @@
+package hci
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+
+	ble "traulfs/Bline/ble"
+
+	"github.com/pkg/errors"
+)
+
+// Sign signs data with the CSRK distributed by the local device, and returns
+// the signature of a Signed Write Command [Vol 3, Part H, 2.4.5].
+func (c *Conn) Sign(m []byte) ([12]byte, error) {
+	s := c.smp
+	s.Lock()
+	defer s.Unlock()
+	s.loadBond()
+	if s.local.Dist&keyDistSign == 0 {
+		return [12]byte{}, ble.ErrNoCSRK
+	}
+	sig := sign(s.local.CSRK, s.local.SignCounter, m)
+	s.local.SignCounter++
+	s.updateBond()
+	return sig, nil
+}
+
+// Verify verifies the signature of data with the CSRK distributed by the remote
+// device. Signatures with a sign counter, which was seen before, are rejected.
+// It tells if the CSRK was distributed with MITM protection.
+func (c *Conn) Verify(m []byte, sig [12]byte) (bool, error) {
+	s := c.smp
+	s.Lock()
+	defer s.Unlock()
+	s.loadBond()
+	if s.remote.Dist&keyDistSign == 0 {
+		return false, errors.New("no remote CSRK")
+	}
+	counter := binary.LittleEndian.Uint32(sig[:4])
+	if counter < s.remote.SignCounter {
+		return false, errors.New("sign counter replayed")
+	}
+	want := sign(s.remote.CSRK, counter, m)
+	if subtle.ConstantTimeCompare(sig[:], want[:]) != 1 {
+		return false, errors.New("invalid signature")
+	}
+	s.remote.SignCounter = counter + 1
+	s.updateBond()
+	return s.remote.Authenticated, nil
+}
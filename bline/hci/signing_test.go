@@ -0,0 +1,61 @@
+package hci
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestVerify checks the signatures of Signed Write Commands of a bonded peer,
+// and that their sign counters are stored.
+func TestVerify(t *testing.T) {
+	h, f := newTestHCI(t)
+	store, err := NewFileBondStore(filepath.Join(t.TempDir(), "bonds.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.SetBondStore(store)
+	remote := Keys{CSRK: h16("0f0e0d0c0b0a09080706050403020100"), SignCounter: 5, Authenticated: true, Dist: keyDistSign}
+	store.Save(Bond{Addr: peerKeys.IdentityAddr, Remote: remote})
+	c, _ := testConn(t, h, f)
+
+	m := []byte{0xD2, 0x03, 0x00, 0x01, 0x02}
+	bad := sign(remote.CSRK, 9, m)
+	bad[11] ^= 0x01
+	for _, tc := range []struct {
+		name string
+		sig  [12]byte
+		ok   bool
+	}{
+		{"valid", sign(remote.CSRK, 5, m), true},
+		{"replayed", sign(remote.CSRK, 5, m), false},
+		{"older counter", sign(remote.CSRK, 4, m), false},
+		{"bad MAC", bad, false},
+		{"other CSRK", sign(h16("000102030405060708090a0b0c0d0e0f"), 9, m), false},
+		{"counter skipped", sign(remote.CSRK, 9, m), true},
+	} {
+		authenticated, err := c.Verify(m, tc.sig)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+		if err == nil && !authenticated {
+			t.Errorf("%s: CSRK not authenticated", tc.name)
+		}
+	}
+
+	c.smp.flushBond()
+	b, _ := store.Load(peerKeys.IdentityAddr)
+	if b.Remote.SignCounter != 10 {
+		t.Errorf("got sign counter %d stored, want 10", b.Remote.SignCounter)
+	}
+}
+
+// TestVerifyNoCSRK checks that signatures are rejected, if the peer didn't
+// distribute a CSRK.
+func TestVerifyNoCSRK(t *testing.T) {
+	h, f := newTestHCI(t)
+	c, _ := testConn(t, h, f)
+	m := []byte{0xD2, 0x03, 0x00, 0x01}
+	if _, err := c.Verify(m, sign(peerKeys.CSRK, 0, m)); err == nil {
+		t.Error("got a verified signature")
+	}
+}
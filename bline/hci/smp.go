@@ -23,9 +23,74 @@ const (
 	pairingKeypress          = 0x0E // Pairing Keypress Notification LE-U
 )
 
+// IO capabilities [Vol 3, Part H, 3.5.1].
+const (
+	IOCapDisplayOnly     = 0x00
+	IOCapDisplayYesNo    = 0x01
+	IOCapKeyboardOnly    = 0x02
+	IOCapNoInputNoOutput = 0x03
+	IOCapKeyboardDisplay = 0x04
+)
+
+// AuthReq flags [Vol 3, Part H, 3.5.1].
+const (
+	authReqBonding  = 0x01
+	authReqMITM     = 0x04
+	authReqSC       = 0x08
+	authReqKeypress = 0x10
+)
+
+// Key distribution flags [Vol 3, Part H, 3.6.1].
+const (
+	keyDistEnc  = 0x01 // LTK, EDIV and Rand.
+	keyDistID   = 0x02 // IRK and identity address.
+	keyDistSign = 0x04 // CSRK.
+)
+
+// Reasons of Pairing Failed [Vol 3, Part H, 3.5.5].
+const (
+	ErrPasskeyEntryFailed      PairingError = 0x01 // Passkey Entry Failed
+	ErrOOBNotAvailable         PairingError = 0x02 // OOB Not Available
+	ErrAuthRequirements        PairingError = 0x03 // Authentication Requirements
+	ErrConfirmValueFailed      PairingError = 0x04 // Confirm Value Failed
+	ErrPairingNotSupported     PairingError = 0x05 // Pairing Not Supported
+	ErrEncryptionKeySize       PairingError = 0x06 // Encryption Key Size
+	ErrSMPCommandNotSupported  PairingError = 0x07 // Command Not Supported
+	ErrUnspecifiedReason       PairingError = 0x08 // Unspecified Reason
+	ErrPairingRepeatedAttempts PairingError = 0x09 // Repeated Attempts
+	ErrInvalidParameters       PairingError = 0x0A // Invalid Parameters
+	ErrDHKeyCheckFailed        PairingError = 0x0B // DHKey Check Failed
+	ErrNumericComparisonFailed PairingError = 0x0C // Numeric Comparison Failed
+)
+
+// PairingError is the reason of a failed pairing procedure [Vol 3, Part H, 3.5.5].
+type PairingError uint8
+
+var pairingErrStr = map[PairingError]string{
+	0x01: "Passkey Entry Failed",
+	0x02: "OOB Not Available",
+	0x03: "Authentication Requirements",
+	0x04: "Confirm Value Failed",
+	0x05: "Pairing Not Supported",
+	0x06: "Encryption Key Size",
+	0x07: "Command Not Supported",
+	0x08: "Unspecified Reason",
+	0x09: "Repeated Attempts",
+	0x0A: "Invalid Parameters",
+	0x0B: "DHKey Check Failed",
+	0x0C: "Numeric Comparison Failed",
+}
+
+func (e PairingError) Error() string {
+	if s, ok := pairingErrStr[e]; ok {
+		return "pairing failed: " + s
+	}
+	return fmt.Sprintf("pairing failed: reason 0x%02X", uint8(e))
+}
+
 func (c *Conn) sendSMP(p pdu) error {
 	buf := bytes.NewBuffer(make([]byte, 0))
-	if err := binary.Write(buf, binary.LittleEndian, uint16(4+len(p))); err != nil {
+	if err := binary.Write(buf, binary.LittleEndian, uint16(len(p))); err != nil {
 		return err
 	}
 	if err := binary.Write(buf, binary.LittleEndian, cidSMP); err != nil {
@@ -41,6 +106,10 @@ func (c *Conn) sendSMP(p pdu) error {
 
 func (c *Conn) handleSMP(p pdu) error {
 	logger.Debug("smp", "recv", fmt.Sprintf("[%X]", p))
+	p = p.payload()
+	if len(p) == 0 {
+		return nil
+	}
 	code := p[0]
 	switch code {
 	case pairingRequest:
@@ -61,7 +130,5 @@ func (c *Conn) handleSMP(p pdu) error {
 		// If a packet is received with a reserved Code it shall be ignored. [Vol 3, Part H, 3.3]
 		return nil
 	}
-	// FIXME: work aound to the lack of SMP implementation - always return non-supported.
-	// C.5.1 Pairing Not Supported by Slave
-	return c.sendSMP([]byte{pairingFailed, 0x05})
+	return c.smp.handle(p)
 }
@@ -19,6 +19,10 @@ var (
 
 var cnt = 0
 
+// tail is the size of the fixed fields following a variable length field,
+// which are located from the end of the PDU.
+var tail = 0
+
 var funcMap = template.FuncMap{
 	"esc": func(s string) string {
 		s = strings.Replace(s, " ", "", -1)
@@ -28,6 +32,25 @@ var funcMap = template.FuncMap{
 	},
 	"reset": func() string {
 		cnt = 0
+		tail = 0
+		return ""
+	},
+	"tail": func(params []field) string {
+		tail = 0
+		for i := len(params) - 1; i >= 0; i-- {
+			for _, v := range params[i] {
+				switch v {
+				case "[]byte":
+					return ""
+				case "[12]byte":
+					tail += 12
+				default:
+					tail = 0
+					return ""
+				}
+			}
+		}
+		tail = 0
 		return ""
 	},
 	"roy": func(n, c, k, v string) string {
@@ -56,6 +79,14 @@ var funcMap = template.FuncMap{
 			s += fmt.Sprintf("func (r %s) Set%s (v %s) { binary.LittleEndian.PutUint64(r[%d:], v)}", n, k, v, cnt)
 			cnt += 8
 		case "[]byte":
+			if tail > 0 {
+				s += fmt.Sprintf("// %s ...\n", k)
+				s += fmt.Sprintf("func (r %s) %s () %s { return r[%d:len(r)-%d]}\n", n, k, v, cnt, tail)
+				s += fmt.Sprintf("// Set%s ...\n", k)
+				s += fmt.Sprintf("func (r %s) Set%s (v %s) { copy(r[%d:len(r)-%d], v)}", n, k, v, cnt, tail)
+				cnt = -tail
+				break
+			}
 			s += fmt.Sprintf("// %s ...\n", k)
 			s += fmt.Sprintf("func (r %s) %s () %s { return r[%d:]}\n", n, k, v, cnt)
 			s += fmt.Sprintf("// Set%s ...\n", k)
@@ -72,6 +103,20 @@ var funcMap = template.FuncMap{
 			s += fmt.Sprintf(`func (r %s) Set%s (v %s) { copy(r[%d:%d+6], v[:]) }`, n, k, v, cnt, cnt)
 			cnt += 6
 		case "[12]byte":
+			if cnt < 0 {
+				// Located from the end, after a variable length field.
+				s += fmt.Sprintf("// %s ...\n", k)
+				s += fmt.Sprintf(`func (r %s) %s () %s {
+				 b:=[12]byte{}
+				 copy(b[:], r[len(r)-%d:])
+				 return b
+				 }
+				 `, n, k, v, -cnt)
+				s += fmt.Sprintf("// Set%s ...\n", k)
+				s += fmt.Sprintf(`func (r %s) Set%s (v %s) { copy(r[len(r)-%d:], v[:]) }`, n, k, v, -cnt)
+				cnt += 12
+				break
+			}
 			s += fmt.Sprintf("// %s ...\n", k)
 			s += fmt.Sprintf(`func (r %s) %s () %s {
 				 b:=[12]byte{}
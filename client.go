@@ -1,5 +1,7 @@
 package ble
 
+import "context"
+
 // A Client is a GATT client.
 type Client interface {
 	// Addr returns platform specific unique ID of the remote peripheral, e.g. MAC on Linux, Client UUID on OS X.
@@ -70,3 +72,51 @@ type Client interface {
 	// Conn returns the client's current connection.
 	Conn() Conn
 }
+
+// ContextClient is a Client, whose operations give up once a context is done.
+// The Clients returned by Dial and Connect implement it.
+type ContextClient interface {
+	Client
+
+	// DiscoverProfileContext is like DiscoverProfile, but gives up once ctx is done.
+	DiscoverProfileContext(ctx context.Context, force bool) (*Profile, error)
+
+	// DiscoverServicesContext is like DiscoverServices, but gives up once ctx is done.
+	DiscoverServicesContext(ctx context.Context, filter []UUID) ([]*Service, error)
+
+	// DiscoverIncludedServicesContext is like DiscoverIncludedServices, but gives up once ctx is done.
+	DiscoverIncludedServicesContext(ctx context.Context, filter []UUID, s *Service) ([]*Service, error)
+
+	// DiscoverCharacteristicsContext is like DiscoverCharacteristics, but gives up once ctx is done.
+	DiscoverCharacteristicsContext(ctx context.Context, filter []UUID, s *Service) ([]*Characteristic, error)
+
+	// DiscoverDescriptorsContext is like DiscoverDescriptors, but gives up once ctx is done.
+	DiscoverDescriptorsContext(ctx context.Context, filter []UUID, c *Characteristic) ([]*Descriptor, error)
+
+	// ReadCharacteristicContext is like ReadCharacteristic, but gives up once ctx is done.
+	ReadCharacteristicContext(ctx context.Context, c *Characteristic) ([]byte, error)
+
+	// ReadLongCharacteristicContext is like ReadLongCharacteristic, but gives up once ctx is done.
+	ReadLongCharacteristicContext(ctx context.Context, c *Characteristic) ([]byte, error)
+
+	// WriteCharacteristicContext is like WriteCharacteristic, but gives up once ctx is done.
+	WriteCharacteristicContext(ctx context.Context, c *Characteristic, value []byte, noRsp bool) error
+
+	// ReadDescriptorContext is like ReadDescriptor, but gives up once ctx is done.
+	ReadDescriptorContext(ctx context.Context, d *Descriptor) ([]byte, error)
+
+	// WriteDescriptorContext is like WriteDescriptor, but gives up once ctx is done.
+	WriteDescriptorContext(ctx context.Context, d *Descriptor, v []byte) error
+
+	// ExchangeMTUContext is like ExchangeMTU, but gives up once ctx is done.
+	ExchangeMTUContext(ctx context.Context, rxMTU int) (txMTU int, err error)
+
+	// SubscribeContext is like Subscribe, but gives up once ctx is done.
+	SubscribeContext(ctx context.Context, c *Characteristic, ind bool, h NotificationHandler) error
+
+	// UnsubscribeContext is like Unsubscribe, but gives up once ctx is done.
+	UnsubscribeContext(ctx context.Context, c *Characteristic, ind bool) error
+
+	// ClearSubscriptionsContext is like ClearSubscriptions, but gives up once ctx is done.
+	ClearSubscriptionsContext(ctx context.Context) error
+}
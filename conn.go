@@ -39,3 +39,36 @@ type Conn interface {
 	// Disconnected returns a receiving channel, which is closed when the connection disconnects.
 	Disconnected() <-chan struct{}
 }
+
+// SecureConn is a Conn, which reports the security state of the link.
+type SecureConn interface {
+	Conn
+
+	// SecurityLevel returns the level of LE security mode 1 (1 - 4) of the link. [Vol 3, Part C, 10.2.1]
+	SecurityLevel() int
+
+	// EncryptionKeySize returns the size of the encryption key in octets, or 0 if the link is not encrypted.
+	EncryptionKeySize() int
+
+	// RequestSecurity requests the remote central to pair, or to encrypt the link. [Vol 3, Part H, 2.4.6]
+	RequestSecurity() error
+
+	// Sign returns the signature of data signed with the local CSRK. [Vol 3, Part H, 2.4.5]
+	Sign(m []byte) ([12]byte, error)
+
+	// Verify verifies the signature of data signed with the remote CSRK, and
+	// tells if the CSRK is authenticated. Replayed signatures are rejected.
+	Verify(m []byte, sig [12]byte) (bool, error)
+}
+
+// IdentityConn is a Conn, which knows the identity of the remote device.
+type IdentityConn interface {
+	Conn
+
+	// IdentityAddr returns the identity address of the remote device, if its
+	// private address is resolved, or its address otherwise.
+	IdentityAddr() Addr
+
+	// Bonded reports whether the remote device is bonded.
+	Bonded() bool
+}
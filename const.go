@@ -30,4 +30,5 @@ var (
 	ReconnectionAddrUUID  = UUID16(0x2A03)
 	PeferredParamsUUID    = UUID16(0x2A04)
 	ServiceChangedUUID    = UUID16(0x2A05)
+	DatabaseHashUUID      = UUID16(0x2B2A)
 )
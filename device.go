@@ -43,3 +43,11 @@ type Device interface {
 	// Dial ...
 	Dial(ctx context.Context, a Addr) (Client, error)
 }
+
+// AutoConnector is a Device, which connects to devices in the background.
+type AutoConnector interface {
+	// AutoConnect connects to the devices in addrs, whenever any of them
+	// advertises, until ctx is done. The connections are delivered on the
+	// returned channel, which is closed when ctx is done.
+	AutoConnect(ctx context.Context, addrs ...Addr) (<-chan Client, error)
+}
@@ -12,6 +12,10 @@ var ErrEIRPacketTooLong = errors.New("max packet length is 31")
 // ErrNotImplemented means the functionality is not implemented.
 var ErrNotImplemented = errors.New("not implemented")
 
+// ErrNoCSRK means data can't be signed, as the local device distributed no
+// CSRK to the remote device [Vol 3, Part H, 2.4.5].
+var ErrNoCSRK = errors.New("no local CSRK")
+
 // ATTError is the error code of Attribute Protocol [Vol 3, Part F, 3.4.1.1].
 type ATTError byte
 
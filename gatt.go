@@ -150,6 +150,20 @@ func Connect(ctx context.Context, f AdvFilter) (Client, error) {
 	return cln, errors.Wrap(err, "can't dial")
 }
 
+// AutoConnect connects to the Peripherals in addrs, whenever any of them
+// advertises, until ctx is done. Unlike Connect, it doesn't scan, so the
+// connections are made in the first connectable advertising events.
+func AutoConnect(ctx context.Context, addrs ...Addr) (<-chan Client, error) {
+	if defaultDevice == nil {
+		return nil, ErrDefaultDevice
+	}
+	ac, ok := defaultDevice.(AutoConnector)
+	if !ok {
+		return nil, ErrNotImplemented
+	}
+	return ac.AutoConnect(ctx, addrs...)
+}
+
 // A NotificationHandler handles notification or indication from a server.
 type NotificationHandler func(req []byte)
 
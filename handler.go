@@ -32,6 +32,13 @@ func (f WriteHandlerFunc) ServeWrite(req Request, rsp ResponseWriter) {
 	f(req, rsp)
 }
 
+// A WriteValidator is a WriteHandler, which validates a write before it's
+// served. The values of an Execute Write Request are validated all before any
+// of them is written, so an invalid value leaves all the attributes unchanged.
+type WriteValidator interface {
+	ValidateWrite(req Request) ATTError
+}
+
 // A NotifyHandler handles GATT requests.
 type NotifyHandler interface {
 	ServeNotify(req Request, n Notifier)
@@ -45,6 +52,19 @@ func (f NotifyHandlerFunc) ServeNotify(req Request, n Notifier) {
 	f(req, n)
 }
 
+// An AuthorizeHandler authorizes GATT requests to attributes, which require authorization.
+type AuthorizeHandler interface {
+	Authorize(req Request, write bool) bool
+}
+
+// AuthorizeHandlerFunc is an adapter to allow the use of ordinary functions as Handlers.
+type AuthorizeHandlerFunc func(req Request, write bool) bool
+
+// Authorize returns f(req, write).
+func (f AuthorizeHandlerFunc) Authorize(req Request, write bool) bool {
+	return f(req, write)
+}
+
 // Request ...
 type Request interface {
 	Conn() Conn
@@ -138,6 +158,34 @@ func (r *responseWriter) Write(b []byte) (int, error) {
 	return r.buf.Write(b)
 }
 
+// A ValueSetter is a ResponseWriter, which takes the whole value of an
+// attribute, and returns the part of it at the offset of the request. The
+// value is kept for the following parts of a long read, so the parts are
+// of the same value.
+type ValueSetter interface {
+	SetValue(v []byte)
+}
+
+// WriteValue writes the whole value v of an attribute, in response to a read
+// request. Unless rsp is a ValueSetter, the part of v at the offset of req,
+// which fits in rsp, is written.
+func WriteValue(req Request, rsp ResponseWriter, v []byte) {
+	if vs, ok := rsp.(ValueSetter); ok {
+		vs.SetValue(v)
+		return
+	}
+	off := req.Offset()
+	if off > len(v) {
+		rsp.SetStatus(ErrInvalidOffset)
+		return
+	}
+	v = v[off:]
+	if n := rsp.Cap() - rsp.Len(); len(v) > n {
+		v = v[:n]
+	}
+	rsp.Write(v)
+}
+
 // Notifier ...
 type Notifier interface {
 	// Context sends data to the central.
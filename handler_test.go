@@ -0,0 +1,43 @@
+package ble
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteValue(t *testing.T) {
+	v := []byte("0123456789")
+	for _, tc := range []struct {
+		offset int
+		cap    int
+		want   string
+		status ATTError
+	}{
+		{0, 22, "0123456789", ErrSuccess},
+		{4, 22, "456789", ErrSuccess},
+		{0, 4, "0123", ErrSuccess},
+		{10, 22, "", ErrSuccess},
+		{11, 22, "", ErrInvalidOffset},
+	} {
+		buf := bytes.NewBuffer(make([]byte, 0, tc.cap))
+		rsp := NewResponseWriter(buf)
+		WriteValue(NewRequest(nil, nil, tc.offset), rsp, v)
+		if buf.String() != tc.want || rsp.Status() != tc.status {
+			t.Errorf("offset %d, cap %d: got %q, %v, want %q, %v", tc.offset, tc.cap, buf.String(), rsp.Status(), tc.want, tc.status)
+		}
+	}
+
+	// A ValueSetter takes the whole value.
+	w := &valueSetter{ResponseWriter: NewResponseWriter(nil)}
+	WriteValue(NewRequest(nil, nil, 4), w, v)
+	if !bytes.Equal(w.v, v) {
+		t.Errorf("ValueSetter: got %q, want %q", w.v, v)
+	}
+}
+
+type valueSetter struct {
+	ResponseWriter
+	v []byte
+}
+
+func (w *valueSetter) SetValue(v []byte) { w.v = v }
@@ -19,6 +19,12 @@ type DeviceOption interface {
 	SetAdvParams(cmd.LESetAdvertisingParameters) error
 	SetConnectedHandler(f func(evt.LEConnectionComplete)) error
 	SetDisconnectedHandler(f func(evt.DisconnectionComplete)) error
+	SetConnParamsRequestHandler(f func(*cmd.LERemoteConnectionParameterRequestReply) bool) error
+	SetConnUpdatedHandler(f func(evt.LEConnectionUpdateComplete)) error
+	SetRandomAddr(Addr) error
+	SetRandomAddrRotation(time.Duration) error
+	SetSecurityRequest(bool) error
+	SetMaxConnections(int) error
 	SetPeripheralRole() error
 	SetCentralRole() error
 }
@@ -96,6 +102,58 @@ func OptDisconnectHandler(f func(evt.DisconnectionComplete)) Option {
 	}
 }
 
+// OptConnParamsRequestHandler sets the policy for connection parameters requested
+// by the remote device. The handler may narrow the parameters in place, or
+// return false to reject the request. All valid requests are accepted by default.
+func OptConnParamsRequestHandler(f func(*cmd.LERemoteConnectionParameterRequestReply) bool) Option {
+	return func(opt DeviceOption) error {
+		opt.SetConnParamsRequestHandler(f)
+		return nil
+	}
+}
+
+// OptConnUpdateHandler sets handler to be called when connection parameters are updated.
+func OptConnUpdateHandler(f func(evt.LEConnectionUpdateComplete)) Option {
+	return func(opt DeviceOption) error {
+		opt.SetConnUpdatedHandler(f)
+		return nil
+	}
+}
+
+// OptRandomAddr sets a random static or non-resolvable private address, which
+// is used as the own address for advertising, scanning and initiating.
+func OptRandomAddr(a Addr) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetRandomAddr(a)
+	}
+}
+
+// OptRandomAddrRotation replaces a non-resolvable private random address with a new one every d.
+// A static address is left unchanged.
+func OptRandomAddrRotation(d time.Duration) Option {
+	return func(opt DeviceOption) error {
+		opt.SetRandomAddrRotation(d)
+		return nil
+	}
+}
+
+// OptSecurityRequest makes the peripheral send a Security Request, when the
+// central accesses an attribute which requires more security than the link has.
+func OptSecurityRequest(b bool) Option {
+	return func(opt DeviceOption) error {
+		opt.SetSecurityRequest(b)
+		return nil
+	}
+}
+
+// OptMaxConnections limits the number of simultaneous central links. Dials
+// wait for a link to disconnect, while the limit is reached.
+func OptMaxConnections(n int) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetMaxConnections(n)
+	}
+}
+
 // OptPeripheralRole configures the device to perform Peripheral tasks.
 func OptPeripheralRole() Option {
 	return func(opt DeviceOption) error {
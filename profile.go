@@ -30,6 +30,19 @@ const (
 	CharExtended    Property = 0x80 // supports extended properties
 )
 
+// Permission is the security requirement of accessing an attribute [Vol 3, Part F, 3.2.5].
+type Permission int
+
+// Attribute permission flags.
+const (
+	PermReadEncrypt  Permission = 0x01 // may be read on an encrypted link
+	PermReadAuthen   Permission = 0x02 // may be read on an authenticated link
+	PermReadAuthor   Permission = 0x04 // may be read if authorized
+	PermWriteEncrypt Permission = 0x10 // may be written to on an encrypted link
+	PermWriteAuthen  Permission = 0x20 // may be written to on an authenticated link
+	PermWriteAuthor  Permission = 0x40 // may be written to if authorized
+)
+
 // A Profile is composed of one or more services necessary to fulfill a use case.
 type Profile struct {
 	Services []*Service
@@ -91,6 +104,10 @@ type Service struct {
 	UUID            UUID
 	Characteristics []*Characteristic
 
+	// IncludedServices are the services, which the service includes. They're
+	// populated by the discovery of a client.
+	IncludedServices []*Service
+
 	Handle    uint16
 	EndHandle uint16
 }
@@ -117,10 +134,17 @@ func (s *Service) NewCharacteristic(u UUID) *Characteristic {
 type Characteristic struct {
 	UUID        UUID
 	Property    Property
-	Secure      Property // FIXME
+	Permission  Permission
+	MinKeySize  int // Minimum encryption key size of encrypted links, if non-zero.
 	Descriptors []*Descriptor
 	CCCD        *Descriptor
 
+	// Secure requires an encrypted link for the properties, which are set in it.
+	// CharRead maps to PermReadEncrypt, and CharWrite or CharWriteNR to PermWriteEncrypt.
+	//
+	// Deprecated: use Permission.
+	Secure Property
+
 	Value []byte
 
 	ReadHandler     ReadHandler
@@ -128,6 +152,9 @@ type Characteristic struct {
 	NotifyHandler   NotifyHandler
 	IndicateHandler NotifyHandler
 
+	// AuthorizeHandler authorizes the requests, if the permission requires authorization.
+	AuthorizeHandler AuthorizeHandler
+
 	Handle      uint16
 	ValueHandle uint16
 	EndHandle   uint16
@@ -198,14 +225,19 @@ func (c *Characteristic) HandleIndicate(h NotifyHandler) {
 
 // Descriptor is a BLE descriptor
 type Descriptor struct {
-	UUID     UUID
-	Property Property
+	UUID       UUID
+	Property   Property
+	Permission Permission
+	MinKeySize int // Minimum encryption key size of encrypted links, if non-zero.
 
 	Handle uint16
 	Value  []byte
 
 	ReadHandler  ReadHandler
 	WriteHandler WriteHandler
+
+	// AuthorizeHandler authorizes the requests, if the permission requires authorization.
+	AuthorizeHandler AuthorizeHandler
 }
 
 // SetValue makes the descriptor support read requests, and returns a static value.